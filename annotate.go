@@ -0,0 +1,89 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdAnnotate = &subcommands.Command{
+	UsageLine: "annotate -comment <comment> <node>",
+	ShortDesc: "changes the comment of a node",
+	LongDesc:  "Replaces the comment of <node> in a DumbCas(tm) archive. When <node> is a tag, the node it points to is updated and the tag keeps pointing to it.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &annotateRun{}
+		c.Init()
+		c.Flags.StringVar(&c.comment, "comment", "", "New comment of the node; an empty value removes it")
+		return c
+	},
+}
+
+type annotateRun struct {
+	CommonFlags
+	comment string
+}
+
+func (c *annotateRun) main(a DumbcasApplication, nodeArg string) error {
+	hasComment := false
+	c.Flags.Visit(func(f *flag.Flag) {
+		hasComment = hasComment || f.Name == "comment"
+	})
+	if !hasComment {
+		return errors.New("Must provide -comment")
+	}
+	c.exclusive = true
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+
+	nodeName, err := resolveNodeArg(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+	if isTag(nodeName) {
+		if nodeName, err = resolveTag(c.nodes, nodeName[len("tags/"):]); err != nil {
+			return err
+		}
+	}
+	data, err := readNode(c.nodes, nodeName)
+	if err != nil {
+		return err
+	}
+	node := &dumbcaslib.Node{}
+	if err := json.Unmarshal(data, node); err != nil {
+		return fmt.Errorf("Failed to read node %s: %s", nodeName, err)
+	}
+	node.Comment = c.comment
+	if err := c.nodes.UpdateEntry(nodeName, node); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Updated %s\n", nodeName)
+	return nil
+}
+
+func (c *annotateRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
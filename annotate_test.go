@@ -0,0 +1,54 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func loadNode(t *testing.T, nodes dumbcaslib.NodesTable, name string) *dumbcaslib.Node {
+	data, err := readNode(nodes, name)
+	ut.AssertEqual(t, nil, err)
+	node := &dumbcaslib.Node{}
+	ut.AssertEqual(t, nil, json.Unmarshal(data, node))
+	return node
+}
+
+func TestAnnotate(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	_, nodeName, entrySha1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	f.Run([]string{"annotate", "-root=\\test_archive", "-comment", "known-good", nodeName}, 0)
+	f.CheckOut("Updated " + nodeName + "\n")
+	expected := &dumbcaslib.Node{Entry: entrySha1, Comment: "known-good"}
+	ut.AssertEqual(t, expected, loadNode(t, f.nodes, nodeName))
+	ut.AssertEqual(t, expected, loadNode(t, f.nodes, "tags/fictious"))
+
+	// Through the tag; the comment is removed.
+	f.Run([]string{"annotate", "-root=\\test_archive", "-comment=", "tags/fictious"}, 0)
+	f.CheckOut("Updated " + nodeName + "\n")
+	expected = &dumbcaslib.Node{Entry: entrySha1}
+	ut.AssertEqual(t, expected, loadNode(t, f.nodes, nodeName))
+	ut.AssertEqual(t, expected, loadNode(t, f.nodes, "tags/fictious"))
+}
+
+func TestAnnotateNoComment(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"annotate", "-root=\\test_archive", "foo"}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -11,12 +11,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -33,14 +37,163 @@ var cmdArchive = &subcommands.Command{
 	CommandRun: func() subcommands.CommandRun {
 		c := &archiveRun{}
 		c.Init()
+		c.InitProfiling()
+		c.InitCache()
+		c.InitMirror()
+		c.InitTempDir()
+		c.InitNodeNameTemplate()
 		c.Flags.StringVar(&c.comment, "comment", "", "Comment to embed in the file")
+		c.Flags.BoolVar(&c.casOptions.Fsync, "fsync", true, "Flushes each file to disk so the archive survives a power loss; disabling it is faster but less safe")
+		c.Flags.IntVar(&c.cacheMaxEntries, "cache-max-entries", 0, "Maximum number of entries kept in memory in the cache; the least recently seen files are evicted to a temporary file and appended back to the cache when it is saved. 0 means unlimited")
+		c.Flags.BoolVar(&c.dereferenceRoot, "dereference-root", false, "Resolves the symlinks in the path of each input so the files are cached and recorded with -orig-path under their real location")
+		c.Flags.BoolVar(&c.origPath, "orig-path", false, "Records the absolute path of each file so it can be restored at the same location with restore -preserve-prefix")
+		c.Flags.BoolVar(&c.precheck, "precheck", false, "Runs fsck -quick on the store first and aborts if it finds a problem, setting the fsck bit, so new data isn't piled onto a damaged store")
+		c.Flags.BoolVar(&c.verify, "verify", false, "Re-hashes the archived objects once the node is written to confirm they are readable")
+		c.Flags.BoolVar(&c.null, "0", false, "The entries in <.toArchive> are NUL-delimited, like the output of find -print0, and are used verbatim without expanding environment variables")
+		c.Flags.BoolVar(&c.null, "null", false, "Alias for -0")
+		c.Flags.StringVar(&c.compress, "compress", "none", "Codec used to compress the new objects: none, gzip or zstd; the objects are always read whatever their codec")
+		c.Flags.BoolVar(&c.nodesOptions.Pretty, "pretty", false, "Indents the JSON of the node file so it is easier to read")
+		c.Flags.BoolVar(&c.nodesOptions.Packed, "packed-nodes", false, "Appends the nodes to a few segment files instead of creating one file per node; the root keeps using them afterward")
+		c.Flags.BoolVar(&c.sparse, "sparse", false, "Records the holes of sparse files so restore recreates them sparse")
+		c.Flags.BoolVar(&c.xattrs, "xattrs", false, "Records the extended attributes of the files so restore sets them back")
+		c.Flags.IntVar(&c.parallelInputs, "parallel-inputs", 1, "Number of inputs enumerated concurrently; only use more than 1 when the inputs are on different disks or network mounts")
+		c.Flags.BoolVar(&c.oneFileSystem, "one-file-system", false, "Doesn't descend into the directories on another file system than their input, e.g. /proc or network mounts when archiving /")
+		c.Flags.Var(&c.excludes, "exclude", "Glob pattern matched against the base name of the files and directories to skip; can be repeated")
+		c.Flags.Var(&c.includes, "include", "Glob pattern matched against the base name of the files to archive; when set, only the files matching one of them are archived. Applied after -exclude; can be repeated")
+		c.Flags.BoolVar(&c.hardLinks, "hard-links", false, "Records hard links so restore recreates them instead of copying the content multiple times")
+		c.Flags.DurationVar(&c.progressInterval, "progress-interval", 5*time.Second, "Interval between progress updates")
+		c.Flags.BoolVar(&c.recordInputs, "record-inputs", false, "Records the resolved list of inputs in the node so info shows what the backup covers")
+		c.Flags.BoolVar(&c.merkle, "merkle", false, "Records the Merkle root of the files in the node so fsck detects a node pointing to another tree")
+		c.Flags.Int64Var(&c.maxNodeSize, "max-node-size", 64*1024*1024, "Refuses to create a node whose entry tree is larger than this many bytes since it is slow to load; 0 means no limit")
+		c.Flags.BoolVar(&c.force, "force", false, "Creates the node even if its entry tree is larger than -max-node-size, with a warning")
+		c.Flags.BoolVar(&c.byExt, "by-ext", false, "Prints the number of files and bytes archived per file extension once done")
+		c.Flags.DurationVar(&c.checkpointEvery, "checkpoint-every", 0, "Writes the files archived so far as a partial node tagged <.toArchive>.partial at this interval, so a crash doesn't lose a long archive; it is removed once the node is written. 0 disables it")
+		c.Flags.Int64Var(&c.smallFileSize, "small-file-size", 64*1024, "Files smaller than this many bytes are read in a single call while enumerating and archived in batches; 0 streams every file")
 		return c
 	},
 }
 
 type archiveRun struct {
 	CommonFlags
-	comment string
+	comment          string
+	progressInterval time.Duration
+	smallFileSize    int64
+	hardLinks        bool
+	oneFileSystem    bool
+	parallelInputs   int
+	excludes         stringsFlag
+	includes         stringsFlag
+	sparse           bool
+	xattrs           bool
+	cacheMaxEntries  int
+	origPath         bool
+	dereferenceRoot  bool
+	recordInputs     bool
+	merkle           bool
+	verify           bool
+	precheck         bool
+	null             bool
+	maxNodeSize      int64
+	force            bool
+	checkpointEvery  time.Duration
+	byExt            bool
+	// progress receives the statistics of the archival. It defaults to printing
+	// them as a table.
+	progress progressFunc
+}
+
+// progressFunc receives a copy of the statistics of an archival. It is called
+// every -progress-interval while they change, then once with final set when
+// the archival is done.
+type progressFunc func(s *statsValues, final bool)
+
+// progressTable is the default progressFunc. It prints the statistics as a
+// table whose last line is updated in place when out is a console.
+type progressTable struct {
+	out           io.Writer
+	log           *log.Logger
+	inline        bool
+	headerPrinted bool
+	linePending   bool
+}
+
+func progressColumns() string {
+	columns := []string{
+		"Found",
+		"Hashed",
+		"In cache",
+		"Archived",
+		"Skipped",
+		"Done",
+	}
+	for i := range columns {
+		columns[i] = fmt.Sprintf("%-19s", columns[i])
+	}
+	return strings.TrimSpace(strings.Join(columns, ""))
+}
+
+// endLine terminates the line updated in place, if any, so the log doesn't
+// overwrite it.
+func (p *progressTable) endLine() {
+	if p.linePending {
+		fmt.Fprintf(p.out, "\n")
+		p.linePending = false
+	}
+}
+
+func (p *progressTable) print(s *statsValues, final bool) {
+	fractionDone := float64(s.bytesArchived.Get()+s.bytesNotArchived.Get()) / float64(s.totalSize.Get())
+	if final {
+		p.endLine()
+		fmt.Fprintf(p.out, "%s\n", progressColumns())
+		fmt.Fprintf(
+			p.out,
+			"%7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %3.1f%% %d errors\n",
+			s.found.Get(),
+			toMb(s.totalSize.Get()),
+			s.nbHashed.Get(),
+			toMb(s.bytesHashed.Get()),
+			s.nbNotHashed.Get(),
+			toMb(s.bytesNotHashed.Get()),
+			s.nbArchived.Get(),
+			toMb(s.bytesArchived.Get()),
+			s.nbNotArchived.Get(),
+			toMb(s.bytesNotArchived.Get()),
+			100.*fractionDone,
+			s.errors.Get())
+		if n := s.nbDuplicated.Get(); n != 0 {
+			fmt.Fprintf(p.out, "Dedup within node: %d duplicate files, %.1fmb saved\n", n, toMb(s.bytesDuplicated.Get()))
+		}
+		return
+	}
+	if !p.headerPrinted {
+		if p.inline {
+			fmt.Fprintf(p.out, "%s\n", progressColumns())
+		} else {
+			p.log.Print(progressColumns())
+		}
+		p.headerPrinted = true
+	}
+	line := fmt.Sprintf(
+		"%6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %3.1f%% %d errors",
+		s.found.Get(),
+		toMb(s.totalSize.Get()),
+		s.nbHashed.Get(),
+		toMb(s.bytesHashed.Get()),
+		s.nbNotHashed.Get(),
+		toMb(s.bytesNotHashed.Get()),
+		s.nbArchived.Get(),
+		toMb(s.bytesArchived.Get()),
+		s.nbNotArchived.Get(),
+		toMb(s.bytesNotArchived.Get()),
+		100.*fractionDone,
+		s.errors.Get())
+	if p.inline {
+		fmt.Fprintf(p.out, "\r%s", line)
+		p.linePending = true
+	} else {
+		p.log.Print(line)
+	}
 }
 
 // For an item, tries to refresh its sha1 efficiently.
@@ -54,9 +207,14 @@ func updateFile(cache *dumbcaslib.EntryCache, item inputItem) (bool, error) {
 		return false, nil
 	}
 
-	digest, err := sha1File(item.fullPath)
-	if err != nil {
-		return false, err
+	var digest string
+	if item.data != nil {
+		digest = dumbcaslib.Sha1Bytes(item.data)
+	} else {
+		var err error
+		if digest, err = sha1File(item.fullPath); err != nil {
+			return false, err
+		}
 	}
 	cache.Sha1 = digest
 	cache.Size = size
@@ -65,17 +223,30 @@ func updateFile(cache *dumbcaslib.EntryCache, item inputItem) (bool, error) {
 	return true, nil
 }
 
-// Reads a file with each line as an entry in the slice.
-func readFileAsStrings(filepath string) ([]string, error) {
+// Reads a file with each line as an entry in the slice. When null is true, the
+// entries are NUL-delimited instead and are kept verbatim, including any
+// whitespace or newline.
+func readFileAsStrings(filepath string, null bool) ([]string, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read %s: %s", filepath, err)
 	}
+	defer func() {
+		_ = f.Close()
+	}()
+	delim := byte('\n')
+	if null {
+		delim = 0
+	}
 	b := bufio.NewReader(f)
 	lines := []string{}
 	for {
-		line, err := b.ReadString('\n')
-		line = strings.TrimSpace(line)
+		line, err := b.ReadString(delim)
+		if null {
+			line = strings.TrimSuffix(line, "\x00")
+		} else {
+			line = strings.TrimSpace(line)
+		}
 		if line != "" {
 			lines = append(lines, line)
 		}
@@ -119,14 +290,67 @@ type statsValues struct {
 	bytesArchived    syncInt
 	nbNotArchived    syncInt
 	bytesNotArchived syncInt
+	nbDuplicated     syncInt // Files with the same content as a previous one.
+	bytesDuplicated  syncInt
 }
 
 // Stores statistic of the on-going process.
 type stats struct {
 	statsValues
 	interrupted syncInt
-	out         chan<- string
-	done        chan<- bool
+	// filtered is the number of files skipped because they match no -include.
+	filtered syncInt
+	// nodeTooLarge is the size of the entry tree when it was refused.
+	nodeTooLarge syncInt
+	// byExt, when set, accumulates the files per extension. It is only used by
+	// archiveInputs() so it is not synchronized.
+	byExt map[string]*extStats
+	out   chan<- string
+	done  chan<- bool
+}
+
+// extStats are the files archived with an extension. The hard links are
+// counted but not their size.
+type extStats struct {
+	files int64
+	bytes int64
+}
+
+// add accounts for an item in byExt. The extensions are compared case
+// insensitively.
+func (s *stats) addExt(item itemToArchive) {
+	ext := strings.ToLower(filepath.Ext(item.relPath))
+	e := s.byExt[ext]
+	if e == nil {
+		e = &extStats{}
+		s.byExt[ext] = e
+	}
+	e.files++
+	if item.hardLinkTo == "" {
+		e.bytes += item.size
+	}
+}
+
+// printByExt prints the files per extension, the largest total first.
+func printByExt(out io.Writer, byExt map[string]*extStats) {
+	exts := make([]string, 0, len(byExt))
+	for ext := range byExt {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if a, b := byExt[exts[i]].bytes, byExt[exts[j]].bytes; a != b {
+			return a > b
+		}
+		return exts[i] < exts[j]
+	})
+	fmt.Fprintf(out, "%-16s %8s %12s\n", "Extension", "Files", "Size")
+	for _, ext := range exts {
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(out, "%-16s %8d %10.1fmb\n", name, byExt[ext].files, toMb(byExt[ext].bytes))
+	}
 }
 
 // Creates a copy of statsValues. Note that the copy *may* be inconsistent.
@@ -143,6 +367,8 @@ func (s *statsValues) Copy() *statsValues {
 		s.bytesArchived.g(),
 		s.nbNotArchived.g(),
 		s.bytesNotArchived.g(),
+		s.nbDuplicated.g(),
+		s.bytesDuplicated.g(),
 	}
 }
 
@@ -158,78 +384,88 @@ func (s *statsValues) equals(rhs *statsValues) bool {
 		s.nbArchived.Get() == rhs.nbArchived.Get() &&
 		s.bytesArchived.Get() == rhs.bytesArchived.Get() &&
 		s.nbNotArchived.Get() == rhs.nbNotArchived.Get() &&
-		s.bytesNotArchived.Get() == rhs.bytesNotArchived.Get())
+		s.bytesNotArchived.Get() == rhs.bytesNotArchived.Get() &&
+		s.nbDuplicated.Get() == rhs.nbDuplicated.Get() &&
+		s.bytesDuplicated.Get() == rhs.bytesDuplicated.Get())
 }
 
 type inputItem struct {
 	fullPath string
 	relPath  string
 	os.FileInfo
+	// data is the content of the file when it is small enough to be read while
+	// enumerating. It is nil for files that are streamed.
+	data []byte
 }
 
-// enumerateInputs reads the directories trees of each inputs and send each
-// file into the output channel.
-func (s *stats) enumerateInputs(inputs []string) <-chan inputItem {
+const (
+	// maxBatchItems and maxBatchBytes bound the batches sent between the
+	// stages of the pipeline. With millions of tiny files, the channel hops
+	// would otherwise dominate over the I/O.
+	maxBatchItems = 512
+	maxBatchBytes = 256 * 1024
+)
+
+// enumerateInputs reads the directories trees of each inputs and send the
+// files in batches into the output channel. The files smaller than
+// smallFileSize are read right away.
+// include, when not nil, returns false for the files to skip.
+func (s *stats) enumerateInputs(inputs []string, opts dumbcaslib.WalkOptions, include func(item dumbcaslib.FileItem) bool, smallFileSize int64) <-chan []inputItem {
 	// Throtttle after 128k entries.
-	c := make(chan inputItem, 128000)
+	c := make(chan []inputItem, 128000/maxBatchItems)
 	go func() {
 		start := time.Now().UTC()
+		var batch []inputItem
+		batchBytes := 0
 		defer func() {
+			if len(batch) != 0 {
+				c <- batch
+			}
 			close(c)
 			s.done <- true
 		}()
 
-		// Do each entry serially. In theory there would be marginal gain by doing
-		// them concurrently if the inputs are on different drives but for the
-		// common use case where it's multiple directories on a single disk-based
-		// HD, it's going to be slower.
-		for _, input := range inputs {
-			stat, err := os.Stat(input)
-			if err != nil {
+		for item := range dumbcaslib.WalkFiles(inputs, opts) {
+			if interrupt.IsSet() {
+				// Drain the walker, it stops shortly.
+				continue
+			}
+			if item.Error != nil {
 				// Eat the error and continue archiving other items.
 				s.errors.Add(1)
-				s.out <- fmt.Sprintf("Failed to process %s: %s", input, err)
+				s.out <- fmt.Sprintf("Failed to process %s: %s", item.FullPath, item.Error)
 				continue
 			}
-			if stat.IsDir() {
-				// Send the items back in the channel.
-				d := dumbcaslib.EnumerateTree(input)
-				cont := true
-				for cont {
-					select {
-					case <-interrupt.Channel:
-						// Early exit.
-						s.interrupted.Add(1)
-						return
-					case item, ok := <-d:
-						if !ok {
-							// Move on the next item.
-							cont = false
-							continue
-						}
-						if item.Error != nil {
-							// Eat the error and continue archiving other items.
-							s.errors.Add(1)
-							s.out <- fmt.Sprintf("Failed to process %s: %s", input, err)
-						} else if !item.IsDir() {
-							// Ignores directories. This tool is backing up content, not
-							// directories.
-							s.found.Add(1)
-							s.totalSize.Add(item.Size())
-							// TODO(maruel): Not necessarily true?
-							relPath := item.FullPath[len(input)+1:]
-							//s.out <- fmt.Sprintf("%s: %d", relPath, item.Size())
-							c <- inputItem{item.FullPath, relPath, item.FileInfo}
-						}
-					}
+			if include != nil && !include(item) {
+				s.filtered.Add(1)
+				continue
+			}
+			s.found.Add(1)
+			s.totalSize.Add(item.Size())
+			i := inputItem{item.FullPath, item.RelPath, item.FileInfo, nil}
+			if item.Size() < smallFileSize && item.Mode().IsRegular() {
+				data, err := ioutil.ReadFile(item.FullPath)
+				if err != nil {
+					s.errors.Add(1)
+					s.out <- fmt.Sprintf("Failed to process %s: %s", item.FullPath, err)
+					continue
 				}
-			} else {
-				s.found.Add(1)
-				s.totalSize.Add(stat.Size())
-				relPath := filepath.Base(input)
-				c <- inputItem{input, relPath, stat}
+				i.data = data
+				batchBytes += len(data)
+			}
+			batch = append(batch, i)
+			if len(batch) == maxBatchItems || batchBytes >= maxBatchBytes {
+				c <- batch
+				batch = nil
+				batchBytes = 0
 			}
 		}
+		if interrupt.IsSet() {
+			// Early exit.
+			batch = nil
+			s.interrupted.Add(1)
+			return
+		}
 		end := time.Now().UTC()
 		s.out <- fmt.Sprintf("Done enumerating inputs: %s", end.Sub(start).String())
 	}()
@@ -241,17 +477,30 @@ type itemToArchive struct {
 	relPath  string
 	sha1     string
 	size     int64
+	// hardLinkTo is the relPath of the first item seen that is the same file.
+	hardLinkTo string
+	// holes are the holes of the file, if requested.
+	holes [][2]int64
+	// xattrs are the extended attributes of the file, if requested.
+	xattrs map[string][]byte
+	// data is the content of a small file, see inputItem.
+	data []byte
 }
 
-// Calculates each entry. Assumes inputs is cleaned paths.
-func (s *stats) hashInputs(a DumbcasApplication, inputs <-chan inputItem) <-chan itemToArchive {
-	c := make(chan itemToArchive, 4096)
+// Calculates each entry. Assumes inputs is cleaned paths. When hardLinks is
+// true, the files with multiple links are only hashed once. When sparse is
+// true, the holes of each file are recorded. When xattrs is true, the extended
+// attributes of each file are recorded. The cache is limited to
+// cacheMaxEntries entries, if positive.
+func (s *stats) hashInputs(a DumbcasApplication, loadCache func() (dumbcaslib.Cache, error), inputs <-chan []inputItem, hardLinks, sparse, xattrs bool, cacheMaxEntries int) <-chan []itemToArchive {
+	c := make(chan []itemToArchive, 4096/maxBatchItems)
 	go func() {
-		// LoadCache must return a valid Cache instance even in case of failure.
-		cache, err := a.LoadCache()
+		// loadCache must return a valid Cache instance even in case of failure.
+		cache, err := loadCache()
 		if err != nil {
 			s.out <- fmt.Sprintf("Failed to load cache: %s\nWARNING: It will be unbearably slow!", err)
 		}
+		cache = dumbcaslib.LimitCache(cache, cacheMaxEntries)
 		defer func() {
 			// Must save the cache *before* sending the 'done' signal.
 			close(c)
@@ -259,54 +508,108 @@ func (s *stats) hashInputs(a DumbcasApplication, inputs <-chan inputItem) <-chan
 			_ = cache.Close()
 			s.done <- true
 		}()
+		links := map[fileID]itemToArchive{}
 		for {
 			select {
 			case <-interrupt.Channel:
 				// Early exit.
 				s.interrupted.Add(1)
 				return
-			case item, ok := <-inputs:
+			case batch, ok := <-inputs:
 				if !ok {
 					s.out <- fmt.Sprintf("Done hashing.")
 					return
 				}
-				if item.IsDir() {
-					panic("This can't happen; enumerateInputs() should eat all the directories.")
+				out := make([]itemToArchive, 0, len(batch))
+				for _, item := range batch {
+					if i, ok := s.hashItem(cache, links, item, hardLinks, sparse, xattrs); ok {
+						out = append(out, i)
+					}
 				}
-				size := item.Size()
-				cachedItem := dumbcaslib.FindInCache(cache, item.fullPath)
-				if wasHashed, err := updateFile(cachedItem, item); err != nil {
-					// Eat the error and continue archiving other items.
-					s.errors.Add(1)
-					s.out <- fmt.Sprintf("Failed to process %s: %s", item.fullPath, err)
-					continue
-				} else if wasHashed {
-					//s.out <- fmt.Sprintf("Hashed: %s", item.relPath)
-					s.nbHashed.Add(1)
-					s.bytesHashed.Add(size)
-				} else {
-					s.nbNotHashed.Add(1)
-					s.bytesNotHashed.Add(size)
+				if len(out) != 0 {
+					c <- out
 				}
-				c <- itemToArchive{item.fullPath, item.relPath, cachedItem.Sha1, size}
 			}
 		}
 	}()
 	return c
 }
 
-// Archives one item in the CAS table.
-func (s *stats) archiveItem(item itemToArchive, cas dumbcaslib.CasTable) {
-	f, err := os.Open(item.fullPath)
-	if err != nil {
+// hashItem returns the itemToArchive for item. It returns false if item
+// couldn't be processed.
+func (s *stats) hashItem(cache dumbcaslib.Cache, links map[fileID]itemToArchive, item inputItem, hardLinks, sparse, xattrs bool) (itemToArchive, bool) {
+	if item.IsDir() {
+		panic("This can't happen; enumerateInputs() should eat all the directories.")
+	}
+	size := item.Size()
+	if item.data != nil {
+		// The file may have changed since it was enumerated.
+		size = int64(len(item.data))
+	}
+	var id fileID
+	isLink := false
+	if hardLinks {
+		id, isLink = getFileID(item.FileInfo)
+		if target, ok := links[id]; isLink && ok {
+			s.nbNotHashed.Add(1)
+			s.bytesNotHashed.Add(size)
+			return itemToArchive{item.fullPath, item.relPath, target.sha1, target.size, target.relPath, target.holes, target.xattrs, nil}, true
+		}
+	}
+	cachedItem := dumbcaslib.FindInCache(cache, item.fullPath)
+	if wasHashed, err := updateFile(cachedItem, item); err != nil {
+		// Eat the error and continue archiving other items.
 		s.errors.Add(1)
-		s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
-		return
+		s.out <- fmt.Sprintf("Failed to process %s: %s", item.fullPath, err)
+		return itemToArchive{}, false
+	} else if wasHashed {
+		//s.out <- fmt.Sprintf("Hashed: %s", item.relPath)
+		s.nbHashed.Add(1)
+		s.bytesHashed.Add(size)
+	} else {
+		s.nbNotHashed.Add(1)
+		s.bytesNotHashed.Add(size)
 	}
-	defer func() {
-		_ = f.Close()
-	}()
-	err = cas.AddEntry(f, item.sha1)
+	i := itemToArchive{item.fullPath, item.relPath, cachedItem.Sha1, size, "", nil, nil, item.data}
+	if sparse {
+		// The file is still archived, just not as a sparse file.
+		var err error
+		if i.holes, err = findHoles(item.fullPath, size); err != nil {
+			s.out <- fmt.Sprintf("Failed to find the holes of %s: %s", item.fullPath, err)
+		}
+	}
+	if xattrs {
+		// The file is still archived, just without its extended attributes.
+		var err error
+		if i.xattrs, err = readXattrs(item.fullPath); err != nil {
+			s.out <- fmt.Sprintf("Failed to read the extended attributes of %s: %s", item.fullPath, err)
+		}
+	}
+	if isLink {
+		links[id] = i
+	}
+	return i, true
+}
+
+// Archives one item in the CAS table. The content of a small file is already
+// in memory, the other files are streamed.
+func (s *stats) archiveItem(item itemToArchive, cas dumbcaslib.CasTable) {
+	var src io.Reader
+	if item.data != nil {
+		src = bytes.NewReader(item.data)
+	} else {
+		f, err := os.Open(item.fullPath)
+		if err != nil {
+			s.errors.Add(1)
+			s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
+			return
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		src = f
+	}
+	err := cas.AddEntry(src, item.sha1)
 	if os.IsExist(err) {
 		s.nbNotArchived.Add(1)
 		s.bytesNotArchived.Add(item.size)
@@ -319,8 +622,9 @@ func (s *stats) archiveItem(item itemToArchive, cas dumbcaslib.CasTable) {
 	}
 }
 
-// Creates the Entry instance and the necessary Entry tree for |item|.
-func makeEntry(root *dumbcaslib.Entry, item itemToArchive) {
+// Creates the Entry instance and the necessary Entry tree for |item|. Returns
+// the Entry of the item.
+func makeEntry(root *dumbcaslib.Entry, item itemToArchive, origPath bool) *dumbcaslib.Entry {
 	for _, p := range strings.Split(item.relPath, string(filepath.Separator)) {
 		if root.Files == nil {
 			root.Files = make(map[string]*dumbcaslib.Entry)
@@ -332,17 +636,96 @@ func makeEntry(root *dumbcaslib.Entry, item itemToArchive) {
 	}
 	root.Sha1 = item.sha1
 	root.Size = item.size
+	root.HardLinkTo = filepath.ToSlash(item.hardLinkTo)
+	root.Holes = item.holes
+	root.Xattrs = item.xattrs
+	if origPath {
+		root.OrigPath = filepath.ToSlash(item.fullPath)
+	}
+	return root
 }
 
-// Archives the items.
-func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, items <-chan itemToArchive) <-chan string {
+// recordStoredSize records in e whether its object is stored compressed and
+// its size in the CAS. An object that failed to be archived is ignored, it was
+// already reported.
+func recordStoredSize(e *dumbcaslib.Entry, cas dumbcaslib.CasTable) {
+	if size, compressed, err := dumbcaslib.StoredSize(cas, e.Sha1); err == nil && compressed {
+		e.Compressed = true
+		e.StoredSize = size
+	}
+}
+
+// checkpointer writes the partial node of archive -checkpoint-every. The node
+// is created on the first checkpoint then replaced by the next ones.
+type checkpointer struct {
+	every   time.Duration
+	nodes   dumbcaslib.NodesTable
+	comment string
+	// tag is the tag of the partial node.
+	tag string
+	// name is the partial node, once created.
+	name string
+}
+
+func (p *checkpointer) write(entrySha1 string) error {
+	node := &dumbcaslib.Node{Entry: entrySha1, Comment: p.comment, Partial: true}
+	if p.name == "" {
+		name, err := p.nodes.AddEntry(node, p.tag)
+		p.name = name
+		return err
+	}
+	return p.nodes.UpdateEntry(p.name, node)
+}
+
+// remove removes the partial node and its tag, once the final node is written.
+func (p *checkpointer) remove() error {
+	if p.name == "" {
+		return nil
+	}
+	if err := p.nodes.Remove(p.name); err != nil {
+		return err
+	}
+	p.name = ""
+	return p.nodes.Remove("tags/" + p.tag)
+}
+
+// checkpoint stores the entry tree archived so far and writes it as the
+// partial node. A failure is only logged since the archive can continue.
+func (s *stats) checkpoint(cas dumbcaslib.CasTable, entryRoot *dumbcaslib.Entry, cp *checkpointer) {
+	data, err := json.Marshal(entryRoot)
+	if err == nil {
+		var entrySha1 string
+		if entrySha1, err = dumbcaslib.AddBytes(cas, data); err == nil || os.IsExist(err) {
+			err = cp.write(entrySha1)
+		}
+	}
+	if err != nil {
+		s.out <- fmt.Sprintf("Failed to write the checkpoint: %s", err)
+	}
+}
+
+// Archives the items. When origPath is true, the absolute path of each item is
+// recorded in its Entry. When storedSize is true, how each object is stored is
+// recorded in its Entry. An entry tree larger than maxNodeSize, unless it is 0,
+// is refused unless force is true, in which case it is only a warning. When cp
+// is set, the entry tree archived so far is written as a partial node every
+// cp.every.
+func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, items <-chan []itemToArchive, origPath, storedSize bool, maxNodeSize int64, force bool, cp *checkpointer) <-chan string {
 	c := make(chan string)
 	go func() {
 		defer func() {
 			close(c)
 			s.done <- true
 		}()
+		var tick <-chan time.Time
+		if cp != nil {
+			ticker := time.NewTicker(cp.every)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
 		entryRoot := &dumbcaslib.Entry{}
+		// seen is the content already in the node, to report the duplicates.
+		seen := map[string]struct{}{}
 		cont := true
 		for cont {
 			select {
@@ -350,14 +733,32 @@ func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, ite
 				// Early exit.
 				s.interrupted.Add(1)
 				return
-			case item, ok := <-items:
+			case <-tick:
+				s.checkpoint(cas, entryRoot, cp)
+			case batch, ok := <-items:
 				if !ok {
 					cont = false
 					continue
 				}
-				//s.out <- fmt.Sprintf("Archiving: %s", item.relPath)
-				makeEntry(entryRoot, item)
-				s.archiveItem(item, cas)
+				for _, item := range batch {
+					//s.out <- fmt.Sprintf("Archiving: %s", item.relPath)
+					e := makeEntry(entryRoot, item, origPath)
+					if _, ok := seen[item.sha1]; ok {
+						s.nbDuplicated.Add(1)
+						s.bytesDuplicated.Add(item.size)
+					} else {
+						seen[item.sha1] = struct{}{}
+					}
+					if item.hardLinkTo == "" {
+						s.archiveItem(item, cas)
+					}
+					if s.byExt != nil {
+						s.addExt(item)
+					}
+					if storedSize {
+						recordStoredSize(e, cas)
+					}
+				}
 			}
 		}
 		// Serializes the entry file to archive it too.
@@ -365,8 +766,13 @@ func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, ite
 		if err != nil {
 			s.errors.Add(1)
 			s.out <- fmt.Sprintf("Failed to marshal entry file: %s", err)
+		} else if size := int64(len(data)); maxNodeSize != 0 && size > maxNodeSize && !force {
+			s.nodeTooLarge.Add(size)
 		} else {
-			entrySha1, err := dumbcaslib.AddBytes(cas, data)
+			if maxNodeSize != 0 && size > maxNodeSize {
+				s.out <- fmt.Sprintf("WARNING: the entry tree is %.1fmb, more than -max-node-size; the node will be slow to load", toMb(size))
+			}
+			entrySha1, err := dumbcaslib.AddBytesVerified(cas, data)
 			if os.IsExist(err) {
 				s.nbNotArchived.Add(1)
 				s.bytesNotArchived.Add(int64(len(data)))
@@ -384,126 +790,243 @@ func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, ite
 	return c
 }
 
-// Converts to absolute paths and evaluate environment variables.
-func cleanupList(relDir string, inputs []string) {
+// Converts to absolute paths, relative to relDir. Environment variables are
+// evaluated when expandEnv is true. The symlinks are resolved when dereference
+// is true; an input that can't be resolved is kept as is so its error is
+// reported while enumerating.
+func cleanupList(relDir string, inputs []string, expandEnv, dereference bool) {
 	for index, item := range inputs {
-		item = os.ExpandEnv(item)
-		item = strings.Replace(item, "/", string(filepath.Separator), 0)
+		if expandEnv {
+			item = os.ExpandEnv(item)
+		}
+		item = filepath.FromSlash(item)
 		if !filepath.IsAbs(item) {
 			item = filepath.Join(relDir, item)
 		}
-		inputs[index] = filepath.Clean(item)
+		item = filepath.Clean(item)
+		if dereference {
+			if resolved, err := filepath.EvalSymlinks(item); err == nil {
+				item = resolved
+			}
+		}
+		inputs[index] = item
+	}
+}
+
+// matchAny returns true if name matches one of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if m, _ := filepath.Match(pattern, name); m {
+			return true
+		}
 	}
+	return false
 }
 
 func toMb(i int64) float64 {
 	return float64(i) / 1024. / 1024.
 }
 
+// isTerminal returns true if w is a character device, e.g. a console.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// runPrecheck runs the quick fsck on the store. On failure, it sets the fsck
+// bit so the next commands ask for a full fsck.
+func (c *archiveRun) runPrecheck(a DumbcasApplication) error {
+	if c.cas.GetFsckBit() {
+		return corruptedErrorf("Precheck failed: fsck is needed. Please run fsck first.")
+	}
+	if err := quickCheck(a, c.cas, c.nodes, c.progressInterval); err != nil {
+		c.cas.SetFsckBit()
+		return corruptedErrorf("Precheck failed: %s", err)
+	}
+	a.GetLog().Printf("Precheck passed")
+	return nil
+}
+
 // Loads the list of inputs and starts the concurrent processes:
 // - Enumerating the trees.
 // - Updating the hash for each items in the cache.
 // - Archiving items.
 func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
+	stop, err := c.startProfiling()
+	defer stop()
+	if err != nil {
+		return err
+	}
+	if c.progressInterval <= 0 {
+		return usageErrorf("-progress-interval must be positive")
+	}
+	if c.parallelInputs < 1 {
+		return usageErrorf("-parallel-inputs must be at least 1")
+	}
+	if c.smallFileSize < 0 {
+		return usageErrorf("-small-file-size must not be negative")
+	}
+	if c.maxNodeSize < 0 {
+		return usageErrorf("-max-node-size must not be negative")
+	}
+	if c.checkpointEvery < 0 {
+		return usageErrorf("-checkpoint-every must not be negative")
+	}
+	if c.hardLinks && !hardLinksSupported {
+		return usageErrorf("-hard-links is not supported on this platform")
+	}
+	if c.oneFileSystem && !dumbcaslib.OneFileSystemSupported {
+		return usageErrorf("-one-file-system is not supported on this platform")
+	}
+	for _, pattern := range append(c.excludes, c.includes...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return usageErrorf("Invalid pattern %q: %s", pattern, err)
+		}
+	}
+	if c.sparse && !sparseSupported {
+		return usageErrorf("-sparse is not supported on this platform")
+	}
+	if c.xattrs && !xattrSupported {
+		return usageErrorf("-xattrs is not supported on this platform")
+	}
+	c.nodesOptions.Fsync = c.casOptions.Fsync
+	c.exclusive = true
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
+	defer c.unlock()
+
+	if c.precheck {
+		if err := c.runPrecheck(a); err != nil {
+			return err
+		}
+	}
 
 	toArchive, err := filepath.Abs(toArchiveArg)
 	if err != nil {
-		return fmt.Errorf("Failed to process %s", toArchiveArg)
+		return usageErrorf("Failed to process %s", toArchiveArg)
 	}
 
-	inputs, err := readFileAsStrings(toArchive)
+	inputs, err := readFileAsStrings(toArchive, c.null)
 	if err != nil {
 		return err
 	}
 	// Make sure the file itself is archived too.
 	inputs = append(inputs, toArchive)
 	a.GetLog().Printf("Found %d entries to backup in %s", len(inputs), toArchive)
-	cleanupList(filepath.Dir(toArchive), inputs)
+	cleanupList(filepath.Dir(toArchive), inputs, !c.null, c.dereferenceRoot)
+
+	var cp *checkpointer
+	if c.checkpointEvery != 0 {
+		cp = &checkpointer{every: c.checkpointEvery, nodes: c.nodes, comment: c.comment, tag: filepath.Base(toArchive) + ".partial"}
+	}
+
+	var include func(item dumbcaslib.FileItem) bool
+	if len(c.includes) != 0 {
+		include = func(item dumbcaslib.FileItem) bool {
+			// The .toArchive file is always archived.
+			return item.FullPath == toArchive || matchAny(c.includes, item.Name())
+		}
+	}
 
 	// Start the processes.
+	started := time.Now()
 	output := make(chan string)
 	done := make(chan bool, 3)
 	s := stats{out: output, done: done}
-	entry := s.archiveInputs(a, c.cas, s.hashInputs(a, s.enumerateInputs(inputs)))
-
-	headerWasPrinted := false
-	columns := []string{
-		"Found",
-		"Hashed",
-		"In cache",
-		"Archived",
-		"Skipped",
-		"Done",
+	if c.byExt {
+		s.byExt = map[string]*extStats{}
 	}
-	for i := range columns {
-		columns[i] = fmt.Sprintf("%-19s", columns[i])
+	entry := s.archiveInputs(a, c.cas, s.hashInputs(a, func() (dumbcaslib.Cache, error) { return c.loadCache(a) }, s.enumerateInputs(inputs, dumbcaslib.WalkOptions{Excludes: c.excludes, OneFileSystem: c.oneFileSystem, Logger: a.GetLog(), Parallel: c.parallelInputs}, include, c.smallFileSize), c.hardLinks, c.sparse, c.xattrs, c.cacheMaxEntries), c.origPath, c.compress != "none", c.maxNodeSize, c.force, cp)
+
+	// When stdout is a console, the progress is printed as a single line that
+	// is updated in place. Otherwise, each update is appended to the log.
+	table := &progressTable{out: a.GetOut(), log: a.GetLog(), inline: isTerminal(a.GetOut())}
+	progress := c.progress
+	if progress == nil {
+		progress = table.print
 	}
-	column := strings.TrimSpace(strings.Join(columns, ""))
+	ticker := time.NewTicker(c.progressInterval)
+	defer ticker.Stop()
 
 	errDone := errors.New("Dummy")
+	entrySha1 := ""
 	prevStats := s.Copy()
 	for err == nil {
 		select {
 		case line := <-output:
+			table.endLine()
 			a.GetLog().Print(line)
 		case <-interrupt.Channel:
 			// Early exit. Note this as an error.
-			err = fmt.Errorf("Was interrupted.")
+			err = errInterrupted
 		case item, ok := <-entry:
 			if !ok {
 				e := s.errors.Get()
 				if e != 0 {
-					err = fmt.Errorf("Got %d errors!", e)
+					err = ioErrorf("Got %d errors!", e)
 				} else if s.interrupted.Get() != 0 {
-					err = fmt.Errorf("Was interrupted.")
+					err = errInterrupted
+				} else if size := s.nodeTooLarge.Get(); size != 0 {
+					err = fmt.Errorf("The entry tree is %.1fmb, more than -max-node-size; archive fewer files or use -force", toMb(size))
 				} else {
 					err = fmt.Errorf("Unexpected error.")
 				}
 				continue
 			}
 			if item != "" {
-				node := &dumbcaslib.Node{Entry: item, Comment: c.comment}
-				_, err = c.nodes.AddEntry(node, filepath.Base(toArchive))
-				err = errDone
+				node := &dumbcaslib.Node{Entry: item, Comment: c.comment, Started: started.Unix()}
+				if c.recordInputs {
+					node.Inputs = inputs
+				}
+				if c.merkle {
+					var root *dumbcaslib.Entry
+					if root, err = dumbcaslib.LoadEntry(c.cas, item); err != nil {
+						continue
+					}
+					node.Merkle = dumbcaslib.MerkleRoot(root)
+				}
+				var nodeName string
+				if nodeName, err = c.nodes.AddEntry(node, filepath.Base(toArchive)); err != nil {
+					continue
+				}
+				c.updateRefIndex(a, nodeName, item)
+				if cp != nil {
+					if err2 := cp.remove(); err2 != nil {
+						a.GetLog().Printf("Failed to remove the checkpoint: %s", err2)
+					}
+				}
+				entrySha1 = item
+				// The node is saved but the files that couldn't be read are
+				// missing from it.
+				if e := s.errors.Get(); e != 0 {
+					err = ioErrorf("Got %d errors!", e)
+				} else {
+					err = errDone
+				}
 			} else {
 				e := s.errors.Get()
 				if e != 0 {
-					err = fmt.Errorf("Got %d errors!", e)
+					err = ioErrorf("Got %d errors!", e)
 				} else if s.interrupted.Get() != 0 {
-					err = fmt.Errorf("Was interrupted.")
+					err = errInterrupted
 				} else {
 					err = fmt.Errorf("Unexpected error.")
 				}
 			}
-		case <-time.After(5 * time.Second):
+		case <-ticker.C:
 			nextStats := s.Copy()
 			if !prevStats.equals(nextStats) {
-				if !headerWasPrinted {
-					a.GetLog().Printf(column)
-					headerWasPrinted = true
-				}
 				prevStats = nextStats
-				fractionDone := float64(prevStats.bytesArchived.Get()+prevStats.bytesNotArchived.Get()) / float64(prevStats.totalSize.Get())
-				a.GetLog().Printf(
-					"%6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %3.1f%% %d errors",
-					prevStats.found.Get(),
-					toMb(prevStats.totalSize.Get()),
-					prevStats.nbHashed.Get(),
-					toMb(prevStats.bytesHashed.Get()),
-					prevStats.nbNotHashed.Get(),
-					toMb(prevStats.bytesNotHashed.Get()),
-					prevStats.nbArchived.Get(),
-					toMb(prevStats.bytesArchived.Get()),
-					prevStats.nbNotArchived.Get(),
-					toMb(prevStats.bytesNotArchived.Get()),
-					100.*fractionDone,
-					prevStats.errors.Get())
+				progress(prevStats, false)
 			}
 		}
 	}
+	table.endLine()
 	if err == errDone {
 		err = nil
 	}
@@ -515,36 +1038,36 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 	for i := 0; i < 3; i++ {
 		<-done
 	}
-	fmt.Fprintf(a.GetOut(), column+"\n")
-	fractionDone := float64(s.bytesArchived.Get()+s.bytesNotArchived.Get()) / float64(s.totalSize.Get())
-	fmt.Fprintf(
-		a.GetOut(),
-		"%7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %3.1f%% %d errors\n",
-		s.found.Get(),
-		toMb(s.totalSize.Get()),
-		s.nbHashed.Get(),
-		toMb(s.bytesHashed.Get()),
-		s.nbNotHashed.Get(),
-		toMb(s.bytesNotHashed.Get()),
-		s.nbArchived.Get(),
-		toMb(s.bytesArchived.Get()),
-		s.nbNotArchived.Get(),
-		toMb(s.bytesNotArchived.Get()),
-		100.*fractionDone,
-		s.errors.Get())
+	progress(s.Copy(), true)
+	if n := s.filtered.Get(); n != 0 {
+		fmt.Fprintf(a.GetOut(), "Skipped %d files matching no -include\n", n)
+	}
+	if s.byExt != nil {
+		printByExt(a.GetOut(), s.byExt)
+	}
+	if err != nil {
+		return err
+	}
+	if c.verify && entrySha1 != "" {
+		root, err := dumbcaslib.LoadEntry(c.cas, entrySha1)
+		if err != nil {
+			return fmt.Errorf("Failed to verify the archive: %s", err)
+		}
+		count, bad := verifyEntry(a.GetLog(), c.cas, entrySha1, root)
+		fmt.Fprintf(a.GetOut(), "Verified %d objects\n", count)
+		if bad != 0 {
+			return corruptedErrorf("Verification failed for %d objects", bad)
+		}
+	}
 	return nil
 }
 
 func (c *archiveRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
 	if len(args) != 1 {
 		fmt.Fprintf(a.GetErr(), "%s: Must only provide a .toArchive file.\n", a.GetName())
-		return 1
+		return exitUsage
 	}
 	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
-	if err := c.main(d, args[0]); err != nil {
-		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
-		return 1
-	}
-	return 0
+	return exitWith(a, c.main(d, args[0]))
 }
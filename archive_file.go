@@ -0,0 +1,130 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdArchiveFile = &subcommands.Command{
+	UsageLine: "archive-file <file>",
+	ShortDesc: "archives a single file",
+	LongDesc:  "Archives a single file to a DumbCas(tm) archive without a .toArchive list and creates a node containing only this file, e.g. for an ad-hoc snapshot of a database dump. The flags must be before <file>.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &archiveFileRun{}
+		c.Init()
+		c.InitCache()
+		c.InitMirror()
+		c.InitTempDir()
+		c.InitNodeNameTemplate()
+		c.Flags.StringVar(&c.tag, "tag", "", "Tag of the node; defaults to the file name")
+		c.Flags.StringVar(&c.comment, "comment", "", "Comment to embed in the node")
+		c.Flags.StringVar(&c.compress, "compress", "none", "Codec used to compress the new objects: none, gzip or zstd; the objects are always read whatever their codec")
+		c.Flags.BoolVar(&c.casOptions.Fsync, "fsync", true, "Flushes the file to disk so the archive survives a power loss; disabling it is faster but less safe")
+		c.Flags.BoolVar(&c.origPath, "orig-path", false, "Records the absolute path of the file so it can be restored at the same location with restore -preserve-prefix")
+		return c
+	},
+}
+
+type archiveFileRun struct {
+	CommonFlags
+	tag      string
+	comment  string
+	origPath bool
+}
+
+func (c *archiveFileRun) main(a DumbcasApplication, path string) error {
+	c.nodesOptions.Fsync = c.casOptions.Fsync
+	c.exclusive = true
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+	fullPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("Failed to process %s", path)
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	tag := c.tag
+	if tag == "" {
+		tag = filepath.Base(fullPath)
+	}
+
+	started := time.Now()
+	// hashItem and archiveItem send at most one line each.
+	out := make(chan string, 2)
+	s := stats{out: out}
+	// loadCache must return a valid Cache instance even in case of failure.
+	cache, err := c.loadCache(a)
+	if err != nil {
+		a.GetLog().Printf("Failed to load cache: %s", err)
+	}
+	item, ok := s.hashItem(cache, nil, inputItem{fullPath: fullPath, relPath: filepath.Base(fullPath), FileInfo: info}, false, false, false)
+	if ok {
+		s.archiveItem(item, c.cas)
+	}
+	if err := cache.Close(); err != nil {
+		a.GetLog().Printf("Failed to save cache: %s", err)
+	}
+	close(out)
+	for line := range out {
+		a.GetLog().Print(line)
+	}
+	if s.errors.Get() != 0 {
+		return fmt.Errorf("Failed to archive %s", path)
+	}
+
+	root := &dumbcaslib.Entry{}
+	e := makeEntry(root, item, c.origPath)
+	if c.compress != "none" {
+		recordStoredSize(e, c.cas)
+	}
+	data, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+	entrySha1, err := dumbcaslib.AddBytes(c.cas, data)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to archive entry file: %s", err)
+	}
+	nodeName, err := c.nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Comment: c.comment, Started: started.Unix()}, tag)
+	if err != nil {
+		return err
+	}
+	c.updateRefIndex(a, nodeName, entrySha1)
+	fmt.Fprintf(a.GetOut(), "Archived %s as %s\n", path, nodeName)
+	return nil
+}
+
+func (c *archiveFileRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a file.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
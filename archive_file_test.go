@@ -0,0 +1,61 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestArchiveFile(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_file")
+	defer removeDir(t, tempData)
+	src := filepath.Join(tempData, "dump.sql")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, []byte("content1"), 0600))
+
+	f.Run([]string{"archive-file", "-root=\\test_archive", "-comment=nightly", src}, 0)
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	f.CheckOut("Archived " + src + " as " + nodeName + "\n")
+	node := loadNode(t, f.nodes, nodeName)
+	ut.AssertEqual(t, "nightly", node.Comment)
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	expected := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{"dump.sql": {Sha1: sha1String("content1"), Size: 8}}}
+	ut.AssertEqual(t, expected, entry)
+	// The tag defaults to the file name.
+	tagged, err := resolveTag(f.nodes, "dump.sql")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nodeName, tagged)
+
+	f.Run([]string{"archive-file", "-root=\\test_archive", "-tag=db", src}, 0)
+	f.CheckBuffer(true, false)
+	_, err = resolveTag(f.nodes, "db")
+	ut.AssertEqual(t, nil, err)
+}
+
+func TestArchiveFileInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_file_invalid")
+	defer removeDir(t, tempData)
+	f.Run([]string{"archive-file", "-root=\\test_archive", tempData}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive-file", "-root=\\test_archive", filepath.Join(tempData, "missing")}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive-file", "-root=\\test_archive"}, 1)
+	f.CheckBuffer(false, true)
+}
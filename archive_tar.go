@@ -0,0 +1,303 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdArchiveTar = &subcommands.Command{
+	UsageLine: "archive-tar <file.tar[.gz]|file.zip>",
+	ShortDesc: "archives the members of a tar or zip file",
+	LongDesc:  "Archives the files of a tar, optionally gzip compressed, or zip file to a DumbCas(tm) archive without extracting them first and creates a node with the tree of the members, e.g. to import an existing backup. Only the regular files and the hard links to them are archived. The flags must be before <file>.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &archiveTarRun{}
+		c.Init()
+		c.InitMirror()
+		c.InitTempDir()
+		c.InitNodeNameTemplate()
+		c.Flags.StringVar(&c.tag, "tag", "", "Tag of the node; defaults to the file name without its extensions")
+		c.Flags.StringVar(&c.comment, "comment", "", "Comment to embed in the node")
+		c.Flags.StringVar(&c.compress, "compress", "none", "Codec used to compress the new objects: none, gzip or zstd; the objects are always read whatever their codec")
+		c.Flags.BoolVar(&c.casOptions.Fsync, "fsync", true, "Flushes the file to disk so the archive survives a power loss; disabling it is faster but less safe")
+		return c
+	},
+}
+
+// maxMemberInMemory is the size above which a member is written to a
+// temporary file while it is hashed instead of being kept in memory.
+const maxMemberInMemory = 1024 * 1024
+
+type archiveTarRun struct {
+	CommonFlags
+	tag     string
+	comment string
+	root    *dumbcaslib.Entry
+	files   int
+	bytes   int64
+}
+
+// memberPath returns the path of a member relative to the root of the archive
+// or "" if it must not be archived.
+func memberPath(name string) string {
+	p := strings.TrimLeft(path.Clean(strings.Replace(name, "\\", "/", -1)), "/")
+	if p == "" || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return ""
+	}
+	return p
+}
+
+// addMember stores the content of a member and adds it to the tree.
+func (c *archiveTarRun) addMember(name string, r io.Reader, size int64) error {
+	var hash string
+	var err error
+	if size <= maxMemberInMemory {
+		var data []byte
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return fmt.Errorf("Failed to read %s: %s", name, err)
+		}
+		hash, err = dumbcaslib.AddBytes(c.cas, data)
+	} else {
+		hash, err = c.addLargeMember(name, r)
+	}
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to archive %s: %s", name, err)
+	}
+	e := c.entry(name)
+	e.Sha1 = hash
+	e.Size = size
+	if c.compress != "none" {
+		recordStoredSize(e, c.cas)
+	}
+	c.files++
+	c.bytes += size
+	return nil
+}
+
+// addLargeMember writes the member to a temporary file while hashing it, then
+// stores the file.
+func (c *archiveTarRun) addLargeMember(name string, r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(c.casOptions.TempDir, "dumbcas_tar")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	h := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return "", fmt.Errorf("Failed to read %s: %s", name, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	return hash, c.cas.AddEntry(f, hash)
+}
+
+// addLink adds a hard link to a member already archived.
+func (c *archiveTarRun) addLink(name, target string) bool {
+	src := c.find(target)
+	if src == nil || src.Sha1 == "" {
+		return false
+	}
+	e := c.entry(name)
+	*e = *src
+	e.HardLinkTo = target
+	c.files++
+	return true
+}
+
+// entry returns the Entry of name, creating it and its parents as needed.
+func (c *archiveTarRun) entry(name string) *dumbcaslib.Entry {
+	e := c.root
+	for _, p := range strings.Split(name, "/") {
+		if e.Files == nil {
+			e.Files = map[string]*dumbcaslib.Entry{}
+		}
+		if e.Files[p] == nil {
+			e.Files[p] = &dumbcaslib.Entry{}
+		}
+		e = e.Files[p]
+	}
+	return e
+}
+
+func (c *archiveTarRun) find(name string) *dumbcaslib.Entry {
+	e := c.root
+	for _, p := range strings.Split(name, "/") {
+		if e = e.Files[p]; e == nil {
+			return nil
+		}
+	}
+	return e
+}
+
+func (c *archiveTarRun) readTar(a DumbcasApplication, r io.Reader) error {
+	b := bufio.NewReader(r)
+	r = b
+	if magic, _ := b.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(b)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		r = gz
+	}
+	t := tar.NewReader(r)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := memberPath(hdr.Name)
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+		case name == "":
+			a.GetLog().Printf("Skipping %s: outside of the archive", hdr.Name)
+		case hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA:
+			if err := c.addMember(name, t, hdr.Size); err != nil {
+				return err
+			}
+		case hdr.Typeflag == tar.TypeLink:
+			if target := memberPath(hdr.Linkname); target == "" || !c.addLink(name, target) {
+				a.GetLog().Printf("Skipping %s: hard link to missing %s", hdr.Name, hdr.Linkname)
+			}
+		default:
+			a.GetLog().Printf("Skipping %s: not a regular file", hdr.Name)
+		}
+	}
+}
+
+func (c *archiveTarRun) readZip(a DumbcasApplication, f *os.File, size int64) error {
+	z, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, m := range z.File {
+		name := memberPath(m.Name)
+		switch {
+		case m.FileInfo().IsDir():
+		case name == "":
+			a.GetLog().Printf("Skipping %s: outside of the archive", m.Name)
+		case m.Mode().IsRegular():
+			r, err := m.Open()
+			if err != nil {
+				return fmt.Errorf("Failed to read %s: %s", m.Name, err)
+			}
+			err = c.addMember(name, r, int64(m.UncompressedSize64))
+			_ = r.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			a.GetLog().Printf("Skipping %s: not a regular file", m.Name)
+		}
+	}
+	return nil
+}
+
+// defaultTarTag returns the file name of p without its archive extensions.
+func defaultTarTag(p string) string {
+	tag := filepath.Base(p)
+	for _, ext := range []string{".gz", ".tgz", ".tar", ".zip"} {
+		tag = strings.TrimSuffix(tag, ext)
+	}
+	return tag
+}
+
+func (c *archiveTarRun) main(a DumbcasApplication, p string) error {
+	c.nodesOptions.Fsync = c.casOptions.Fsync
+	c.exclusive = true
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", p, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", p, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", p)
+	}
+	tag := c.tag
+	if tag == "" {
+		tag = defaultTarTag(p)
+	}
+
+	c.root = &dumbcaslib.Entry{}
+	magic := make([]byte, 4)
+	if n, _ := io.ReadFull(f, magic); n == 4 && string(magic) == "PK\x03\x04" {
+		err = c.readZip(a, f, info.Size())
+	} else if _, err = f.Seek(0, io.SeekStart); err == nil {
+		err = c.readTar(a, f)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to archive %s: %s", p, err)
+	}
+
+	data, err := json.Marshal(c.root)
+	if err != nil {
+		return err
+	}
+	entrySha1, err := dumbcaslib.AddBytes(c.cas, data)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to archive entry file: %s", err)
+	}
+	nodeName, err := c.nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Comment: c.comment}, tag)
+	if err != nil {
+		return err
+	}
+	c.updateRefIndex(a, nodeName, entrySha1)
+	fmt.Fprintf(a.GetOut(), "Archived %d files (%.1fmb) from %s as %s\n", c.files, toMb(c.bytes), p, nodeName)
+	return nil
+}
+
+func (c *archiveTarRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a tar or zip file.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
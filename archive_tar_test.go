@@ -0,0 +1,118 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestArchiveTar(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_tar")
+	defer removeDir(t, tempData)
+	large := strings.Repeat("l", maxMemberInMemory+1)
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	w := tar.NewWriter(gz)
+	add := func(hdr *tar.Header, content string) {
+		hdr.Size = int64(len(content))
+		ut.AssertEqual(t, nil, w.WriteHeader(hdr))
+		_, err := w.Write([]byte(content))
+		ut.AssertEqual(t, nil, err)
+	}
+	add(&tar.Header{Name: "./dir/", Typeflag: tar.TypeDir, Mode: 0700}, "")
+	add(&tar.Header{Name: "./dir/a", Typeflag: tar.TypeReg, Mode: 0600}, "a\n")
+	add(&tar.Header{Name: "./dir/large", Typeflag: tar.TypeReg, Mode: 0600}, large)
+	add(&tar.Header{Name: "./b", Typeflag: tar.TypeLink, Linkname: "./dir/a"}, "")
+	add(&tar.Header{Name: "./c", Typeflag: tar.TypeSymlink, Linkname: "b"}, "")
+	add(&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600}, "x")
+	ut.AssertEqual(t, nil, w.Close())
+	ut.AssertEqual(t, nil, gz.Close())
+	src := filepath.Join(tempData, "export.tar.gz")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, buf.Bytes(), 0600))
+
+	f.Run([]string{"archive-tar", "-root=\\test_archive", "-comment=imported", src}, 0)
+	nodeName, err := resolveTag(f.nodes, "export")
+	ut.AssertEqual(t, nil, err)
+	f.CheckOut("Archived 3 files (1.0mb) from " + src + " as " + nodeName + "\n")
+	node := loadNode(t, f.nodes, nodeName)
+	ut.AssertEqual(t, "imported", node.Comment)
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	expected := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{
+		"b": {Sha1: sha1String("a\n"), Size: 2, HardLinkTo: "dir/a"},
+		"dir": {Files: map[string]*dumbcaslib.Entry{
+			"a":     {Sha1: sha1String("a\n"), Size: 2},
+			"large": {Sha1: sha1String(large), Size: int64(len(large))},
+		}},
+	}}
+	ut.AssertEqual(t, expected, entry)
+	r, err := f.cas.Open(sha1String(large))
+	ut.AssertEqual(t, nil, err)
+	content, err := ioutil.ReadAll(r)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, r.Close())
+	ut.AssertEqual(t, large, string(content))
+}
+
+func TestArchiveTarZip(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_tar_zip")
+	defer removeDir(t, tempData)
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	_, err := w.Create("dir/")
+	ut.AssertEqual(t, nil, err)
+	m, err := w.Create("dir/a")
+	ut.AssertEqual(t, nil, err)
+	_, err = m.Write([]byte("a\n"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, w.Close())
+	src := filepath.Join(tempData, "export.zip")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, buf.Bytes(), 0600))
+
+	f.Run([]string{"archive-tar", "-root=\\test_archive", "-tag=zipped", src}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err := resolveTag(f.nodes, "zipped")
+	ut.AssertEqual(t, nil, err)
+	entry, err := dumbcaslib.LoadEntry(f.cas, loadNode(t, f.nodes, nodeName).Entry)
+	ut.AssertEqual(t, nil, err)
+	expected := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{
+		"dir": {Files: map[string]*dumbcaslib.Entry{"a": {Sha1: sha1String("a\n"), Size: 2}}},
+	}}
+	ut.AssertEqual(t, expected, entry)
+}
+
+func TestArchiveTarInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_tar_invalid")
+	defer removeDir(t, tempData)
+	src := filepath.Join(tempData, "bad.tar")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, []byte("not a tar file"), 0600))
+	f.Run([]string{"archive-tar", "-root=\\test_archive", src}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive-tar", "-root=\\test_archive", tempData}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive-tar", "-root=\\test_archive"}, 1)
+	f.CheckBuffer(false, true)
+}
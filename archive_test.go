@@ -10,8 +10,15 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
@@ -59,4 +66,816 @@ func TestArchive(t *testing.T) {
 	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, 2, len(nodes))
+	entry, err := dumbcaslib.LoadEntry(f.cas, loadNode(t, f.nodes, nodes[0]).Entry)
+	ut.AssertEqual(t, nil, err)
+	_, expectedEntry := makeEntryTree(archived)
+	ut.AssertEqual(t, true, expectedEntry.Equal(entry))
+}
+
+func TestArchiveNull(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("File names can't contain a newline")
+	}
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive")
+	defer removeDir(t, tempData)
+
+	// The names are used verbatim.
+	tree := map[string]string{
+		"toArchive": "a\nb\x00 $x\x00",
+		"a\nb":      "newline\n",
+		" $x":       "space\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=\\test_archive", "-0", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	expected := []string{}
+	sha1tree, entries := marshalData(f.TB, tree)
+	for _, v := range sha1tree {
+		expected = append(expected, v)
+	}
+	expected = append(expected, dumbcaslib.Sha1Bytes(entries))
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, items)
+}
+
+func TestReadFileAsStrings(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "archive")
+	defer removeDir(t, tempData)
+	p := filepath.Join(tempData, "list")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte(" a \n\nb\x00c\n"), 0600))
+
+	lines, err := readFileAsStrings(p, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"a", "b\x00c"}, lines)
+	lines, err = readFileAsStrings(p, true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{" a \n\nb", "c\n"}, lines)
+}
+
+func TestArchiveProgressIntervalInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"archive", "-root=\\test_archive", "-progress-interval=0", "toArchive"}
+	f.Run(args, exitUsage)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveProgress(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_progress")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	c := cmdArchive.CommandRun().(*archiveRun)
+	ut.AssertEqual(t, nil, c.GetFlags().Parse([]string{"-root=\\test_archive"}))
+	var final *statsValues
+	c.progress = func(s *statsValues, last bool) {
+		ut.AssertEqual(t, true, final == nil)
+		if last {
+			final = s
+		}
+	}
+	ut.AssertEqual(t, nil, c.main(f, filepath.Join(tempData, "toArchive")))
+	ut.AssertEqual(t, int64(2), final.found.Get())
+	ut.AssertEqual(t, int64(2), final.nbArchived.Get())
+	ut.AssertEqual(t, int64(0), final.errors.Get())
+	// toArchive and x have the same content.
+	ut.AssertEqual(t, int64(1), final.nbDuplicated.Get())
+	// Nothing is printed since the callback replaces the progress table.
+	ut.AssertEqual(t, "", f.GetOut().(*bytes.Buffer).String())
+}
+
+func TestArchiveDedupReport(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_dedup")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "dir\n", "dir/a": "content\n", "dir/b": "content\n", "dir/c": "content\n", "dir/d": "other\n"}); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	ut.AssertEqualf(t, true, strings.Contains(out, "Dedup within node: 2 duplicate files, 0.0mb saved\n"), "Unexpected output: %s", out)
+}
+
+func TestArchiveLocked(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_locked")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}
+	root, err := filepath.Abs("\\test_archive")
+	ut.AssertEqual(t, nil, err)
+	lock, err := f.LockRoot(root)
+	ut.AssertEqual(t, nil, err)
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+
+	// A read-only command doesn't need the lock.
+	f.Run([]string{"labels", "-root=\\test_archive"}, 0)
+	f.CheckBuffer(false, false)
+
+	ut.AssertEqual(t, nil, lock.Close())
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, map[string]bool{}, f.locked)
+}
+
+func TestArchiveMaxNodeSize(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_max_node_size")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	toArchive := filepath.Join(tempData, "toArchive")
+	f.Run([]string{"archive", "-root=\\test_archive", "-max-node-size=10", toArchive}, 1)
+	ut.AssertEqual(t, true, strings.HasPrefix(f.GetErr().(*bytes.Buffer).String(), "dumbcas: The entry tree is 0.0mb, more than -max-node-size;"))
+	f.CheckBuffer(true, true)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, nodes)
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-max-node-size=10", "-force", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	nodes, err = dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+}
+
+func TestArchiveReadErrors(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_read_errors")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\nlink\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tempData, "missing"), filepath.Join(tempData, "link")); err != nil {
+		t.Skipf("Symlinks are not supported: %s", err)
+	}
+	// The node is saved with the files that could be read but the failure is
+	// still reported.
+	f.Run([]string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}, exitIO)
+	ut.AssertEqual(t, "dumbcas: Got 1 errors!\n", f.GetErr().(*bytes.Buffer).String())
+	f.CheckBuffer(true, true)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+}
+
+func TestCheckpointer(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	cp := &checkpointer{nodes: nodes, comment: "c", tag: "set.partial"}
+	ut.AssertEqual(t, nil, cp.write("1"))
+	name := cp.name
+	ut.AssertEqual(t, nil, cp.write("2"))
+	ut.AssertEqual(t, name, cp.name)
+	expected := &dumbcaslib.Node{Entry: "2", Comment: "c", Partial: true}
+	ut.AssertEqual(t, expected, loadNode(t, nodes, name))
+	ut.AssertEqual(t, expected, loadNode(t, nodes, "tags/set.partial"))
+
+	ut.AssertEqual(t, nil, cp.remove())
+	names, err := dumbcaslib.EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+	ut.AssertEqual(t, nil, cp.remove())
+}
+
+func TestArchiveCheckpointEvery(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_checkpoint")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"toArchive": "dir\n"}
+	for i := 0; i < 100; i++ {
+		tree[fmt.Sprintf("dir/%d", i)] = fmt.Sprintf("content%d\n", i)
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_archive", "-checkpoint-every=1ns", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	// The partial node is removed once the node is written.
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+	ut.AssertEqual(t, false, loadNode(t, f.nodes, "tags/toArchive").Partial)
+}
+
+func TestArchiveProfile(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_profile")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	cpuprofile := filepath.Join(tempData, "cpu.pprof")
+	trace := filepath.Join(tempData, "trace.out")
+	args := []string{"archive", "-root=\\test_archive", "-cpuprofile=" + cpuprofile, "-trace=" + trace, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	for _, p := range []string{cpuprofile, trace} {
+		stat, err := os.Stat(p)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, true, stat.Size() != 0)
+	}
+}
+
+func TestArchiveHardLinks(t *testing.T) {
+	t.Parallel()
+	if !hardLinksSupported {
+		t.Skip("hard links are not supported on this platform")
+	}
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_hard_links")
+	defer removeDir(t, tempData)
+	src := filepath.Join(tempData, "src")
+	if err := createTree(tempData, map[string]string{"src/toArchive": "dir\n", "src/dir/a": "content\n"}); err != nil {
+		f.Fatal(err)
+	}
+	ut.AssertEqual(t, nil, os.Link(filepath.Join(src, "dir", "a"), filepath.Join(src, "dir", "b")))
+
+	args := []string{"archive", "-root=\\test_archive", "-hard-links", filepath.Join(src, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	nodeName := ""
+	for _, n := range nodes {
+		if !isTag(n) {
+			nodeName = n
+		}
+	}
+	data, err := readNode(f.nodes, nodeName)
+	ut.AssertEqual(t, nil, err)
+	node := &dumbcaslib.Node{}
+	ut.AssertEqual(t, nil, json.Unmarshal(data, node))
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	// The enumeration order decides which one is the link.
+	a, b := entry.Files["a"], entry.Files["b"]
+	ut.AssertEqual(t, true, (a.HardLinkTo == "b") != (b.HardLinkTo == "a"))
+	ut.AssertEqual(t, a.Sha1, b.Sha1)
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, nodeName}, 0)
+	f.CheckBuffer(true, false)
+	statA, err := os.Stat(filepath.Join(out, "a"))
+	ut.AssertEqual(t, nil, err)
+	statB, err := os.Stat(filepath.Join(out, "b"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, os.SameFile(statA, statB))
+}
+
+func TestArchiveOrigPath(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_orig_path")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"src/toArchive": "dir\n", "src/dir/a": "content\n"}); err != nil {
+		f.Fatal(err)
+	}
+	src := filepath.Join(tempData, "src")
+	f.Run([]string{"archive", "-root=\\test_archive", "-orig-path", filepath.Join(src, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	nodeName := ""
+	for _, n := range nodes {
+		if !isTag(n) {
+			nodeName = n
+		}
+	}
+
+	// Without -preserve-prefix, the layout is relative to the inputs.
+	out := filepath.Join(tempData, "out1")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, nodeName}, 0)
+	f.CheckBuffer(true, false)
+	_, err = os.Stat(filepath.Join(out, "a"))
+	ut.AssertEqual(t, nil, err)
+
+	out = filepath.Join(tempData, "out2")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, "-preserve-prefix", nodeName}, 0)
+	f.CheckBuffer(true, false)
+	p := filepath.Join(src, "dir", "a")
+	if v := filepath.VolumeName(p); v != "" {
+		p = v[:len(v)-1] + p[len(v):]
+	}
+	_, err = os.Stat(filepath.Join(out, p))
+	ut.AssertEqual(t, nil, err)
+	_, err = os.Stat(filepath.Join(out, "a"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
+
+func TestCleanupList(t *testing.T) {
+	// Not parallel because of t.Setenv().
+	t.Setenv("DUMBCAS_TEST_DIR", "env")
+	relDir := filepath.Join(string(filepath.Separator)+"base", "dir")
+	inputs := []string{"a/b", "../c", "${DUMBCAS_TEST_DIR}/d", string(filepath.Separator) + "abs"}
+	cleanupList(relDir, inputs, true, false)
+	expected := []string{
+		filepath.Join(relDir, "a", "b"),
+		filepath.Join(string(filepath.Separator)+"base", "c"),
+		filepath.Join(relDir, "env", "d"),
+		string(filepath.Separator) + "abs",
+	}
+	ut.AssertEqual(t, expected, inputs)
+
+	// Used verbatim with -0.
+	inputs = []string{"${DUMBCAS_TEST_DIR}"}
+	cleanupList(relDir, inputs, false, false)
+	ut.AssertEqual(t, []string{filepath.Join(relDir, "${DUMBCAS_TEST_DIR}")}, inputs)
+}
+
+func TestArchiveDereferenceRoot(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_dereference_root")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"src/toArchive": "link\n", "real/a": "content\n"}); err != nil {
+		f.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tempData, "real"), filepath.Join(tempData, "src", "link")); err != nil {
+		t.Skipf("Symlinks are not supported: %s", err)
+	}
+	realDir, err := filepath.EvalSymlinks(filepath.Join(tempData, "real"))
+	ut.AssertEqual(t, nil, err)
+	inputs := []string{"link", "missing"}
+	cleanupList(filepath.Join(tempData, "src"), inputs, true, true)
+	ut.AssertEqual(t, []string{realDir, filepath.Join(tempData, "src", "missing")}, inputs)
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-orig-path", "-dereference-root", filepath.Join(tempData, "src", "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	node := loadNode(t, f.nodes, nodeName)
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, filepath.ToSlash(filepath.Join(realDir, "a")), entry.Files["a"].OrigPath)
+}
+
+func TestArchiveVerify(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_verify")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=\\test_archive", "-verify", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+}
+
+func TestVerifyEntry(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	sha1tree, _, entrySha1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"a":     "content",
+		"dir/b": "content",
+		"c":     "other",
+	})
+	entry, err := dumbcaslib.LoadEntry(f.cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+	count, bad := verifyEntry(f.GetLog(), f.cas, entrySha1, entry)
+	ut.AssertEqual(t, 3, count)
+	ut.AssertEqual(t, 0, bad)
+
+	// Replace an object with different content.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["c"]))
+	ut.AssertEqual(t, nil, f.cas.AddEntry(strings.NewReader("corrupted"), sha1tree["c"]))
+	count, bad = verifyEntry(f.GetLog(), f.cas, entrySha1, entry)
+	ut.AssertEqual(t, 3, count)
+	ut.AssertEqual(t, 1, bad)
+}
+
+func TestArchiveEncrypted(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_encrypted")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"src/toArchive": "dir\n", "src/dir/a": "content\n", "passphrase": "secret\n"}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	passphrase := "-passphrase-file=" + filepath.Join(tempData, "passphrase")
+	f.Run([]string{"archive", "-root=\\test_archive", passphrase, filepath.Join(tempData, "src", "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+
+	f.Run([]string{"fsck", "-root=\\test_archive", passphrase}, 0)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(items))
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", passphrase, "-out=" + out, nodeName}, 0)
+	f.CheckBuffer(true, false)
+	actual, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"a": "content\n", "toArchive": "dir\n"}, actual)
+
+	// Without the passphrase, the entry can't be read.
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + filepath.Join(tempData, "out2"), nodeName}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveCompressed(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_compressed")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"src/toArchive": "dir\n", "src/dir/a": strings.Repeat("content\n", 1000)}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_archive", "-compress=zstd", filepath.Join(tempData, "src", "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+
+	// The object is stored compressed.
+	r, err := f.cas.Open(sha1String(tree["src/dir/a"]))
+	ut.AssertEqual(t, nil, err)
+	stored, err := ioutil.ReadAll(r)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, r.Close())
+	ut.AssertEqual(t, true, len(stored) < 100)
+
+	// How it is stored is recorded in the entry.
+	cas, err := dumbcaslib.MakeCompressedCasTable(f.cas, "none")
+	ut.AssertEqual(t, nil, err)
+	node := loadNode(t, f.nodes, nodeName)
+	entry, err := dumbcaslib.LoadEntry(cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, entry.Files["a"].Compressed)
+	ut.AssertEqual(t, int64(len(stored)), entry.Files["a"].StoredSize)
+	total := entry.Files["a"].StoredSize + entry.Files["toArchive"].StoredSize
+	f.Run([]string{"info", "-root=\\test_archive", nodeName}, 0)
+	f.CheckOut(fmt.Sprintf(" a(8000)\n toArchive(4)\nTotal 2, stored %d of 8004 bytes (%.1f%%)\n", total, 100.*float64(total)/8004.))
+
+	f.Run([]string{"fsck", "-root=\\test_archive", "-quick"}, 0)
+	f.Run([]string{"fsck", "-root=\\test_archive"}, 0)
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, nodeName}, 0)
+	f.CheckBuffer(true, false)
+	actual, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"a": tree["src/dir/a"], "toArchive": "dir\n"}, actual)
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-compress=lzma", filepath.Join(tempData, "src", "toArchive")}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveRecordInputs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_record_inputs")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"src/toArchive": "dir\n", "src/dir/a": "content\n"}); err != nil {
+		f.Fatal(err)
+	}
+	toArchive := filepath.Join(tempData, "src", "toArchive")
+	f.Run([]string{"archive", "-root=\\test_archive", "-record-inputs", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	inputs := []string{filepath.Join(tempData, "src", "dir"), toArchive}
+	ut.AssertEqual(t, inputs, loadNode(t, f.nodes, nodeName).Inputs)
+
+	f.Run([]string{"info", "-root=\\test_archive", nodeName}, 0)
+	f.CheckOut("Inputs:\n " + inputs[0] + "\n " + inputs[1] + "\nFiles:\n a(8)\n toArchive(4)\nTotal 2\n")
+	f.CheckBuffer(false, false)
+
+	// Without the flag, the inputs are not recorded.
+	f.Run([]string{"archive", "-root=\\test_archive", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err = latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string(nil), loadNode(t, f.nodes, nodeName).Inputs)
+}
+
+func TestArchivePrecheck(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_precheck")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"src/toArchive": "dir\n", "src/dir/a": "content\n"}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=\\test_archive", "-precheck", filepath.Join(tempData, "src", "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+
+	// Damage the store; the precheck refuses to archive and sets the fsck bit.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1String(tree["src/dir/a"])))
+	f.Run(args, exitCorrupted)
+	f.CheckBuffer(false, true)
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+
+	// It keeps refusing until fsck is run.
+	ut.AssertEqual(t, nil, f.cas.AddEntry(strings.NewReader(tree["src/dir/a"]), sha1String(tree["src/dir/a"])))
+	f.Run(args, exitCorrupted)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"fsck", "-root=\\test_archive"}, 0)
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+}
+
+func TestArchiveParallelInputs(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "archive_parallel_inputs")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"src/toArchive": "a\nb\nc\n", "src/a/x": "x\n", "src/b/y": "y\n", "src/c/z/z": "z\n"}
+	if err := createTree(tempData, tree); err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, parallel := range []string{"1", "3"} {
+		f := makeDumbcasAppMock(t)
+		f.Run([]string{"archive", "-root=\\test_archive", "-parallel-inputs=" + parallel, filepath.Join(tempData, "src", "toArchive")}, 0)
+		f.CheckBuffer(true, false)
+		items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+		ut.AssertEqual(t, nil, err)
+		if expected == nil {
+			expected = items
+		}
+		ut.AssertEqual(t, expected, items)
+	}
+	ut.AssertEqual(t, 5, len(expected))
+
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"archive", "-root=\\test_archive", "-parallel-inputs=0", filepath.Join(tempData, "src", "toArchive")}, exitUsage)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchivePerRootCache(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_per_root_cache")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "", f.cacheRoot)
+	f.Run([]string{"archive", "-root=\\test_archive", "-per-root-cache", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	root, err := filepath.Abs("\\test_archive")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, root, f.cacheRoot)
+}
+
+func TestArchiveVerifyCache(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_verify_cache")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "x\n"}); err != nil {
+		f.Fatal(err)
+	}
+	// A truncated hash with the right size and timestamp would be trusted.
+	x := filepath.Join(tempData, "x")
+	info, err := os.Stat(x)
+	ut.AssertEqual(t, nil, err)
+	f.cache = dumbcaslib.MakeMemoryCache()
+	e := dumbcaslib.FindInCache(f.cache, x)
+	e.Sha1 = sha1String("x\n")[:20]
+	e.Size = info.Size()
+	e.Timestamp = info.ModTime().Unix()
+	f.Run([]string{"archive", "-root=\\test_archive", "-verify-cache", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, sha1String("x\n"), dumbcaslib.FindInCache(f.cache, x).Sha1)
+}
+
+func TestArchiveStreamed(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "archive_streamed")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"src/toArchive": "dir\n", "src/dir/a": "a\n", "src/dir/b": strings.Repeat("b", 4096)}
+	if err := createTree(tempData, tree); err != nil {
+		t.Fatal(err)
+	}
+	// Every file streamed, only b streamed and every file read while
+	// enumerating must archive the same objects.
+	var expected []string
+	for _, size := range []string{"0", "1024", "65536"} {
+		f := makeDumbcasAppMock(t)
+		f.Run([]string{"archive", "-root=\\test_archive", "-small-file-size=" + size, filepath.Join(tempData, "src", "toArchive")}, 0)
+		f.CheckBuffer(true, false)
+		items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+		ut.AssertEqual(t, nil, err)
+		if expected == nil {
+			expected = items
+		}
+		ut.AssertEqual(t, expected, items)
+		for _, k := range []string{"src/dir/a", "src/dir/b"} {
+			r, err := f.cas.Open(sha1String(tree[k]))
+			ut.AssertEqual(t, nil, err)
+			content, err := ioutil.ReadAll(r)
+			ut.AssertEqual(t, nil, err)
+			ut.AssertEqual(t, nil, r.Close())
+			ut.AssertEqual(t, tree[k], string(content))
+		}
+	}
+
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"archive", "-root=\\test_archive", "-small-file-size=-1", filepath.Join(tempData, "src", "toArchive")}, exitUsage)
+	f.CheckBuffer(false, true)
+}
+
+// benchArchiveApp only provides a fresh cache so every file is hashed.
+type benchArchiveApp struct {
+	DumbcasApplication
+}
+
+func (benchArchiveApp) LoadCache(rootDir string) (dumbcaslib.Cache, error) {
+	return dumbcaslib.MakeMemoryCache(), nil
+}
+
+func BenchmarkArchive(b *testing.B) {
+	// Archives 100k files of 100 bytes in the memory CAS.
+	const nbFiles = 100000
+	tempData := makeTempDir(b, "archive_bench")
+	defer removeDir(b, tempData)
+	tree := make(map[string]string, nbFiles)
+	for i := 0; i < nbFiles; i++ {
+		tree[fmt.Sprintf("dir%d/file%d", i%100, i)] = fmt.Sprintf("%0100d", i)
+	}
+	if err := createTree(tempData, tree); err != nil {
+		b.Fatal(err)
+	}
+	inputs := []string{tempData}
+
+	for _, smallFileSize := range []int64{0, 64 * 1024} {
+		name := "streamed"
+		if smallFileSize != 0 {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				output := make(chan string)
+				done := make(chan bool, 3)
+				go func() {
+					for range output {
+					}
+				}()
+				s := stats{out: output, done: done}
+				cas := dumbcaslib.MakeMemoryCasTable()
+				entry := s.archiveInputs(benchArchiveApp{}, cas, s.hashInputs(benchArchiveApp{}, func() (dumbcaslib.Cache, error) { return benchArchiveApp{}.LoadCache("") }, s.enumerateInputs(inputs, dumbcaslib.WalkOptions{}, nil, smallFileSize), false, false, false, 0), false, false, 0, false, nil)
+				ut.AssertEqual(b, true, <-entry != "")
+				for j := 0; j < 3; j++ {
+					<-done
+				}
+				close(output)
+				ut.AssertEqual(b, int64(0), s.errors.Get())
+				ut.AssertEqual(b, int64(nbFiles), s.nbArchived.Get()-1)
+			}
+			b.SetBytes(nbFiles * 100)
+		})
+	}
+}
+
+func TestArchiveMirror(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_mirror")
+	defer removeDir(t, tempData)
+	mirror := dumbcaslib.MakeMemoryCasTable()
+	f.mirrors = map[string]dumbcaslib.CasTable{filepath.Join(tempData, "mirror"): mirror}
+	if err := createTree(tempData, map[string]string{"toArchive": "x\n", "x": "content\n"}); err != nil {
+		f.Fatal(err)
+	}
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-mirror=" + filepath.Join(tempData, "mirror"), filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(items))
+	mirrored, err := dumbcaslib.EnumerateCasAsList(mirror)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, items, mirrored)
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-mirror=" + filepath.Join(tempData, "mirror"), "-mirror-quorum=3", filepath.Join(tempData, "toArchive")}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveByExt(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_by_ext")
+	defer removeDir(t, tempData)
+	tree := map[string]string{
+		"toArchive": "dir\n",
+		"dir/a.JPG": "content1",
+		"dir/b.jpg": "content2",
+		"dir/c.log": "log",
+		"dir/d":     "",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_archive", "-by-ext", filepath.Join(tempData, "toArchive")}, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	expected := "Extension           Files         Size\n" +
+		".jpg                    2        0.0mb\n" +
+		"(none)                  2        0.0mb\n" +
+		".log                    1        0.0mb\n"
+	ut.AssertEqualf(t, true, strings.HasSuffix(out, expected), "Unexpected output: %s", out)
+}
+
+func TestArchiveMerkle(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_merkle")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "dir\n", "dir/a": "content1", "dir/b": "content2"}); err != nil {
+		f.Fatal(err)
+	}
+	toArchive := filepath.Join(tempData, "toArchive")
+	f.Run([]string{"archive", "-root=\\test_archive", "-merkle", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	node := loadNode(t, f.nodes, nodeName)
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, dumbcaslib.MerkleRoot(entry), node.Merkle)
+
+	f.Run([]string{"archive", "-root=\\test_archive", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	nodeName, err = latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "", loadNode(t, f.nodes, nodeName).Merkle)
+}
+
+func TestArchiveInclude(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_include")
+	defer removeDir(t, tempData)
+	tree := map[string]string{
+		"src/toArchive":        "dir\n",
+		"src/dir/a.sql":        "a",
+		"src/dir/b.conf":       "b",
+		"src/dir/c.log":        "c",
+		"src/dir/old/d.sql":    "d",
+		"src/dir/sub/e.sql":    "e",
+		"src/dir/sub/f.sql.gz": "f",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_archive", "-include=*.sql", "-include=*.conf", "-exclude=old", filepath.Join(tempData, "src", "toArchive")}, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	ut.AssertEqualf(t, true, strings.Contains(out, "Skipped 2 files matching no -include\n"), "Unexpected output: %s", out)
+	f.CheckBuffer(true, false)
+
+	dst := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + dst, "@toArchive"}, 0)
+	f.CheckBuffer(true, false)
+	actual, err := readTree(dst)
+	ut.AssertEqual(t, nil, err)
+	expected := map[string]string{
+		"a.sql":     "a",
+		"b.conf":    "b",
+		"sub/e.sql": "e",
+		"toArchive": "dir\n",
+	}
+	ut.AssertEqual(t, expected, actual)
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-include=[", filepath.Join(tempData, "src", "toArchive")}, exitUsage)
+	f.CheckBuffer(false, true)
 }
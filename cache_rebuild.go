@@ -0,0 +1,130 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdCacheRebuild = &subcommands.Command{
+	UsageLine: "cache-rebuild",
+	ShortDesc: "rebuilds the local cache from a node",
+	LongDesc:  "Rebuilds the local hashing cache from the most recent node, or the node of -tag, so the next archive doesn't need to hash every file again. The node must have been archived with -orig-path. Only the files not modified since the archive of the node started are added to the cache.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &cacheRebuildRun{}
+		c.Init()
+		c.InitCache()
+		c.Flags.StringVar(&c.tag, "tag", "", "Tag of the node to use; defaults to the most recent node")
+		return c
+	},
+}
+
+type cacheRebuildRun struct {
+	CommonFlags
+	tag string
+}
+
+// populateCache adds to cache the files of entry that are still present on
+// disk at their OrigPath and weren't modified since the archive started.
+// Returns the number of files with an OrigPath and the number of files added.
+func populateCache(cache dumbcaslib.Cache, entry *dumbcaslib.Entry, started time.Time) (int, int) {
+	now := time.Now().Unix()
+	found := 0
+	added := 0
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 == "" || e.OrigPath == "" {
+			return nil
+		}
+		found++
+		p := filepath.FromSlash(e.OrigPath)
+		stat, err := os.Stat(p)
+		// A file modified after the archive started may have been archived
+		// before the modification, with the same size.
+		if err != nil || stat.Size() != e.Size || !stat.ModTime().Before(started) {
+			return nil
+		}
+		item := dumbcaslib.FindInCache(cache, p)
+		item.Sha1 = e.Sha1
+		item.Size = e.Size
+		item.Timestamp = stat.ModTime().Unix()
+		item.LastTested = now
+		added++
+		return nil
+	})
+	return found, added
+}
+
+func (c *cacheRebuildRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	var nodeName string
+	var err error
+	if c.tag != "" {
+		nodeName, err = resolveTag(c.nodes, c.tag)
+	} else {
+		nodeName, err = latestNode(c.nodes)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := readNode(c.nodes, nodeName)
+	if err != nil {
+		return err
+	}
+	node := &dumbcaslib.Node{}
+	if err := json.Unmarshal(data, node); err != nil {
+		return err
+	}
+	// Neither the node name nor Timestamp can be used, they are the time the
+	// node was written at the end of the archive or imported.
+	if node.Started == 0 {
+		return fmt.Errorf("Node %s doesn't record when its archive started; archive again to rebuild the cache from it", nodeName)
+	}
+	entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+	if err != nil {
+		return err
+	}
+
+	// loadCache must return a valid Cache instance even in case of failure.
+	cache, err := c.loadCache(a)
+	if err != nil {
+		a.GetLog().Printf("Failed to load cache: %s", err)
+	}
+	found, added := populateCache(cache, entry, time.Unix(node.Started, 0))
+	if err := cache.Close(); err != nil {
+		return err
+	}
+	if found == 0 {
+		return fmt.Errorf("Node %s was not archived with -orig-path", nodeName)
+	}
+	fmt.Fprintf(a.GetOut(), "Added %d of %d files from %s to the cache\n", added, found, nodeName)
+	return nil
+}
+
+func (c *cacheRebuildRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
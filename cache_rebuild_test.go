@@ -0,0 +1,112 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestCacheRebuild(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "cache_rebuild")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"toArchive": "dir\n", "dir/a": "content\n", "dir/b": "other\n"}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	// Make the files older than the node.
+	old := time.Now().Add(-time.Hour)
+	for p := range tree {
+		ut.AssertEqual(t, nil, os.Chtimes(filepath.Join(tempData, p), old, old))
+	}
+	f.Run([]string{"archive", "-root=\\test_cache", "-orig-path", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+
+	// Lose the cache and modify one file.
+	f.cache = dumbcaslib.MakeMemoryCache()
+	ut.AssertEqual(t, nil, os.Chtimes(filepath.Join(tempData, "dir", "b"), time.Now(), time.Now()))
+
+	f.Run([]string{"cache-rebuild", "-root=\\test_cache"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, true, f.cache.Root().Files != nil)
+	a := dumbcaslib.FindInCache(f.cache, filepath.Join(tempData, "dir", "a"))
+	ut.AssertEqual(t, sha1String("content\n"), a.Sha1)
+	ut.AssertEqual(t, old.Unix(), a.Timestamp)
+	b := dumbcaslib.FindInCache(f.cache, filepath.Join(tempData, "dir", "b"))
+	ut.AssertEqual(t, "", b.Sha1)
+}
+
+func TestCacheRebuildNoOrigPath(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"a": "content"})
+	_, err := f.nodes.AddEntry(&dumbcaslib.Node{Entry: entry, Started: time.Now().Unix()}, "started")
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"cache-rebuild", "-root=\\test_cache", "-tag=started"}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestCacheRebuildNoStarted(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "cache_rebuild_no_started")
+	defer removeDir(t, tempData)
+	tree := map[string]string{"toArchive": "dir\n", "dir/a": "content\n"}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	f.Run([]string{"archive", "-root=\\test_cache", "-orig-path", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+
+	// A node archived before the start time was recorded can't be trusted.
+	nodeName, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	node := loadNode(t, f.nodes, nodeName)
+	ut.AssertEqual(t, true, node.Started != 0)
+	node.Started = 0
+	ut.AssertEqual(t, nil, f.nodes.UpdateEntry(nodeName, node))
+	f.cache = dumbcaslib.MakeMemoryCache()
+	f.Run([]string{"cache-rebuild", "-root=\\test_cache"}, 1)
+	f.CheckBuffer(false, true)
+	ut.AssertEqual(t, 0, len(f.cache.Root().Files))
+}
+
+func TestPopulateCacheStarted(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "populate_cache")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"a": "a", "b": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	// b was modified while the archive ran, before the node was written.
+	started := time.Now().Add(-time.Hour)
+	before := started.Add(-time.Minute)
+	during := started.Add(time.Minute)
+	ut.AssertEqual(t, nil, os.Chtimes(filepath.Join(tempData, "a"), before, before))
+	ut.AssertEqual(t, nil, os.Chtimes(filepath.Join(tempData, "b"), during, during))
+	entry := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{
+		"a": {Sha1: sha1String("a"), Size: 1, OrigPath: filepath.ToSlash(filepath.Join(tempData, "a"))},
+		"b": {Sha1: sha1String("old"), Size: 1, OrigPath: filepath.ToSlash(filepath.Join(tempData, "b"))},
+	}}
+	cache := dumbcaslib.MakeMemoryCache()
+	found, added := populateCache(cache, entry, started)
+	ut.AssertEqual(t, 2, found)
+	ut.AssertEqual(t, 1, added)
+	ut.AssertEqual(t, "", dumbcaslib.FindInCache(cache, filepath.Join(tempData, "b")).Sha1)
+}
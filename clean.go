@@ -0,0 +1,208 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdClean = &subcommands.Command{
+	UsageLine: "clean -keep-last <N>",
+	ShortDesc: "removes the old nodes then the objects not referenced anymore",
+	LongDesc:  "Keeps the N most recent nodes of each tag and the labeled nodes, removes the others then moves to trash all the objects not referenced by the remaining nodes, like gc. With -dry-run, only prints what would be removed.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &cleanRun{}
+		c.Init()
+		c.Flags.IntVar(&c.keepLast, "keep-last", 0, "Number of nodes to keep for each tag; required")
+		c.Flags.BoolVar(&c.dryRun, "dry-run", false, "Prints the nodes and the objects that would be removed without removing anything")
+		return c
+	},
+}
+
+type cleanRun struct {
+	CommonFlags
+	keepLast int
+	dryRun   bool
+}
+
+type cleanNode struct {
+	name    string
+	created time.Time
+	entry   string
+	data    string
+}
+
+// plan returns the nodes to remove and the entries of the nodes to keep. The
+// labeled nodes are always kept. It fails on a node whose tag and creation
+// time are unknown instead of keeping it forever.
+func (c *cleanRun) plan() ([]string, []string, error) {
+	byTag := map[string][]cleanNode{}
+	kept := []string{}
+	// Labels are compared by content like resolveTag() does.
+	labeled := map[string]bool{}
+	cancel := make(chan struct{})
+	defer close(cancel)
+	for item := range c.nodes.Enumerate(cancel) {
+		if item.Error != nil {
+			return nil, nil, item.Error
+		}
+		data, err := readNode(c.nodes, item.Item)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+		}
+		node := &dumbcaslib.Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			return nil, nil, fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+		}
+		if isLabel(item.Item) {
+			labeled[string(data)] = true
+		}
+		if isTag(item.Item) {
+			kept = append(kept, node.Entry)
+			continue
+		}
+		tag, created, ok := nodeInfo(item.Item, node)
+		if !ok {
+			return nil, nil, fmt.Errorf("Node %s has no tag nor creation time; it was named with a -node-name-template before they were recorded in the node", item.Item)
+		}
+		byTag[tag] = append(byTag[tag], cleanNode{item.Item, created, node.Entry, string(data)})
+	}
+	pruned := []string{}
+	for _, nodes := range byTag {
+		sort.Slice(nodes, func(i, j int) bool {
+			if !nodes[i].created.Equal(nodes[j].created) {
+				return nodes[i].created.After(nodes[j].created)
+			}
+			return nodes[i].name > nodes[j].name
+		})
+		for i, n := range nodes {
+			if i < c.keepLast || labeled[n.data] {
+				kept = append(kept, n.entry)
+			} else {
+				pruned = append(pruned, n.name)
+			}
+		}
+	}
+	sort.Strings(pruned)
+	return pruned, kept, nil
+}
+
+func (c *cleanRun) main(a DumbcasApplication) error {
+	if c.keepLast <= 0 {
+		return errors.New("Must provide -keep-last greater than 0")
+	}
+	c.exclusive = !c.dryRun
+	c.casOptions.ReadOnly = c.dryRun
+	if err := c.Parse(a, false); err != nil {
+		return err
+	}
+	defer c.unlock()
+	pruned, kept, err := c.plan()
+	if err != nil {
+		return err
+	}
+
+	// Computes the orphans against the nodes that would be left.
+	referenced := map[string]bool{}
+	for _, entrySha1 := range kept {
+		if referenced[entrySha1] {
+			continue
+		}
+		referenced[entrySha1] = true
+		entry, err := dumbcaslib.LoadEntry(c.cas, entrySha1)
+		if err != nil {
+			return err
+		}
+		tagRecurse(referenced, entry)
+	}
+	orphans := []string{}
+	size := int64(0)
+	cancel := make(chan struct{})
+	defer close(cancel)
+	for item := range c.cas.Enumerate(cancel) {
+		if item.Error != nil {
+			return fmt.Errorf("Failed enumerating the CAS table %s", item.Error)
+		}
+		if !referenced[item.Item] {
+			orphans = append(orphans, item.Item)
+			if item.Size > 0 {
+				size += item.Size
+			}
+		}
+	}
+	sort.Strings(orphans)
+
+	if c.dryRun {
+		for _, name := range pruned {
+			fmt.Fprintf(a.GetOut(), "Would remove node %s\n", name)
+		}
+		fmt.Fprintf(a.GetOut(), "Would remove %d nodes and %d objects, reclaiming %.1fmb\n", len(pruned), len(orphans), toMb(size))
+		return nil
+	}
+	c.unindex(a, pruned, orphans)
+	for _, name := range pruned {
+		if err := c.nodes.Remove(name); err != nil {
+			return fmt.Errorf("Failed to remove node %s: %s", name, err)
+		}
+		fmt.Fprintf(a.GetOut(), "Removed node %s\n", name)
+	}
+	if err := removeOrphans(a, c.cas, orphans, 0); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Removed %d nodes and %d objects, reclaiming %.1fmb\n", len(pruned), len(orphans), toMb(size))
+	return nil
+}
+
+// unindex removes the pruned nodes from the reference index, if there is one,
+// while their entry trees are still in the CAS. The orphans are pending until
+// clean removes them. A failure is not fatal; gc -incremental asks to rebuild
+// the index when it finds an entry tree missing.
+func (c *cleanRun) unindex(a DumbcasApplication, pruned, orphans []string) {
+	index, err := c.refs.Load()
+	if err != nil || index == nil {
+		if err != nil {
+			a.GetLog().Printf("Failed to update the reference index: %s", err)
+		}
+		return
+	}
+	changes, err := c.refs.Journal()
+	if err == nil {
+		for _, name := range pruned {
+			changes = append(changes, dumbcaslib.RefChange{Node: name})
+		}
+		if _, err = index.Fold(c.cas, changes); err == nil {
+			index.Pending = orphans
+			err = c.refs.Save(index)
+		}
+	}
+	if err != nil {
+		a.GetLog().Printf("Failed to update the reference index: %s", err)
+	}
+}
+
+func (c *cleanRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestClean(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	_, node1, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file2": "content2"})
+	sha1tree, node3, entry3 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1", "file3": "content3"})
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 6, len(items))
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+
+	// Nothing is removed.
+	f.Run([]string{"clean", "-root=\\test_archive", "-keep-last=1", "-dry-run"}, 0)
+	ut.AssertEqual(t, true, f.casOptions.ReadOnly)
+	f.CheckOut("Would remove node " + node1 + "\nWould remove node " + node2 + "\nWould remove 2 nodes and 3 objects, reclaiming 0.0mb\n")
+	actual, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, items, actual)
+	actual, err = dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nodes, actual)
+
+	f.Run([]string{"clean", "-root=\\test_archive", "-keep-last=1"}, 0)
+	f.CheckOut("Removed node " + node1 + "\nRemoved node " + node2 + "\nRemoved 2 nodes and 3 objects, reclaiming 0.0mb\n")
+	actual, err = dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{node3, "tags/fictious"}, actual)
+	expected := []string{entry3, sha1tree["file1"], sha1tree["file3"]}
+	actual, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, actual)
+}
+
+func TestCleanRefIndex(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"gc", "-root=\\test_clean_refs", "-rebuild-index"}, 0)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file2": "content2"})
+	f.Run([]string{"gc", "-root=\\test_clean_refs", "-rebuild-index"}, 0)
+
+	// The removed nodes are removed from the index along with their entry
+	// trees so gc -incremental still works.
+	f.Run([]string{"clean", "-root=\\test_clean_refs", "-keep-last=1"}, 0)
+	index, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"gc", "-root=\\test_clean_refs", "-incremental"}, 0)
+	f.Run([]string{"gc", "-root=\\test_clean_refs", "-rebuild-index"}, 0)
+	rebuilt, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, rebuilt.Nodes, index.Nodes)
+	ut.AssertEqual(t, rebuilt.Refs, index.Refs)
+}
+
+func TestCleanNameTemplate(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "clean_template")
+	defer removeDir(t, tempData)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	nodes, err := dumbcaslib.LoadLocalNodesTable(tempData, f.cas, dumbcaslib.NodesTableOptions{NameTemplate: `{{.Name}}-{{.Time.Format "20060102T150405Z"}}`})
+	ut.AssertEqual(t, nil, err)
+	f.nodes = nodes
+	_, node1, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file2": "content2"})
+
+	// The names are opaque; the creation time is read from the nodes.
+	latest, err := latestNode(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, node2, latest)
+	f.Run([]string{"clean", "-root=\\test_clean_template", "-keep-last=1"}, 0)
+	f.CheckOut("Removed node " + node1 + "\nRemoved 1 nodes and 2 objects, reclaiming 0.0mb\n")
+
+	// A node that records neither can't be cleaned up safely.
+	data, err := json.Marshal(&dumbcaslib.Node{Entry: "0"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "nodes", node2), data, 0640))
+	f.Run([]string{"clean", "-root=\\test_clean_template", "-keep-last=1"}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestCleanNoKeepLast(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"clean", "-root=\\test_archive"}, 1)
+	f.CheckBuffer(false, true)
+}
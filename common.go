@@ -10,13 +10,24 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
@@ -25,21 +36,204 @@ import (
 // CommonFlags is common flags for all commands.
 type CommonFlags struct {
 	subcommands.CommandRunBase
-	Root string
+	Root           string
+	passphraseFile string
+	// compress is the codec of the new objects. Only set by the commands adding
+	// objects.
+	compress string
 	// These are not "flags" per se but are created indirectly by the -root flag.
 	cas   dumbcaslib.CasTable
 	nodes dumbcaslib.NodesTable
+	refs  dumbcaslib.RefIndexTable
+	// casOptions and nodesOptions are set by the commands before calling
+	// Parse().
+	casOptions   dumbcaslib.CasTableOptions
+	nodesOptions dumbcaslib.NodesTableOptions
+	// exclusive is set by the commands modifying the root before calling
+	// Parse(), which then locks the root until unlock() is called.
+	exclusive bool
+	lock      io.Closer
+	// Only set when InitProfiling() is called.
+	cpuprofile string
+	trace      string
+	// Only set when InitCache() is called.
+	perRootCache bool
+	verifyCache  bool
+	// Only set when InitProgress() is called.
+	progressInterval time.Duration
+	// Only set when InitMirror() is called.
+	mirrors      stringsFlag
+	mirrorQuorum int
+}
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 // Init initializes the common flags.
 func (c *CommonFlags) Init() {
 	c.Flags.StringVar(&c.Root, "root", os.Getenv("DUMBCAS_ROOT"), "Root directory; required. Set $DUMBCAS_ROOT to set a default.")
+	c.Flags.StringVar(&c.passphraseFile, "passphrase-file", "", "File containing the passphrase used to encrypt the CAS objects; the archive must always be used with the same passphrase")
+}
+
+// InitProfiling adds the flags to profile the command. The command must call
+// startProfiling().
+func (c *CommonFlags) InitProfiling() {
+	c.Flags.StringVar(&c.cpuprofile, "cpuprofile", "", "Writes a CPU profile to this file")
+	c.Flags.StringVar(&c.trace, "trace", "", "Writes an execution trace to this file")
+}
+
+// InitCache adds the flags to select and check the hashing cache. The command
+// must load it with loadCache().
+func (c *CommonFlags) InitCache() {
+	c.Flags.BoolVar(&c.perRootCache, "per-root-cache", false, "Keeps the hashing cache in <root>/cache.gob instead of the cache shared by all the roots in ~/.dumbcas")
+	c.Flags.BoolVar(&c.verifyCache, "verify-cache", false, "Checks the structure of the hashing cache when loading it and prunes the corrupted entries, e.g. after a crash while it was saved")
+}
+
+// InitMirror adds the flags to write the new objects to other roots too.
+func (c *CommonFlags) InitMirror() {
+	c.Flags.Var(&c.mirrors, "mirror", "Root also receiving every new object, in the same pass; can be repeated. Only the CAS objects are mirrored, not the nodes")
+	c.Flags.IntVar(&c.mirrorQuorum, "mirror-quorum", 0, "Number of roots, including -root, that must store an object for it to be archived; 0 means all of them")
+}
+
+// InitTempDir adds the flag to write the new objects elsewhere before moving
+// them into the root.
+func (c *CommonFlags) InitTempDir() {
+	c.Flags.StringVar(&c.casOptions.TempDir, "temp-dir", "", "Directory where the new objects are written before being moved into the root, e.g. on a faster disk; on another file system the move is a copy. Defaults to writing them in place")
+}
+
+// InitNodeNameTemplate adds the flag to choose the name of the nodes created.
+func (c *CommonFlags) InitNodeNameTemplate() {
+	c.Flags.StringVar(&c.nodesOptions.NameTemplate, "node-name-template", "", "Go text/template of the name of the node created, using .Hostname, .Time in UTC and .Name, the tag; defaults to "+dumbcaslib.DefaultNodeNameTemplate)
+}
+
+// InitProgress adds the flag to log the progress of the enumerations. The
+// command must count the items with scanProgress.
+func (c *CommonFlags) InitProgress() {
+	c.Flags.DurationVar(&c.progressInterval, "progress-interval", 0, "Logs the number of items enumerated so far at this interval, e.g. 5s, so a long enumeration doesn't look hung; 0 disables it")
+}
+
+// cacheRoot returns the argument to DumbcasApplication.LoadCache().
+func (c *CommonFlags) cacheRoot() string {
+	if c.perRootCache {
+		return c.Root
+	}
+	return ""
+}
+
+// loadCache loads the hashing cache, verifying it with -verify-cache. Like
+// DumbcasApplication.LoadCache(), the Cache is valid even on error.
+func (c *CommonFlags) loadCache(a DumbcasApplication) (dumbcaslib.Cache, error) {
+	cache, err := a.LoadCache(c.cacheRoot())
+	if c.verifyCache {
+		pruned := dumbcaslib.VerifyCache(cache)
+		a.GetLog().Printf("Verified the cache; pruned %d corrupted entries", pruned)
+	}
+	return cache, err
 }
 
-// Parse parses the common flags.
+// startProfiling starts the profilers requested on the command line. The
+// returned function must be called to stop them and flush the files.
+func (c *CommonFlags) startProfiling() (func(), error) {
+	var closers []func()
+	stop := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	if c.cpuprofile != "" {
+		f, err := os.Create(c.cpuprofile)
+		if err != nil {
+			return stop, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			_ = f.Close()
+			return stop, err
+		}
+		closers = append(closers, func() {
+			pprof.StopCPUProfile()
+			_ = f.Close()
+		})
+	}
+	if c.trace != "" {
+		f, err := os.Create(c.trace)
+		if err != nil {
+			return stop, err
+		}
+		if err := trace.Start(f); err != nil {
+			_ = f.Close()
+			return stop, err
+		}
+		closers = append(closers, func() {
+			trace.Stop()
+			_ = f.Close()
+		})
+	}
+	return stop, nil
+}
+
+// rootMarker is the file marking a directory as a root, for findRoot().
+const rootMarker = ".dumbcas-root"
+
+// isDir returns true if p is a directory.
+func isDir(p string) bool {
+	stat, err := os.Stat(p)
+	return err == nil && stat.IsDir()
+}
+
+// expandPath expands the environment variables and a leading ~ in a path given
+// on the command line, like a shell would.
+func expandPath(p string) string {
+	p = os.ExpandEnv(p)
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		if usr, err := user.Current(); err == nil {
+			p = filepath.Join(usr.HomeDir, p[1:])
+		}
+	}
+	return p
+}
+
+// findRoot returns the first directory from dir upward that contains a
+// .dumbcas-root file or both the cas and nodes directories, like git looks
+// for .git.
+func findRoot(dir string) (string, bool) {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, rootMarker)); err == nil {
+			return dir, true
+		}
+		if isDir(filepath.Join(dir, "cas")) && isDir(filepath.Join(dir, "nodes")) {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// Parse parses the common flags. When neither -root nor $DUMBCAS_ROOT is set,
+// the root is found from the current directory with findRoot().
 func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
+	c.Root = expandPath(c.Root)
 	if c.Root == "" {
-		return errors.New("Must provide -root")
+		wd, err := os.Getwd()
+		if err != nil {
+			return usageErrorf("Must provide -root")
+		}
+		root, ok := findRoot(wd)
+		if !ok {
+			return usageErrorf("Must provide -root; no %s file nor cas and nodes directories found in %s or its parents", rootMarker, wd)
+		}
+		c.Root = root
 	}
 	root, err := filepath.Abs(c.Root)
 	if err != nil {
@@ -47,26 +241,79 @@ func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
 	}
 	c.Root = root
 
-	cas, err := d.MakeCasTable(c.Root)
+	if c.casOptions.Logger == nil {
+		c.casOptions.Logger = d.GetLog()
+	}
+	cas, err := d.MakeCasTable(c.Root, c.casOptions)
 	if err != nil {
 		return err
 	}
+	if len(c.mirrors) != 0 {
+		tables := []dumbcaslib.CasTable{cas}
+		for _, m := range c.mirrors {
+			mirror, err := filepath.Abs(expandPath(m))
+			if err != nil {
+				return fmt.Errorf("Failed to find %s", m)
+			}
+			if mirror == c.Root {
+				return fmt.Errorf("Can't mirror %s to itself", m)
+			}
+			t, err := d.MakeCasTable(mirror, c.casOptions)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, t)
+		}
+		if cas, err = dumbcaslib.MakeMultiCasTable(tables, c.mirrorQuorum); err != nil {
+			return err
+		}
+	}
+	if c.passphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(c.passphraseFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read the passphrase: %s", err)
+		}
+		if cas, err = dumbcaslib.MakeEncryptedCasTable(cas, bytes.TrimRight(passphrase, "\r\n")); err != nil {
+			return err
+		}
+	}
+	codec := c.compress
+	if codec == "" {
+		codec = "none"
+	}
+	if cas, err = dumbcaslib.MakeCompressedCasTable(cas, codec); err != nil {
+		return err
+	}
 	c.cas = cas
 
 	if c.cas.GetFsckBit() {
 		if !bypassFsck {
-			return fmt.Errorf("Can't run if fsck is needed. Please run fsck first.")
+			return corruptedErrorf("Can't run if fsck is needed. Please run fsck first.")
 		}
 		fmt.Fprintf(os.Stderr, "WARNING: fsck is needed.")
 	}
-	nodes, err := d.LoadNodesTable(c.Root, c.cas)
+	nodes, err := d.LoadNodesTable(c.Root, c.cas, c.nodesOptions)
 	if err != nil {
 		return err
 	}
 	c.nodes = nodes
+	c.refs = d.MakeRefIndexTable(c.Root)
+	if c.exclusive {
+		if c.lock, err = d.LockRoot(c.Root); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// unlock releases the lock of the root taken by Parse(), if any.
+func (c *CommonFlags) unlock() {
+	if c.lock != nil {
+		_ = c.lock.Close()
+		c.lock = nil
+	}
+}
+
 func sha1Reader(f io.Reader) (string, error) {
 	hash := sha1.New()
 	if _, err := io.Copy(hash, f); err != nil {
@@ -85,3 +332,268 @@ func sha1File(filePath string) (string, error) {
 	}()
 	return sha1Reader(f)
 }
+
+// verifyEntry re-hashes the object of entrySha1 and of every file in entry.
+// Each object is only verified once. Returns the number of objects verified
+// and the number of objects missing or corrupted; each is logged.
+func verifyEntry(l *log.Logger, cas dumbcaslib.CasTable, entrySha1 string, entry *dumbcaslib.Entry) (int, int) {
+	seen := map[string]bool{}
+	bad := 0
+	verify := func(sha1 string, relPath string) {
+		if seen[sha1] {
+			return
+		}
+		seen[sha1] = true
+		f, err := cas.Open(sha1)
+		if err != nil {
+			bad++
+			l.Printf("Failed to open %s for %s: %s", sha1, relPath, err)
+			return
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		actual, err := sha1Reader(f)
+		if err != nil {
+			bad++
+			l.Printf("Failed to read %s for %s: %s", sha1, relPath, err)
+		} else if actual != sha1 {
+			bad++
+			l.Printf("Object %s for %s is corrupted, its content hashes to %s", sha1, relPath, actual)
+		}
+	}
+	verify(entrySha1, "<entry>")
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 != "" {
+			verify(e.Sha1, relPath)
+		}
+		return nil
+	})
+	return len(seen), bad
+}
+
+// reNodeName matches the base name of a node as created by
+// NodesTable.AddEntry(), e.g. "host_2012-01-02_03-04-05_tag(1)". The hostname
+// is optional since the in-memory implementation doesn't use it.
+var reNodeName = regexp.MustCompile(`^(?:.*?_)?(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})_(.+?)(?:\(\d+\))?$`)
+
+// parseNodeName returns the tag name and the creation time embedded in a node
+// name.
+func parseNodeName(nodeName string) (string, time.Time, bool) {
+	match := reNodeName.FindStringSubmatch(filepath.Base(nodeName))
+	if match == nil {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse("2006-01-02_15-04-05", match[1])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return match[2], t, true
+}
+
+// nodeInfo returns the tag name and the creation time of a node. They are
+// parsed from the node name unless they are recorded in the node itself, like
+// when the name is made with -node-name-template.
+func nodeInfo(nodeName string, node *dumbcaslib.Node) (string, time.Time, bool) {
+	tag, created, ok := parseNodeName(nodeName)
+	if node.Tag != "" {
+		tag = node.Tag
+	}
+	if node.Timestamp != 0 {
+		created = time.Unix(node.Timestamp, 0).UTC()
+	}
+	return tag, created, ok || (node.Tag != "" && node.Timestamp != 0)
+}
+
+// nodeTimestamp returns the creation time of a node, preferably the one
+// recorded in the node itself.
+func nodeTimestamp(nodeName string, node *dumbcaslib.Node) (time.Time, bool) {
+	if node.Timestamp != 0 {
+		return time.Unix(node.Timestamp, 0).UTC(), true
+	}
+	_, t, ok := parseNodeName(nodeName)
+	return t, ok
+}
+
+// isTag returns true if the node name is a tag and not an actual node.
+func isTag(nodeName string) bool {
+	return strings.HasPrefix(filepath.ToSlash(nodeName), "tags/")
+}
+
+// isLabel returns true if the node name is a label set with the label command.
+func isLabel(nodeName string) bool {
+	return strings.HasPrefix(filepath.ToSlash(nodeName), "tags/labels/")
+}
+
+// readNode reads the raw data of a node.
+func readNode(nodes dumbcaslib.NodesTable, nodeName string) ([]byte, error) {
+	f, err := nodes.Open(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return ioutil.ReadAll(f)
+}
+
+// resolveTag returns the name of the most recent node that the tag points to.
+//
+// The NodesTable interface has no notion of symlink so the node is found by
+// comparing the content of the tag with each node.
+func resolveTag(nodes dumbcaslib.NodesTable, tag string) (string, error) {
+	tagData, err := readNode(nodes, "tags/"+tag)
+	if err != nil {
+		return "", notFoundErrorf("Failed to read tag %s: %s", tag, err)
+	}
+	names, err := dumbcaslib.EnumerateNodesAsList(nodes)
+	if err != nil {
+		return "", err
+	}
+	// Look from the most recent node.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		if isTag(name) {
+			continue
+		}
+		data, err := readNode(nodes, name)
+		if err != nil {
+			return "", err
+		}
+		if bytes.Equal(data, tagData) {
+			return name, nil
+		}
+	}
+	return "", notFoundErrorf("Failed to find the node for tag %s", tag)
+}
+
+// latestNode returns the name of the most recently created node, ignoring the
+// tags. Each node is read since its name may not embed its creation time.
+func latestNode(nodes dumbcaslib.NodesTable) (string, error) {
+	names, err := dumbcaslib.EnumerateNodesAsList(nodes)
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	latestTime := time.Time{}
+	for _, name := range names {
+		if isTag(name) {
+			continue
+		}
+		data, err := readNode(nodes, name)
+		if err != nil {
+			return "", err
+		}
+		node := &dumbcaslib.Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			return "", fmt.Errorf("Failed reading node %s: %s", name, err)
+		}
+		if _, t, ok := nodeInfo(name, node); ok && (latest == "" || !t.Before(latestTime)) {
+			latest = name
+			latestTime = t
+		}
+	}
+	if latest == "" {
+		return "", errors.New("No node found")
+	}
+	return latest, nil
+}
+
+// resolveNodeArg resolves a node given on the command line. It can be a node
+// name, a tag as tags/<tag>, @<tag> or <tag>, or a substring matching a single
+// node name. A tag is returned as tags/<tag> so the caller decides whether to
+// follow it.
+func resolveNodeArg(nodes dumbcaslib.NodesTable, arg string) (string, error) {
+	if arg == "" {
+		return "", usageErrorf("Must provide a node")
+	}
+	arg = filepath.ToSlash(arg)
+	if strings.HasPrefix(arg, "@") {
+		tag := "tags/" + arg[1:]
+		if _, err := readNode(nodes, tag); err != nil {
+			return "", notFoundErrorf("Failed to find tag %s", arg[1:])
+		}
+		return tag, nil
+	}
+	if _, err := readNode(nodes, arg); err == nil {
+		return arg, nil
+	}
+	if !isTag(arg) {
+		if _, err := readNode(nodes, "tags/"+arg); err == nil {
+			return "tags/" + arg, nil
+		}
+	}
+	names, err := dumbcaslib.EnumerateNodesAsList(nodes)
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, name := range names {
+		name = filepath.ToSlash(name)
+		if !isTag(name) && strings.Contains(name, arg) {
+			matches = append(matches, name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", notFoundErrorf("Failed to find node %s", arg)
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", usageErrorf("Node %s is ambiguous: %s", arg, strings.Join(matches, ", "))
+}
+
+// loadNodeEntry returns the entry tree of the node given on the command line.
+func loadNodeEntry(nodes dumbcaslib.NodesTable, cas dumbcaslib.CasTable, arg string) (*dumbcaslib.Entry, error) {
+	name, err := resolveNodeArg(nodes, arg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readNode(nodes, name)
+	if err != nil {
+		return nil, err
+	}
+	node := &dumbcaslib.Node{}
+	if err := json.Unmarshal(data, node); err != nil {
+		return nil, fmt.Errorf("Failed to read node %s: %s", name, err)
+	}
+	return dumbcaslib.LoadEntry(cas, node.Entry)
+}
+
+// updateRefIndex journals the node for the reference index, if there is one.
+// The index itself is only rewritten by gc. A failure is not fatal since gc
+// -incremental indexes the missing nodes.
+func (c *CommonFlags) updateRefIndex(a DumbcasApplication, nodeName, entrySha1 string) {
+	if err := c.refs.Append(dumbcaslib.RefChange{Node: nodeName, Entry: entrySha1}); err != nil {
+		a.GetLog().Printf("Failed to update the reference index: %s", err)
+	}
+}
+
+// scanProgress logs the number of items enumerated so far, at most once per
+// interval. It does nothing when interval is 0.
+type scanProgress struct {
+	log      *log.Logger
+	what     string
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	count    int
+}
+
+func makeScanProgress(l *log.Logger, what string, interval time.Duration) *scanProgress {
+	now := time.Now()
+	return &scanProgress{log: l, what: what, interval: interval, start: now, last: now}
+}
+
+// add counts one item.
+func (p *scanProgress) add() {
+	p.count++
+	if p.interval <= 0 {
+		return
+	}
+	if now := time.Now(); now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.log.Printf("Enumerating %s: %d so far in %s", p.what, p.count, now.Sub(p.start).Round(time.Second))
+	}
+}
@@ -14,11 +14,17 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -84,8 +90,8 @@ func sha1String(content string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// marshalData returns the tree of sha1s and the json encoded Node as bytes.
-func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byte) {
+// makeEntryTree returns the tree of sha1s and the Entry describing tree.
+func makeEntryTree(tree map[string]string) (map[string]string, *dumbcaslib.Entry) {
 	sha1tree := map[string]string{}
 	entries := &dumbcaslib.Entry{}
 	for k, v := range tree {
@@ -110,8 +116,12 @@ func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byt
 			Size: int64(len(v)),
 		}
 	}
+	return sha1tree, entries
+}
 
-	// Then process entries itself.
+// marshalData returns the tree of sha1s and the json encoded Entry as bytes.
+func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byte) {
+	sha1tree, entries := makeEntryTree(tree)
 	data, err := json.Marshal(entries)
 	ut.AssertEqual(t, nil, err)
 	return sha1tree, data
@@ -131,8 +141,167 @@ func archiveData(t testing.TB, cas dumbcaslib.CasTable, nodes dumbcaslib.NodesTa
 
 	// And finally add the node.
 	now := time.Now().UTC()
-	nodeName, err := nodes.AddEntry(&dumbcaslib.Node{entrySha1, "useful comment"}, "fictious")
+	nodeName, err := nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Comment: "useful comment"}, "fictious")
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqualf(t, true, strings.HasPrefix(nodeName, now.Format("2006-01")+string(filepath.Separator)), "Invalid node name %s", nodeName)
 	return sha1tree, nodeName, entrySha1
 }
+
+// symlinksToPointers replaces the symlinks under root with pointer files, as if
+// the tree had been copied to a file system without symlinks.
+func symlinksToPointers(t testing.TB, root string) {
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(p, []byte("ref: "+filepath.ToSlash(target)+"\n"), 0640)
+	})
+	ut.AssertEqual(t, nil, err)
+}
+
+// addNodes adds count nodes referencing entry, tagged after "fictious" so
+// they are enumerated after the node corrupted by Corrupt().
+func addNodes(t testing.TB, nodes dumbcaslib.NodesTable, entry string, count int) {
+	for i := 0; i < count; i++ {
+		_, err := nodes.AddEntry(&dumbcaslib.Node{Entry: entry}, fmt.Sprintf("zz%d", i))
+		ut.AssertEqual(t, nil, err)
+	}
+}
+
+// countingCasTable counts the calls to Open() for each object.
+type countingCasTable struct {
+	dumbcaslib.CasTable
+	lock   sync.Mutex
+	opened map[string]int
+}
+
+func (c *countingCasTable) Open(item string) (dumbcaslib.ReadSeekCloser, error) {
+	c.lock.Lock()
+	if c.opened == nil {
+		c.opened = map[string]int{}
+	}
+	c.opened[item]++
+	c.lock.Unlock()
+	return c.CasTable.Open(item)
+}
+
+// countGoroutines returns the number of running goroutines, ignoring the ones
+// started by interrupt.HandleCtrlC on each Run, which never return.
+func countGoroutines() int {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if !strings.Contains(g, "maruel/interrupt.") && !strings.Contains(g, "os/signal.") {
+			count++
+		}
+	}
+	return count
+}
+
+// assertNoLeak fails if more goroutines than before, as returned by
+// countGoroutines(), are still running. The goroutines stopped by a cancel may
+// take a moment to return. The caller must not be run in parallel.
+func assertNoLeak(t testing.TB, before int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for countGoroutines() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Leaked %d goroutines", countGoroutines()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFindRoot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "find_root")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"a/" + rootMarker: "", "a/b/c/file": "", "cas/x": "", "nodes/x": "", "d/file": ""}); err != nil {
+		t.Fatal(err)
+	}
+	root, ok := findRoot(filepath.Join(tempData, "a", "b", "c"))
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, filepath.Join(tempData, "a"), root)
+	root, ok = findRoot(filepath.Join(tempData, "d"))
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, tempData, root)
+}
+
+func TestResolveNodeArg(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	first, err := nodes.AddEntry(&dumbcaslib.Node{Entry: "0"}, "myset")
+	ut.AssertEqual(t, nil, err)
+	second, err := nodes.AddEntry(&dumbcaslib.Node{Entry: "1"}, "other")
+	ut.AssertEqual(t, nil, err)
+	first = filepath.ToSlash(first)
+	second = filepath.ToSlash(second)
+
+	data := []struct {
+		arg      string
+		expected string
+	}{
+		{first, first},
+		{"tags/myset", "tags/myset"},
+		{"@other", "tags/other"},
+		{"myset", "tags/myset"},
+		{"_other", second},
+		{path.Base(first), first},
+	}
+	for i, line := range data {
+		actual, err := resolveNodeArg(nodes, line.arg)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, line.expected, actual)
+	}
+
+	_, err = resolveNodeArg(nodes, "@missing")
+	ut.AssertEqual(t, notFoundErrorf("Failed to find tag missing"), err)
+	_, err = resolveNodeArg(nodes, "missing")
+	ut.AssertEqual(t, notFoundErrorf("Failed to find node missing"), err)
+	_, err = resolveNodeArg(nodes, "_")
+	ut.AssertEqual(t, usageErrorf("Node _ is ambiguous: %s, %s", first, second), err)
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Parallel()
+	usr, err := user.Current()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, os.Setenv("DUMBCAS_TEST_EXPAND_PATH", "foo"))
+	ut.AssertEqual(t, filepath.Join("bar", "foo", "baz"), expandPath(filepath.Join("bar", "${DUMBCAS_TEST_EXPAND_PATH}", "baz")))
+	ut.AssertEqual(t, usr.HomeDir, expandPath("~"))
+	ut.AssertEqual(t, filepath.Join(usr.HomeDir, "backups"), expandPath("~/backups"))
+	ut.AssertEqual(t, "~foo", expandPath("~foo"))
+	ut.AssertEqual(t, "", expandPath(""))
+}
+
+func TestScanProgress(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	p := makeScanProgress(log.New(buf, "", 0), "objects", time.Nanosecond)
+	p.last = p.last.Add(-time.Second)
+	p.add()
+	p.add()
+	ut.AssertEqual(t, true, strings.HasPrefix(buf.String(), "Enumerating objects: 1 so far in "))
+	ut.AssertEqual(t, 2, p.count)
+
+	// Disabled.
+	buf.Reset()
+	p = makeScanProgress(log.New(buf, "", 0), "nodes", 0)
+	p.add()
+	ut.AssertEqual(t, "", buf.String())
+}
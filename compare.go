@@ -0,0 +1,202 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdCompare = &subcommands.Command{
+	UsageLine: "compare <node> <live-dir>",
+	ShortDesc: "tells which files changed since a node was archived",
+	LongDesc:  "Hashes the files in <live-dir> and compares them with the entry tree of <node>, listing the files added, removed or modified since the node was archived. The hashing cache is used so only the files modified since they were last hashed are read. Exits with 1 when there is a difference.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &compareRun{}
+		c.Init()
+		c.InitCache()
+		c.Flags.Var(&c.excludes, "exclude", "Glob pattern matched against the base name of the files and directories to ignore, like archive -exclude; can be repeated")
+		c.Flags.Var(&c.includes, "include", "Glob pattern matched against the base name of the files to compare, like archive -include; can be repeated")
+		return c
+	},
+}
+
+type compareRun struct {
+	CommonFlags
+	excludes stringsFlag
+	includes stringsFlag
+}
+
+// treeDiff are the posix-style paths of the files that differ between an entry
+// tree and a directory.
+type treeDiff struct {
+	added     []string
+	removed   []string
+	modified  []string
+	unchanged int
+	errors    int
+}
+
+func (d *treeDiff) count() int {
+	return len(d.added) + len(d.removed) + len(d.modified)
+}
+
+// print prints the files sorted by path, prefixed with A, D or M like
+// git status --short.
+func (d *treeDiff) print(out io.Writer) {
+	lines := make([][2]string, 0, d.count())
+	for _, p := range d.added {
+		lines = append(lines, [2]string{p, "A"})
+	}
+	for _, p := range d.removed {
+		lines = append(lines, [2]string{p, "D"})
+	}
+	for _, p := range d.modified {
+		lines = append(lines, [2]string{p, "M"})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i][0] < lines[j][0]
+	})
+	for _, l := range lines {
+		fmt.Fprintf(out, "%s %s\n", l[1], l[0])
+	}
+	fmt.Fprintf(out, "%d added, %d removed, %d modified, %d unchanged\n", len(d.added), len(d.removed), len(d.modified), d.unchanged)
+}
+
+// ignored returns true if the file relPath of the entry tree wouldn't be
+// enumerated in the directory with these excludes and includes.
+func ignored(relPath string, excludes, includes []string) bool {
+	parts := strings.Split(relPath, "/")
+	for _, part := range parts {
+		if matchAny(excludes, part) {
+			return true
+		}
+	}
+	return len(includes) != 0 && !matchAny(includes, parts[len(parts)-1])
+}
+
+// compareTree compares the files of entry with the ones in liveDir. The files
+// with the same size are hashed, using cache to skip the ones not modified
+// since they were last hashed. The files that can't be read are logged and
+// counted in errors.
+func compareTree(l *log.Logger, cache dumbcaslib.Cache, entry *dumbcaslib.Entry, liveDir string, excludes, includes []string) *treeDiff {
+	files := map[string]*dumbcaslib.Entry{}
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 != "" && !ignored(relPath, excludes, includes) {
+			files[relPath] = e
+		}
+		return nil
+	})
+	d := &treeDiff{}
+	for item := range dumbcaslib.WalkFiles([]string{liveDir}, dumbcaslib.WalkOptions{Excludes: excludes}) {
+		if interrupt.IsSet() {
+			// Drain the walker, it stops shortly.
+			continue
+		}
+		if item.Error != nil {
+			d.errors++
+			l.Printf("Failed to process %s: %s", item.FullPath, item.Error)
+			continue
+		}
+		if len(includes) != 0 && !matchAny(includes, item.Name()) {
+			continue
+		}
+		relPath := filepath.ToSlash(item.RelPath)
+		e := files[relPath]
+		if e == nil {
+			d.added = append(d.added, relPath)
+			continue
+		}
+		delete(files, relPath)
+		if e.Size != item.Size() {
+			d.modified = append(d.modified, relPath)
+			continue
+		}
+		cached := dumbcaslib.FindInCache(cache, item.FullPath)
+		if _, err := updateFile(cached, inputItem{item.FullPath, item.RelPath, item.FileInfo, nil}); err != nil {
+			d.errors++
+			l.Printf("Failed to process %s: %s", item.FullPath, err)
+			continue
+		}
+		if cached.Sha1 != e.Sha1 {
+			d.modified = append(d.modified, relPath)
+		} else {
+			d.unchanged++
+		}
+	}
+	for relPath := range files {
+		d.removed = append(d.removed, relPath)
+	}
+	return d
+}
+
+func (c *compareRun) main(a DumbcasApplication, nodeArg, liveDirArg string) error {
+	for _, pattern := range append(c.excludes, c.includes...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return usageErrorf("Invalid pattern %q: %s", pattern, err)
+		}
+	}
+	liveDir, err := filepath.Abs(expandPath(liveDirArg))
+	if err != nil {
+		return usageErrorf("Failed to find %s", liveDirArg)
+	}
+	if stat, err := os.Stat(liveDir); err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return usageErrorf("%s is not a directory", liveDir)
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	entry, err := loadNodeEntry(c.nodes, c.cas, nodeArg)
+	if err != nil {
+		return err
+	}
+
+	// loadCache must return a valid Cache instance even in case of failure.
+	cache, err := c.loadCache(a)
+	if err != nil {
+		a.GetLog().Printf("Failed to load cache: %s", err)
+	}
+	d := compareTree(a.GetLog(), cache, entry, liveDir, c.excludes, c.includes)
+	if err := cache.Close(); err != nil {
+		a.GetLog().Printf("Failed to save cache: %s", err)
+	}
+	if interrupt.IsSet() {
+		return errInterrupted
+	}
+	d.print(a.GetOut())
+	if d.errors != 0 {
+		return ioErrorf("Got %d errors!", d.errors)
+	}
+	if n := d.count(); n != 0 {
+		return fmt.Errorf("Found %d differences", n)
+	}
+	return nil
+}
+
+func (c *compareRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 2 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide a <node> and a <live-dir>.\n", a.GetName())
+		return exitUsage
+	}
+	interrupt.HandleCtrlC()
+	d := a.(DumbcasApplication)
+	return exitWith(a, c.main(d, args[0], args[1]))
+}
@@ -0,0 +1,59 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+)
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	tempData := makeTempDir(t, "compare")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"dir1/bar":     "bar\n",
+		"dir1/removed": "removed\n",
+		"file1":        "content1",
+		"resized":      "small",
+		"skip/x":       "x\n",
+	}
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
+	err := createTree(tempData, map[string]string{
+		"dir1/bar":   "bar\n",
+		"dir1/added": "added\n",
+		"file1":      "content2",
+		"resized":    "larger",
+		"skip/y":     "y\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Run([]string{"compare", "-root=\\test_archive", "-exclude=skip", nodeName, tempData}, exitFailure)
+	f.CheckOut("A dir1/added\nD dir1/removed\nM file1\nM resized\n1 added, 1 removed, 2 modified, 1 unchanged\n")
+	f.CheckBuffer(false, true)
+
+	// Only the files matching -include are compared.
+	f.Run([]string{"compare", "-root=\\test_archive", "-include=bar", nodeName, tempData}, 0)
+	f.CheckOut("0 added, 0 removed, 0 modified, 1 unchanged\n")
+	f.CheckBuffer(false, false)
+
+	f.Run([]string{"compare", "-root=\\test_archive", nodeName, filepath.Join(tempData, "missing")}, exitNotFound)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"compare", "-root=\\test_archive", nodeName}, exitUsage)
+	f.CheckBuffer(false, true)
+}
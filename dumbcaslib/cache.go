@@ -10,11 +10,16 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bufio"
+	"container/list"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 )
@@ -65,6 +70,55 @@ func (e *EntryCache) CountMembers() int {
 	return sum
 }
 
+var reCacheSha1 = regexp.MustCompile("^[a-f0-9]{40}$")
+
+// VerifyCache checks the structure of the tree of c and removes the entries
+// that can't be trusted, like the ones left by a crash while the cache was
+// saved: a nil entry, an invalid name, a negative size or timestamp, an
+// invalid hash or a file that also has children. The whole branch is removed
+// so the files are hashed again. It returns the number of entries removed.
+func VerifyCache(c Cache) int {
+	pruned := 0
+	var walk func(e *EntryCache)
+	walk = func(e *EntryCache) {
+		for name, child := range e.Files {
+			if child == nil || !validCacheEntry(name, child) {
+				pruned += countCacheEntries(child)
+				delete(e.Files, name)
+				continue
+			}
+			walk(child)
+		}
+	}
+	walk(c.Root())
+	return pruned
+}
+
+// countCacheEntries is like CountMembers but doesn't trust the tree.
+func countCacheEntries(e *EntryCache) int {
+	if e == nil {
+		return 1
+	}
+	sum := 1
+	for _, v := range e.Files {
+		sum += countCacheEntries(v)
+	}
+	return sum
+}
+
+func validCacheEntry(name string, e *EntryCache) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	if e.Size < 0 || e.Timestamp < 0 || e.LastTested < 0 {
+		return false
+	}
+	if e.Sha1 != "" && (!reCacheSha1.MatchString(e.Sha1) || len(e.Files) != 0) {
+		return false
+	}
+	return true
+}
+
 // Cache is a cache to entries to speed up adding elements to a CasTable.
 type Cache interface {
 	io.Closer
@@ -74,12 +128,19 @@ type Cache interface {
 }
 
 // FindInCache finds an item in the cache or create it if not present.
+//
+// If c was returned by LimitCache(), the least recently found entries are
+// evicted as needed to stay within the limit.
 func FindInCache(c Cache, itemPath string) *EntryCache {
 	if filepath.Separator == '/' && itemPath[0] == '/' {
 		itemPath = itemPath[1:]
 	}
+	parts := strings.Split(itemPath, string(filepath.Separator))
+	if l, ok := c.(*limitedCache); ok {
+		return l.find(parts)
+	}
 	entry := c.Root()
-	for _, p := range strings.Split(itemPath, string(filepath.Separator)) {
+	for _, p := range parts {
 		if entry.Files == nil {
 			entry.Files = make(map[string]*EntryCache)
 		}
@@ -91,6 +152,249 @@ func FindInCache(c Cache, itemPath string) *EntryCache {
 	return entry
 }
 
+// LimitCache returns a Cache that keeps at most maxEntries entries in memory
+// when used with FindInCache(). The least recently found files are evicted
+// first. When c is saved to a file, the evicted files are written to a
+// temporary file as they are evicted and appended to the cache when it is
+// closed, so they are not hashed again the next time. This trades some
+// hashing for bounded memory. c is returned as-is if maxEntries is 0 or less.
+func LimitCache(c Cache, maxEntries int) Cache {
+	if maxEntries <= 0 {
+		return c
+	}
+	l := &limitedCache{
+		Cache:      c,
+		maxEntries: maxEntries,
+		count:      1,
+		lru:        list.New(),
+		nodes:      map[*EntryCache]*lruNode{},
+	}
+	// Sort the files once so the least recently tested are evicted first.
+	var leaves []*EntryCache
+	var walk func(e *EntryCache)
+	walk = func(e *EntryCache) {
+		for name, child := range e.Files {
+			l.nodes[child] = &lruNode{parent: e, name: name}
+			l.count++
+			if len(child.Files) == 0 {
+				leaves = append(leaves, child)
+			} else {
+				walk(child)
+			}
+		}
+	}
+	walk(c.Root())
+	sort.Slice(leaves, func(i, j int) bool {
+		return leaves[i].LastTested < leaves[j].LastTested
+	})
+	for _, e := range leaves {
+		l.nodes[e].elem = l.lru.PushFront(e)
+	}
+	if l.count > maxEntries {
+		l.evict(maxEntries)
+	}
+	return l
+}
+
+type limitedCache struct {
+	Cache
+	maxEntries int
+	// count is the number of entries in the tree, including the root.
+	count int
+	// lru holds the entries without children, the most recently found first.
+	lru *list.List
+	// nodes has the parent of every entry but the root.
+	nodes map[*EntryCache]*lruNode
+	// spill receives the evicted files. It is created on the first eviction
+	// when the cache is saved to a file.
+	spill *cacheSpill
+}
+
+type lruNode struct {
+	parent *EntryCache
+	name   string
+	// elem is the element in lru, nil when the entry has children.
+	elem *list.Element
+}
+
+func (l *limitedCache) find(parts []string) *EntryCache {
+	if l.count+len(parts) > l.maxEntries {
+		// Evict more than needed so it doesn't happen on every call.
+		l.evict(l.maxEntries - l.maxEntries/10 - len(parts))
+	}
+	entry := l.Root()
+	for _, p := range parts {
+		if entry.Files == nil {
+			entry.Files = make(map[string]*EntryCache)
+		}
+		child := entry.Files[p]
+		if child == nil {
+			child = &EntryCache{}
+			entry.Files[p] = child
+			l.nodes[child] = &lruNode{parent: entry, name: p}
+			l.count++
+			// The parent now has a child so it can't be evicted by itself.
+			if n := l.nodes[entry]; n != nil && n.elem != nil {
+				l.lru.Remove(n.elem)
+				n.elem = nil
+			}
+		}
+		entry = child
+	}
+	if n := l.nodes[entry]; n != nil && len(entry.Files) == 0 {
+		if n.elem != nil {
+			l.lru.MoveToFront(n.elem)
+		} else {
+			n.elem = l.lru.PushFront(entry)
+		}
+	}
+	return entry
+}
+
+// evict removes the least recently found entries without children until
+// there is at most target entries. The directories emptied this way are
+// removed too.
+func (l *limitedCache) evict(target int) {
+	for l.count > target {
+		back := l.lru.Back()
+		if back == nil {
+			return
+		}
+		l.remove(back.Value.(*EntryCache))
+	}
+}
+
+func (l *limitedCache) remove(e *EntryCache) {
+	n := l.nodes[e]
+	if n.elem != nil {
+		l.lru.Remove(n.elem)
+	}
+	if e.Sha1 != "" {
+		l.save(e)
+	}
+	delete(n.parent.Files, n.name)
+	delete(l.nodes, e)
+	l.count--
+	if l.nodes[n.parent] != nil && len(n.parent.Files) == 0 && n.parent.Sha1 == "" {
+		l.remove(n.parent)
+	}
+}
+
+// save writes the evicted file e to the spill file.
+func (l *limitedCache) save(e *EntryCache) {
+	if l.spill == nil {
+		c, ok := l.Cache.(*cache)
+		if !ok || c.filePath == "" {
+			return
+		}
+		l.spill = makeCacheSpill(filepath.Dir(c.filePath))
+	}
+	var path []string
+	for n := l.nodes[e]; n != nil; n = l.nodes[n.parent] {
+		path = append(path, n.name)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	l.spill.add(&cacheRecord{path, EntryCache{Sha1: e.Sha1, Size: e.Size, Timestamp: e.Timestamp, LastTested: e.LastTested}})
+}
+
+func (l *limitedCache) Close() error {
+	if l.spill == nil {
+		return l.Cache.Close()
+	}
+	defer l.spill.remove()
+	c := l.Cache.(*cache)
+	c.records = l.spill.records
+	return c.Close()
+}
+
+// cacheRecord is a file saved after the tree of the cache. Path are the
+// components of its path.
+type cacheRecord struct {
+	Path  []string
+	Entry EntryCache
+}
+
+// addCacheRecord adds r to the tree of root, unless the file there was tested
+// more recently.
+func addCacheRecord(root *EntryCache, r *cacheRecord) {
+	if len(r.Path) == 0 {
+		return
+	}
+	entry := root
+	for _, p := range r.Path {
+		if entry.Files == nil {
+			entry.Files = make(map[string]*EntryCache)
+		}
+		if entry.Files[p] == nil {
+			entry.Files[p] = &EntryCache{}
+		}
+		entry = entry.Files[p]
+	}
+	if len(entry.Files) == 0 && entry.LastTested <= r.Entry.LastTested {
+		*entry = r.Entry
+	}
+}
+
+// cacheSpill is a temporary file receiving the files evicted from a
+// limitedCache. On failure to write it, the evicted files are lost and will
+// be hashed again.
+type cacheSpill struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *gob.Encoder
+	err error
+}
+
+func makeCacheSpill(dir string) *cacheSpill {
+	s := &cacheSpill{}
+	if s.f, s.err = ioutil.TempFile(dir, "cache.evicted"); s.err == nil {
+		s.w = bufio.NewWriter(s.f)
+		s.enc = gob.NewEncoder(s.w)
+	}
+	return s
+}
+
+func (s *cacheSpill) add(r *cacheRecord) {
+	if s.err == nil {
+		s.err = s.enc.Encode(r)
+	}
+}
+
+// records calls fn for each file written so far.
+func (s *cacheSpill) records(fn func(r *cacheRecord) error) error {
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	if s.err == nil {
+		_, s.err = s.f.Seek(0, io.SeekStart)
+	}
+	if s.err != nil {
+		return nil
+	}
+	d := gob.NewDecoder(bufio.NewReader(s.f))
+	for {
+		r := &cacheRecord{}
+		if err := d.Decode(r); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read the evicted entries: %s", err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *cacheSpill) remove() {
+	if s.f != nil {
+		_ = s.f.Close()
+		_ = os.Remove(s.f.Name())
+	}
+}
+
 type memoryCache struct {
 	root   *EntryCache
 	closed bool
@@ -10,6 +10,8 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -27,13 +29,19 @@ import (
 func LoadCache() (Cache, error) {
 	cacheDir, err := getCachePath()
 	if err != nil {
-		return &cache{&EntryCache{}, ""}, err
+		return &cache{root: &EntryCache{}}, err
 	}
 	return loadCacheInner(cacheDir)
 }
 
+// LoadRootCache is like LoadCache but the cache is kept in rootDir, so each
+// archive root has its own cache.
+func LoadRootCache(rootDir string) (Cache, error) {
+	return loadCacheInner(rootDir)
+}
+
 func loadCacheInner(cacheDir string) (Cache, error) {
-	cache := &cache{&EntryCache{}, filepath.Join(cacheDir, "cache.gob")}
+	cache := &cache{root: &EntryCache{}, filePath: filepath.Join(cacheDir, "cache.gob")}
 	if err := os.Mkdir(cacheDir, 0700); err != nil && !os.IsExist(err) {
 		return cache, fmt.Errorf("Failed to access %s: %s", cacheDir, err)
 	}
@@ -55,19 +63,46 @@ func loadCacheInner(cacheDir string) (Cache, error) {
 	// - It's significantly smaller than json.
 	// - The program works fine without cache so it's not a big deal if it ever
 	//   become backward incomatible.
-	d := gob.NewDecoder(f)
+	// The cache is gzip compressed since the paths compress well. An
+	// uncompressed cache, as written by older versions, is still loaded.
+	r := bufio.NewReader(f)
+	var src io.Reader = r
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return cache, fmt.Errorf("failed loading cache: %s", err)
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		src = gz
+	}
+	d := gob.NewDecoder(src)
 	if err = d.Decode(cache.root); err != nil && err != io.EOF {
 		// Ignore unmarshaling failure by reseting the content. Better be safe than
 		// sorry.
 		err = fmt.Errorf("failed loading cache: %s", err)
 		cache.root = &EntryCache{}
+		return cache, err
 	}
-	return cache, err
+	// The files evicted by LimitCache() follow the tree.
+	for err == nil {
+		r := &cacheRecord{}
+		if err = d.Decode(r); err == nil {
+			addCacheRecord(cache.root, r)
+		}
+	}
+	if err != io.EOF {
+		return cache, fmt.Errorf("failed loading cache: %s", err)
+	}
+	return cache, nil
 }
 
 type cache struct {
 	root     *EntryCache
 	filePath string
+	// records, when set, enumerates the files to save after the tree.
+	records func(fn func(r *cacheRecord) error) error
 }
 
 func getCachePath() (string, error) {
@@ -82,33 +117,66 @@ func (c *cache) Root() *EntryCache {
 	return c.root
 }
 
-func encode(filePath string, root *EntryCache) error {
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// encode writes root then the files enumerated by records, if set, gzip
+// compressed and returns the size of the gob stream before compression.
+func encode(filePath string, root *EntryCache, records func(fn func(r *cacheRecord) error) error) (int64, error) {
 	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if f == nil {
-		return fmt.Errorf("failed to save cache %s: %s", filePath, err)
+		return 0, fmt.Errorf("failed to save cache %s: %s", filePath, err)
 	}
 	defer func() {
 		_ = f.Close()
 	}()
+	gz := gzip.NewWriter(f)
+	w := &countingWriter{w: gz}
 	// TODO(maruel): Trim anything > ~1yr old.
-	e := gob.NewEncoder(f)
+	e := gob.NewEncoder(w)
 	if err := e.Encode(root); err != nil {
-		return fmt.Errorf("failed to write %s: %s", filePath, err)
+		return 0, fmt.Errorf("failed to write %s: %s", filePath, err)
 	}
-	return nil
+	if records != nil {
+		err := records(func(r *cacheRecord) error {
+			return e.Encode(r)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to write %s: %s", filePath, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %s", filePath, err)
+	}
+	return w.n, nil
 }
 
 func (c *cache) Close() error {
 	if c.filePath == "" {
 		return nil
 	}
-	if err := encode(c.filePath, c.root); err != nil {
+	size, err := encode(c.filePath, c.root, c.records)
+	if err != nil {
 		return err
 	}
+	// The uncompressed size is checked since a small cache may compress to
+	// less than the gob type definitions.
+	if size < 100 {
+		return fmt.Errorf("Failed to serialize %s: %d", c.filePath, size)
+	}
 	stat, err := os.Stat(c.filePath)
 	if err != nil {
 		return fmt.Errorf("Unexpected error while stat'ing %s: %s", c.filePath, err)
-	} else if stat.Size() < 100 {
+	} else if stat.Size() == 0 {
 		return fmt.Errorf("Failed to serialize %s: %d", c.filePath, stat.Size())
 	}
 	return nil
@@ -11,6 +11,9 @@ package dumbcaslib
 
 import (
 	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -45,6 +48,40 @@ func TestCacheRedirected(t *testing.T) {
 	testCacheImpl(t, load)
 }
 
+func TestCacheRoot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cache")
+	defer removeDir(t, tempData)
+	load := func() (Cache, error) {
+		return LoadRootCache(tempData)
+	}
+	testCacheImpl(t, load)
+	_, err := os.Stat(filepath.Join(tempData, "cache.gob"))
+	ut.AssertEqual(t, nil, err)
+}
+
+func TestCacheCompressed(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cache")
+	defer removeDir(t, tempData)
+	c, err := loadCacheInner(tempData)
+	ut.AssertEqual(t, nil, err)
+	FindInCache(c, filepath.Join("foo", "bar")).Sha1 = "x"
+	ut.AssertEqual(t, nil, c.Close())
+	data, err := ioutil.ReadFile(filepath.Join(tempData, "cache.gob"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []byte{0x1f, 0x8b}, data[:2])
+
+	// An uncompressed cache, as written by older versions, is still loaded.
+	f, err := os.Create(filepath.Join(tempData, "cache.gob"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, gob.NewEncoder(f).Encode(c.Root()))
+	ut.AssertEqual(t, nil, f.Close())
+	c, err = loadCacheInner(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "x", c.Root().Files["foo"].Files["bar"].Sha1)
+}
+
 func TestFakeCache(t *testing.T) {
 	t.Parallel()
 	// Keep the cache alive, since it's all in-memory.
@@ -89,3 +126,104 @@ func testCacheImpl(t testing.TB, load func() (Cache, error)) {
 		c.Close()
 	}
 }
+
+func TestLimitCache(t *testing.T) {
+	t.Parallel()
+	c := LimitCache(MakeMemoryCache(), 10)
+	for i := 0; i < 100; i++ {
+		e := FindInCache(c, filepath.Join("dir", fmt.Sprintf("%d", i%7), fmt.Sprintf("%d", i)))
+		e.LastTested = int64(i + 1)
+		ut.AssertEqualf(t, true, c.Root().CountMembers() <= 10, "%d", c.Root().CountMembers())
+	}
+	// The most recently tested entry was kept.
+	ut.AssertEqual(t, int64(100), FindInCache(c, filepath.Join("dir", "1", "99")).LastTested)
+	ut.AssertEqual(t, nil, c.Close())
+}
+
+func TestLimitCacheLoad(t *testing.T) {
+	t.Parallel()
+	c := MakeMemoryCache()
+	for i := 0; i < 20; i++ {
+		FindInCache(c, fmt.Sprintf("%d", i)).LastTested = int64(i + 1)
+	}
+	c = LimitCache(c, 5)
+	ut.AssertEqual(t, 5, c.Root().CountMembers())
+	ut.AssertEqual(t, []string{"16", "17", "18", "19"}, c.Root().SortedFiles())
+}
+
+func TestLimitCacheRecentlyFound(t *testing.T) {
+	t.Parallel()
+	c := LimitCache(MakeMemoryCache(), 4)
+	FindInCache(c, "a").LastTested = 1
+	FindInCache(c, "b").LastTested = 2
+	// Finding a again makes b the least recently found.
+	FindInCache(c, "a")
+	FindInCache(c, "c")
+	FindInCache(c, "d")
+	ut.AssertEqual(t, []string{"a", "c", "d"}, c.Root().SortedFiles())
+}
+
+func TestLimitCacheSpill(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cache_spill")
+	defer removeDir(t, tempData)
+	c, err := loadCacheInner(tempData)
+	ut.AssertEqual(t, nil, err)
+	c = LimitCache(c, 10)
+	for i := 0; i < 100; i++ {
+		e := FindInCache(c, filepath.Join("dir", fmt.Sprintf("%d", i%7), fmt.Sprintf("%d", i)))
+		e.Sha1 = Sha1Bytes([]byte(fmt.Sprintf("%d", i)))
+		e.Size = int64(i)
+		e.LastTested = int64(i + 1)
+		ut.AssertEqualf(t, true, c.Root().CountMembers() <= 10, "%d", c.Root().CountMembers())
+	}
+	ut.AssertEqual(t, nil, c.Close())
+	// The temporary file is removed.
+	files, err := ioutil.ReadDir(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(files))
+
+	// The evicted files were saved with the cache.
+	c, err = loadCacheInner(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1+1+7+100, c.Root().CountMembers())
+	for i := 0; i < 100; i++ {
+		e := FindInCache(c, filepath.Join("dir", fmt.Sprintf("%d", i%7), fmt.Sprintf("%d", i)))
+		ut.AssertEqual(t, Sha1Bytes([]byte(fmt.Sprintf("%d", i))), e.Sha1)
+		ut.AssertEqual(t, int64(i), e.Size)
+	}
+	ut.AssertEqual(t, nil, c.Close())
+}
+
+func BenchmarkLimitCache(b *testing.B) {
+	c := LimitCache(MakeMemoryCache(), 100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FindInCache(c, filepath.Join("dir", fmt.Sprintf("%d", i%100), fmt.Sprintf("%d", i))).LastTested = int64(i)
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	t.Parallel()
+	c := MakeMemoryCache()
+	good := FindInCache(c, filepath.Join("dir", "good"))
+	good.Sha1 = Sha1Bytes([]byte("good"))
+	good.Size = 4
+	FindInCache(c, filepath.Join("dir", "short")).Sha1 = "abc"
+	FindInCache(c, filepath.Join("dir", "negative")).Size = -1
+	bad := FindInCache(c, filepath.Join("bad", "sub", "file"))
+	bad.Timestamp = -1
+	FindInCache(c, filepath.Join("bad", "sub", "other"))
+	both := FindInCache(c, "both")
+	both.Sha1 = good.Sha1
+	FindInCache(c, filepath.Join("both", "child"))
+	c.Root().Files["nil"] = nil
+	c.Root().Files["a/b"] = &EntryCache{}
+
+	// short, negative, file, both with its child, nil and a/b.
+	ut.AssertEqual(t, 7, VerifyCache(c))
+	ut.AssertEqual(t, []string{"bad", "dir"}, c.Root().SortedFiles())
+	ut.AssertEqual(t, []string{"good"}, c.Root().Files["dir"].SortedFiles())
+	ut.AssertEqual(t, []string{"other"}, c.Root().Files["bad"].Files["sub"].SortedFiles())
+	ut.AssertEqual(t, 0, VerifyCache(c))
+}
@@ -16,7 +16,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"time"
 )
 
 // CasTable describes the interface to a content-addressed-storage.
@@ -32,11 +35,31 @@ type CasTable interface {
 	ClearFsckBit()
 }
 
+// CasTableOptions are the options used to create a CasTable.
+type CasTableOptions struct {
+	// ReadOnly makes SetFsckBit() a logged no-op, so the table can be served
+	// from a read-only file system.
+	ReadOnly bool
+	// Fsync flushes each object to disk before AddEntry() returns. It makes the
+	// objects durable in case of power loss at the cost of throughput.
+	Fsync bool
+	// Logger is used to log unusual events. Nothing is logged if nil.
+	Logger Logger
+	// EnumerateBatch is the number of objects read at once from each prefix
+	// directory by Enumerate(), to bound the memory used on very large
+	// stores. 0 uses 1024.
+	EnumerateBatch int
+	// TempDir is where AddEntry() writes an object before moving it into the
+	// table, e.g. on a faster disk. On another file system the move is a copy,
+	// which costs a second write. By default the object is written in place.
+	TempDir string
+}
+
 // EnumerateCasAsList returns a sorted list of all the entries in a CasTable.
 // It is meant to be used in test.
 func EnumerateCasAsList(cas CasTable) ([]string, error) {
 	items := []string{}
-	for v := range cas.Enumerate() {
+	for v := range cas.Enumerate(nil) {
 		if v.Error != nil {
 			return nil, v.Error
 		}
@@ -49,49 +72,89 @@ func EnumerateCasAsList(cas CasTable) ([]string, error) {
 // MakeMemoryCasTable returns a CasTable implementation that keeps all the data
 // in memory. Is it useful for testing.
 func MakeMemoryCasTable() CasTable {
-	return &memoryCasTable{make(map[string][]byte), false}
+	return &memoryCasTable{entries: make(map[string][]byte), mtimes: make(map[string]time.Time)}
 }
 
+// memoryCasSnapshotName is the file written by SnapshotTo.
+const memoryCasSnapshotName = "cas.gob"
+
 type memoryCasTable struct {
-	entries  map[string][]byte
+	lock    sync.Mutex
+	entries map[string][]byte
+	// mtimes is when each object was added. It is not saved by SnapshotTo.
+	mtimes   map[string]time.Time
 	needFsck bool
 }
 
+// memoryCasSnapshot is the content of a memoryCasTable as saved by
+// SnapshotTo.
+type memoryCasSnapshot struct {
+	Entries  map[string][]byte
+	NeedFsck bool
+}
+
 func (m *memoryCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, _ = w.Write(m.entries[r.URL.Path[1:]])
+	m.lock.Lock()
+	data := m.entries[r.URL.Path[1:]]
+	m.lock.Unlock()
+	_, _ = w.Write(data)
 }
 
-func (m *memoryCasTable) Enumerate() <-chan EnumerationEntry {
-	// First make a copy of the keys.
+func (m *memoryCasTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
+	// First make a copy of the keys. Sort them so the enumeration is
+	// deterministic.
+	m.lock.Lock()
 	keys := make([]string, len(m.entries))
+	sizes := make(map[string]int64, len(m.entries))
+	mtimes := make(map[string]time.Time, len(m.entries))
 	i := 0
-	for k := range m.entries {
+	for k, v := range m.entries {
 		keys[i] = k
+		sizes[k] = int64(len(v))
+		mtimes[k] = m.mtimes[k]
 		i++
 	}
+	m.lock.Unlock()
+	sort.Strings(keys)
 	c := make(chan EnumerationEntry)
 	go func() {
+		defer close(c)
 		for _, k := range keys {
-			c <- EnumerationEntry{Item: k}
+			select {
+			case c <- EnumerationEntry{Item: k, Size: sizes[k], ModTime: mtimes[k]}:
+			case <-cancel:
+				return
+			}
 		}
-		close(c)
 	}()
 	return c
 }
 
 func (m *memoryCasTable) AddEntry(source io.Reader, item string) error {
-	if _, ok := m.entries[item]; ok {
+	m.lock.Lock()
+	_, ok := m.entries[item]
+	m.lock.Unlock()
+	if ok {
 		return os.ErrExist
 	}
 	data, err := ioutil.ReadAll(source)
-	if err == nil {
-		m.entries[item] = data
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[item]; ok {
+		return os.ErrExist
 	}
-	return err
+	m.entries[item] = data
+	m.mtimes[item] = time.Now()
+	return nil
 }
 
 func (m *memoryCasTable) Open(item string) (ReadSeekCloser, error) {
+	m.lock.Lock()
 	data, ok := m.entries[item]
+	m.lock.Unlock()
 	if !ok {
 		return nil, fmt.Errorf("Missing: %s", item)
 	}
@@ -99,25 +162,64 @@ func (m *memoryCasTable) Open(item string) (ReadSeekCloser, error) {
 }
 
 func (m *memoryCasTable) Remove(item string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if _, ok := m.entries[item]; !ok {
 		return os.ErrNotExist
 	}
 	delete(m.entries, item)
+	delete(m.mtimes, item)
 	return nil
 }
 
 func (m *memoryCasTable) SetFsckBit() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.needFsck = true
 }
 
 func (m *memoryCasTable) GetFsckBit() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	return m.needFsck
 }
 
 func (m *memoryCasTable) ClearFsckBit() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.needFsck = false
 }
 
 func (m *memoryCasTable) Corrupt() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.entries[Sha1Bytes([]byte{0, 1})] = []byte("content5")
 }
+
+// SnapshotTo writes the objects and the fsck bit in dir. The objects are
+// immutable so only the map is copied while locked.
+func (m *memoryCasTable) SnapshotTo(dir string) error {
+	m.lock.Lock()
+	s := memoryCasSnapshot{Entries: make(map[string][]byte, len(m.entries)), NeedFsck: m.needFsck}
+	for k, v := range m.entries {
+		s.Entries[k] = v
+	}
+	m.lock.Unlock()
+	return saveGob(filepath.Join(dir, memoryCasSnapshotName), &s)
+}
+
+func (m *memoryCasTable) RestoreFrom(dir string) error {
+	s := memoryCasSnapshot{}
+	if err := loadGob(filepath.Join(dir, memoryCasSnapshotName), &s); err != nil {
+		return err
+	}
+	if s.Entries == nil {
+		s.Entries = map[string][]byte{}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = s.Entries
+	m.mtimes = map[string]time.Time{}
+	m.needFsck = s.NeedFsck
+	return nil
+}
@@ -0,0 +1,348 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Each compressed object is the magic, a byte for the codec, the compressed
+// stream and the size of the uncompressed data as a big endian uint64. Objects
+// without the magic are stored verbatim, so a store can mix objects written
+// with any codec, including the ones written before compression was supported.
+const (
+	compressedMagic       = "DCASCMP1"
+	compressedHeaderSize  = len(compressedMagic) + 1
+	compressedTrailerSize = 8
+)
+
+// The index of each codec in Codecs is the value stored in the header.
+const (
+	codecNone byte = iota
+	codecGzip
+	codecZstd
+)
+
+// Codecs lists the codecs supported by MakeCompressedCasTable().
+var Codecs = []string{"none", "gzip", "zstd"}
+
+// Enumerate is not overridden so it reports the size of each object as
+// stored, without opening it. Open() returns the uncompressed size.
+type compressedCasTable struct {
+	CasTable
+	// codec is used for the objects added by this instance.
+	codec byte
+}
+
+// MakeCompressedCasTable returns a CasTable that compresses the objects
+// added to cas with codec, one of Codecs. Objects are decompressed according
+// to their own header so the codec can be changed at any time.
+func MakeCompressedCasTable(cas CasTable, codec string) (CasTable, error) {
+	for i, name := range Codecs {
+		if name == codec {
+			return &compressedCasTable{cas, byte(i)}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown codec %s; valid values are %s", codec, strings.Join(Codecs, ", "))
+}
+
+func (c *compressedCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.Error(w, "Internal failure. CasTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	f, err := c.Open(r.URL.Path[1:])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func (c *compressedCasTable) AddEntry(source io.Reader, name string) error {
+	b := bufio.NewReader(source)
+	if c.codec == codecNone {
+		// Stores the object verbatim unless it could be mistaken for a compressed
+		// one.
+		if prefix, _ := b.Peek(len(compressedMagic)); string(prefix) != compressedMagic {
+			return c.CasTable.AddEntry(b, name)
+		}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(compress(pw, b, c.codec))
+	}()
+	err := c.CasTable.AddEntry(pr, name)
+	// Unblocks compress() if AddEntry() returned without reading everything.
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// The zstd encoders and decoders are expensive to create so they are reused
+// across objects.
+var (
+	zstdEncoders = sync.Pool{
+		New: func() interface{} {
+			e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+			return e
+		},
+	}
+	zstdDecoders = sync.Pool{
+		New: func() interface{} {
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			return d
+		},
+	}
+)
+
+// zstdWriter returns the encoder to the pool once closed.
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (z zstdWriter) Close() error {
+	err := z.Encoder.Close()
+	zstdEncoders.Put(z.Encoder)
+	return err
+}
+
+// zstdReader returns the decoder to the pool once closed.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	_ = z.Decoder.Reset(nil)
+	zstdDecoders.Put(z.Decoder)
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compress writes the compressed form of src to dst.
+func compress(dst io.Writer, src io.Reader, codec byte) error {
+	if _, err := dst.Write(append([]byte(compressedMagic), codec)); err != nil {
+		return err
+	}
+	var w io.WriteCloser
+	switch codec {
+	case codecNone:
+		w = nopWriteCloser{dst}
+	case codecGzip:
+		w = gzip.NewWriter(dst)
+	case codecZstd:
+		e := zstdEncoders.Get().(*zstd.Encoder)
+		e.Reset(dst)
+		w = zstdWriter{e}
+	}
+	size, err := io.Copy(w, src)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, compressedTrailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(size))
+	_, err = dst.Write(trailer)
+	return err
+}
+
+func (c *compressedCasTable) Open(name string) (ReadSeekCloser, error) {
+	f, err := c.CasTable.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := makeDecompressReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("Failed to open %s: %s", name, err)
+	}
+	return r, nil
+}
+
+// makeDecompressReader returns f itself when the object is not compressed.
+func makeDecompressReader(f ReadSeekCloser) (ReadSeekCloser, error) {
+	header := make([]byte, compressedHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n != compressedHeaderSize || !bytes.HasPrefix(header, []byte(compressedMagic)) {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	codec := header[len(compressedMagic)]
+	if int(codec) >= len(Codecs) {
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+	end, err := f.Seek(-compressedTrailerSize, io.SeekEnd)
+	if err != nil || end < int64(compressedHeaderSize) {
+		return nil, errors.New("truncated")
+	}
+	trailer := make([]byte, compressedTrailerSize)
+	if _, err := io.ReadFull(f, trailer); err != nil {
+		return nil, err
+	}
+	return &decompressReader{
+		f:     f,
+		codec: codec,
+		end:   end,
+		size:  int64(binary.BigEndian.Uint64(trailer)),
+	}, nil
+}
+
+// StoredSize returns the size of the object name as stored in cas and whether
+// it is compressed. Only a CasTable returned by MakeCompressedCasTable can
+// report a compressed object. It doesn't read the object content.
+func StoredSize(cas CasTable, name string) (int64, bool, error) {
+	c, isCompressed := cas.(*compressedCasTable)
+	if isCompressed {
+		cas = c.CasTable
+	}
+	f, err := cas.Open(name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil || !isCompressed {
+		return size, false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	header := make([]byte, len(compressedMagic))
+	n, _ := io.ReadFull(f, header)
+	return size, n == len(header) && string(header) == compressedMagic, nil
+}
+
+// decompressReader decompresses an object. A compressed stream can't be
+// seeked so seeking backward restarts from the beginning.
+type decompressReader struct {
+	f     ReadSeekCloser
+	codec byte
+	// end is the offset of the trailer in f.
+	end int64
+	// size is the size of the uncompressed data.
+	size int64
+	pos  int64
+	// d is the decompressor, at offset dpos.
+	d    io.ReadCloser
+	dpos int64
+}
+
+func (d *decompressReader) reset() error {
+	if d.d != nil {
+		_ = d.d.Close()
+		d.d = nil
+	}
+	if _, err := d.f.Seek(int64(compressedHeaderSize), io.SeekStart); err != nil {
+		return err
+	}
+	r := io.LimitReader(d.f, d.end-int64(compressedHeaderSize))
+	switch d.codec {
+	case codecNone:
+		d.d = ioutil.NopCloser(r)
+	case codecGzip:
+		g, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		d.d = g
+	case codecZstd:
+		z := zstdDecoders.Get().(*zstd.Decoder)
+		if err := z.Reset(r); err != nil {
+			zstdDecoders.Put(z)
+			return err
+		}
+		d.d = zstdReader{z}
+	}
+	d.dpos = 0
+	return nil
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	if d.d == nil || d.pos < d.dpos {
+		if err := d.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if d.pos > d.dpos {
+		n, err := io.CopyN(ioutil.Discard, d.d, d.pos-d.dpos)
+		d.dpos += n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	if int64(len(p)) > d.size-d.pos {
+		p = p[:d.size-d.pos]
+	}
+	n, err := d.d.Read(p)
+	d.dpos += int64(n)
+	d.pos = d.dpos
+	if err == io.EOF && d.pos < d.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (d *decompressReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = offset
+	return d.pos, nil
+}
+
+func (d *decompressReader) Close() error {
+	if d.d != nil {
+		_ = d.d.Close()
+	}
+	return d.f.Close()
+}
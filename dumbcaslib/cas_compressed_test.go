@@ -0,0 +1,233 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+// compressibleData returns size bytes that look like a text file.
+func compressibleData(size int) []byte {
+	buf := &bytes.Buffer{}
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(buf, "line %d: the quick brown fox jumps over the lazy dog %d\n", i, i*i%97)
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestCompressedCasTable(t *testing.T) {
+	t.Parallel()
+	for _, codec := range Codecs {
+		cas, err := MakeCompressedCasTable(MakeMemoryCasTable(), codec)
+		ut.AssertEqual(t, nil, err)
+		testCasTableImpl(t, cas)
+	}
+}
+
+func TestCompressedCasTableUnknown(t *testing.T) {
+	t.Parallel()
+	_, err := MakeCompressedCasTable(MakeMemoryCasTable(), "lzma")
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCompressedCasTableStoredSize(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	cas, err := MakeCompressedCasTable(inner, "gzip")
+	ut.AssertEqual(t, nil, err)
+	data := compressibleData(100000)
+	name, err := AddBytes(cas, data)
+	ut.AssertEqual(t, nil, err)
+	plain, err := AddBytes(inner, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+
+	size, compressed, err := StoredSize(cas, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, compressed)
+	ut.AssertEqual(t, true, size > 0 && size < int64(len(data)))
+	size, compressed, err = StoredSize(cas, plain)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, compressed)
+	ut.AssertEqual(t, int64(8), size)
+	// Without the compression layer, nothing is known to be compressed.
+	_, compressed, err = StoredSize(inner, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, compressed)
+	_, _, err = StoredSize(cas, Sha1Bytes([]byte("missing")))
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCompressedCasTableMixed(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	expected := map[string]int64{}
+	contents := map[string][]byte{}
+	add := func(cas CasTable, data []byte) string {
+		name, err := AddBytes(cas, data)
+		ut.AssertEqual(t, nil, err)
+		expected[name] = int64(len(data))
+		contents[name] = data
+		return name
+	}
+
+	// Written before compression was enabled.
+	add(inner, []byte("content1"))
+	// Content that looks like a compressed object is escaped.
+	none, err := MakeCompressedCasTable(inner, "none")
+	ut.AssertEqual(t, nil, err)
+	add(none, []byte(compressedMagic+"\x01content2"))
+	add(none, []byte("content3"))
+	for i, codec := range []string{"gzip", "zstd"} {
+		cas, err := MakeCompressedCasTable(inner, codec)
+		ut.AssertEqual(t, nil, err)
+		data := compressibleData(100000 + i)
+		name := add(cas, data)
+		f, err := inner.Open(name)
+		ut.AssertEqual(t, nil, err)
+		stored, err := f.Seek(0, io.SeekEnd)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, nil, f.Close())
+		ut.AssertEqualf(t, true, stored < int64(len(data))/4, "%s: %d", codec, stored)
+		add(cas, []byte(codec))
+	}
+
+	// Any codec reads all the objects.
+	cas, err := MakeCompressedCasTable(inner, "zstd")
+	ut.AssertEqual(t, nil, err)
+	for name, data := range contents {
+		f, err := cas.Open(name)
+		ut.AssertEqual(t, nil, err)
+		actual, err := ioutil.ReadAll(f)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, data, actual)
+		end, err := f.Seek(0, io.SeekEnd)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, int64(len(data)), end)
+		if len(data) > 2 {
+			// Seeks backward.
+			_, err = f.Seek(int64(len(data)/2), io.SeekStart)
+			ut.AssertEqual(t, nil, err)
+			actual, err = ioutil.ReadAll(f)
+			ut.AssertEqual(t, nil, err)
+			ut.AssertEqual(t, data[len(data)/2:], actual)
+		}
+		ut.AssertEqual(t, nil, f.Close())
+	}
+
+	// Enumerate() returns the stored size without opening the objects.
+	stored := map[string]int64{}
+	for item := range inner.Enumerate(nil) {
+		stored[item.Item] = item.Size
+	}
+	actual := map[string]int64{}
+	for item := range cas.Enumerate(nil) {
+		ut.AssertEqual(t, nil, item.Error)
+		actual[item.Item] = item.Size
+	}
+	ut.AssertEqual(t, stored, actual)
+}
+
+func TestCompressedCasTableTruncated(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	cas, err := MakeCompressedCasTable(inner, "zstd")
+	ut.AssertEqual(t, nil, err)
+	name, err := AddBytes(cas, compressibleData(10000))
+	ut.AssertEqual(t, nil, err)
+	f, err := inner.Open(name)
+	ut.AssertEqual(t, nil, err)
+	raw, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+
+	// The end of the compressed stream is lost but the trailer is intact.
+	ut.AssertEqual(t, nil, inner.Remove(name))
+	truncated := append(append([]byte{}, raw[:len(raw)/2]...), raw[len(raw)-compressedTrailerSize:]...)
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(truncated), name))
+	f, err = cas.Open(name)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, false, err == nil)
+
+	// Only the header is left.
+	ut.AssertEqual(t, nil, inner.Remove(name))
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(raw[:compressedHeaderSize]), name))
+	_, err = cas.Open(name)
+	ut.AssertEqual(t, false, err == nil)
+	for item := range cas.Enumerate(nil) {
+		item.ModTime = time.Time{}
+		ut.AssertEqual(t, EnumerationEntry{Item: name, Size: int64(compressedHeaderSize)}, item)
+	}
+}
+
+func TestCompressedCasTableServeHTTP(t *testing.T) {
+	t.Parallel()
+	cas, err := MakeCompressedCasTable(MakeMemoryCasTable(), "gzip")
+	ut.AssertEqual(t, nil, err)
+	name, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	w := httptest.NewRecorder()
+	cas.ServeHTTP(w, httptest.NewRequest("GET", "/"+name, nil))
+	ut.AssertEqual(t, 200, w.Code)
+	ut.AssertEqual(t, "content1", w.Body.String())
+}
+
+// BenchmarkCompressedCasTable adds then reads back a sample tree of text and
+// random files with each codec and reports the compression ratio.
+func BenchmarkCompressedCasTable(b *testing.B) {
+	var files [][]byte
+	for i := 0; i < 20; i++ {
+		text := append([]byte(fmt.Sprintf("file %d\n", i)), compressibleData(4096<<uint(i%6))...)
+		files = append(files, text)
+		random := make([]byte, 4096<<uint(i%6))
+		seed := uint32(i + 1)
+		for j := range random {
+			seed = seed*1664525 + 1013904223
+			random[j] = byte(seed >> 24)
+		}
+		files = append(files, random)
+	}
+	total := 0
+	for _, f := range files {
+		total += len(f)
+	}
+	for _, codec := range Codecs {
+		b.Run(codec, func(b *testing.B) {
+			b.SetBytes(int64(total))
+			var stored int64
+			for i := 0; i < b.N; i++ {
+				inner := MakeMemoryCasTable()
+				cas, err := MakeCompressedCasTable(inner, codec)
+				ut.AssertEqual(b, nil, err)
+				for _, data := range files {
+					name, err := AddBytes(cas, data)
+					ut.AssertEqual(b, nil, err)
+					f, err := cas.Open(name)
+					ut.AssertEqual(b, nil, err)
+					_, err = io.Copy(ioutil.Discard, f)
+					ut.AssertEqual(b, nil, err)
+					ut.AssertEqual(b, nil, f.Close())
+				}
+				stored = 0
+				for item := range inner.Enumerate(nil) {
+					stored += item.Size
+				}
+			}
+			b.ReportMetric(float64(stored)/float64(total), "ratio")
+		})
+	}
+}
@@ -0,0 +1,365 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Each encrypted object is the header followed by the plaintext cut in chunks,
+// each sealed independently so the object can be read and seeked without
+// loading it all in memory. The nonce of a chunk is the nonce prefix, its
+// index and a flag set only on the last chunk so truncation is detected.
+//
+// All the objects written by an instance share the key derived from the
+// passphrase and the salt, so each object is sealed with its own key derived
+// with HKDF from it, the random prefix and the object name. A random prefix
+// alone would collide after about 2^28 objects. Objects with the
+// encryptedMagicV1 header were sealed with the shared key and are still read.
+const (
+	encryptedMagic      = "DCASENC2"
+	encryptedMagicV1    = "DCASENC1"
+	encryptedSaltSize   = 16
+	encryptedPrefixSize = 7
+	encryptedHeaderSize = len(encryptedMagic) + encryptedSaltSize + encryptedPrefixSize
+	encryptedChunkSize  = 64 * 1024
+	// gcmOverhead is the size of the tag appended to each sealed chunk.
+	gcmOverhead = 16
+)
+
+type encryptedCasTable struct {
+	CasTable
+	passphrase []byte
+	// salt is used for the objects added by this instance.
+	salt []byte
+
+	lock sync.Mutex
+	// keys caches the key derived for each salt seen, since deriving it is
+	// slow on purpose.
+	keys map[string][]byte
+}
+
+// MakeEncryptedCasTable returns a CasTable that encrypts the objects stored in
+// cas with AES-GCM, with a key derived from passphrase with scrypt. The objects
+// are still named by the hash of their plaintext, so deduplication and fsck
+// work as usual.
+func MakeEncryptedCasTable(cas CasTable, passphrase []byte) (CasTable, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("The passphrase can't be empty")
+	}
+	salt := make([]byte, encryptedSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	e := &encryptedCasTable{
+		CasTable:   cas,
+		passphrase: passphrase,
+		salt:       salt,
+		keys:       map[string][]byte{},
+	}
+	if _, err := e.key(salt); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptedCasTable) key(salt []byte) ([]byte, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if k, ok := e.keys[string(salt)]; ok {
+		return k, nil
+	}
+	k, err := scrypt.Key(e.passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	e.keys[string(salt)] = k
+	return k, nil
+}
+
+// objectAEAD returns the AEAD sealing the object name with the nonce prefix.
+func objectAEAD(key, prefix []byte, name string) (cipher.AEAD, error) {
+	subkey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, prefix, []byte("dumbcas object "+name)), subkey); err != nil {
+		return nil, err
+	}
+	return newGCM(subkey)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedPrefixSize:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (e *encryptedCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.Error(w, "Internal failure. CasTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	f, err := e.Open(r.URL.Path[1:])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func (e *encryptedCasTable) AddEntry(source io.Reader, name string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(e.encrypt(pw, source, name))
+	}()
+	err := e.CasTable.AddEntry(pr, name)
+	// Unblocks encrypt() if AddEntry() returned without reading everything.
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// encrypt writes the encrypted form of src, the content of the object name,
+// to dst.
+func (e *encryptedCasTable) encrypt(dst io.Writer, src io.Reader, name string) error {
+	key, err := e.key(e.salt)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, encryptedPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	a, err := objectAEAD(key, prefix, name)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(append(append(header, encryptedMagic...), e.salt...), prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	// Reads one chunk ahead to know which one is the last.
+	cur := make([]byte, encryptedChunkSize)
+	next := make([]byte, encryptedChunkSize)
+	out := make([]byte, 0, encryptedChunkSize+a.Overhead())
+	n, err := io.ReadFull(src, cur)
+	for i := uint32(0); ; i++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		m := 0
+		var err2 error
+		if !last {
+			if m, err2 = io.ReadFull(src, next); m == 0 && err2 == io.EOF {
+				last = true
+			}
+		}
+		out = a.Seal(out[:0], chunkNonce(prefix, i, last), cur[:n], nil)
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		cur, next = next, cur
+		n, err = m, err2
+	}
+}
+
+func (e *encryptedCasTable) Open(name string) (ReadSeekCloser, error) {
+	f, err := e.CasTable.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := e.makeReader(f, name)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("Failed to open %s: %s", name, err)
+	}
+	return r, nil
+}
+
+func (e *encryptedCasTable) makeReader(f ReadSeekCloser, name string) (*decryptReader, error) {
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+	v1 := bytes.HasPrefix(header, []byte(encryptedMagicV1))
+	if !v1 && !bytes.HasPrefix(header, []byte(encryptedMagic)) {
+		return nil, errors.New("not encrypted")
+	}
+	salt := header[len(encryptedMagic) : len(encryptedMagic)+encryptedSaltSize]
+	prefix := header[encryptedHeaderSize-encryptedPrefixSize:]
+	key, err := e.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	var a cipher.AEAD
+	if v1 {
+		a, err = newGCM(key)
+	} else {
+		a, err = objectAEAD(key, prefix, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	total, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	size, chunks, ok := plaintextSize(total, a.Overhead())
+	if !ok {
+		return nil, errors.New("truncated")
+	}
+	return &decryptReader{
+		f:       f,
+		aead:    a,
+		prefix:  prefix,
+		size:    size,
+		chunks:  chunks,
+		current: -1,
+	}, nil
+}
+
+// plaintextSize returns the size of the plaintext and the number of chunks of
+// an encrypted object of total bytes. ok is false if the object is truncated.
+func plaintextSize(total int64, overhead int) (size, chunks int64, ok bool) {
+	body := total - int64(encryptedHeaderSize)
+	sealedSize := int64(encryptedChunkSize + overhead)
+	chunks = (body + sealedSize - 1) / sealedSize
+	size = body - chunks*int64(overhead)
+	if chunks <= 0 || size < (chunks-1)*encryptedChunkSize {
+		return 0, 0, false
+	}
+	return size, chunks, true
+}
+
+// Enumerate returns the size of the plaintext of each object.
+func (e *encryptedCasTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
+	src := e.CasTable.Enumerate(cancel)
+	c := make(chan EnumerationEntry)
+	go func() {
+		defer close(c)
+		for item := range src {
+			if item.Error == nil {
+				// A truncated object is reported with a size of -1 so it never
+				// matches the expected size.
+				size, _, ok := plaintextSize(item.Size, gcmOverhead)
+				if !ok {
+					size = -1
+				}
+				item.Size = size
+			}
+			select {
+			case c <- item:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// decryptReader decrypts one chunk at a time.
+type decryptReader struct {
+	f      ReadSeekCloser
+	aead   cipher.AEAD
+	prefix []byte
+	// size is the size of the plaintext.
+	size   int64
+	chunks int64
+	pos    int64
+	// current is the index of the chunk in plain.
+	current int64
+	plain   []byte
+	sealed  []byte
+}
+
+func (d *decryptReader) load(index int64) error {
+	sealedSize := int64(encryptedChunkSize + d.aead.Overhead())
+	if _, err := d.f.Seek(int64(encryptedHeaderSize)+index*sealedSize, io.SeekStart); err != nil {
+		return err
+	}
+	if d.sealed == nil {
+		d.sealed = make([]byte, sealedSize)
+	}
+	n, err := io.ReadFull(d.f, d.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	d.current = -1
+	d.plain, err = d.aead.Open(d.plain[:0], chunkNonce(d.prefix, uint32(index), index == d.chunks-1), d.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("chunk %d is corrupted: %s", index, err)
+	}
+	d.current = index
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	index := d.pos / encryptedChunkSize
+	if index != d.current {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos%encryptedChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return d.pos, errors.New("negative position")
+	}
+	d.pos = offset
+	return d.pos, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
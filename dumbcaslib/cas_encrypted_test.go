@@ -0,0 +1,180 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestEncryptedCasTable(t *testing.T) {
+	t.Parallel()
+	cas, err := MakeEncryptedCasTable(MakeMemoryCasTable(), []byte("secret"))
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+}
+
+func TestEncryptedCasTableSizes(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	cas, err := MakeEncryptedCasTable(inner, []byte("secret"))
+	ut.AssertEqual(t, nil, err)
+	expected := map[string]int64{}
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3 * encryptedChunkSize} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		name, err := AddBytes(cas, data)
+		ut.AssertEqual(t, nil, err)
+		expected[name] = int64(size)
+
+		// The plaintext is not stored.
+		f, err := inner.Open(name)
+		ut.AssertEqual(t, nil, err)
+		raw, err := ioutil.ReadAll(f)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, false, size >= 16 && bytes.Contains(raw, data))
+
+		f, err = cas.Open(name)
+		ut.AssertEqual(t, nil, err)
+		actual, err := ioutil.ReadAll(f)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, data, actual)
+		end, err := f.Seek(0, io.SeekEnd)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, int64(size), end)
+		if size > 2 {
+			_, err = f.Seek(int64(size/2), io.SeekStart)
+			ut.AssertEqual(t, nil, err)
+			actual, err = ioutil.ReadAll(f)
+			ut.AssertEqual(t, nil, err)
+			ut.AssertEqual(t, data[size/2:], actual)
+		}
+		ut.AssertEqual(t, nil, f.Close())
+	}
+
+	// Enumerate() returns the size of the plaintext.
+	actual := map[string]int64{}
+	for item := range cas.Enumerate(nil) {
+		ut.AssertEqual(t, nil, item.Error)
+		actual[item.Item] = item.Size
+	}
+	ut.AssertEqual(t, expected, actual)
+}
+
+func TestEncryptedCasTableCorrupted(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	cas, err := MakeEncryptedCasTable(inner, []byte("secret"))
+	ut.AssertEqual(t, nil, err)
+	name, err := AddBytes(cas, make([]byte, 2*encryptedChunkSize))
+	ut.AssertEqual(t, nil, err)
+	f, err := inner.Open(name)
+	ut.AssertEqual(t, nil, err)
+	raw, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+
+	// A flipped bit.
+	flipped := append([]byte{}, raw...)
+	flipped[len(flipped)-1] ^= 1
+	ut.AssertEqual(t, nil, inner.Remove(name))
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(flipped), name))
+	f, err = cas.Open(name)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, false, err == nil)
+
+	// The last chunk is missing.
+	ut.AssertEqual(t, nil, inner.Remove(name))
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(raw[:encryptedHeaderSize+encryptedChunkSize+16]), name))
+	f, err = cas.Open(name)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, false, err == nil)
+
+	// Wrong passphrase.
+	ut.AssertEqual(t, nil, inner.Remove(name))
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(raw), name))
+	other, err := MakeEncryptedCasTable(inner, []byte("other"))
+	ut.AssertEqual(t, nil, err)
+	f, err = other.Open(name)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestEncryptedCasTableObjectKey(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	cas, err := MakeEncryptedCasTable(inner, []byte("secret"))
+	ut.AssertEqual(t, nil, err)
+	name, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	f, err := inner.Open(name)
+	ut.AssertEqual(t, nil, err)
+	raw, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, encryptedMagic, string(raw[:len(encryptedMagic)]))
+
+	// Each object has its own key so an object copied under another name
+	// can't be decrypted.
+	other := Sha1Bytes([]byte("content2"))
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(raw), other))
+	f, err = cas.Open(other)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestEncryptedCasTableV1(t *testing.T) {
+	t.Parallel()
+	inner := MakeMemoryCasTable()
+	cas, err := MakeEncryptedCasTable(inner, []byte("secret"))
+	ut.AssertEqual(t, nil, err)
+	// An object sealed with the key shared by all the objects, as written by
+	// older versions.
+	e := cas.(*encryptedCasTable)
+	key, err := e.key(e.salt)
+	ut.AssertEqual(t, nil, err)
+	a, err := newGCM(key)
+	ut.AssertEqual(t, nil, err)
+	prefix := []byte("1234567")
+	data := make([]byte, encryptedChunkSize+10)
+	raw := append(append([]byte(encryptedMagicV1), e.salt...), prefix...)
+	raw = a.Seal(raw, chunkNonce(prefix, 0, false), data[:encryptedChunkSize], nil)
+	raw = a.Seal(raw, chunkNonce(prefix, 1, true), data[encryptedChunkSize:], nil)
+	name := Sha1Bytes(data)
+	ut.AssertEqual(t, nil, inner.AddEntry(bytes.NewReader(raw), name))
+
+	f, err := cas.Open(name)
+	ut.AssertEqual(t, nil, err)
+	actual, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, data, actual)
+	ut.AssertEqual(t, nil, f.Close())
+}
+
+func TestEncryptedCasTableServeHTTP(t *testing.T) {
+	t.Parallel()
+	cas, err := MakeEncryptedCasTable(MakeMemoryCasTable(), []byte("secret"))
+	ut.AssertEqual(t, nil, err)
+	name, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	w := httptest.NewRecorder()
+	cas.ServeHTTP(w, httptest.NewRequest("GET", "/"+name, nil))
+	ut.AssertEqual(t, 200, w.Code)
+	ut.AssertEqual(t, "content1", w.Body.String())
+}
@@ -12,12 +12,15 @@ package dumbcaslib
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 
 	"github.com/maruel/interrupt"
 )
@@ -32,6 +35,11 @@ type casTable struct {
 	hashLength   int
 	validPath    *regexp.Regexp
 	trash        trash
+	readOnly     bool
+	fsync        bool
+	log          Logger
+	batch        int
+	tempDir      string
 }
 
 // filePath converts an entry in the table into a proper file path.
@@ -55,7 +63,7 @@ func prefixSpace(prefixLength uint) int {
 }
 
 // MakeLocalCasTable returns a CasTable rooted at rootDir.
-func MakeLocalCasTable(rootDir string) (CasTable, error) {
+func MakeLocalCasTable(rootDir string, opts CasTableOptions) (CasTable, error) {
 	// Creates 16^3 (4096) directories. Preferable values are 2 or 3.
 	prefixLength := 3
 	// Currently hardcoded for SHA-1 but could be used for any length.
@@ -65,6 +73,12 @@ func MakeLocalCasTable(rootDir string) (CasTable, error) {
 		return nil, fmt.Errorf("MakeCasTable(%s) is not valid", rootDir)
 	}
 	rootDir = filepath.Clean(rootDir)
+	batch := opts.EnumerateBatch
+	if batch < 0 {
+		return nil, fmt.Errorf("MakeCasTable(%s): invalid enumeration batch %d", rootDir, batch)
+	} else if batch == 0 {
+		batch = 1024
+	}
 	casDir := filepath.Join(rootDir, casName)
 	if err := os.MkdirAll(casDir, 0750); err != nil && !os.IsExist(err) {
 		return nil, fmt.Errorf("MakeCasTable(%s): failed to create the directory: %s", casDir, err)
@@ -85,6 +99,11 @@ func MakeLocalCasTable(rootDir string) (CasTable, error) {
 		hashLength,
 		regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength)),
 		makeTrash(casDir),
+		opts.ReadOnly,
+		opts.Fsync,
+		orNullLogger(opts.Logger),
+		batch,
+		opts.TempDir,
 	}, nil
 }
 
@@ -102,59 +121,99 @@ func (c *casTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, casItem)
 }
 
-// Enumerates all the entries in the table. If a file or directory is found in
-// the directory tree that doesn't match the expected format, it will be moved
-// into the trash.
-func (c *casTable) Enumerate() <-chan EnumerationEntry {
+// Enumerates all the entries in the table, by increasing prefix. If a file or
+// directory is found in the directory tree that doesn't match the expected
+// format, it will be moved into the trash.
+func (c *casTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
 	rePrefix := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.prefixLength))
 	reRest := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.hashLength-c.prefixLength))
 	items := make(chan EnumerationEntry)
+	send := func(e EnumerationEntry) bool {
+		select {
+		case items <- e:
+			return true
+		case <-cancel:
+			return false
+		}
+	}
 
-	// TODO(maruel): No need to read all at once.
 	go func() {
+		defer close(items)
 		prefixes, err := readDirNames(c.casDir)
 		if err != nil {
-			items <- EnumerationEntry{Error: fmt.Errorf("Failed reading %s", c.casDir)}
-		} else {
-			for _, prefix := range prefixes {
-				if interrupt.IsSet() {
-					break
-				}
-				if prefix == trashName {
-					continue
-				}
-				if !rePrefix.MatchString(prefix) {
+			send(EnumerationEntry{Error: fmt.Errorf("Failed reading %s", c.casDir)})
+			return
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			if interrupt.IsSet() {
+				return
+			}
+			if prefix == trashName {
+				continue
+			}
+			if !rePrefix.MatchString(prefix) {
+				if !c.readOnly {
 					_ = c.trash.move(prefix)
-					c.SetFsckBit()
-					continue
-				}
-				// TODO(maruel): No need to read all at once.
-				prefixPath := filepath.Join(c.casDir, prefix)
-				subitems, err := readDirNames(prefixPath)
-				if err != nil {
-					items <- EnumerationEntry{Error: fmt.Errorf("Failed reading %s", prefixPath)}
-					c.SetFsckBit()
-					continue
-				}
-				for _, item := range subitems {
-					if !reRest.MatchString(item) {
-						_ = c.trash.move(filepath.Join(prefix, item))
-						c.SetFsckBit()
-						continue
-					}
-					items <- EnumerationEntry{Item: prefix + item}
 				}
+				c.SetFsckBit()
+				continue
+			}
+			if !c.enumeratePrefix(prefix, reRest, send) {
+				return
 			}
 		}
-		close(items)
 	}()
 	return items
 }
 
+// enumeratePrefix sends the objects in the prefix directory as they are read,
+// c.batch at a time. Returns false if the enumeration must stop.
+func (c *casTable) enumeratePrefix(prefix string, reRest *regexp.Regexp, send func(EnumerationEntry) bool) bool {
+	prefixPath := filepath.Join(c.casDir, prefix)
+	f, err := os.Open(prefixPath)
+	if err != nil {
+		c.SetFsckBit()
+		return send(EnumerationEntry{Error: fmt.Errorf("Failed reading %s", prefixPath)})
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	for {
+		if interrupt.IsSet() {
+			return false
+		}
+		subitems, err := f.Readdir(c.batch)
+		for _, info := range subitems {
+			item := info.Name()
+			if !reRest.MatchString(item) {
+				if !c.readOnly {
+					_ = c.trash.move(filepath.Join(prefix, item))
+				}
+				c.SetFsckBit()
+				continue
+			}
+			if !send(EnumerationEntry{Item: prefix + item, Size: info.Size(), ModTime: info.ModTime()}) {
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			c.SetFsckBit()
+			return send(EnumerationEntry{Error: fmt.Errorf("Failed reading %s", prefixPath)})
+		}
+	}
+}
+
 // Adds an entry with the hash calculated already if not alreaady present. It's
 // a performance optimization to be able to not write the object unless needed.
 func (c *casTable) AddEntry(source io.Reader, hash string) error {
 	dst := c.filePath(hash)
+	if c.tempDir != "" {
+		return c.addEntryFromTemp(source, dst)
+	}
 	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
 	if os.IsExist(err) {
 		return err
@@ -162,11 +221,60 @@ func (c *casTable) AddEntry(source io.Reader, hash string) error {
 	if err != nil {
 		return fmt.Errorf("Failed to copy(dst) %s: %s", dst, err)
 	}
-	defer func() {
-		_ = df.Close()
-	}()
 	_, err = io.Copy(df, source)
-	return err
+	if err == nil && c.fsync {
+		err = df.Sync()
+	}
+	if err2 := df.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		// Do not leave a truncated object under its final name; it would be
+		// considered present by the next AddEntry.
+		_ = os.Remove(dst)
+		return err
+	}
+	if c.fsync {
+		syncDir(filepath.Dir(dst))
+	}
+	return nil
+}
+
+// addEntryFromTemp writes the object in c.tempDir then moves it to dst.
+func (c *casTable) addEntryFromTemp(source io.Reader, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return os.ErrExist
+	}
+	f, err := ioutil.TempFile(c.tempDir, "cas")
+	if err != nil {
+		return fmt.Errorf("Failed to copy(dst) %s: %s", dst, err)
+	}
+	tmpPath := f.Name()
+	_, err = io.Copy(f, source)
+	if err == nil && c.fsync {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		// ioutil.TempFile creates the file as 0600.
+		err = os.Chmod(tmpPath, 0640)
+	}
+	if err == nil {
+		err = moveFile(tmpPath, dst, c.fsync)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		if os.IsExist(err) {
+			return os.ErrExist
+		}
+		return fmt.Errorf("Failed to copy(dst) %s: %s", dst, err)
+	}
+	if c.fsync {
+		syncDir(filepath.Dir(dst))
+	}
+	return nil
 }
 
 func (c *casTable) Open(hash string) (ReadSeekCloser, error) {
@@ -178,6 +286,10 @@ func (c *casTable) Open(hash string) (ReadSeekCloser, error) {
 }
 
 func (c *casTable) SetFsckBit() {
+	if c.readOnly {
+		c.log.Printf("%s is read-only; not setting the fsck bit", c.casDir)
+		return
+	}
 	f, _ := os.Create(filepath.Join(c.casDir, needFsckName))
 	if f != nil {
 		_ = f.Close()
@@ -211,3 +323,31 @@ func AddBytes(c CasTable, data []byte) (string, error) {
 	hash := Sha1Bytes(data)
 	return hash, c.AddEntry(bytes.NewBuffer(data), hash)
 }
+
+// ErrMismatch is returned by AddBytesVerified when an object already stored
+// under the hash of the data has a different content.
+var ErrMismatch = errors.New("The stored object doesn't match its hash")
+
+// AddBytesVerified is like AddBytes but when the object is already present, it
+// is read back and compared to data so a corrupted object is caught instead of
+// being silently reused. It returns os.ErrExist when the stored object matches
+// and ErrMismatch when it doesn't.
+func AddBytesVerified(c CasTable, data []byte) (string, error) {
+	hash, err := AddBytes(c, data)
+	if !os.IsExist(err) {
+		return hash, err
+	}
+	f, err := c.Open(hash)
+	if err != nil {
+		return hash, fmt.Errorf("Failed to read back %s: %s", hash, err)
+	}
+	stored, err := ioutil.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		return hash, fmt.Errorf("Failed to read back %s: %s", hash, err)
+	}
+	if !bytes.Equal(stored, data) {
+		return hash, ErrMismatch
+	}
+	return hash, os.ErrExist
+}
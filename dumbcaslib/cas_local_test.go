@@ -11,7 +11,12 @@ package dumbcaslib
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
@@ -44,7 +49,110 @@ func TestCasTableImpl(t *testing.T) {
 	tempData := makeTempDir(t, "cas")
 	defer removeDir(t, tempData)
 
-	cas, err := MakeLocalCasTable(tempData)
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{})
 	ut.AssertEqual(t, nil, err)
 	testCasTableImpl(t, cas)
 }
+
+func TestCasTableFsync(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{Fsync: true})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+}
+
+func TestCasTableTempDir(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas")
+	defer removeDir(t, tempData)
+	tempDir := makeTempDir(t, "cas_temp")
+	defer removeDir(t, tempDir)
+
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{TempDir: tempDir, Fsync: true})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+	names, err := readDirNames(tempDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+
+	// The objects have the same mode as when written in place.
+	if runtime.GOOS != "windows" {
+		hash, err := AddBytes(cas, []byte("mode"))
+		ut.AssertEqual(t, nil, err)
+		stat, err := os.Stat(cas.(*casTable).filePath(hash))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, os.FileMode(0640), stat.Mode().Perm())
+	}
+}
+
+func TestCasTableReadOnly(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas")
+	defer removeDir(t, tempData)
+
+	l := &recordLogger{}
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{ReadOnly: true, Logger: l})
+	ut.AssertEqual(t, nil, err)
+	cas.SetFsckBit()
+	ut.AssertEqual(t, false, cas.GetFsckBit())
+	ut.AssertEqual(t, 1, len(l.lines))
+}
+
+func TestCasTableEnumerateCancel(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	tree := map[string]string{}
+	for i := 0; i < 20; i++ {
+		tree[fmt.Sprintf("file%d", i)] = fmt.Sprintf("content%d", i)
+	}
+	archiveData(t, cas, MakeMemoryNodesTable(cas), tree)
+
+	cancel := make(chan struct{})
+	c := cas.Enumerate(cancel)
+	item := <-c
+	ut.AssertEqual(t, nil, item.Error)
+	close(cancel)
+	// The enumeration must stop and close the channel without being drained.
+	timeout := time.After(5 * time.Second)
+	for received := 0; ; received++ {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				ut.AssertEqual(t, true, received < len(tree))
+				return
+			}
+		case <-timeout:
+			t.Fatal("Enumeration didn't stop after cancel")
+		}
+	}
+}
+
+func TestCasTableEnumerateBatch(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas")
+	defer removeDir(t, tempData)
+
+	_, err := MakeLocalCasTable(tempData, CasTableOptions{EnumerateBatch: -1})
+	ut.AssertEqual(t, false, err == nil)
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{EnumerateBatch: 2})
+	ut.AssertEqual(t, nil, err)
+	// Put more objects than the batch size in a single prefix directory.
+	expected := []string{}
+	for i := 0; i < 5; i++ {
+		item := fmt.Sprintf("000%037x", i)
+		expected = append(expected, item)
+		ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, casName, "000", item[3:]), []byte("x"), 0600))
+	}
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, casName, "000", "invalid"), []byte("x"), 0600))
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, true, cas.GetFsckBit())
+}
@@ -0,0 +1,179 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// multiCasTable writes each object to all its tables. The first table is the
+// primary; it is the one enumerated and served over HTTP.
+type multiCasTable struct {
+	tables []CasTable
+	// quorum is the number of tables that must succeed for AddEntry to
+	// succeed.
+	quorum int
+}
+
+// MakeMultiCasTable returns a CasTable that mirrors the objects added to it to
+// all of tables in a single pass. AddEntry succeeds when at least quorum
+// tables stored the object; 0 means all of them. Open reads from the first
+// table that has the object. Enumerate only enumerates the first table so fsck
+// and gc must be run on each table separately.
+func MakeMultiCasTable(tables []CasTable, quorum int) (CasTable, error) {
+	if len(tables) == 0 {
+		return nil, errors.New("At least one CasTable is required")
+	}
+	if quorum < 0 || quorum > len(tables) {
+		return nil, fmt.Errorf("Invalid quorum %d for %d tables", quorum, len(tables))
+	}
+	if quorum == 0 {
+		quorum = len(tables)
+	}
+	return &multiCasTable{tables: tables, quorum: quorum}, nil
+}
+
+func (m *multiCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.tables[0].ServeHTTP(w, r)
+}
+
+func (m *multiCasTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
+	return m.tables[0].Enumerate(cancel)
+}
+
+// AddEntry streams source to every table at once. A table that returns early,
+// e.g. because it already has the object, is dropped from the stream.
+func (m *multiCasTable) AddEntry(source io.Reader, name string) error {
+	errs := make([]error, len(m.tables))
+	writers := make([]*io.PipeWriter, len(m.tables))
+	var wg sync.WaitGroup
+	for i, t := range m.tables {
+		r, w := io.Pipe()
+		writers[i] = w
+		wg.Add(1)
+		go func(i int, t CasTable, r *io.PipeReader) {
+			defer wg.Done()
+			errs[i] = t.AddEntry(r, name)
+			// Unblocks the writer if the table didn't read everything.
+			_ = r.CloseWithError(io.ErrClosedPipe)
+		}(i, t, r)
+	}
+	buf := make([]byte, 64*1024)
+	var readErr error
+	for {
+		n, err := source.Read(buf)
+		for i, w := range writers {
+			if n != 0 && w != nil {
+				if _, err := w.Write(buf[:n]); err != nil {
+					writers[i] = nil
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+	for _, w := range writers {
+		if w != nil {
+			_ = w.CloseWithError(readErr)
+		}
+	}
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+
+	succeeded := 0
+	existed := 0
+	var failures []string
+	for i, err := range errs {
+		if err == nil || os.IsExist(err) {
+			succeeded++
+			if err != nil {
+				existed++
+			}
+		} else {
+			failures = append(failures, fmt.Sprintf("table %d: %s", i, err))
+		}
+	}
+	if succeeded < m.quorum {
+		return fmt.Errorf("Failed to store %s in %d tables out of %d: %s", name, len(failures), len(m.tables), strings.Join(failures, "; "))
+	}
+	if existed == succeeded {
+		return os.ErrExist
+	}
+	return nil
+}
+
+func (m *multiCasTable) Open(name string) (ReadSeekCloser, error) {
+	var firstErr error
+	for _, t := range m.tables {
+		f, err := t.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Remove removes the object from every table. It is not an error if some
+// tables don't have it.
+func (m *multiCasTable) Remove(name string) error {
+	missing := 0
+	var firstErr error
+	for _, t := range m.tables {
+		if err := t.Remove(name); os.IsNotExist(err) {
+			missing++
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if missing == len(m.tables) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (m *multiCasTable) SetFsckBit() {
+	for _, t := range m.tables {
+		t.SetFsckBit()
+	}
+}
+
+// GetFsckBit returns true if any of the tables needs to be checked.
+func (m *multiCasTable) GetFsckBit() bool {
+	for _, t := range m.tables {
+		if t.GetFsckBit() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multiCasTable) ClearFsckBit() {
+	for _, t := range m.tables {
+		t.ClearFsckBit()
+	}
+}
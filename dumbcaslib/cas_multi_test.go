@@ -0,0 +1,95 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// failingCasTable fails every AddEntry after reading part of the source.
+type failingCasTable struct {
+	CasTable
+}
+
+func (f *failingCasTable) AddEntry(source io.Reader, name string) error {
+	_, _ = source.Read(make([]byte, 10))
+	return errors.New("disk full")
+}
+
+func TestMultiCasTable(t *testing.T) {
+	t.Parallel()
+	cas, err := MakeMultiCasTable([]CasTable{MakeMemoryCasTable(), MakeMemoryCasTable()}, 0)
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+}
+
+func TestMultiCasTableMirror(t *testing.T) {
+	t.Parallel()
+	primary := MakeMemoryCasTable()
+	mirror := MakeMemoryCasTable()
+	cas, err := MakeMultiCasTable([]CasTable{primary, mirror}, 0)
+	ut.AssertEqual(t, nil, err)
+	// Larger than the copy buffer, and already present in the primary so it
+	// stops reading right away.
+	data := compressibleData(200000)
+	name, err := AddBytes(primary, data)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewReader(data), name))
+	ut.AssertEqual(t, true, os.IsExist(cas.AddEntry(bytes.NewReader(data), name)))
+	f, err := mirror.Open(name)
+	ut.AssertEqual(t, nil, err)
+	actual, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	ut.AssertEqual(t, data, actual)
+
+	// Reads from the mirror when the primary lost the object.
+	ut.AssertEqual(t, nil, primary.Remove(name))
+	f, err = cas.Open(name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+
+	ut.AssertEqual(t, nil, cas.Remove(name))
+	_, err = mirror.Open(name)
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, true, os.IsNotExist(cas.Remove(name)))
+
+	mirror.SetFsckBit()
+	ut.AssertEqual(t, true, cas.GetFsckBit())
+	cas.ClearFsckBit()
+	ut.AssertEqual(t, false, mirror.GetFsckBit())
+}
+
+func TestMultiCasTableQuorum(t *testing.T) {
+	t.Parallel()
+	data := compressibleData(200000)
+	name := Sha1Bytes(data)
+	tables := []CasTable{MakeMemoryCasTable(), &failingCasTable{MakeMemoryCasTable()}}
+	cas, err := MakeMultiCasTable(tables, 0)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, cas.AddEntry(bytes.NewReader(data), name) == nil)
+
+	tables[0] = MakeMemoryCasTable()
+	cas, err = MakeMultiCasTable(tables, 1)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewReader(data), name))
+
+	_, err = MakeMultiCasTable(tables, 3)
+	ut.AssertEqual(t, false, err == nil)
+	_, err = MakeMultiCasTable(nil, 0)
+	ut.AssertEqual(t, false, err == nil)
+}
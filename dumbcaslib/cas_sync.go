@@ -0,0 +1,140 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// SyncOptions are the options of SyncCas().
+type SyncOptions struct {
+	// Parallel is the number of objects copied concurrently. 0 means 1.
+	Parallel int
+	// Cancel stops the copy when closed. The objects being copied are completed
+	// and ErrSyncCanceled is returned.
+	Cancel <-chan struct{}
+}
+
+// ErrSyncCanceled is returned by SyncCas() when SyncOptions.Cancel is closed.
+var ErrSyncCanceled = errors.New("The copy was canceled")
+
+// SyncCas copies the objects of src missing in dst. The objects are copied
+// verbatim, so compressed or encrypted objects stay so; src and dst should be
+// the underlying tables, not the ones returned by MakeCompressedCasTable() or
+// MakeEncryptedCasTable(). dst is enumerated first to skip the objects it
+// already has. It returns the number of objects copied and skipped. It stops
+// at the first error.
+func SyncCas(src, dst CasTable, opts SyncOptions) (copied, skipped int, err error) {
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = 1
+	}
+	present := map[string]bool{}
+	for item := range dst.Enumerate(opts.Cancel) {
+		if item.Error != nil {
+			return 0, 0, fmt.Errorf("Failed to enumerate the destination: %s", item.Error)
+		}
+		present[item.Item] = true
+	}
+	if isClosed(opts.Cancel) {
+		return 0, 0, ErrSyncCanceled
+	}
+
+	var lock sync.Mutex
+	var firstErr error
+	failed := make(chan struct{})
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				err := copyObject(src, dst, name)
+				lock.Lock()
+				if os.IsExist(err) {
+					skipped++
+				} else if err == nil {
+					copied++
+				}
+				lock.Unlock()
+				if err != nil && !os.IsExist(err) {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	// Stops the enumeration on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+loop:
+	for item := range src.Enumerate(cancel) {
+		if item.Error != nil {
+			fail(fmt.Errorf("Failed to enumerate the source: %s", item.Error))
+			break
+		}
+		if present[item.Item] {
+			lock.Lock()
+			skipped++
+			lock.Unlock()
+			continue
+		}
+		select {
+		case names <- item.Item:
+		case <-failed:
+			break loop
+		case <-opts.Cancel:
+			break loop
+		}
+	}
+	close(names)
+	wg.Wait()
+	if firstErr == nil && isClosed(opts.Cancel) {
+		firstErr = ErrSyncCanceled
+	}
+	return copied, skipped, firstErr
+}
+
+func copyObject(src, dst CasTable, name string) error {
+	f, err := src.Open(name)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", name, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	err = dst.AddEntry(f, name)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to copy %s: %s", name, err)
+	}
+	return err
+}
+
+// isClosed returns true if c is closed. A nil channel is never closed.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,121 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestSyncCas(t *testing.T) {
+	t.Parallel()
+	src := MakeMemoryCasTable()
+	dst := MakeMemoryCasTable()
+	for i := 0; i < 20; i++ {
+		_, err := AddBytes(src, []byte(fmt.Sprintf("content%d", i)))
+		ut.AssertEqual(t, nil, err)
+	}
+	_, err := AddBytes(dst, []byte("content0"))
+	ut.AssertEqual(t, nil, err)
+	only, err := AddBytes(dst, []byte("only in dst"))
+	ut.AssertEqual(t, nil, err)
+
+	copied, skipped, err := SyncCas(src, dst, SyncOptions{Parallel: 4})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 19, copied)
+	ut.AssertEqual(t, 1, skipped)
+	srcItems, err := EnumerateCasAsList(src)
+	ut.AssertEqual(t, nil, err)
+	dstItems, err := EnumerateCasAsList(dst)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 21, len(dstItems))
+	for _, name := range append(srcItems, only) {
+		f, err := dst.Open(name)
+		ut.AssertEqual(t, nil, err)
+		data, err := ioutil.ReadAll(f)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, nil, f.Close())
+		ut.AssertEqual(t, name, Sha1Bytes(data))
+	}
+
+	// Nothing left to copy.
+	copied, skipped, err = SyncCas(src, dst, SyncOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, copied)
+	ut.AssertEqual(t, 20, skipped)
+
+	cancel := make(chan struct{})
+	close(cancel)
+	copied, _, err = SyncCas(src, MakeMemoryCasTable(), SyncOptions{Cancel: cancel})
+	ut.AssertEqual(t, ErrSyncCanceled, err)
+	ut.AssertEqual(t, 0, copied)
+}
+
+// truncatedCasTable fails reading any object after its first bytes.
+type truncatedCasTable struct {
+	CasTable
+}
+
+func (t *truncatedCasTable) Open(name string) (ReadSeekCloser, error) {
+	f, err := t.CasTable.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &truncatedReader{ReadSeekCloser: f}, nil
+}
+
+type truncatedReader struct {
+	ReadSeekCloser
+	read bool
+}
+
+func (t *truncatedReader) Read(p []byte) (int, error) {
+	if t.read {
+		return 0, errors.New("connection reset")
+	}
+	t.read = true
+	if len(p) > 4 {
+		p = p[:4]
+	}
+	return t.ReadSeekCloser.Read(p)
+}
+
+func TestSyncCasPartialCopy(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas")
+	defer removeDir(t, tempData)
+	dst, err := MakeLocalCasTable(tempData, CasTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	src := MakeMemoryCasTable()
+	name, err := AddBytes(src, []byte("content that is cut short"))
+	ut.AssertEqual(t, nil, err)
+
+	_, _, err = SyncCas(&truncatedCasTable{src}, dst, SyncOptions{})
+	ut.AssertEqual(t, true, err != nil)
+	_, err = dst.Open(name)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// The next sync copies the object instead of skipping it.
+	copied, skipped, err := SyncCas(src, dst, SyncOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, copied)
+	ut.AssertEqual(t, 0, skipped)
+	f, err := dst.Open(name)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	ut.AssertEqual(t, name, Sha1Bytes(data))
+}
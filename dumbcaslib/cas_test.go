@@ -10,9 +10,13 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
@@ -23,6 +27,54 @@ func TestFakeCasTable(t *testing.T) {
 	testCasTableImpl(t, cas)
 }
 
+func TestFakeCasTableEnumerateSorted(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	expected := []string{}
+	for i := 0; i < 32; i++ {
+		h, err := AddBytes(cas, []byte{byte(i)})
+		ut.AssertEqual(t, nil, err)
+		expected = append(expected, h)
+	}
+	sort.Strings(expected)
+	actual := []string{}
+	for v := range cas.Enumerate(nil) {
+		actual = append(actual, v.Item)
+	}
+	ut.AssertEqual(t, expected, actual)
+}
+
+func TestFakeCasTableSnapshot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_snapshot")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	h, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	cas.SetFsckBit()
+	ut.AssertEqual(t, nil, cas.(Snapshotter).SnapshotTo(tempData))
+
+	// Changes after the snapshot are lost once restored.
+	_, err = AddBytes(cas, []byte("content2"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.(Snapshotter).RestoreFrom(tempData))
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{h}, items)
+
+	other := MakeMemoryCasTable()
+	ut.AssertEqual(t, nil, other.(Snapshotter).RestoreFrom(tempData))
+	ut.AssertEqual(t, true, other.GetFsckBit())
+	f, err := other.Open(h)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	ut.AssertEqual(t, "content1", string(data))
+
+	ut.AssertEqual(t, false, other.(Snapshotter).RestoreFrom(filepath.Join(tempData, "missing")) == nil)
+}
+
 func testCasTableImpl(t testing.TB, cas CasTable) {
 	items, err := EnumerateCasAsList(cas)
 	ut.AssertEqual(t, nil, err)
@@ -34,6 +86,14 @@ func testCasTableImpl(t testing.TB, cas CasTable) {
 	items, err = EnumerateCasAsList(cas)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, []string{file1}, items)
+	// The size enumerated is the stored size.
+	stored, _, err := StoredSize(cas, file1)
+	ut.AssertEqual(t, nil, err)
+	for item := range cas.Enumerate(nil) {
+		ut.AssertEqual(t, false, item.ModTime.IsZero())
+		item.ModTime = time.Time{}
+		ut.AssertEqual(t, EnumerationEntry{Item: file1, Size: stored}, item)
+	}
 
 	// Add the same content.
 	file2, err := AddBytes(cas, []byte("content1"))
@@ -68,3 +128,19 @@ func testCasTableImpl(t testing.TB, cas CasTable) {
 	cas.ClearFsckBit()
 	ut.AssertEqual(t, false, cas.GetFsckBit())
 }
+
+func TestAddBytesVerified(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	h, err := AddBytesVerified(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, Sha1Bytes([]byte("content1")), h)
+	_, err = AddBytesVerified(cas, []byte("content1"))
+	ut.AssertEqual(t, true, os.IsExist(err))
+
+	// Simulate a corrupted object stored under the hash of the data.
+	data := []byte("content2")
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewBufferString("corrupted"), Sha1Bytes(data)))
+	_, err = AddBytesVerified(cas, data)
+	ut.AssertEqual(t, ErrMismatch, err)
+}
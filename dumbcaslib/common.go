@@ -12,6 +12,7 @@ package dumbcaslib
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -20,16 +21,39 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/maruel/interrupt"
 )
 
+// Logger is the logging interface used by this package. *log.Logger
+// implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// nullLogger is the Logger used when none is specified.
+type nullLogger struct{}
+
+func (nullLogger) Printf(format string, v ...interface{}) {
+}
+
+// orNullLogger returns l or a no-op Logger if l is nil.
+func orNullLogger(l Logger) Logger {
+	if l == nil {
+		return nullLogger{}
+	}
+	return l
+}
+
 // Table represents a flat table of data.
 type Table interface {
 	// Must be able to efficiently respond to an HTTP GET request.
 	http.Handler
-	// Enumerate enumerates all the entries in the table.
-	Enumerate() <-chan EnumerationEntry
+	// Enumerate enumerates all the entries in the table. Closing cancel stops
+	// the enumeration and the returned channel is closed shortly after, so a
+	// caller returning early must close it. cancel may be nil.
+	Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry
 	// Open opens an entry for reading.
 	Open(name string) (ReadSeekCloser, error)
 	// Remove removes a node enumerated by Enumerate().
@@ -43,10 +67,27 @@ type Corruptable interface {
 	Corrupt()
 }
 
+// Snapshotter is implemented by the in-memory implementations so an embedder
+// can run fast in memory and checkpoint the content to disk.
+type Snapshotter interface {
+	// SnapshotTo writes the content of the table in the directory dir, which
+	// must exist.
+	SnapshotTo(dir string) error
+	// RestoreFrom replaces the content of the table with the snapshot in dir.
+	RestoreFrom(dir string) error
+}
+
 // EnumerationEntry is one element in the enumeration functions.
 type EnumerationEntry struct {
-	Item  string
-	Error error
+	Item string
+	// Size is the size in bytes of the object as stored, which is the size
+	// returned by Open() unless the object is compressed. It is only set by
+	// CasTable implementations.
+	Size int64
+	// ModTime is the last modification time of the object. It is only set by
+	// CasTable implementations and is zero when unknown.
+	ModTime time.Time
+	Error   error
 }
 
 // ReadSeekCloser implements all of io.Reader, io.Seeker and io.Closer.
@@ -63,10 +104,20 @@ type TreeItem struct {
 	Error error
 }
 
-func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
+// sendTreeItem returns false if cancel was closed instead.
+func sendTreeItem(c chan<- TreeItem, item TreeItem, cancel <-chan struct{}) bool {
+	select {
+	case c <- item:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+func recurseEnumerateTree(rootDir string, c chan<- TreeItem, cancel <-chan struct{}) bool {
 	f, err := os.Open(rootDir)
 	if err != nil {
-		c <- TreeItem{Error: err}
+		sendTreeItem(c, TreeItem{Error: err}, cancel)
 		return false
 	}
 	defer func() {
@@ -78,7 +129,7 @@ func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
 		}
 		dirs, err := f.Readdir(128)
 		if err != nil && err != io.EOF {
-			c <- TreeItem{Error: err}
+			sendTreeItem(c, TreeItem{Error: err}, cancel)
 			return false
 		}
 		if len(dirs) == 0 {
@@ -91,27 +142,69 @@ func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
 			name := d.Name()
 			fullPath := filepath.Join(rootDir, name)
 			if d.IsDir() {
-				if !recurseEnumerateTree(fullPath, c) {
+				if !recurseEnumerateTree(fullPath, c, cancel) {
 					return false
 				}
-			} else {
-				c <- TreeItem{FullPath: fullPath, FileInfo: d}
+			} else if !sendTreeItem(c, TreeItem{FullPath: fullPath, FileInfo: d}, cancel) {
+				return false
 			}
 		}
 	}
 	return true
 }
 
-// EnumerateTree walks the directory tree.
-func EnumerateTree(rootDir string) <-chan TreeItem {
+// EnumerateTree walks the directory tree. Closing cancel stops the walk.
+func EnumerateTree(rootDir string, cancel <-chan struct{}) <-chan TreeItem {
 	c := make(chan TreeItem)
 	go func() {
-		recurseEnumerateTree(rootDir, c)
+		recurseEnumerateTree(rootDir, c, cancel)
 		close(c)
 	}()
 	return c
 }
 
+// syncDir flushes a directory so the files created in it are durable. It is
+// best effort since not all OSes support it.
+func syncDir(dirPath string) {
+	if f, err := os.Open(dirPath); err == nil {
+		_ = f.Sync()
+		_ = f.Close()
+	}
+}
+
+// moveFile moves the file src to dst. It is a rename when both are on the same
+// file system, otherwise src is copied to dst, which must not exist, then
+// removed. With fsync, the copy is flushed to disk before src is removed.
+func moveFile(src, dst string, fsync bool) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = s.Close()
+	}()
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d, s)
+	if err == nil && fsync {
+		err = d.Sync()
+	}
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	_ = s.Close()
+	return os.Remove(src)
+}
+
 func isDir(path string) bool {
 	stat, _ := os.Stat(path)
 	return stat != nil && stat.IsDir()
@@ -182,6 +275,45 @@ func loadFileAsJSON(filepath string, value interface{}) error {
 	return LoadReaderAsJSON(f, value)
 }
 
+// saveGob writes value to p. It writes to a temporary file first so a crash
+// never leaves a partial file behind.
+func saveGob(p string, value interface{}) error {
+	tmpPath := p + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %s", tmpPath, err)
+	}
+	err = gob.NewEncoder(f).Encode(value)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, p)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Failed to write %s: %s", p, err)
+	}
+	return nil
+}
+
+func loadGob(p string, value interface{}) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return fmt.Errorf("Failed to load %s: %s", p, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err := gob.NewDecoder(f).Decode(value); err != nil {
+		return fmt.Errorf("Failed to load %s: %s", p, err)
+	}
+	return nil
+}
+
 type closableBuffer struct {
 	*bytes.Reader
 }
@@ -10,8 +10,10 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/maruel/ut"
@@ -27,3 +29,28 @@ func removeDir(t testing.TB, tempDir string) {
 	err := os.RemoveAll(tempDir)
 	ut.AssertEqual(t, nil, err)
 }
+
+// recordLogger is a Logger that keeps the formatted lines.
+type recordLogger struct {
+	lines []string
+}
+
+func (r *recordLogger) Printf(format string, v ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+}
+
+func TestMoveFile(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "move_file")
+	defer removeDir(t, tempData)
+
+	src := filepath.Join(tempData, "src")
+	dst := filepath.Join(tempData, "dst")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, []byte("content"), 0600))
+	ut.AssertEqual(t, nil, moveFile(src, dst, true))
+	data, err := ioutil.ReadFile(dst)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content", string(data))
+	_, err = os.Stat(src)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
@@ -10,12 +10,18 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bytes"
 	"fmt"
+	"html"
 	"io"
+	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+
+	"github.com/yuin/goldmark"
 )
 
 // Entry is an element. It can only contain the 2 firsts or the last one.
@@ -25,6 +31,23 @@ type Entry struct {
 	Sha1  string            `json:"h,omitempty"`
 	Size  int64             `json:"s,omitempty"`
 	Files map[string]*Entry `json:"f,omitempty"`
+	// HardLinkTo is the posix-style path, relative to the root Entry, of the
+	// file this one is a hard link to. Sha1 and Size are still set.
+	HardLinkTo string `json:"l,omitempty"`
+	// OrigPath is the posix-style absolute path the file was archived from. It
+	// is only recorded when requested.
+	OrigPath string `json:"o,omitempty"`
+	// Holes are the sorted [offset, length] ranges of zeros that were holes in
+	// the sparse file, so restore can leave them unallocated. The object still
+	// has the full content. It is only recorded when requested.
+	Holes [][2]int64 `json:"z,omitempty"`
+	// Xattrs are the extended attributes of the file. The values are binary so
+	// they are serialized as base64. It is only recorded when requested.
+	Xattrs map[string][]byte `json:"x,omitempty"`
+	// Compressed is true when the object is stored compressed and StoredSize is
+	// then its size in the CAS. They are only recorded by archive -compress.
+	Compressed bool  `json:"c,omitempty"`
+	StoredSize int64 `json:"p,omitempty"`
 }
 
 // SortedFiles returns the child entry names sorted.
@@ -40,6 +63,38 @@ func (e *Entry) SortedFiles() []string {
 	return out
 }
 
+// Equal returns true if e and other describe the same tree. A nil and an
+// empty Files, Holes or Xattrs are equal since they are serialized the same way.
+func (e *Entry) Equal(other *Entry) bool {
+	if e == nil || other == nil {
+		return e == other
+	}
+	if e.Sha1 != other.Sha1 || e.Size != other.Size || e.HardLinkTo != other.HardLinkTo || e.OrigPath != other.OrigPath || e.Compressed != other.Compressed || e.StoredSize != other.StoredSize {
+		return false
+	}
+	if len(e.Holes) != len(other.Holes) || len(e.Files) != len(other.Files) || len(e.Xattrs) != len(other.Xattrs) {
+		return false
+	}
+	for i := range e.Holes {
+		if e.Holes[i] != other.Holes[i] {
+			return false
+		}
+	}
+	for name, v := range e.Xattrs {
+		o, ok := other.Xattrs[name]
+		if !ok || !bytes.Equal(v, o) {
+			return false
+		}
+	}
+	for name, f := range e.Files {
+		o, ok := other.Files[name]
+		if !ok || !f.Equal(o) {
+			return false
+		}
+	}
+	return true
+}
+
 // CountMembers returns the number of all children elements recursively.
 func (e *Entry) CountMembers() int {
 	countI := 1
@@ -49,6 +104,29 @@ func (e *Entry) CountMembers() int {
 	return countI
 }
 
+// Walk calls fn for e and all its children recursively, in sorted order.
+// relPath is posix-style and is "" for e itself. It stops at the first error
+// returned by fn.
+func (e *Entry) Walk(fn func(relPath string, entry *Entry) error) error {
+	return e.walk("", fn)
+}
+
+func (e *Entry) walk(relPath string, fn func(relPath string, entry *Entry) error) error {
+	if err := fn(relPath, e); err != nil {
+		return err
+	}
+	for _, f := range e.SortedFiles() {
+		childPath := f
+		if relPath != "" {
+			childPath = relPath + "/" + f
+		}
+		if err := e.Files[f].walk(childPath, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Print prints the Entry in Yaml-inspired output.
 func (e *Entry) Print(w io.Writer, indent string) {
 	if e.Sha1 != "" {
@@ -68,6 +146,8 @@ func (e *Entry) isDir() bool {
 type entryFileSystem struct {
 	entry *Entry
 	cas   CasTable
+	// header is HTML shown at the top of the root directory.
+	header string
 }
 
 // "itemPath" must be posix-style.
@@ -114,21 +194,62 @@ func (e *entryFileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if toServe.isDir() {
 		if !hasTrailing {
 			localRedirect(w, r, filepath.Base(r.URL.Path)+"/")
+		} else if r.URL.Query().Get("format") == "zip" {
+			e.serveZip(w, r, toServe)
 		} else {
-			toServe.ServeDir(w)
+			header := ""
+			if toServe == e.entry {
+				header = e.header
+			}
+			toServe.serveDir(w, header)
 		}
 	} else {
 		if hasTrailing {
 			localRedirect(w, r, filepath.Base(r.URL.Path))
 		} else {
+			// The CAS only knows the hash; name the file after its entry and
+			// derive its type from its extension. ?download=1 forces a download.
+			name := path.Base(r.URL.Path)
+			if r.URL.Query().Get("download") == "1" {
+				w.Header().Set("Content-Disposition", attachmentDisposition(name))
+			} else {
+				w.Header().Set("Content-Disposition", contentDisposition(name))
+			}
+			if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+				w.Header().Set("Content-Type", t)
+			}
 			r.URL.Path = "/" + toServe.Sha1
 			e.cas.ServeHTTP(w, r)
 		}
 	}
 }
 
+// contentDisposition returns the Content-Disposition header value to display
+// a file named name inline.
+func contentDisposition(name string) string {
+	if v := mime.FormatMediaType("inline", map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	// Older versions of mime can't encode non-ASCII names.
+	return "inline"
+}
+
+// attachmentDisposition is like contentDisposition but to download the file.
+func attachmentDisposition(name string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	return "attachment"
+}
+
 // ServeDir returns the child entries for an Entry.
 func (e *Entry) ServeDir(w http.ResponseWriter) {
+	e.serveDir(w, "")
+}
+
+// serveDir lists the child entries below header, with a link to download
+// them as a zip archive.
+func (e *Entry) serveDir(w http.ResponseWriter, header string) {
 	names := make([]string, len(e.Files))
 	i := 0
 	for name, entry := range e.Files {
@@ -138,5 +259,20 @@ func (e *Entry) ServeDir(w http.ResponseWriter) {
 		names[i] = name
 		i++
 	}
-	dirList(w, names)
+	dirListHeader(w, header+"<a href=\"?format=zip\">Download as zip</a>", names)
+}
+
+// renderComment returns the HTML for a node comment, rendered as Markdown if
+// requested. The raw HTML in the Markdown is not rendered.
+func renderComment(comment string, markdown bool) string {
+	if comment == "" {
+		return ""
+	}
+	if markdown {
+		var buf bytes.Buffer
+		if err := goldmark.Convert([]byte(comment), &buf); err == nil {
+			return "<div class=\"comment\">" + buf.String() + "</div><hr>"
+		}
+	}
+	return "<pre class=\"comment\">" + html.EscapeString(comment) + "</pre><hr>"
 }
@@ -0,0 +1,138 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestEntryWalk(t *testing.T) {
+	t.Parallel()
+	e := &Entry{
+		Files: map[string]*Entry{
+			"b": {Sha1: "2", Size: 2},
+			"a": {
+				Files: map[string]*Entry{
+					"c": {Sha1: "3", Size: 3},
+				},
+			},
+		},
+	}
+	paths := []string{}
+	err := e.Walk(func(relPath string, entry *Entry) error {
+		paths = append(paths, relPath)
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"", "a", "a/c", "b"}, paths)
+
+	stop := errors.New("stop")
+	paths = []string{}
+	err = e.Walk(func(relPath string, entry *Entry) error {
+		paths = append(paths, relPath)
+		if relPath == "a" {
+			return stop
+		}
+		return nil
+	})
+	ut.AssertEqual(t, stop, err)
+	ut.AssertEqual(t, []string{"", "a"}, paths)
+}
+
+func TestEntryEqual(t *testing.T) {
+	t.Parallel()
+	tree := map[string]string{
+		"dir1/dir2/file2": "content2",
+		"file1":           "content1",
+	}
+	_, expected := makeEntryTree(tree)
+	cas := MakeMemoryCasTable()
+	_, _, entrySha1 := archiveData(t, cas, MakeMemoryNodesTable(cas), tree)
+	entry, err := LoadEntry(cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, expected.Equal(entry))
+	ut.AssertEqual(t, true, entry.Equal(expected))
+
+	entry.Files["dir1"].Files["dir2"].Files["file2"].Size = 7
+	ut.AssertEqual(t, false, expected.Equal(entry))
+	ut.AssertEqual(t, false, entry.Equal(expected))
+
+	data := []struct {
+		a, b  *Entry
+		equal bool
+	}{
+		{nil, nil, true},
+		{&Entry{}, nil, false},
+		{&Entry{Files: map[string]*Entry{}}, &Entry{}, true},
+		{&Entry{Holes: [][2]int64{}}, &Entry{}, true},
+		{&Entry{Holes: [][2]int64{{0, 1}}}, &Entry{Holes: [][2]int64{{0, 2}}}, false},
+		{&Entry{HardLinkTo: "a"}, &Entry{}, false},
+		{&Entry{OrigPath: "/a"}, &Entry{}, false},
+		{&Entry{Files: map[string]*Entry{"a": {}}}, &Entry{Files: map[string]*Entry{"b": {}}}, false},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.equal, line.a.Equal(line.b))
+		ut.AssertEqualIndex(t, i, line.equal, line.b.Equal(line.a))
+	}
+}
+
+func TestEntryFileSystemContentDisposition(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	tree := map[string]string{
+		"dir1/my file.txt": "content1",
+		"dir1/page.html":   "<p>content3</p>",
+		"file2":            "content2",
+	}
+	sha1tree, _, entrySha1 := archiveData(t, cas, nodes, tree)
+	entry, err := LoadEntry(cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+	e := &entryFileSystem{entry: entry, cas: cas}
+
+	data := []struct {
+		path     string
+		expected string
+	}{
+		{"/dir1/my%20file.txt", "inline; filename=\"my file.txt\""},
+		{"/file2", "inline; filename=file2"},
+		{"/file2?download=1", "attachment; filename=file2"},
+		{"/dir1/page.html?download=1", "attachment; filename=page.html"},
+		{"/dir1/", ""},
+	}
+	for i, line := range data {
+		req, err := http.NewRequest("GET", "http://test"+line.path, nil)
+		ut.AssertEqualIndex(t, i, nil, err)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		ut.AssertEqualIndex(t, i, line.expected, w.Header().Get("Content-Disposition"))
+	}
+
+	// The type is derived from the extension since the CAS only knows the hash.
+	req, err := http.NewRequest("GET", "http://test/dir1/page.html", nil)
+	ut.AssertEqual(t, nil, err)
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	ut.AssertEqual(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	ut.AssertEqual(t, "<p>content3</p>", w.Body.String())
+
+	// The bare CAS endpoint doesn't set it.
+	req, err = http.NewRequest("GET", "http://test/"+sha1tree["file2"], nil)
+	ut.AssertEqual(t, nil, err)
+	w = httptest.NewRecorder()
+	cas.ServeHTTP(w, req)
+	ut.AssertEqual(t, "content2", w.Body.String())
+	ut.AssertEqual(t, "", w.Header().Get("Content-Disposition"))
+}
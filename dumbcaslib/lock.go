@@ -0,0 +1,58 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// lockName is the file in the root that exists while a command modifies it.
+const lockName = "lock"
+
+type rootLock struct {
+	path string
+}
+
+func (r *rootLock) Close() error {
+	return os.Remove(r.path)
+}
+
+// LockRoot takes the advisory lock of rootDir so a single command modifies it
+// at a time. It fails right away if the lock is already taken. The lock file
+// records the process holding it. Close() releases the lock.
+func LockRoot(rootDir string) (io.Closer, error) {
+	if err := os.MkdirAll(rootDir, 0750); err != nil {
+		return nil, fmt.Errorf("Failed to create %s: %s", rootDir, err)
+	}
+	lockPath := filepath.Join(rootDir, lockName)
+	f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if os.IsExist(err) {
+		owner, _ := ioutil.ReadFile(lockPath)
+		return nil, fmt.Errorf("Another operation is in progress on %s by %s; delete %s if it was killed", rootDir, strings.TrimSpace(string(owner)), lockPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock %s: %s", rootDir, err)
+	}
+	hostname, _ := os.Hostname()
+	_, err = fmt.Fprintf(f, "pid %d on %s\n", os.Getpid(), hostname)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(lockPath)
+		return nil, fmt.Errorf("Failed to lock %s: %s", rootDir, err)
+	}
+	return &rootLock{lockPath}, nil
+}
@@ -0,0 +1,39 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestLockRoot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "lock")
+	defer removeDir(t, tempData)
+
+	lock, err := LockRoot(tempData)
+	ut.AssertEqual(t, nil, err)
+	_, err = LockRoot(tempData)
+	prefix := fmt.Sprintf("Another operation is in progress on %s by pid %d on ", tempData, os.Getpid())
+	ut.AssertEqualf(t, true, err != nil && strings.HasPrefix(err.Error(), prefix), "Unexpected error: %s", err)
+
+	ut.AssertEqual(t, nil, lock.Close())
+	_, err = os.Stat(filepath.Join(tempData, lockName))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	lock, err = LockRoot(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, lock.Close())
+}
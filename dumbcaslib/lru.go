@@ -0,0 +1,97 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruCache keeps up to max values, evicting the least recently used one. The
+// values are kept in a list ordered by their last access so the lookups and
+// the eviction are O(1).
+type lruCache struct {
+	lock  sync.Mutex
+	max   int
+	items map[string]*list.Element
+	// order has the most recently used *lruItem at the front.
+	order *list.List
+	// cleared is incremented on each clear().
+	cleared int64
+}
+
+type lruItem struct {
+	key   string
+	value interface{}
+}
+
+func makeLRUCache(max int) *lruCache {
+	return &lruCache{max: max, items: map[string]*list.Element{}, order: list.New()}
+}
+
+// get returns the value of key, if present, and marks it as recently used.
+func (l *lruCache) get(key string) (interface{}, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+// add sets the value of key, evicting the least recently used values in
+// excess.
+func (l *lruCache) add(key string, value interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.addLocked(key, value)
+}
+
+// generation returns a value to pass to addSince().
+func (l *lruCache) generation() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cleared
+}
+
+// addSince is like add() but drops the value if clear() was called after
+// generation() returned generation, since the value may be stale.
+func (l *lruCache) addSince(generation int64, key string, value interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.cleared == generation {
+		l.addLocked(key, value)
+	}
+}
+
+func (l *lruCache) addLocked(key string, value interface{}) {
+	if e, ok := l.items[key]; ok {
+		e.Value.(*lruItem).value = value
+		l.order.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value})
+	for len(l.items) > l.max {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruItem).key)
+	}
+}
+
+// clear removes all the values.
+func (l *lruCache) clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.items = map[string]*list.Element{}
+	l.order.Init()
+	l.cleared++
+}
@@ -0,0 +1,89 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestLRUCache(t *testing.T) {
+	t.Parallel()
+	l := makeLRUCache(2)
+	_, ok := l.get("a")
+	ut.AssertEqual(t, false, ok)
+	l.add("a", 1)
+	l.add("b", 2)
+	v, ok := l.get("a")
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, 1, v)
+	// b is the least recently used.
+	l.add("c", 3)
+	_, ok = l.get("b")
+	ut.AssertEqual(t, false, ok)
+	_, ok = l.get("a")
+	ut.AssertEqual(t, true, ok)
+	_, ok = l.get("c")
+	ut.AssertEqual(t, true, ok)
+	// Replacing a value marks it as recently used.
+	l.add("a", 4)
+	l.add("d", 5)
+	v, ok = l.get("a")
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, 4, v)
+	_, ok = l.get("c")
+	ut.AssertEqual(t, false, ok)
+	l.clear()
+	_, ok = l.get("a")
+	ut.AssertEqual(t, false, ok)
+}
+
+func TestLRUCacheAddSince(t *testing.T) {
+	t.Parallel()
+	l := makeLRUCache(2)
+	generation := l.generation()
+	l.addSince(generation, "a", 1)
+	v, ok := l.get("a")
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, 1, v)
+
+	// The value read before clear() is stale.
+	l.clear()
+	l.addSince(generation, "a", 1)
+	_, ok = l.get("a")
+	ut.AssertEqual(t, false, ok)
+	l.addSince(l.generation(), "a", 2)
+	v, ok = l.get("a")
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, 2, v)
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	t.Parallel()
+	l := makeLRUCache(4)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("%d", (i+j)%6)
+				if _, ok := l.get(key); !ok {
+					l.add(key, j)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	ut.AssertEqual(t, true, len(l.items) <= 4)
+}
@@ -0,0 +1,58 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+)
+
+// MerkleRoot returns the root of a Merkle tree whose leaves are the files of
+// entry in sorted order. Each leaf hashes the posix-style path of a file with
+// its content hash so moving, removing or adding a file changes the root even
+// if every object is still valid. Only the entry tree is read, not the
+// content.
+func MerkleRoot(entry *Entry) string {
+	level := [][]byte{}
+	_ = entry.Walk(func(relPath string, e *Entry) error {
+		if e.Sha1 != "" {
+			// The 0 and 1 prefixes keep a leaf from being mistaken for an inner
+			// node.
+			h := sha1.New()
+			_, _ = h.Write([]byte{0})
+			_, _ = io.WriteString(h, relPath)
+			_, _ = h.Write([]byte{0})
+			_, _ = io.WriteString(h, e.Sha1)
+			level = append(level, h.Sum(nil))
+		}
+		return nil
+	})
+	if len(level) == 0 {
+		return Sha1Bytes(nil)
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				// An odd node is promoted as-is.
+				next = append(next, level[i])
+				continue
+			}
+			h := sha1.New()
+			_, _ = h.Write([]byte{1})
+			_, _ = h.Write(level[i])
+			_, _ = h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
@@ -0,0 +1,52 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	t.Parallel()
+	file := func(content string) *Entry {
+		return &Entry{Sha1: Sha1Bytes([]byte(content)), Size: int64(len(content))}
+	}
+	tree := func() *Entry {
+		return &Entry{Files: map[string]*Entry{
+			"a": file("a"),
+			"b": file("b"),
+			"dir": {Files: map[string]*Entry{
+				"c": file("c"),
+			}},
+		}}
+	}
+	root := MerkleRoot(tree())
+	ut.AssertEqual(t, 40, len(root))
+	ut.AssertEqual(t, root, MerkleRoot(tree()))
+	ut.AssertEqual(t, Sha1Bytes(nil), MerkleRoot(&Entry{}))
+
+	// Each file is a leaf on its own.
+	one := &Entry{Files: map[string]*Entry{"a": file("a")}}
+	ut.AssertEqual(t, false, MerkleRoot(one) == Sha1Bytes(nil))
+
+	// Removing, swapping or moving a file changes the root.
+	removed := tree()
+	delete(removed.Files, "b")
+	swapped := tree()
+	swapped.Files["a"], swapped.Files["b"] = swapped.Files["b"], swapped.Files["a"]
+	moved := tree()
+	moved.Files["c"] = moved.Files["dir"].Files["c"]
+	delete(moved.Files, "dir")
+	for i, e := range []*Entry{removed, swapped, moved} {
+		ut.AssertEqualIndex(t, i, false, MerkleRoot(e) == root)
+	}
+}
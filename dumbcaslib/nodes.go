@@ -20,6 +20,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 )
 
@@ -27,6 +28,127 @@ import (
 type Node struct {
 	Entry   string
 	Comment string `json:",omitempty"`
+	// Timestamp is the creation time of the node in seconds since the epoch. It
+	// is only set when it differs from the time embedded in the node name, e.g.
+	// once imported from another root, or when the name is made with a
+	// NameTemplate.
+	Timestamp int64 `json:",omitempty"`
+	// Tag is the name the node was added with. It is only set when the name is
+	// made with a NameTemplate, since it can't be parsed back from the name.
+	Tag string `json:",omitempty"`
+	// Started is the time the archive started in seconds since the epoch. A
+	// file modified after it may have been archived with its previous content.
+	Started int64 `json:",omitempty"`
+	// Inputs are the inputs of the archive, as absolute paths. They are only
+	// recorded with archive -record-inputs.
+	Inputs []string `json:",omitempty"`
+	// Partial is set on the node written periodically by archive
+	// -checkpoint-every while it runs. It only has the files archived so far.
+	Partial bool `json:",omitempty"`
+	// Merkle is the MerkleRoot() of the entry tree, recorded with archive
+	// -merkle. fsck verifies that the node still points to the same tree.
+	Merkle string `json:",omitempty"`
+}
+
+// NodesTableOptions are the options used to create a NodesTable.
+type NodesTableOptions struct {
+	// Fsync flushes each node to disk before AddEntry() returns.
+	Fsync bool
+	// Pretty indents the JSON of the node files so they are easier to inspect
+	// or track in a VCS. Both forms are read back the same way.
+	Pretty bool
+	// Markdown renders the comment of a node as Markdown at the top of its
+	// root directory in ServeHTTP, instead of as preformatted text.
+	Markdown bool
+	// Packed appends the nodes to a few segment files instead of creating one
+	// file per node. A root keeps using packed nodes once it has some.
+	Packed bool
+	// NameTemplate is the text/template of the node names. It can use
+	// .Hostname, .Time in UTC and .Name, the tag. It defaults to
+	// DefaultNodeNameTemplate.
+	NameTemplate string
+}
+
+// DefaultNodeNameTemplate is the template of the node names when
+// NodesTableOptions.NameTemplate is not set.
+const DefaultNodeNameTemplate = `{{.Hostname}}_{{.Time.Format "2006-01-02_15-04-05"}}_{{.Name}}`
+
+// nodeNamer formats the node names with a NameTemplate. The names are opaque
+// to the rest of the code; only the month directory is fixed.
+type nodeNamer struct {
+	t        *template.Template
+	hostname string
+	// custom is set when the names are not made with DefaultNodeNameTemplate
+	// so the creation time and the tag are recorded in the node instead.
+	custom bool
+}
+
+func makeNodeNamer(text, hostname string) (*nodeNamer, error) {
+	if text == "" {
+		text = DefaultNodeNameTemplate
+	}
+	t, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid node name template: %s", err)
+	}
+	n := &nodeNamer{t: t, hostname: hostname, custom: text != DefaultNodeNameTemplate}
+	// Catches an invalid template now instead of on the first node.
+	if _, err := n.name(time.Now().UTC(), "tag"); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// name returns the name of a node created at now for the tag name. The
+// characters a file system rejects are escaped by the nodes table but the
+// name must not be a path.
+func (n *nodeNamer) name(now time.Time, name string) (string, error) {
+	buf := &bytes.Buffer{}
+	vars := struct {
+		Hostname string
+		Time     time.Time
+		Name     string
+	}{n.hostname, now, name}
+	if err := n.t.Execute(buf, vars); err != nil {
+		return "", fmt.Errorf("Invalid node name template: %s", err)
+	}
+	out := buf.String()
+	if out == "" || out == "." || out == ".." || strings.ContainsAny(out, "/\\") {
+		return "", fmt.Errorf("The node name template generated the invalid name %q", out)
+	}
+	return out, nil
+}
+
+// stamp returns node with its creation time and its tag name recorded when
+// they can't be parsed back from the node name. A creation time already
+// recorded, like the one of an imported node, is kept. node is not modified.
+func (n *nodeNamer) stamp(node *Node, now time.Time, name string) *Node {
+	if !n.custom {
+		return node
+	}
+	out := *node
+	if out.Timestamp == 0 {
+		out.Timestamp = now.Unix()
+	}
+	out.Tag = name
+	return &out
+}
+
+// keepStamp returns node with the creation time and the tag recorded in old,
+// the data of the node it replaces, unless node sets them.
+func keepStamp(node *Node, old []byte) *Node {
+	prev := &Node{}
+	if json.Unmarshal(old, prev) != nil || (prev.Timestamp == 0 && prev.Tag == "") {
+		return node
+	}
+	out := *node
+	if out.Timestamp == 0 {
+		out.Timestamp = prev.Timestamp
+	}
+	if out.Tag == "" {
+		out.Tag = prev.Tag
+	}
+	return &out
 }
 
 // NodesTable is an index to a CasTable.
@@ -34,13 +156,29 @@ type NodesTable interface {
 	Table
 	// AddEntry adds a node to the table.
 	AddEntry(node *Node, name string) (string, error)
+	// UpdateEntry atomically replaces the node name, as returned by AddEntry().
+	// The tags pointing to it are updated accordingly. name can't be a tag. The
+	// creation time and the tag recorded by AddEntry() are kept.
+	UpdateEntry(name string, node *Node) error
+	// SetLabel makes the tag "labels/<label>" point to the node name, as
+	// returned by AddEntry(). Unlike the other tags, it is never updated by
+	// AddEntry().
+	SetLabel(label, name string) error
+}
+
+// checkLabel returns an error if label can't be used as a file name.
+func checkLabel(label string) error {
+	if label == "" || label == "." || label == ".." || strings.ContainsAny(label, "/\\") {
+		return fmt.Errorf("Invalid label %q", label)
+	}
+	return nil
 }
 
 // EnumerateNodesAsList returns a sorted list of all the entries. It is means
 // for testing.
 func EnumerateNodesAsList(nodes NodesTable) ([]string, error) {
 	items := []string{}
-	for v := range nodes.Enumerate() {
+	for v := range nodes.Enumerate(nil) {
 		if v.Error != nil {
 			return nil, v.Error
 		}
@@ -50,15 +188,27 @@ func EnumerateNodesAsList(nodes NodesTable) ([]string, error) {
 	return items, nil
 }
 
+// memoryNodesSnapshotName is the file written by SnapshotTo.
+const memoryNodesSnapshotName = "nodes.gob"
+
 type memoryNodesTable struct {
 	lock    sync.Mutex
 	entries map[string][]byte
-	cas     CasTable
+	// tags maps each tag to the node it points to, like a symlink would.
+	tags map[string]string
+	cas  CasTable
+}
+
+// memoryNodesSnapshot is the content of a memoryNodesTable as saved by
+// SnapshotTo. The CAS is not part of it.
+type memoryNodesSnapshot struct {
+	Entries map[string][]byte
+	Tags    map[string]string
 }
 
 // MakeMemoryNodesTable returns a NodeTable implementation all in memory.
 func MakeMemoryNodesTable(cas CasTable) NodesTable {
-	return &memoryNodesTable{entries: make(map[string][]byte), cas: cas}
+	return &memoryNodesTable{entries: make(map[string][]byte), tags: map[string]string{}, cas: cas}
 }
 
 func (m *memoryNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -67,7 +217,7 @@ func (m *memoryNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Slow search, it's fine for a fake.
 		for k, v := range m.entries {
 			k = strings.Replace(k, string(filepath.Separator), "/", -1)
-			if strings.HasPrefix(suburl, k) {
+			if suburl == k || strings.HasPrefix(suburl, k+"/") {
 				// Found.
 				rest := suburl[len(k):]
 				if rest == "" {
@@ -88,7 +238,7 @@ func (m *memoryNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 				// Defer to the cas file system.
 				r.URL.Path = rest
-				entryFs := entryFileSystem{cas: m.cas, entry: entry}
+				entryFs := entryFileSystem{cas: m.cas, entry: entry, header: renderComment(node.Comment, false)}
 				entryFs.ServeHTTP(w, r)
 				return
 			}
@@ -130,6 +280,8 @@ func (m *memoryNodesTable) AddEntry(node *Node, name string) (string, error) {
 	now := time.Now().UTC()
 	monthName := now.Format("2006-01")
 
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	nodePath := ""
 	suffix := 0
 	for {
@@ -147,22 +299,70 @@ func (m *memoryNodesTable) AddEntry(node *Node, name string) (string, error) {
 	}
 	// The real implementation creates a symlink if possible.
 	m.entries[tagsName+"/"+name] = data
+	m.tags[tagsName+"/"+name] = nodePath
 	return nodePath, nil
 }
 
-func (m *memoryNodesTable) Enumerate() <-chan EnumerationEntry {
+func (m *memoryNodesTable) UpdateEntry(name string, node *Node) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.tags[name]; ok {
+		return fmt.Errorf("Can't update tag %s", name)
+	}
+	if _, ok := m.entries[name]; !ok {
+		return fmt.Errorf("Failed to find node %s", name)
+	}
+	m.entries[name] = data
+	for tag, target := range m.tags {
+		if target == name {
+			m.entries[tag] = data
+		}
+	}
+	return nil
+}
+
+func (m *memoryNodesTable) SetLabel(label, name string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.tags[name]; ok {
+		return fmt.Errorf("Can't label %s", name)
+	}
+	data, ok := m.entries[name]
+	if !ok {
+		return fmt.Errorf("Failed to find node %s", name)
+	}
+	tag := tagsName + "/" + labelsName + "/" + label
+	m.entries[tag] = data
+	m.tags[tag] = name
+	return nil
+}
+
+func (m *memoryNodesTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
 	c := make(chan EnumerationEntry)
 	go func() {
+		// Make a sorted copy of the keys so the enumeration is deterministic.
 		m.lock.Lock()
-		entries := make(map[string][]byte)
-		for k, v := range m.entries {
-			entries[k] = v
+		keys := make([]string, 0, len(m.entries))
+		for k := range m.entries {
+			keys = append(keys, k)
 		}
 		m.lock.Unlock()
-		for k := range entries {
-			c <- EnumerationEntry{Item: k}
+		sort.Strings(keys)
+		defer close(c)
+		for _, k := range keys {
+			select {
+			case c <- EnumerationEntry{Item: k}:
+			case <-cancel:
+				return
+			}
 		}
-		close(c)
 	}()
 	return c
 }
@@ -190,3 +390,36 @@ func (m *memoryNodesTable) Remove(name string) error {
 func (m *memoryNodesTable) Corrupt() {
 	m.entries["tags/fictious"] = []byte("Invalid JSON")
 }
+
+// SnapshotTo writes the nodes and the tags in dir. The CAS has to be saved
+// separately.
+func (m *memoryNodesTable) SnapshotTo(dir string) error {
+	m.lock.Lock()
+	s := memoryNodesSnapshot{Entries: make(map[string][]byte, len(m.entries)), Tags: make(map[string]string, len(m.tags))}
+	for k, v := range m.entries {
+		s.Entries[k] = v
+	}
+	for k, v := range m.tags {
+		s.Tags[k] = v
+	}
+	m.lock.Unlock()
+	return saveGob(filepath.Join(dir, memoryNodesSnapshotName), &s)
+}
+
+func (m *memoryNodesTable) RestoreFrom(dir string) error {
+	s := memoryNodesSnapshot{}
+	if err := loadGob(filepath.Join(dir, memoryNodesSnapshotName), &s); err != nil {
+		return err
+	}
+	if s.Entries == nil {
+		s.Entries = map[string][]byte{}
+	}
+	if s.Tags == nil {
+		s.Tags = map[string]string{}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries = s.Entries
+	m.tags = s.Tags
+	return nil
+}
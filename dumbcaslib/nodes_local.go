@@ -10,11 +10,14 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -33,83 +36,135 @@ const nodesName = "nodes"
 // nodes. They are overwritten automatically.
 const tagsName = "tags"
 
+// labelsName is a tags subdirectory holding the labels, which are named
+// pointers to any node set with SetLabel().
+const labelsName = "labels"
+
+// unsafeChars are the characters that can't be in a file name on at least
+// one supported OS. They are percent-encoded in the node and tag file names,
+// along with '%' itself.
+const unsafeChars = "%/\\:*?\"<>|"
+
+// pointerPrefix starts a tag file that refers to its node by path. It is used
+// when symlinks can't be created.
+const pointerPrefix = "ref: "
+
 type nodesTable struct {
 	nodesDir string
 	cas      CasTable
-	maxItems int
-	hostname string
+	namer    *nodeNamer
 	trash    trash
+	fsync    bool
+	pretty   bool
+	markdown bool
+	// symlinks is false when the file system of nodesDir doesn't support
+	// symlinks, e.g. FAT, so the tags are written as pointer files right away.
+	// It is probed on the first tag write so opening the table for reading
+	// doesn't write to it.
+	probe    sync.Once
+	symlinks bool
 
-	mutex         sync.Mutex
-	recentNodes   map[string]*nodeCache
-	recentEntries map[string]*entryCache
-}
-
-type nodeCache struct {
-	Node
-	lastAccess time.Time
-}
-
-type entryCache struct {
-	entryFileSystem
-	lastAccess time.Time
+	// recentNodes are the *Node recently served, keyed by their URL prefix
+	// using "/" as the path separator. recentEntries are the *entryFileSystem
+	// of the entry trees recently served, keyed by their hash.
+	recentNodes   *lruCache
+	recentEntries *lruCache
 }
 
 // LoadLocalNodesTable returns a NodesTable rooted at rootDir using CasTable as
-// its data source.
-func LoadLocalNodesTable(rootDir string, cas CasTable) (NodesTable, error) {
-	nodesDir := filepath.Join(rootDir, nodesName)
-	if err := os.Mkdir(nodesDir, 0750); err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("LoadNodesTable(%s): Failed to create %s: %s\n", rootDir, nodesDir, err)
-	}
+// its data source. The nodes are packed in segment files when opts.Packed is
+// set or when rootDir already has packed nodes.
+func LoadLocalNodesTable(rootDir string, cas CasTable, opts NodesTableOptions) (NodesTable, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get the hostname: %s", err)
 	}
 	parts := strings.SplitN(hostname, ".", 2)
-	hostname = parts[0]
+	namer, err := makeNodeNamer(opts.NameTemplate, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if opts.Packed || hasPackedNodes(rootDir) {
+		return loadPackedNodesTable(rootDir, cas, opts, namer)
+	}
+	nodesDir := filepath.Join(rootDir, nodesName)
+	if err := os.Mkdir(nodesDir, 0750); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("LoadNodesTable(%s): Failed to create %s: %s\n", rootDir, nodesDir, err)
+	}
 	return &nodesTable{
 		nodesDir:      nodesDir,
 		cas:           cas,
-		maxItems:      10,
-		hostname:      hostname,
+		namer:         namer,
 		trash:         makeTrash(nodesDir),
-		recentNodes:   map[string]*nodeCache{},
-		recentEntries: map[string]*entryCache{},
+		fsync:         opts.Fsync,
+		pretty:        opts.Pretty,
+		markdown:      opts.Markdown,
+		recentNodes:   makeLRUCache(10),
+		recentEntries: makeLRUCache(10),
 	}, nil
 }
 
-func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
-	data, err := json.Marshal(node)
+func (n *nodesTable) marshal(node *Node) ([]byte, error) {
+	var data []byte
+	var err error
+	if n.pretty {
+		data, err = json.MarshalIndent(node, "", "  ")
+	} else {
+		data, err = json.Marshal(node)
+	}
 	if err != nil {
-		return "", fmt.Errorf("Failed to marshall internal state: %s", err)
+		return nil, fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	return data, nil
+}
+
+func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
+	// The other characters are escaped but a separator would make the node name
+	// ambiguous.
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("Invalid tag %q", name)
 	}
 	now := time.Now().UTC()
+	data, err := n.marshal(n.namer.stamp(node, now, name))
+	if err != nil {
+		return "", err
+	}
 	// Create one directory store per month.
 	monthName := now.Format("2006-01")
 	monthDir := filepath.Join(n.nodesDir, monthName)
 	if err := os.MkdirAll(monthDir, 0750); err != nil && !os.IsExist(err) {
 		return "", fmt.Errorf("Failed to create %s: %s\n", monthDir, err)
 	}
+	baseName, err := n.namer.name(now, name)
+	if err != nil {
+		return "", err
+	}
 	suffix := 0
 	nodeName := ""
 	nodePath := ""
 	for {
-		nodeName = n.hostname + "_" + now.Format("2006-01-02_15-04-05") + "_" + name
+		nodeName = baseName
 		if suffix != 0 {
 			nodeName += fmt.Sprintf("(%d)", suffix)
 		}
-		nodePath = filepath.Join(monthDir, nodeName)
+		nodePath = filepath.Join(monthDir, escapeName(nodeName))
 		f, err := os.OpenFile(nodePath, os.O_WRONLY|os.O_EXCL|os.O_CREATE, 0640)
 		if err != nil {
 			// Try ad nauseam.
 			suffix++
 		} else {
-			if _, err = f.Write(data); err != nil {
-				_ = f.Close()
-				return "", fmt.Errorf("Failed to write %s: %s", f.Name(), err)
+			if _, err = f.Write(data); err == nil && n.fsync {
+				err = f.Sync()
+			}
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				return "", fmt.Errorf("Failed to write %s: %s", nodePath, err)
+			}
+			if n.fsync {
+				syncDir(monthDir)
 			}
-			_ = f.Close()
 			break
 		}
 	}
@@ -119,49 +174,302 @@ func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
 	if err := os.MkdirAll(tagsDir, 0750); err != nil && !os.IsExist(err) {
 		return "", fmt.Errorf("Failed to create %s: %s\n", tagsDir, err)
 	}
-	tagPath := filepath.Join(tagsDir, name)
-	relPath, err := filepath.Rel(tagsDir, nodePath)
-	if err != nil {
+	tagPath := filepath.Join(tagsDir, escapeName(name))
+	if err := link(tagPath, nodePath, filepath.Join(n.nodesDir, trashName), n.useSymlinks()); err != nil {
 		return "", err
 	}
-	_ = os.Remove(tagPath)
-	if err := os.Symlink(relPath, tagPath); err != nil {
-		// Fallback to rewrite the same data.
-		f, err := os.OpenFile(tagPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
-		if err != nil {
-			return "", fmt.Errorf("Failed to create tag %s: %s", tagPath, err)
-		}
-		defer func() {
-			_ = f.Close()
-		}()
-		if _, err = f.Write(data); err != nil {
-			return "", fmt.Errorf("Failed to write %s: %s", tagPath, err)
+	if legacy := filepath.Join(tagsDir, name); legacy != tagPath && filepath.Dir(legacy) == tagsDir {
+		// The tag written before the names were escaped is superseded.
+		if _, err := os.Lstat(legacy); err == nil {
+			_ = n.trash.move(filepath.Join(tagsName, name))
 		}
 	}
+	// The tag now points to the new node.
+	n.recentNodes.clear()
 	return filepath.Join(monthName, nodeName), nil
 }
 
+// escapeName percent-encodes the characters of name that can't be in a file
+// name, so any node or tag name can be stored. A trailing dot or space is
+// encoded too since Windows strips them.
+func escapeName(name string) string {
+	out := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 0x20 || c == 0x7f || strings.IndexByte(unsafeChars, c) != -1 || (i == len(name)-1 && (c == '.' || c == ' ')) {
+			out = append(out, fmt.Sprintf("%%%02X", c)...)
+		} else {
+			out = append(out, c)
+		}
+	}
+	return string(out)
+}
+
+// unescapeName is the reverse of escapeName. A file name that escapeName
+// couldn't have produced, e.g. "a%41" or "100%", was written before the names
+// were escaped and is returned as-is.
+func unescapeName(fileName string) string {
+	if name, err := url.PathUnescape(fileName); err == nil && escapeName(name) == fileName {
+		return name
+	}
+	return fileName
+}
+
+// itemFile returns the file path, relative to nodesDir, of the node or tag
+// item. Each path component is escaped, except when only the unescaped file
+// exists, as written before the names were escaped.
+func (n *nodesTable) itemFile(item string) string {
+	parts := strings.Split(filepath.ToSlash(item), "/")
+	raw := filepath.Join(parts...)
+	for i := range parts {
+		parts[i] = escapeName(parts[i])
+	}
+	escaped := filepath.Join(parts...)
+	if escaped != raw {
+		if _, err := os.Lstat(filepath.Join(n.nodesDir, escaped)); os.IsNotExist(err) {
+			if _, err := os.Lstat(filepath.Join(n.nodesDir, raw)); err == nil {
+				return raw
+			}
+		}
+	}
+	return escaped
+}
+
+// useSymlinks returns true if the tags should be written as symlinks. The file
+// system is probed on the first call.
+func (n *nodesTable) useSymlinks() bool {
+	n.probe.Do(func() {
+		n.symlinks = probeSymlinks(filepath.Join(n.nodesDir, trashName))
+	})
+	return n.symlinks
+}
+
+// probeSymlinks returns false if a symlink can't be created in tmpDir. It
+// returns true when it can't tell, e.g. on a read only file system, so link()
+// still tries the symlink first.
+func probeSymlinks(tmpDir string) bool {
+	if err := os.MkdirAll(tmpDir, 0750); err != nil {
+		return true
+	}
+	f, err := ioutil.TempFile(tmpDir, "probe")
+	if err != nil {
+		return true
+	}
+	tmpPath := f.Name()
+	_ = f.Close()
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+	if err := os.Symlink(filepath.Base(tmpPath), tmpPath+".link"); err != nil {
+		return false
+	}
+	_ = os.Remove(tmpPath + ".link")
+	return true
+}
+
+// link makes tagPath point to nodePath with a symlink, or a pointer file if
+// symlinks are not supported. With symlinks false, the symlink isn't even
+// tried. The link is created in tmpDir then renamed over tagPath so the tag is
+// never missing while it is replaced.
+func link(tagPath, nodePath, tmpDir string, symlinks bool) error {
+	relPath, err := filepath.Rel(filepath.Dir(tagPath), nodePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", tmpDir, err)
+	}
+	// The temporary file reserves a unique name for the symlink too.
+	f, err := ioutil.TempFile(tmpDir, "tag")
+	if err != nil {
+		return fmt.Errorf("Failed to create tag %s: %s", tagPath, err)
+	}
+	if !symlinks {
+		return replaceWithPointer(f, tagPath, relPath)
+	}
+	tmpPath := f.Name()
+	if err := os.Symlink(relPath, tmpPath+".link"); err == nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		if err := os.Rename(tmpPath+".link", tagPath); err != nil {
+			_ = os.Remove(tmpPath + ".link")
+			return fmt.Errorf("Failed to create tag %s: %s", tagPath, err)
+		}
+		return nil
+	}
+	return replaceWithPointer(f, tagPath, relPath)
+}
+
+// replaceWithPointer writes a pointer file to relPath in f then renames it over
+// tagPath. f is closed.
+func replaceWithPointer(f *os.File, tagPath, relPath string) error {
+	tmpPath := f.Name()
+	_, err := f.Write([]byte(pointerPrefix + filepath.ToSlash(relPath) + "\n"))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0640)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, tagPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Failed to write %s: %s", tagPath, err)
+	}
+	return nil
+}
+
+// SetLabel creates or replaces tags/labels/<label> to point to the node.
+func (n *nodesTable) SetLabel(label, name string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+	nodePath := filepath.Join(n.nodesDir, n.itemFile(filepath.Clean(string(filepath.Separator)+name)))
+	rel, err := filepath.Rel(n.nodesDir, nodePath)
+	if err != nil {
+		return err
+	}
+	if first := strings.SplitN(rel, string(filepath.Separator), 2)[0]; first == tagsName || first == trashName {
+		return fmt.Errorf("Can't label %s", name)
+	}
+	if stat, err := os.Lstat(nodePath); err != nil || !stat.Mode().IsRegular() {
+		return fmt.Errorf("Failed to find node %s", name)
+	}
+	labelsDir := filepath.Join(n.nodesDir, tagsName, labelsName)
+	if err := os.MkdirAll(labelsDir, 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", labelsDir, err)
+	}
+	if err := link(filepath.Join(labelsDir, escapeName(label)), nodePath, filepath.Join(n.nodesDir, trashName), n.useSymlinks()); err != nil {
+		return err
+	}
+	n.recentNodes.clear()
+	return nil
+}
+
+// UpdateEntry writes the node to a temporary file in the trash then renames it
+// over the old one. The tags are symlinks or pointer files so they follow.
+func (n *nodesTable) UpdateEntry(name string, node *Node) error {
+	nodePath := filepath.Join(n.nodesDir, n.itemFile(filepath.Clean(string(filepath.Separator)+name)))
+	rel, err := filepath.Rel(n.nodesDir, nodePath)
+	if err != nil {
+		return err
+	}
+	if first := strings.SplitN(rel, string(filepath.Separator), 2)[0]; first == tagsName || first == trashName {
+		return fmt.Errorf("Can't update %s", name)
+	}
+	if stat, err := os.Lstat(nodePath); err != nil || !stat.Mode().IsRegular() {
+		return fmt.Errorf("Failed to find node %s", name)
+	}
+	old, err := ioutil.ReadFile(nodePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read node %s: %s", name, err)
+	}
+	data, err := n.marshal(keepStamp(node, old))
+	if err != nil {
+		return err
+	}
+	trashDir := filepath.Join(n.nodesDir, trashName)
+	if err := os.MkdirAll(trashDir, 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", trashDir, err)
+	}
+	f, err := ioutil.TempFile(trashDir, "update")
+	if err != nil {
+		return fmt.Errorf("Failed to update %s: %s", name, err)
+	}
+	tmpPath := f.Name()
+	if _, err = f.Write(data); err == nil && n.fsync {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0640)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, nodePath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("Failed to update %s: %s", name, err)
+	}
+	if n.fsync {
+		syncDir(filepath.Dir(nodePath))
+	}
+	n.recentNodes.clear()
+	return nil
+}
+
 func (n *nodesTable) Open(item string) (ReadSeekCloser, error) {
-	return os.Open(filepath.Join(n.nodesDir, item))
+	return os.Open(n.resolve(filepath.Join(n.nodesDir, n.itemFile(item))))
+}
+
+// readPointer returns the path a pointer file refers to. It returns false if
+// filePath is not a pointer file.
+func readPointer(filePath string) (string, bool) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	// A pointer file is small, a node is JSON.
+	buf := make([]byte, 1024)
+	size, _ := io.ReadFull(f, buf)
+	if !bytes.HasPrefix(buf[:size], []byte(pointerPrefix)) {
+		return "", false
+	}
+	relPath := strings.TrimSpace(string(buf[len(pointerPrefix):size]))
+	return filepath.Join(filepath.Dir(filePath), filepath.FromSlash(relPath)), true
+}
+
+// resolve returns the path of the node that filePath refers to. Only tags can
+// be pointer files.
+func (n *nodesTable) resolve(filePath string) string {
+	if strings.HasPrefix(filePath, filepath.Join(n.nodesDir, tagsName)+string(filepath.Separator)) {
+		if target, ok := readPointer(filePath); ok {
+			return target
+		}
+	}
+	return filePath
 }
 
 // Enumerates all the entries in the table.
-func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
+func (n *nodesTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
 	items := make(chan EnumerationEntry)
-	c := EnumerateTree(n.nodesDir)
+	// stop stops EnumerateTree() when this goroutine returns.
+	stop := make(chan struct{})
+	c := EnumerateTree(n.nodesDir, stop)
 	go func() {
+		defer func() {
+			close(stop)
+			close(items)
+		}()
+		send := func(e EnumerationEntry) bool {
+			select {
+			case items <- e:
+				return true
+			case <-cancel:
+				return false
+			}
+		}
 		for {
 			select {
 			case <-interrupt.Channel:
-				close(items)
+				return
+			case <-cancel:
 				return
 			case v, ok := <-c:
 				if !ok {
-					close(items)
 					return
 				}
 				if v.Error != nil {
-					items <- EnumerationEntry{Error: v.Error}
+					if !send(EnumerationEntry{Error: v.Error}) {
+						return
+					}
 					continue
 				}
 				if v.FileInfo.IsDir() {
@@ -172,17 +480,26 @@ func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
 					// TODO(maruel): Cancel iterating inside the directory!
 					continue
 				}
-				items <- EnumerationEntry{Item: relPath}
+				parts := strings.Split(relPath, string(filepath.Separator))
+				for i := range parts {
+					parts[i] = unescapeName(parts[i])
+				}
+				if !send(EnumerationEntry{Item: strings.Join(parts, string(filepath.Separator))}) {
+					return
+				}
 			}
 		}
-		close(items)
 	}()
 	return items
 }
 
 func (n *nodesTable) Remove(name string) error {
 	// TODO(maruel): Remove empty directories.
-	return n.trash.move(name)
+	if err := n.trash.move(n.itemFile(name)); err != nil {
+		return err
+	}
+	n.recentNodes.clear()
+	return nil
 }
 
 // LoadEntry is an utility functiont that loads an node stored in the CasTable
@@ -207,9 +524,14 @@ func LoadEntry(cas CasTable, hash string) (*Entry, error) {
 // Sadly, http.dirList is not exported. Also it doesn't sort the list by
 // default but we don't care about performance.
 func dirList(w http.ResponseWriter, items []string) {
+	dirListHeader(w, "", items)
+}
+
+// dirListHeader is like dirList with header, which is HTML, above the items.
+func dirListHeader(w http.ResponseWriter, header string, items []string) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	_, _ = io.WriteString(w, "<html><body><pre>")
+	_, _ = io.WriteString(w, "<html><body>"+header+"<pre>")
 	sort.Strings(items)
 	for _, name := range items {
 		name = html.EscapeString(name)
@@ -220,6 +542,8 @@ func dirList(w http.ResponseWriter, items []string) {
 
 // Loads a node from the file system if found.
 func (n *nodesTable) getNode(url string) (*Node, string, error) {
+	// The node read may be replaced by UpdateEntry() before it is cached.
+	generation := n.recentNodes.generation()
 	prefix := ""
 	rest := url
 	for rest != "" {
@@ -233,7 +557,7 @@ func (n *nodesTable) getNode(url string) (*Node, string, error) {
 		}
 		// Convert to OS file path.
 		relPath := strings.Replace(strings.Trim(prefix, "/"), "/", string(filepath.Separator), 0)
-		f, err := os.Open(filepath.Join(n.nodesDir, relPath))
+		f, err := os.Open(n.resolve(filepath.Join(n.nodesDir, n.itemFile(relPath))))
 		if err != nil {
 			return nil, "", err
 		}
@@ -245,12 +569,11 @@ func (n *nodesTable) getNode(url string) (*Node, string, error) {
 			return nil, "", err
 		}
 		if !stat.IsDir() {
-			node := &nodeCache{}
-			if err := LoadReaderAsJSON(f, &node.Node); err == nil {
-				node.lastAccess = time.Now()
+			node := &Node{}
+			if err := LoadReaderAsJSON(f, node); err == nil {
 				// Note that prefix is using "/" as path separator.
-				go n.updateNodeCache(prefix, node)
-				return &node.Node, rest, err
+				n.recentNodes.addSince(generation, prefix, node)
+				return node, rest, err
 			}
 			return nil, "", err
 		}
@@ -259,50 +582,27 @@ func (n *nodesTable) getNode(url string) (*Node, string, error) {
 	return nil, url, nil
 }
 
-// Tries to find the node in the cache by testing all the cached nodes. It's
+// Tries to find the node in the cache by looking up each prefix of url. It's
 // faster than touching the file system.
 func (n *nodesTable) findCachedNode(url string) (*Node, string) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-	for key, node := range n.recentNodes {
-		if strings.HasPrefix(url, key) {
-			rest := url[len(key):]
-			node.lastAccess = time.Now()
-			return &node.Node, rest
+	for i := 0; i < len(url); i++ {
+		if url[i] != '/' && i != len(url)-1 {
+			continue
 		}
-	}
-	return nil, ""
-}
-
-func (n *nodesTable) updateNodeCache(nodeName string, nodeObj *nodeCache) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-	n.recentNodes[nodeName] = nodeObj
-	for len(n.recentNodes) > n.maxItems {
-		// Find the oldest and remove it.
-		olderName := nodeName
-		olderStamp := nodeObj.lastAccess
-		for n, o := range n.recentNodes {
-			if o.lastAccess.Before(olderStamp) {
-				olderStamp = o.lastAccess
-				olderName = n
-			}
+		if v, ok := n.recentNodes.get(url[:i+1]); ok {
+			return v.(*Node), url[i+1:]
 		}
-		delete(n.recentNodes, olderName)
 	}
+	return nil, ""
 }
 
-func (n *nodesTable) getEntry(entryName string) (*entryCache, error) {
-	n.mutex.Lock()
-	if entryObj, ok := n.recentEntries[entryName]; ok {
-		entryObj.lastAccess = time.Now()
-		n.mutex.Unlock()
-		return entryObj, nil
+func (n *nodesTable) getEntry(entryName string) (*entryFileSystem, error) {
+	if v, ok := n.recentEntries.get(entryName); ok {
+		return v.(*entryFileSystem), nil
 	}
-	n.mutex.Unlock()
 
 	// Create a new entry without the lock.
-	entryObj := &entryCache{entryFileSystem: entryFileSystem{cas: n.cas}}
+	entryObj := &entryFileSystem{cas: n.cas}
 	f, err := n.cas.Open(entryName)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load the entry file: %s", err)
@@ -313,28 +613,10 @@ func (n *nodesTable) getEntry(entryName string) (*entryCache, error) {
 	if err := LoadReaderAsJSON(f, &entryObj.entry); err != nil {
 		return nil, err
 	}
-	go n.updateEntryCache(entryName, entryObj)
+	n.recentEntries.add(entryName, entryObj)
 	return entryObj, nil
 }
 
-func (n *nodesTable) updateEntryCache(entryName string, entryObj *entryCache) {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
-	n.recentEntries[entryName] = entryObj
-	for len(n.recentEntries) > n.maxItems {
-		// Find the oldest and remove it.
-		olderName := entryName
-		olderStamp := entryObj.lastAccess
-		for n, o := range n.recentEntries {
-			if o.lastAccess.Before(olderStamp) {
-				olderStamp = o.lastAccess
-				olderName = n
-			}
-		}
-		delete(n.recentEntries, olderName)
-	}
-}
-
 // Serves the NodesName directory and its virtual directory.
 func (n *nodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "" || r.URL.Path[0] != '/' {
@@ -381,6 +663,15 @@ func (n *nodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	files, _ := readDirFancy(strings.Replace(path.Join(n.nodesDir, name), "/", string(filepath.Separator), -1))
+	if name == "" {
+		// The trash is an implementation detail.
+		for i, f := range files {
+			if f == trashName+"/" {
+				files = append(files[:i], files[i+1:]...)
+				break
+			}
+		}
+	}
 	dirList(w, files)
 	return
 }
@@ -393,12 +684,16 @@ func (n *nodesTable) corruption(w http.ResponseWriter, format string, a ...inter
 }
 
 // Converts the Node request to a entryFileSystem request. This loads the entry
-// file and redirects to its virtual file system.
+// file and redirects to its virtual file system. The node comment is shown at
+// the top of the root directory.
 func (n *nodesTable) serveObj(w http.ResponseWriter, r *http.Request, node *Node) {
-	entryFs, err := n.getEntry(node.Entry)
+	entryObj, err := n.getEntry(node.Entry)
 	if err != nil {
 		n.corruption(w, "Failed to load Entry %s: %s", node.Entry, err)
 		return
 	}
+	// The cached entry may be shared by multiple nodes so make a copy.
+	entryFs := *entryObj
+	entryFs.header = renderComment(node.Comment, n.markdown)
 	entryFs.ServeHTTP(w, r)
 }
@@ -10,20 +10,506 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
 
+// tagModes are the two ways the tags are written: as symlinks and as pointer
+// files, like on a file system without symlinks. The table must behave the
+// same either way.
+var tagModes = []bool{true, false}
+
+// loadTestNodesTable returns a nodesTable writing its tags as symlinks or as
+// pointer files.
+func loadTestNodesTable(t *testing.T, tempData string, cas CasTable, opts NodesTableOptions, symlinks bool) NodesTable {
+	nodes, err := LoadLocalNodesTable(tempData, cas, opts)
+	ut.AssertEqual(t, nil, err)
+	setSymlinks(nodes, symlinks)
+	return nodes
+}
+
+// setSymlinks skips the symlink probe of a freshly loaded nodesTable.
+func setSymlinks(nodes NodesTable, symlinks bool) {
+	n := nodes.(*nodesTable)
+	n.probe.Do(func() {
+		n.symlinks = symlinks
+	})
+}
+
 func TestNodesTable(t *testing.T) {
+	t.Parallel()
+	for _, symlinks := range tagModes {
+		tempData := makeTempDir(t, "nodes")
+		// Explicitely use a fake in-memory CasTable.
+		cas := MakeMemoryCasTable()
+		testNodesTableImpl(t, cas, loadTestNodesTable(t, tempData, cas, NodesTableOptions{Fsync: true}, symlinks))
+		removeDir(t, tempData)
+	}
+}
+
+func TestNodesTableUpdate(t *testing.T) {
+	t.Parallel()
+	for _, symlinks := range tagModes {
+		tempData := makeTempDir(t, "nodes")
+		cas := MakeMemoryCasTable()
+		testNodesTableUpdate(t, cas, loadTestNodesTable(t, tempData, cas, NodesTableOptions{}, symlinks))
+		removeDir(t, tempData)
+	}
+}
+
+func TestNodesTableLabel(t *testing.T) {
+	t.Parallel()
+	for _, symlinks := range tagModes {
+		tempData := makeTempDir(t, "nodes")
+		cas := MakeMemoryCasTable()
+		testNodesTableLabel(t, cas, loadTestNodesTable(t, tempData, cas, NodesTableOptions{}, symlinks))
+		removeDir(t, tempData)
+	}
+}
+
+func TestNodesTablePointerTag(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	_, nodeName, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+
+	// Replace the symlink with a pointer file, like on a file system without
+	// symlink support.
+	tagPath := filepath.Join(tempData, nodesName, tagsName, "fictious")
+	ut.AssertEqual(t, nil, os.Remove(tagPath))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(tagPath, []byte(pointerPrefix+"../"+filepath.ToSlash(nodeName)+"\n"), 0600))
+
+	// The pointer file is enumerated like a symlink.
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{nodeName, filepath.Join(tagsName, "fictious")}, items)
+
+	// But it can be opened and browsed as the node.
+	f, err := nodes.Open(filepath.Join(tagsName, "fictious"))
+	ut.AssertEqual(t, nil, err)
+	tagData, err := ioutil.ReadAll(f)
+	f.Close()
+	ut.AssertEqual(t, nil, err)
+	f, err = nodes.Open(nodeName)
+	ut.AssertEqual(t, nil, err)
+	nodeData, err := ioutil.ReadAll(f)
+	f.Close()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, string(nodeData), string(tagData))
+	request(t, nodes, "/tags/fictious/file1", 200, "content1")
+}
+
+func TestNodesTableNoSymlinks(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+
+	// Simulate a file system without symlink support, like FAT.
+	setSymlinks(nodes, false)
+	_, nodeName, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	ut.AssertEqual(t, nil, nodes.SetLabel("good", nodeName))
+	for _, tag := range []string{"fictious", filepath.Join(labelsName, "good")} {
+		stat, err := os.Lstat(filepath.Join(tempData, nodesName, tagsName, tag))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, true, stat.Mode().IsRegular())
+		f, err := nodes.Open(filepath.Join(tagsName, tag))
+		ut.AssertEqual(t, nil, err)
+		node := &Node{}
+		ut.AssertEqual(t, nil, LoadReaderAsJSON(f, node))
+		f.Close()
+		ut.AssertEqual(t, "useful comment", node.Comment)
+	}
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{nodeName, filepath.Join(tagsName, "fictious"), filepath.Join(tagsName, labelsName, "good")}, items)
+	request(t, nodes, "/tags/fictious/file1", 200, "content1")
+}
+
+func TestProbeSymlinks(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires a privilege on Windows")
+	}
+	tempData := makeTempDir(t, "probe_symlinks")
+	defer removeDir(t, tempData)
+	ut.AssertEqual(t, true, probeSymlinks(filepath.Join(tempData, "tmp")))
+	tmp, err := ioutil.ReadDir(filepath.Join(tempData, "tmp"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(tmp))
+}
+
+func TestNodesTableLazyProbe(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	// Opening and reading the table doesn't write to it.
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, items)
+	names, err := readDirNames(filepath.Join(tempData, nodesName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+
+	// The first tag write probes the file system and removes the probe file.
+	archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	names, err = readDirNames(filepath.Join(tempData, nodesName, trashName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+}
+
+func TestNodesTableReplaceTag(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	_, node1, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(t, cas, nodes, map[string]string{"file2": "content2"})
+	nodesDir := filepath.Join(tempData, nodesName)
+	tagPath := filepath.Join(nodesDir, tagsName, "fictious")
+	tmpDir := filepath.Join(nodesDir, trashName)
+
+	done := make(chan struct{})
+	missing := make(chan error, 1)
+	go func() {
+		defer close(missing)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			f, err := nodes.Open(filepath.Join(tagsName, "fictious"))
+			if err != nil {
+				missing <- err
+				return
+			}
+			_ = f.Close()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		target := filepath.Join(nodesDir, node1)
+		if i%2 == 1 {
+			target = filepath.Join(nodesDir, node2)
+		}
+		if i%4 < 2 {
+			ut.AssertEqual(t, nil, link(tagPath, target, tmpDir, true))
+		} else {
+			// The fallback used when symlinks are not supported.
+			f, err := ioutil.TempFile(tmpDir, "tag")
+			ut.AssertEqual(t, nil, err)
+			ut.AssertEqual(t, nil, replaceWithPointer(f, tagPath, "../"+filepath.ToSlash(node1)))
+		}
+	}
+	close(done)
+	ut.AssertEqual(t, nil, <-missing)
+
+	// The temporary files are renamed away.
+	tmp, err := ioutil.ReadDir(tmpDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(tmp))
+}
+
+func TestNodesTablePretty(t *testing.T) {
 	t.Parallel()
 	tempData := makeTempDir(t, "nodes")
 	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{Pretty: true})
+	ut.AssertEqual(t, nil, err)
+	_, nodeName, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
 
-	// Explicitely use a fake in-memory CasTable.
+	data, err := ioutil.ReadFile(filepath.Join(tempData, nodesName, nodeName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, strings.Contains(string(data), "{\n  \"Entry\": "))
+
+	// The indented node is read back like a compact one.
+	request(t, nodes, "/tags/fictious/file1", 200, "content1")
+}
+
+func TestNodesTableComment(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	comment := "Some *notes* <b>x</b>\n\n[link](http://example.com)"
+	for _, markdown := range []bool{false, true} {
+		root := filepath.Join(tempData, fmt.Sprintf("%v", markdown))
+		ut.AssertEqual(t, nil, os.Mkdir(root, 0700))
+		cas := MakeMemoryCasTable()
+		nodes, err := LoadLocalNodesTable(root, cas, NodesTableOptions{Markdown: markdown})
+		ut.AssertEqual(t, nil, err)
+		_, _, entrySha1 := archiveData(t, cas, nodes, map[string]string{"dir/file1": "content1"})
+		_, err = nodes.AddEntry(&Node{Entry: entrySha1, Comment: comment}, "commented")
+		ut.AssertEqual(t, nil, err)
+
+		body := request(t, nodes, "/tags/commented/", 200, "")
+		if markdown {
+			ut.AssertEqual(t, true, strings.Contains(body, "<em>notes</em>"))
+			ut.AssertEqual(t, true, strings.Contains(body, "<a href=\"http://example.com\">link</a>"))
+			// The raw HTML is not rendered.
+			ut.AssertEqual(t, false, strings.Contains(body, "<b>"))
+		} else {
+			ut.AssertEqual(t, true, strings.Contains(body, "<pre class=\"comment\">Some *notes* &lt;b&gt;x&lt;/b&gt;\n"))
+		}
+		ut.AssertEqual(t, true, strings.Contains(body, "<a href=\"dir/\">dir/</a>"))
+
+		// The same entry is served without the comment for the other node, and
+		// the comment is only shown at the root.
+		body = request(t, nodes, "/tags/fictious/", 200, "")
+		ut.AssertEqual(t, true, strings.Contains(body, "useful comment"))
+		ut.AssertEqual(t, false, strings.Contains(body, "notes"))
+		body = request(t, nodes, "/tags/commented/dir/", 200, "")
+		ut.AssertEqual(t, false, strings.Contains(body, "notes"))
+	}
+}
+
+func TestNodesTableUnsafeTag(t *testing.T) {
+	t.Parallel()
+	for _, symlinks := range tagModes {
+		testUnsafeTag(t, symlinks)
+	}
+}
+
+func testUnsafeTag(t *testing.T, symlinks bool) {
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes := loadTestNodesTable(t, tempData, cas, NodesTableOptions{}, symlinks)
+	tagsDir := filepath.Join(tempData, nodesName, tagsName)
+
+	data := []struct {
+		tag      string
+		fileName string
+	}{
+		{"my backup", "my backup"},
+		{"c:drive", "c%3Adrive"},
+		{"日本語", "日本語"},
+		{"50%", "50%25"},
+		{"a*b?", "a%2Ab%3F"},
+		{"end.", "end%2E"},
+	}
+	expected := []string{}
+	for i, d := range data {
+		name, err := nodes.AddEntry(&Node{Entry: "0", Comment: d.tag}, d.tag)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, true, strings.HasSuffix(name, "_"+d.tag))
+		expected = append(expected, name, filepath.Join(tagsName, d.tag))
+
+		_, err = os.Lstat(filepath.Join(tagsDir, d.fileName))
+		ut.AssertEqualIndex(t, i, nil, err)
+		for _, item := range []string{name, filepath.Join(tagsName, d.tag)} {
+			f, err := nodes.Open(item)
+			ut.AssertEqualIndex(t, i, nil, err)
+			node := &Node{}
+			ut.AssertEqualIndex(t, i, nil, LoadReaderAsJSON(f, node))
+			_ = f.Close()
+			ut.AssertEqualIndex(t, i, d.tag, node.Comment)
+		}
+		node, rest, err := nodes.(*nodesTable).getNode(tagsName + "/" + d.tag + "/")
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, d.tag, node.Comment)
+		ut.AssertEqualIndex(t, i, "", rest)
+	}
+	sort.Strings(expected)
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+
+	ut.AssertEqual(t, nil, nodes.Remove(filepath.Join(tagsName, "c:drive")))
+	_, err = os.Lstat(filepath.Join(tagsDir, "c%3Adrive"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	_, err = nodes.AddEntry(&Node{Entry: "0"}, "a/b")
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestNodesTableLegacyTag(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("File names can't contain a colon")
+	}
+	for _, symlinks := range tagModes {
+		testLegacyTag(t, symlinks)
+	}
+}
+
+func testLegacyTag(t *testing.T, symlinks bool) {
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
 	cas := MakeMemoryCasTable()
-	nodes, err := LoadLocalNodesTable(tempData, cas)
+	nodes := loadTestNodesTable(t, tempData, cas, NodesTableOptions{}, symlinks)
+	name, err := nodes.AddEntry(&Node{Entry: "0"}, "x")
 	ut.AssertEqual(t, nil, err)
 
-	testNodesTableImpl(t, cas, nodes)
+	// A tag written before the names were escaped is still found.
+	tagsDir := filepath.Join(tempData, nodesName, tagsName)
+	ut.AssertEqual(t, nil, os.Rename(filepath.Join(tagsDir, "x"), filepath.Join(tagsDir, "a:b")))
+	f, err := nodes.Open(filepath.Join(tagsName, "a:b"))
+	ut.AssertEqual(t, nil, err)
+	_ = f.Close()
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{name, filepath.Join(tagsName, "a:b")}, items)
+
+	// An old name that happens to contain valid percent-encoding isn't decoded.
+	ut.AssertEqual(t, nil, os.Rename(filepath.Join(tagsDir, "a:b"), filepath.Join(tagsDir, "a%41")))
+	f, err = nodes.Open(filepath.Join(tagsName, "a%41"))
+	ut.AssertEqual(t, nil, err)
+	_ = f.Close()
+	items, err = EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{name, filepath.Join(tagsName, "a%41")}, items)
+	ut.AssertEqual(t, nil, os.Rename(filepath.Join(tagsDir, "a%41"), filepath.Join(tagsDir, "a:b")))
+
+	// It is replaced by the escaped one once the tag is updated.
+	_, err = nodes.AddEntry(&Node{Entry: "1"}, "a:b")
+	ut.AssertEqual(t, nil, err)
+	_, err = os.Lstat(filepath.Join(tagsDir, "a:b"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(tagsDir, "a%3Ab"))
+	ut.AssertEqual(t, nil, err)
+}
+
+func TestNodesTableNameTemplate(t *testing.T) {
+	t.Parallel()
+	for _, packed := range []bool{false, true} {
+		tempData := makeTempDir(t, "nodes")
+		defer removeDir(t, tempData)
+		cas := MakeMemoryCasTable()
+		opts := NodesTableOptions{Packed: packed, NameTemplate: `{{.Name}}-{{.Time.Format "20060102T150405Z"}}`}
+		nodes, err := LoadLocalNodesTable(tempData, cas, opts)
+		ut.AssertEqual(t, nil, err)
+		name, err := nodes.AddEntry(&Node{Entry: "0"}, "backup")
+		ut.AssertEqual(t, nil, err)
+		base := filepath.Base(name)
+		ut.AssertEqualf(t, true, strings.HasPrefix(base, "backup-") && strings.HasSuffix(base, "Z"), "Unexpected name %s", name)
+		second, err := nodes.AddEntry(&Node{Entry: "1"}, "backup")
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, false, name == second)
+
+		items, err := EnumerateNodesAsList(nodes)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, 3, len(items))
+		f, err := nodes.Open(filepath.Join(tagsName, "backup"))
+		ut.AssertEqual(t, nil, err)
+		node := &Node{}
+		ut.AssertEqual(t, nil, LoadReaderAsJSON(f, node))
+		_ = f.Close()
+		ut.AssertEqual(t, "1", node.Entry)
+		// The tag and the creation time can't be parsed from the name so they are
+		// recorded in the node, and kept when it is updated.
+		ut.AssertEqual(t, "backup", node.Tag)
+		ut.AssertEqual(t, true, node.Timestamp != 0)
+		ut.AssertEqual(t, nil, nodes.UpdateEntry(second, &Node{Entry: "2"}))
+		f, err = nodes.Open(second)
+		ut.AssertEqual(t, nil, err)
+		updated := &Node{}
+		ut.AssertEqual(t, nil, LoadReaderAsJSON(f, updated))
+		_ = f.Close()
+		ut.AssertEqual(t, &Node{Entry: "2", Timestamp: node.Timestamp, Tag: "backup"}, updated)
+	}
+
+	// Nothing is added to the nodes named with the default template.
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	nodes, err := LoadLocalNodesTable(tempData, MakeMemoryCasTable(), NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	name, err := nodes.AddEntry(&Node{Entry: "0"}, "backup")
+	ut.AssertEqual(t, nil, err)
+	f, err := nodes.Open(name)
+	ut.AssertEqual(t, nil, err)
+	node := &Node{}
+	ut.AssertEqual(t, nil, LoadReaderAsJSON(f, node))
+	_ = f.Close()
+	ut.AssertEqual(t, &Node{Entry: "0"}, node)
+}
+
+func TestMakeNodeNamer(t *testing.T) {
+	t.Parallel()
+	n, err := makeNodeNamer("", "host")
+	ut.AssertEqual(t, nil, err)
+	name, err := n.name(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), "tag")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "host_2024-01-02_15-04-05_tag", name)
+
+	for i, text := range []string{"{{.Name", "{{.Unknown}}", "{{.Name}}/x", "{{if false}}x{{end}}"} {
+		_, err := makeNodeNamer(text, "host")
+		ut.AssertEqualIndex(t, i, false, err == nil)
+	}
+}
+
+func TestNodesTableConcurrentServe(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	var names []string
+	for i := 0; i < 20; i++ {
+		tree := map[string]string{fmt.Sprintf("file%d", i): "content1", "dir1/file2": "content2"}
+		_, name, _ := archiveData(t, cas, nodes, tree)
+		names = append(names, name)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := filepath.ToSlash(names[(i+j)%len(names)])
+				request(t, nodes, "/"+name+"/dir1/file2", 200, "content2")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// BenchmarkNodesTableServeParallel serves files of many nodes from concurrent
+// readers, which share the node and entry caches.
+func BenchmarkNodesTableServeParallel(b *testing.B) {
+	tempData := makeTempDir(b, "nodes")
+	defer removeDir(b, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(b, nil, err)
+	var paths []string
+	for i := 0; i < 8; i++ {
+		tree := map[string]string{fmt.Sprintf("file%d", i): "content1", "dir1/file2": "content2"}
+		_, name, _ := archiveData(b, cas, nodes, tree)
+		paths = append(paths, "/"+filepath.ToSlash(name)+"/dir1/file2")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			nodes.ServeHTTP(w, httptest.NewRequest("GET", paths[i%len(paths)], nil))
+			if w.Code != 200 {
+				b.Fatalf("Unexpected code %d", w.Code)
+			}
+			i++
+		}
+	})
 }
@@ -0,0 +1,422 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maruel/interrupt"
+)
+
+// The packed nodes are stored in a separate directory from the unpacked ones.
+const packedNodesName = "nodes.pack"
+
+// segmentSize is the size after which a new segment file is started.
+const segmentSize = 4 * 1024 * 1024
+
+// packedRecord is one line of a segment file. It either sets the content of
+// a node, makes a tag point to a node or removes a node or a tag. Names use
+// "/" as the path separator.
+type packedRecord struct {
+	Name    string          `json:"n"`
+	Data    json.RawMessage `json:"d,omitempty"`
+	Target  string          `json:"t,omitempty"`
+	Removed bool            `json:"r,omitempty"`
+}
+
+// packedNodesTable stores the nodes as records appended to segment files
+// instead of one file per node. The segments are the log of all the changes;
+// the index of the live nodes and tags is rebuilt in memory by replaying them
+// and is refreshed before each operation to see the records appended by other
+// processes.
+type packedNodesTable struct {
+	packDir  string
+	cas      CasTable
+	namer    *nodeNamer
+	fsync    bool
+	markdown bool
+
+	lock sync.Mutex
+	// nodes and tags are the index, keyed by "/" separated names.
+	nodes map[string][]byte
+	tags  map[string]string
+	// read is the number of bytes replayed in each segment.
+	read []int64
+	// partial is true when the last segment ends with an incomplete record,
+	// e.g. after a crash. The next record is written to a new segment.
+	partial bool
+}
+
+// hasPackedNodes returns true if rootDir already uses packed nodes.
+func hasPackedNodes(rootDir string) bool {
+	return isDir(filepath.Join(rootDir, packedNodesName))
+}
+
+func loadPackedNodesTable(rootDir string, cas CasTable, opts NodesTableOptions, namer *nodeNamer) (NodesTable, error) {
+	packDir := filepath.Join(rootDir, packedNodesName)
+	if !isDir(packDir) {
+		// Don't hide the nodes already archived.
+		if names, _ := readDirNames(filepath.Join(rootDir, nodesName)); len(names) != 0 {
+			return nil, fmt.Errorf("LoadNodesTable(%s): Can't pack the nodes of a root that already has unpacked nodes", rootDir)
+		}
+		if err := os.Mkdir(packDir, 0750); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("LoadNodesTable(%s): Failed to create %s: %s\n", rootDir, packDir, err)
+		}
+	}
+	p := &packedNodesTable{
+		packDir:  packDir,
+		cas:      cas,
+		namer:    namer,
+		fsync:    opts.Fsync,
+		markdown: opts.Markdown,
+		nodes:    map[string][]byte{},
+		tags:     map[string]string{},
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *packedNodesTable) segmentPath(i int) string {
+	return filepath.Join(p.packDir, fmt.Sprintf("%06d.seg", i))
+}
+
+// refresh replays the records appended since the last call. A record that
+// can't be decoded is skipped and sets the fsck bit. p.lock must be held.
+func (p *packedNodesTable) refresh() error {
+	for i := 0; ; i++ {
+		if i == len(p.read) {
+			if _, err := os.Stat(p.segmentPath(i)); os.IsNotExist(err) {
+				return nil
+			}
+			p.read = append(p.read, 0)
+		}
+		f, err := os.Open(p.segmentPath(i))
+		if err != nil {
+			return fmt.Errorf("Failed to open %s: %s", p.segmentPath(i), err)
+		}
+		_, err = f.Seek(p.read[i], io.SeekStart)
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(f)
+		}
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %s", p.segmentPath(i), err)
+		}
+		// Only complete records are replayed.
+		end := bytes.LastIndexByte(data, '\n') + 1
+		for _, line := range bytes.Split(data[:end], []byte{'\n'}) {
+			if len(line) != 0 {
+				p.apply(line)
+			}
+		}
+		p.read[i] += int64(end)
+		p.partial = end != len(data)
+	}
+}
+
+// apply updates the index with one record.
+func (p *packedNodesTable) apply(line []byte) {
+	r := packedRecord{}
+	if err := json.Unmarshal(line, &r); err != nil || r.Name == "" {
+		p.cas.SetFsckBit()
+		return
+	}
+	if r.Removed {
+		delete(p.nodes, r.Name)
+		delete(p.tags, r.Name)
+	} else if r.Target != "" {
+		p.tags[r.Name] = r.Target
+	} else {
+		p.nodes[r.Name] = r.Data
+	}
+}
+
+// write appends the record to the last segment, or to a new one when it is
+// full, and replays it. Each record is written at once so concurrent writers
+// don't interleave. p.lock must be held.
+func (p *packedNodesTable) write(r *packedRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	i := len(p.read) - 1
+	if i == -1 || p.partial || p.read[i] >= segmentSize {
+		i++
+	}
+	segPath := p.segmentPath(i)
+	f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", segPath, err)
+	}
+	if _, err = f.Write(append(line, '\n')); err == nil && p.fsync {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %s", segPath, err)
+	}
+	if p.fsync && i == len(p.read) {
+		syncDir(p.packDir)
+	}
+	return p.refresh()
+}
+
+// resolve returns the content of the node or the tag name.
+func (p *packedNodesTable) resolve(name string) ([]byte, bool) {
+	if target, ok := p.tags[name]; ok {
+		name = target
+	}
+	data, ok := p.nodes[name]
+	return data, ok
+}
+
+func (p *packedNodesTable) AddEntry(node *Node, name string) (string, error) {
+	now := time.Now().UTC()
+	data, err := json.Marshal(p.namer.stamp(node, now, name))
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	monthName := now.Format("2006-01")
+	baseName, err := p.namer.name(now, name)
+	if err != nil {
+		return "", err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refresh(); err != nil {
+		return "", err
+	}
+	nodeName := ""
+	for suffix := 0; ; suffix++ {
+		nodeName = monthName + "/" + baseName
+		if suffix != 0 {
+			nodeName += fmt.Sprintf("(%d)", suffix)
+		}
+		if _, ok := p.nodes[nodeName]; !ok {
+			break
+		}
+	}
+	if err := p.write(&packedRecord{Name: nodeName, Data: data}); err != nil {
+		return "", err
+	}
+	if err := p.write(&packedRecord{Name: tagsName + "/" + name, Target: nodeName}); err != nil {
+		return "", err
+	}
+	return filepath.FromSlash(nodeName), nil
+}
+
+func (p *packedNodesTable) UpdateEntry(name string, node *Node) error {
+	name = filepath.ToSlash(name)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	old, ok := p.nodes[name]
+	if !ok {
+		return fmt.Errorf("Failed to find node %s", name)
+	}
+	data, err := json.Marshal(keepStamp(node, old))
+	if err != nil {
+		return fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	return p.write(&packedRecord{Name: name, Data: data})
+}
+
+func (p *packedNodesTable) SetLabel(label, name string) error {
+	if err := checkLabel(label); err != nil {
+		return err
+	}
+	name = filepath.ToSlash(name)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	if _, ok := p.nodes[name]; !ok {
+		return fmt.Errorf("Failed to find node %s", name)
+	}
+	return p.write(&packedRecord{Name: tagsName + "/" + labelsName + "/" + label, Target: name})
+}
+
+func (p *packedNodesTable) Enumerate(cancel <-chan struct{}) <-chan EnumerationEntry {
+	c := make(chan EnumerationEntry)
+	go func() {
+		defer close(c)
+		p.lock.Lock()
+		err := p.refresh()
+		keys := make([]string, 0, len(p.nodes)+len(p.tags))
+		for k := range p.nodes {
+			keys = append(keys, k)
+		}
+		for k := range p.tags {
+			keys = append(keys, k)
+		}
+		p.lock.Unlock()
+		sort.Strings(keys)
+		if err != nil {
+			select {
+			case c <- EnumerationEntry{Error: err}:
+			case <-cancel:
+			}
+			return
+		}
+		for _, k := range keys {
+			select {
+			case <-interrupt.Channel:
+				return
+			case c <- EnumerationEntry{Item: filepath.FromSlash(k)}:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (p *packedNodesTable) Open(item string) (ReadSeekCloser, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	data, ok := p.resolve(filepath.ToSlash(item))
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: item, Err: os.ErrNotExist}
+	}
+	return closableBuffer{bytes.NewReader(data)}, nil
+}
+
+// Remove appends a record removing the node or the tag. The content of a
+// removed node stays in its segment.
+func (p *packedNodesTable) Remove(name string) error {
+	name = filepath.ToSlash(name)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.refresh(); err != nil {
+		return err
+	}
+	_, isNode := p.nodes[name]
+	_, isTag := p.tags[name]
+	if !isNode && !isTag {
+		return os.ErrNotExist
+	}
+	return p.write(&packedRecord{Name: name, Removed: true})
+}
+
+// ServeHTTP serves the nodes and the tags as a virtual tree, like nodesTable.
+func (p *packedNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.Error(w, "Internal failure. nodesTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	name := r.URL.Path[1:]
+	p.lock.Lock()
+	if err := p.refresh(); err != nil {
+		p.lock.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Nodes are "<month>/<name>", tags "tags/<name>" and labels
+	// "tags/labels/<name>".
+	var data []byte
+	rest := ""
+	parts := strings.Split(name, "/")
+	for i := 2; i <= len(parts) && i <= 3 && data == nil; i++ {
+		key := strings.Join(parts[:i], "/")
+		if d, ok := p.resolve(key); ok {
+			data, rest = d, name[len(key):]
+		}
+	}
+	items := []string{}
+	if data == nil {
+		prefix := strings.TrimSuffix(name, "/") + "/"
+		if name == "" {
+			prefix = ""
+		}
+		seen := map[string]bool{}
+		add := func(k string) {
+			if strings.HasPrefix(k, prefix) {
+				v := strings.SplitAfterN(k[len(prefix):], "/", 2)[0]
+				if !seen[v] {
+					seen[v] = true
+					items = append(items, v)
+				}
+			}
+		}
+		for k := range p.nodes {
+			add(k)
+		}
+		for k := range p.tags {
+			add(k)
+		}
+	}
+	p.lock.Unlock()
+
+	if data != nil {
+		if rest == "" {
+			localRedirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+		node := &Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			p.corruption(w, "Failed to load Node %s: %s", name, err)
+			return
+		}
+		entry, err := LoadEntry(p.cas, node.Entry)
+		if err != nil {
+			p.corruption(w, "Failed to load Entry %s: %s", node.Entry, err)
+			return
+		}
+		r.URL.Path = rest
+		entryFs := entryFileSystem{cas: p.cas, entry: entry, header: renderComment(node.Comment, p.markdown)}
+		entryFs.ServeHTTP(w, r)
+		return
+	}
+	if name != "" && len(items) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if name != "" && !strings.HasSuffix(name, "/") {
+		localRedirect(w, r, path.Base(r.URL.Path)+"/")
+		return
+	}
+	dirList(w, items)
+}
+
+// Either failed to load a Node or an Entry.
+func (p *packedNodesTable) corruption(w http.ResponseWriter, format string, a ...interface{}) {
+	p.cas.SetFsckBit()
+	str := fmt.Sprintf(format, a...)
+	http.Error(w, "Internal failure: "+str, http.StatusNotImplemented)
+}
@@ -0,0 +1,102 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestPackedNodesTable(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{Fsync: true, Packed: true})
+	ut.AssertEqual(t, nil, err)
+	testNodesTableImpl(t, cas, nodes)
+}
+
+func TestPackedNodesTableUpdate(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{Packed: true})
+	ut.AssertEqual(t, nil, err)
+	testNodesTableUpdate(t, cas, nodes)
+}
+
+func TestPackedNodesTableLabel(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{Packed: true})
+	ut.AssertEqual(t, nil, err)
+	testNodesTableLabel(t, cas, nodes)
+}
+
+func TestPackedNodesTableReload(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{Packed: true})
+	ut.AssertEqual(t, nil, err)
+	_, node1, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content2"})
+	ut.AssertEqual(t, nil, nodes.Remove(node1))
+	ut.AssertEqual(t, os.ErrNotExist, nodes.Remove(node1))
+	expected := []string{node2, filepath.Join(tagsName, "fictious")}
+
+	// A crash left an incomplete record. The root keeps using packed nodes
+	// without being told to.
+	segPath := filepath.Join(tempData, packedNodesName, "000000.seg")
+	f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_APPEND, 0)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Write([]byte(`{"n":"incomplete`))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	nodes, err = LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, false, cas.GetFsckBit())
+	request(t, nodes, "/"+filepath.ToSlash(node2)+"/file1", 200, "content2")
+
+	// The next record goes to a new segment and is seen by the first instance.
+	_, node3, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content3"})
+	_, err = os.Stat(filepath.Join(tempData, packedNodesName, "000001.seg"))
+	ut.AssertEqual(t, nil, err)
+	items, err = EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	expected = []string{node2, node3}
+	sort.Strings(expected)
+	ut.AssertEqual(t, append(expected, filepath.Join(tagsName, "fictious")), items)
+	request(t, nodes, "/"+tagsName+"/fictious/file1", 200, "content3")
+}
+
+func TestPackedNodesTableUnpackedRoot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	_, err = LoadLocalNodesTable(tempData, cas, NodesTableOptions{Packed: true})
+	ut.AssertEqual(t, false, err == nil)
+}
@@ -18,6 +18,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -31,6 +32,69 @@ func TestFakeNodesTable(t *testing.T) {
 	testNodesTableImpl(t, cas, MakeMemoryNodesTable(cas))
 }
 
+func TestFakeNodesTableUpdate(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	testNodesTableUpdate(t, cas, MakeMemoryNodesTable(cas))
+}
+
+func TestFakeNodesTableLabel(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	testNodesTableLabel(t, cas, MakeMemoryNodesTable(cas))
+}
+
+func TestFakeNodesTableEnumerateSorted(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	for _, name := range []string{"c", "a", "b"} {
+		_, err := nodes.AddEntry(&Node{Entry: Sha1Bytes([]byte(name))}, name)
+		ut.AssertEqual(t, nil, err)
+	}
+	actual := []string{}
+	for v := range nodes.Enumerate(nil) {
+		actual = append(actual, v.Item)
+	}
+	ut.AssertEqual(t, 6, len(actual))
+	ut.AssertEqual(t, true, sort.StringsAreSorted(actual))
+}
+
+func TestFakeNodesTableSnapshot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes_snapshot")
+	defer removeDir(t, tempData)
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	name, err := nodes.AddEntry(&Node{Entry: Sha1Bytes([]byte("a"))}, "a")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, nodes.SetLabel("keep", name))
+	ut.AssertEqual(t, nil, cas.(Snapshotter).SnapshotTo(tempData))
+	ut.AssertEqual(t, nil, nodes.(Snapshotter).SnapshotTo(tempData))
+	expected, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+
+	cas2 := MakeMemoryCasTable()
+	ut.AssertEqual(t, nil, cas2.(Snapshotter).RestoreFrom(tempData))
+	nodes2 := MakeMemoryNodesTable(cas2)
+	ut.AssertEqual(t, nil, nodes2.(Snapshotter).RestoreFrom(tempData))
+	actual, err := EnumerateNodesAsList(nodes2)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+
+	// The tags are restored too, so updating the node updates its tags.
+	ut.AssertEqual(t, nil, nodes2.UpdateEntry(name, &Node{Entry: Sha1Bytes([]byte("b"))}))
+	for _, tag := range []string{name, "tags/a", "tags/labels/keep"} {
+		f, err := nodes2.Open(tag)
+		ut.AssertEqual(t, nil, err)
+		node := &Node{}
+		ut.AssertEqual(t, nil, LoadReaderAsJSON(f, node))
+		ut.AssertEqual(t, nil, f.Close())
+		ut.AssertEqual(t, Sha1Bytes([]byte("b")), node.Entry)
+	}
+	ut.AssertEqual(t, false, nodes2.(Snapshotter).RestoreFrom(filepath.Join(tempData, "missing")) == nil)
+}
+
 func request(t testing.TB, nodes NodesTable, path string, expectedCode int, expectedBody string) string {
 	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBufferString("GET " + path + " HTTP/1.1\r\nHost: test\r\n\r\n")))
 	ut.AssertEqual(t, nil, err)
@@ -46,8 +110,8 @@ func request(t testing.TB, nodes NodesTable, path string, expectedCode int, expe
 	return body
 }
 
-// marshalData returns the tree of sha1s and the json encoded Node as bytes.
-func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byte) {
+// makeEntryTree returns the tree of sha1s and the Entry describing tree.
+func makeEntryTree(tree map[string]string) (map[string]string, *Entry) {
 	sha1tree := map[string]string{}
 	entries := &Entry{}
 	for k, v := range tree {
@@ -72,8 +136,12 @@ func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byt
 			Size: int64(len(v)),
 		}
 	}
+	return sha1tree, entries
+}
 
-	// Then process entries itself.
+// marshalData returns the tree of sha1s and the json encoded Entry as bytes.
+func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byte) {
+	sha1tree, entries := makeEntryTree(tree)
 	data, err := json.Marshal(entries)
 	ut.AssertEqual(t, nil, err)
 	return sha1tree, data
@@ -93,7 +161,7 @@ func archiveData(t testing.TB, cas CasTable, nodes NodesTable, tree map[string]s
 
 	// And finally add the node.
 	now := time.Now().UTC()
-	nodeName, err := nodes.AddEntry(&Node{entrySha1, "useful comment"}, "fictious")
+	nodeName, err := nodes.AddEntry(&Node{Entry: entrySha1, Comment: "useful comment"}, "fictious")
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqualf(t, true, strings.HasPrefix(nodeName, now.Format("2006-01")+string(filepath.Separator)), "Invalid node name %s", nodeName)
 	return sha1tree, nodeName, entrySha1
@@ -125,3 +193,57 @@ func testNodesTableImpl(t testing.TB, cas CasTable, nodes NodesTable) {
 	request(t, nodes, "/"+name+"/dir1/dir2/file3", 404, "")
 	request(t, nodes, "/"+name+"/dir1/dir2", 301, "")
 }
+
+func testNodesTableUpdate(t testing.TB, cas CasTable, nodes NodesTable) {
+	_, nodeName, entrySha1 := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	tag := tagsName + "/fictious"
+	ut.AssertEqual(t, nil, nodes.UpdateEntry(nodeName, &Node{Entry: entrySha1, Comment: "new"}))
+	for _, name := range []string{nodeName, tag} {
+		f, err := nodes.Open(name)
+		ut.AssertEqual(t, nil, err)
+		node := &Node{}
+		ut.AssertEqual(t, nil, LoadReaderAsJSON(f, node))
+		f.Close()
+		ut.AssertEqual(t, Node{Entry: entrySha1, Comment: "new"}, *node)
+	}
+	request(t, nodes, "/"+filepath.ToSlash(nodeName)+"/file1", 200, "content1")
+
+	// Tags and unknown nodes can't be updated.
+	ut.AssertEqual(t, true, nodes.UpdateEntry(tag, &Node{Entry: entrySha1}) != nil)
+	ut.AssertEqual(t, true, nodes.UpdateEntry("missing", &Node{Entry: entrySha1}) != nil)
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(items))
+}
+
+func testNodesTableLabel(t testing.TB, cas CasTable, nodes NodesTable) {
+	_, node1, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content2"})
+	label := tagsName + "/" + labelsName + "/release"
+	ut.AssertEqual(t, nil, nodes.SetLabel("release", node1))
+	request(t, nodes, "/"+label+"/file1", 200, "content1")
+
+	// A label is moved explicitly, not by AddEntry().
+	archiveData(t, cas, nodes, map[string]string{"file1": "content3"})
+	request(t, nodes, "/"+label+"/file1", 200, "content1")
+	ut.AssertEqual(t, nil, nodes.SetLabel("release", node2))
+	request(t, nodes, "/"+label+"/file1", 200, "content2")
+
+	// It follows the updates of its node.
+	ut.AssertEqual(t, nil, nodes.UpdateEntry(node2, &Node{Entry: Sha1Bytes([]byte("x")), Comment: "new"}))
+	f, err := nodes.Open(label)
+	ut.AssertEqual(t, nil, err)
+	node := &Node{}
+	ut.AssertEqual(t, nil, LoadReaderAsJSON(f, node))
+	f.Close()
+	ut.AssertEqual(t, "new", node.Comment)
+
+	ut.AssertEqual(t, true, nodes.SetLabel("../x", node1) != nil)
+	ut.AssertEqual(t, true, nodes.SetLabel("", node1) != nil)
+	ut.AssertEqual(t, true, nodes.SetLabel("x", "missing") != nil)
+	ut.AssertEqual(t, true, nodes.SetLabel("x", tagsName+"/fictious") != nil)
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 5, len(items))
+	ut.AssertEqual(t, label, filepath.ToSlash(items[4]))
+}
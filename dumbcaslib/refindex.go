@@ -0,0 +1,199 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RefIndex counts how many nodes reference each CAS object so orphans can be
+// found without walking every node.
+//
+// Each node counts once per distinct object in its tree, including the entry
+// tree object itself. Adding and removing the same node is idempotent.
+type RefIndex struct {
+	// Nodes maps each indexed node name to its entry tree object.
+	Nodes map[string]string
+	// Refs is the number of indexed nodes referencing each object. Objects
+	// without reference are not kept.
+	Refs map[string]int
+	// Pending are the orphans found by gc -incremental that were not removed
+	// because of its budget. The next run removes them.
+	Pending []string
+}
+
+// MakeRefIndex returns an empty RefIndex.
+func MakeRefIndex() *RefIndex {
+	return &RefIndex{Nodes: map[string]string{}, Refs: map[string]int{}}
+}
+
+// objects returns the distinct objects referenced by the entry tree entrySha1.
+func objects(cas CasTable, entrySha1 string) (map[string]bool, error) {
+	entry, err := LoadEntry(cas, entrySha1)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load entry %s: %s", entrySha1, err)
+	}
+	out := map[string]bool{entrySha1: true}
+	_ = entry.Walk(func(relPath string, e *Entry) error {
+		if e.Sha1 != "" {
+			out[e.Sha1] = true
+		}
+		return nil
+	})
+	return out, nil
+}
+
+// AddNode references the objects of the node and returns the objects that are
+// not referenced anymore, sorted. It is a no-op if the node is already indexed
+// with the same entry. A node indexed with another entry has its new objects
+// referenced before its old ones are dereferenced so the shared objects are
+// never orphaned. Nothing is modified on error.
+func (r *RefIndex) AddNode(cas CasTable, nodeName, entrySha1 string) ([]string, error) {
+	old, ok := r.Nodes[nodeName]
+	if ok && old == entrySha1 {
+		return []string{}, nil
+	}
+	items, err := objects(cas, entrySha1)
+	if err != nil {
+		return nil, err
+	}
+	var oldItems map[string]bool
+	if ok {
+		if oldItems, err = objects(cas, old); err != nil {
+			return nil, err
+		}
+	}
+	for item := range items {
+		r.Refs[item]++
+	}
+	r.Nodes[nodeName] = entrySha1
+	return r.release(oldItems), nil
+}
+
+// RemoveNode dereferences the objects of the node and returns the ones that
+// are not referenced anymore, sorted. It is a no-op if the node is not
+// indexed. The entry tree object of the node must still be in the CAS. Nothing
+// is modified on error.
+func (r *RefIndex) RemoveNode(cas CasTable, nodeName string) ([]string, error) {
+	entrySha1, ok := r.Nodes[nodeName]
+	if !ok {
+		return []string{}, nil
+	}
+	items, err := objects(cas, entrySha1)
+	if err != nil {
+		return nil, err
+	}
+	delete(r.Nodes, nodeName)
+	return r.release(items), nil
+}
+
+// RefChange is a change of a node journaled since the RefIndex was last
+// saved. An empty Entry means the node was removed.
+type RefChange struct {
+	Node  string
+	Entry string
+}
+
+// Fold applies the changes in order and returns the objects that were
+// dereferenced to zero on the way. They may have been referenced again by a
+// later change so the caller must check Refs. The RefIndex is partially
+// modified on error.
+func (r *RefIndex) Fold(cas CasTable, changes []RefChange) ([]string, error) {
+	orphans := []string{}
+	for _, c := range changes {
+		var o []string
+		var err error
+		if c.Entry == "" {
+			o, err = r.RemoveNode(cas, c.Node)
+		} else {
+			o, err = r.AddNode(cas, c.Node, c.Entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, o...)
+	}
+	return orphans, nil
+}
+
+// release decrements items and returns the ones not referenced anymore.
+func (r *RefIndex) release(items map[string]bool) []string {
+	orphans := []string{}
+	for item := range items {
+		if r.Refs[item]--; r.Refs[item] <= 0 {
+			delete(r.Refs, item)
+			orphans = append(orphans, item)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// RefIndexTable persists a RefIndex and a journal of the node changes made
+// since, so a node can be indexed without rewriting the whole RefIndex.
+type RefIndexTable interface {
+	// Load returns the saved RefIndex or nil if none was saved yet. The journal
+	// is not applied.
+	Load() (*RefIndex, error)
+	// Save replaces the saved RefIndex and clears the journal.
+	Save(r *RefIndex) error
+	// Append journals a change. It is a no-op if no RefIndex was saved yet.
+	Append(change RefChange) error
+	// Journal returns the changes appended since the last Save, in order.
+	Journal() ([]RefChange, error)
+}
+
+type memoryRefIndexTable struct {
+	index   *RefIndex
+	changes []RefChange
+}
+
+// MakeMemoryRefIndexTable returns an in-memory RefIndexTable. Useful for
+// testing.
+func MakeMemoryRefIndexTable() RefIndexTable {
+	return &memoryRefIndexTable{}
+}
+
+func (m *memoryRefIndexTable) Load() (*RefIndex, error) {
+	if m.index == nil {
+		return nil, nil
+	}
+	return m.index.copy(), nil
+}
+
+func (m *memoryRefIndexTable) Save(r *RefIndex) error {
+	m.index = r.copy()
+	m.changes = nil
+	return nil
+}
+
+func (m *memoryRefIndexTable) Append(change RefChange) error {
+	if m.index != nil {
+		m.changes = append(m.changes, change)
+	}
+	return nil
+}
+
+func (m *memoryRefIndexTable) Journal() ([]RefChange, error) {
+	return append([]RefChange{}, m.changes...), nil
+}
+
+func (r *RefIndex) copy() *RefIndex {
+	out := MakeRefIndex()
+	for k, v := range r.Nodes {
+		out.Nodes[k] = v
+	}
+	for k, v := range r.Refs {
+		out.Refs[k] = v
+	}
+	out.Pending = append([]string(nil), r.Pending...)
+	return out
+}
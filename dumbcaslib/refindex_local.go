@@ -0,0 +1,117 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	refIndexName   = "refcount.gob"
+	refJournalName = "refcount.journal"
+)
+
+type refIndexTable struct {
+	filePath    string
+	journalPath string
+}
+
+// MakeLocalRefIndexTable returns a RefIndexTable stored as rootDir/refcount.gob
+// with its journal in rootDir/refcount.journal.
+func MakeLocalRefIndexTable(rootDir string) RefIndexTable {
+	return &refIndexTable{filepath.Join(rootDir, refIndexName), filepath.Join(rootDir, refJournalName)}
+}
+
+func (r *refIndexTable) Load() (*RefIndex, error) {
+	f, err := os.Open(r.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to access %s: %s", r.filePath, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	// Like the cache, gob is used since the index can be large.
+	index := MakeRefIndex()
+	if err := gob.NewDecoder(f).Decode(index); err != nil {
+		return nil, fmt.Errorf("Failed to load %s: %s", r.filePath, err)
+	}
+	return index, nil
+}
+
+// Save writes to a temporary file first so a crash never leaves a partial
+// index behind.
+func (r *refIndexTable) Save(index *RefIndex) error {
+	if err := saveGob(r.filePath, index); err != nil {
+		return err
+	}
+	// If the journal can't be removed, replaying it is harmless since the
+	// changes are applied in order.
+	if err := os.Remove(r.journalPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to clear %s: %s", r.journalPath, err)
+	}
+	return nil
+}
+
+// Append writes the change as one line of JSON with a single write so
+// concurrent archives don't interleave.
+func (r *refIndexTable) Append(change RefChange) error {
+	if _, err := os.Stat(r.filePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed to access %s: %s", r.filePath, err)
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.journalPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", r.journalPath, err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %s", r.journalPath, err)
+	}
+	return nil
+}
+
+// Journal skips the lines that can't be decoded, like a partial last line
+// left by a crash. The change is lost but gc -incremental still finds the
+// node by enumerating the nodes.
+func (r *refIndexTable) Journal() ([]RefChange, error) {
+	data, err := ioutil.ReadFile(r.journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RefChange{}, nil
+		}
+		return nil, fmt.Errorf("Failed to read %s: %s", r.journalPath, err)
+	}
+	changes := []RefChange{}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		change := RefChange{}
+		if json.Unmarshal(line, &change) == nil && change.Node != "" {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,193 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestRefIndexAddRemove(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	sha1tree1, _, entry1 := archiveData(t, cas, nodes, map[string]string{
+		"file1": "content1",
+		"file2": "shared",
+	})
+	sha1tree2, _, entry2 := archiveData(t, cas, nodes, map[string]string{
+		"dir/file3": "content3",
+		"file2":     "shared",
+	})
+	shared := sha1tree1["file2"]
+
+	r := MakeRefIndex()
+	orphans, err := r.AddNode(cas, "a", entry1)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, orphans)
+	orphans, err = r.AddNode(cas, "b", entry2)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, orphans)
+	ut.AssertEqual(t, 2, r.Refs[shared])
+
+	// Adding the same node again is a no-op.
+	_, err = r.AddNode(cas, "a", entry1)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, r.Refs[shared])
+	ut.AssertEqual(t, 5, len(r.Refs))
+
+	// Only the objects unique to "a" are orphaned.
+	orphans, err = r.RemoveNode(cas, "a")
+	ut.AssertEqual(t, nil, err)
+	expected := []string{entry1, sha1tree1["file1"]}
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, orphans)
+	ut.AssertEqual(t, 1, r.Refs[shared])
+
+	// Removing it again is a no-op.
+	orphans, err = r.RemoveNode(cas, "a")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, orphans)
+
+	orphans, err = r.RemoveNode(cas, "b")
+	ut.AssertEqual(t, nil, err)
+	expected = []string{entry2, sha1tree2["dir/file3"], shared}
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, orphans)
+	ut.AssertEqual(t, MakeRefIndex(), r)
+}
+
+func TestRefIndexChangedEntry(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	sha1tree1, _, entry1 := archiveData(t, cas, nodes, map[string]string{
+		"file1": "content1",
+		"file2": "shared",
+	})
+	sha1tree2, _, entry2 := archiveData(t, cas, nodes, map[string]string{
+		"file2": "shared",
+	})
+
+	r := MakeRefIndex()
+	_, err := r.AddNode(cas, "a", entry1)
+	ut.AssertEqual(t, nil, err)
+	// The shared object is kept while the entry is swapped.
+	orphans, err := r.AddNode(cas, "a", entry2)
+	ut.AssertEqual(t, nil, err)
+	expected := []string{entry1, sha1tree1["file1"]}
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, orphans)
+	ut.AssertEqual(t, map[string]string{"a": entry2}, r.Nodes)
+	ut.AssertEqual(t, map[string]int{entry2: 1, sha1tree2["file2"]: 1}, r.Refs)
+}
+
+func TestRefIndexMissingEntry(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	_, _, entry1 := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+
+	r := MakeRefIndex()
+	_, err := r.AddNode(cas, "a", entry1)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(entry1))
+	// The index is left untouched when the objects can't be found.
+	_, err = r.RemoveNode(cas, "a")
+	ut.AssertEqual(t, true, err != nil)
+	ut.AssertEqual(t, 1, len(r.Nodes))
+	ut.AssertEqual(t, 2, len(r.Refs))
+}
+
+func TestRefIndexTable(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "refindex")
+	defer removeDir(t, tempData)
+
+	for _, table := range []RefIndexTable{MakeMemoryRefIndexTable(), MakeLocalRefIndexTable(tempData)} {
+		r, err := table.Load()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, (*RefIndex)(nil), r)
+		// Nothing is journaled without an index.
+		ut.AssertEqual(t, nil, table.Append(RefChange{"a", "1"}))
+		changes, err := table.Journal()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, []RefChange{}, changes)
+
+		r = MakeRefIndex()
+		r.Nodes["a"] = "1"
+		r.Refs["1"] = 1
+		ut.AssertEqual(t, nil, table.Save(r))
+		actual, err := table.Load()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, r, actual)
+
+		// The journal is kept aside of the index until the next Save.
+		expected := []RefChange{{"b", "2"}, {"a", ""}}
+		for _, c := range expected {
+			ut.AssertEqual(t, nil, table.Append(c))
+		}
+		changes, err = table.Journal()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, expected, changes)
+		actual, err = table.Load()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, r, actual)
+		ut.AssertEqual(t, nil, table.Save(r))
+		changes, err = table.Journal()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, []RefChange{}, changes)
+	}
+}
+
+func TestRefIndexTablePartialJournal(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "refindex")
+	defer removeDir(t, tempData)
+
+	table := MakeLocalRefIndexTable(tempData)
+	ut.AssertEqual(t, nil, table.Save(MakeRefIndex()))
+	ut.AssertEqual(t, nil, table.Append(RefChange{"a", "1"}))
+	// A crash while appending leaves a partial line, which is skipped.
+	f, err := os.OpenFile(filepath.Join(tempData, refJournalName), os.O_WRONLY|os.O_APPEND, 0)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Write([]byte(`{"Node":"b","En`))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	changes, err := table.Journal()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []RefChange{{"a", "1"}}, changes)
+}
+
+func TestRefIndexFold(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	sha1tree1, _, entry1 := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	_, _, entry2 := archiveData(t, cas, nodes, map[string]string{"file2": "content2"})
+
+	r := MakeRefIndex()
+	orphans, err := r.Fold(cas, []RefChange{{"a", entry1}, {"b", entry2}, {"a", ""}})
+	ut.AssertEqual(t, nil, err)
+	expected := []string{entry1, sha1tree1["file1"]}
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, orphans)
+	ut.AssertEqual(t, map[string]string{"b": entry2}, r.Nodes)
+
+	// Folding is the same as adding and removing the nodes one at a time.
+	r2 := MakeRefIndex()
+	_, err = r2.AddNode(cas, "b", entry2)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, r2, r)
+}
@@ -12,7 +12,9 @@ package dumbcaslib
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
 const trashName = "trash"
@@ -50,3 +52,68 @@ func (t *trashImpl) move(relPath string) error {
 	}
 	return os.Rename(filepath.Join(t.rootDir, relPath), filepath.Join(t.trashDir, relPath))
 }
+
+// TrashItem is a file in the trash of a local table.
+type TrashItem struct {
+	// Name is the path of the file before it was moved to the trash, relative to
+	// the root, e.g. cas/<prefix>/<rest> for an object.
+	Name string
+	Size int64
+}
+
+// ListTrash returns the files in the trash of the local CAS and Nodes tables
+// of rootDir, sorted by name since filepath.Walk() is. The temporary files of the Nodes table are
+// skipped.
+func ListTrash(rootDir string) ([]TrashItem, error) {
+	items := []TrashItem{}
+	for _, table := range []string{casName, nodesName} {
+		trashDir := filepath.Join(rootDir, table, trashName)
+		err := filepath.Walk(trashDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == trashDir {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(trashDir, p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if table == nodesName && !strings.Contains(rel, "/") {
+				return nil
+			}
+			items = append(items, TrashItem{Name: table + "/" + rel, Size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list %s: %s", trashDir, err)
+		}
+	}
+	return items, nil
+}
+
+// RestoreTrash moves the file name, as returned by ListTrash(), back to its
+// place in its table. It fails if a file with the same name exists there.
+func RestoreTrash(rootDir, name string) error {
+	parts := strings.SplitN(path.Clean("/" + name)[1:], "/", 2)
+	if len(parts) != 2 || (parts[0] != casName && parts[0] != nodesName) {
+		return fmt.Errorf("Invalid trash item %s", name)
+	}
+	tableDir := filepath.Join(rootDir, parts[0])
+	src := filepath.Join(tableDir, trashName, filepath.FromSlash(parts[1]))
+	dst := filepath.Join(tableDir, filepath.FromSlash(parts[1]))
+	if _, err := os.Lstat(src); err != nil {
+		return fmt.Errorf("Failed to find %s in the trash", name)
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("Can't restore %s: it already exists", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", filepath.Dir(dst), err)
+	}
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,60 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "trash")
+	defer removeDir(t, tempData)
+
+	items, err := ListTrash(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []TrashItem{}, items)
+
+	cas, err := MakeLocalCasTable(tempData, CasTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	nodes, err := LoadLocalNodesTable(tempData, cas, NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	nodeName, err := nodes.AddEntry(&Node{Entry: hash}, "set")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(hash))
+	ut.AssertEqual(t, nil, nodes.Remove(nodeName))
+
+	items, err = ListTrash(tempData)
+	ut.AssertEqual(t, nil, err)
+	casItem := "cas/" + hash[:3] + "/" + hash[3:]
+	expected := []TrashItem{{Name: casItem, Size: 7}, {Name: "nodes/" + filepath.ToSlash(nodeName), Size: items[1].Size}}
+	ut.AssertEqual(t, expected, items)
+
+	ut.AssertEqual(t, nil, RestoreTrash(tempData, casItem))
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	ut.AssertEqual(t, errors.New("Failed to find "+casItem+" in the trash"), RestoreTrash(tempData, casItem))
+	ut.AssertEqual(t, errors.New("Invalid trash item refs/x"), RestoreTrash(tempData, "refs/x"))
+
+	ut.AssertEqual(t, nil, RestoreTrash(tempData, items[1].Name))
+	f, err = nodes.Open(nodeName)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Close())
+	items, err = ListTrash(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []TrashItem{}, items)
+}
@@ -0,0 +1,172 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/maruel/interrupt"
+)
+
+// FileItem is an item returned by WalkFiles. Either Error is set or FileInfo
+// is a file.
+type FileItem struct {
+	FullPath string
+	// RelPath is relative to the input the file was found in. For an input
+	// that is a file, it is the base name of the file.
+	RelPath string
+	os.FileInfo
+	Error error
+}
+
+// WalkOptions are the options used by WalkFiles.
+type WalkOptions struct {
+	// Excludes are glob patterns as understood by filepath.Match. A file or a
+	// directory whose base name matches one of them is skipped.
+	Excludes []string
+	// OneFileSystem skips the directories on a different file system than the
+	// input they were found in, like tar --one-file-system. Only supported
+	// when OneFileSystemSupported is true.
+	OneFileSystem bool
+	// Logger is used to log the skipped directories. Nothing is logged if nil.
+	Logger Logger
+	// Parallel is the number of inputs enumerated concurrently. It only helps
+	// when the inputs are on different disks or network mounts. 0 or 1
+	// enumerates them serially.
+	Parallel int
+}
+
+func (o *WalkOptions) isExcluded(name string) bool {
+	for _, pattern := range o.Excludes {
+		if m, _ := filepath.Match(pattern, name); m {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkFiles enumerates the files in inputs, which can be files or directories.
+// Directories themselves are not returned. Errors are returned in the channel
+// and the enumeration continues with the next item. It stops early when
+// interrupt is set.
+func WalkFiles(inputs []string, opts WalkOptions) <-chan FileItem {
+	c := make(chan FileItem)
+	if opts.Parallel > 1 {
+		go walkParallel(inputs, &opts, c)
+		return c
+	}
+	go func() {
+		defer close(c)
+		// Do each entry serially. In theory there would be marginal gain by doing
+		// them concurrently if the inputs are on different drives but for the
+		// common use case where it's multiple directories on a single disk-based
+		// HD, it's going to be slower.
+		for _, input := range inputs {
+			if !walkInput(input, &opts, c) {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// walkParallel enumerates up to opts.Parallel inputs concurrently and closes
+// c once all of them are done.
+func walkParallel(inputs []string, opts *WalkOptions, c chan<- FileItem) {
+	defer close(c)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Parallel)
+	for _, input := range inputs {
+		sem <- struct{}{}
+		if interrupt.IsSet() {
+			break
+		}
+		wg.Add(1)
+		go func(input string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			walkInput(input, opts, c)
+		}(input)
+	}
+	wg.Wait()
+}
+
+// walkInput returns false if the enumeration was interrupted.
+func walkInput(input string, opts *WalkOptions, c chan<- FileItem) bool {
+	if interrupt.IsSet() {
+		return false
+	}
+	stat, err := os.Stat(input)
+	if err != nil {
+		c <- FileItem{FullPath: input, Error: err}
+		return true
+	}
+	if opts.isExcluded(stat.Name()) {
+		return true
+	}
+	if stat.IsDir() {
+		dev, _ := deviceID(stat)
+		return walkDir(input, "", opts, dev, c)
+	}
+	c <- FileItem{FullPath: input, RelPath: filepath.Base(input), FileInfo: stat}
+	return true
+}
+
+// walkDir returns false if the enumeration was interrupted. dev is the device
+// of the input, used with opts.OneFileSystem.
+func walkDir(fullDir, relDir string, opts *WalkOptions, dev uint64, c chan<- FileItem) bool {
+	f, err := os.Open(fullDir)
+	if err != nil {
+		c <- FileItem{FullPath: fullDir, Error: err}
+		return true
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	for {
+		if interrupt.IsSet() {
+			return false
+		}
+		dirs, err := f.Readdir(128)
+		if err != nil && err != io.EOF {
+			c <- FileItem{FullPath: fullDir, Error: err}
+			return true
+		}
+		if len(dirs) == 0 {
+			return true
+		}
+		for _, d := range dirs {
+			name := d.Name()
+			if opts.isExcluded(name) {
+				continue
+			}
+			fullPath := filepath.Join(fullDir, name)
+			relPath := filepath.Join(relDir, name)
+			if d.IsDir() {
+				if opts.OneFileSystem {
+					if other, ok := deviceID(d); ok && other != dev {
+						orNullLogger(opts.Logger).Printf("Skipping %s on another file system", fullPath)
+						continue
+					}
+				}
+				if !walkDir(fullPath, relPath, opts, dev, c) {
+					return false
+				}
+			} else {
+				c <- FileItem{FullPath: fullPath, RelPath: relPath, FileInfo: d}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func writeTree(t testing.TB, root string, files []string) {
+	for _, f := range files {
+		p := filepath.Join(root, filepath.FromSlash(f))
+		ut.AssertEqual(t, nil, os.MkdirAll(filepath.Dir(p), 0700))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte(f), 0600))
+	}
+}
+
+// walkAsList returns the sorted posix-style relative paths and the number of
+// errors.
+func walkAsList(t testing.TB, inputs []string, opts WalkOptions) ([]string, int) {
+	out := []string{}
+	errors := 0
+	for item := range WalkFiles(inputs, opts) {
+		if item.Error != nil {
+			errors++
+			continue
+		}
+		ut.AssertEqual(t, false, item.IsDir())
+		out = append(out, filepath.ToSlash(item.RelPath))
+	}
+	sort.Strings(out)
+	return out, errors
+}
+
+func TestWalkFilesSingleFile(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "walk")
+	defer removeDir(t, tempData)
+	writeTree(t, tempData, []string{"a/b"})
+
+	items, errors := walkAsList(t, []string{filepath.Join(tempData, "a", "b")}, WalkOptions{})
+	ut.AssertEqual(t, 0, errors)
+	ut.AssertEqual(t, []string{"b"}, items)
+}
+
+func TestWalkFilesNested(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "walk")
+	defer removeDir(t, tempData)
+	writeTree(t, tempData, []string{"a/b/c", "a/d", "e", "a/x.tmp", "a/tmp/f"})
+
+	items, errors := walkAsList(t, []string{tempData}, WalkOptions{})
+	ut.AssertEqual(t, 0, errors)
+	ut.AssertEqual(t, []string{"a/b/c", "a/d", "a/tmp/f", "a/x.tmp", "e"}, items)
+
+	items, errors = walkAsList(t, []string{filepath.Join(tempData, "a")}, WalkOptions{Excludes: []string{"*.tmp", "tmp"}})
+	ut.AssertEqual(t, 0, errors)
+	ut.AssertEqual(t, []string{"b/c", "d"}, items)
+}
+
+func TestWalkFilesError(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "walk")
+	defer removeDir(t, tempData)
+	writeTree(t, tempData, []string{"a"})
+
+	inputs := []string{filepath.Join(tempData, "missing"), filepath.Join(tempData, "a")}
+	items, errors := walkAsList(t, inputs, WalkOptions{})
+	ut.AssertEqual(t, 1, errors)
+	ut.AssertEqual(t, []string{"a"}, items)
+}
+
+func TestWalkFilesOneFileSystem(t *testing.T) {
+	t.Parallel()
+	if !OneFileSystemSupported {
+		t.Skip("-one-file-system is not supported on this platform")
+	}
+	tempData := makeTempDir(t, "walk")
+	defer removeDir(t, tempData)
+	writeTree(t, tempData, []string{"a/x", "b/y", "z"})
+
+	items, errors := walkAsList(t, []string{tempData}, WalkOptions{OneFileSystem: true})
+	ut.AssertEqual(t, 0, errors)
+	ut.AssertEqual(t, []string{"a/x", "b/y", "z"}, items)
+
+	// Pretend the input is on another device so both subdirectories look like
+	// mount points.
+	stat, err := os.Stat(tempData)
+	ut.AssertEqual(t, nil, err)
+	dev, ok := deviceID(stat)
+	ut.AssertEqual(t, true, ok)
+	buf := &bytes.Buffer{}
+	opts := &WalkOptions{OneFileSystem: true, Logger: log.New(buf, "", 0)}
+	c := make(chan FileItem)
+	go func() {
+		defer close(c)
+		walkDir(tempData, "", opts, dev+1, c)
+	}()
+	items = []string{}
+	for item := range c {
+		items = append(items, item.RelPath)
+	}
+	ut.AssertEqual(t, []string{"z"}, items)
+	ut.AssertEqual(t, 2, strings.Count(buf.String(), "on another file system"))
+}
+
+func TestWalkFilesParallel(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "walk")
+	defer removeDir(t, tempData)
+	files := []string{}
+	inputs := []string{filepath.Join(tempData, "missing")}
+	for i := 0; i < 8; i++ {
+		files = append(files, fmt.Sprintf("d%d/a/b", i), fmt.Sprintf("d%d/c", i))
+		inputs = append(inputs, filepath.Join(tempData, fmt.Sprintf("d%d", i)))
+	}
+	writeTree(t, tempData, files)
+
+	expected, errors := walkAsList(t, inputs, WalkOptions{})
+	ut.AssertEqual(t, 1, errors)
+	ut.AssertEqual(t, 16, len(expected))
+	for _, parallel := range []int{2, 3, 16} {
+		items, errors := walkAsList(t, inputs, WalkOptions{Parallel: parallel})
+		ut.AssertEqual(t, 1, errors)
+		ut.AssertEqual(t, expected, items)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"os"
+	"syscall"
+)
+
+// OneFileSystemSupported is true when WalkOptions.OneFileSystem is supported.
+const OneFileSystemSupported = true
+
+// deviceID returns the device the file is on.
+func deviceID(stat os.FileInfo) (uint64, bool) {
+	s, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(s.Dev), true
+}
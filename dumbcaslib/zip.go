@@ -0,0 +1,69 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"archive/zip"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// serveZip streams the files under e as a zip archive. The objects are
+// stored, not deflated, since they are usually not compressible and it keeps
+// the download at disk speed. Nothing is buffered; the sizes come from the
+// entries.
+func (e *entryFileSystem) serveZip(w http.ResponseWriter, r *http.Request, toServe *Entry) {
+	name := path.Base(strings.TrimSuffix(r.URL.Path, "/"))
+	if name == "/" || name == "." {
+		name = "root"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", attachmentDisposition(name+".zip"))
+	w.WriteHeader(http.StatusOK)
+	// The status is already sent so an error can only abort the stream. The
+	// client notices the truncated archive.
+	_ = writeZip(w, e.cas, toServe)
+}
+
+// writeZip writes the files under root as a zip archive to w.
+func writeZip(w io.Writer, cas CasTable, root *Entry) error {
+	z := zip.NewWriter(w)
+	err := root.Walk(func(relPath string, e *Entry) error {
+		if relPath == "" {
+			return nil
+		}
+		if e.isDir() {
+			// Keeps the empty directories.
+			_, err := z.CreateHeader(&zip.FileHeader{Name: relPath + "/", Method: zip.Store})
+			return err
+		}
+		dst, err := z.CreateHeader(&zip.FileHeader{Name: relPath, Method: zip.Store, UncompressedSize64: uint64(e.Size)})
+		if err != nil {
+			return err
+		}
+		src, err := cas.Open(e.Sha1)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		if err2 := src.Close(); err == nil {
+			err = err2
+		}
+		return err
+	})
+	if err != nil {
+		// Don't write the central directory so the archive is clearly
+		// truncated instead of silently missing files.
+		return err
+	}
+	return z.Close()
+}
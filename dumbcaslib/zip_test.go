@@ -0,0 +1,76 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// readZip returns the content of each file in the zip archive, and "" for the
+// directories.
+func readZip(t testing.TB, data []byte) map[string]string {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	ut.AssertEqual(t, nil, err)
+	out := map[string]string{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		ut.AssertEqual(t, nil, err)
+		content, err := ioutil.ReadAll(r)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, nil, r.Close())
+		out[f.Name] = string(content)
+	}
+	return out
+}
+
+func TestServeZip(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	archiveData(t, cas, nodes, map[string]string{"file1": "content1", "dir1/dir2/file2": "content2"})
+
+	resp := httptest.NewRecorder()
+	nodes.ServeHTTP(resp, httptest.NewRequest("GET", "/tags/fictious/?format=zip", nil))
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "application/zip", resp.Header().Get("Content-Type"))
+	ut.AssertEqual(t, "attachment; filename=root.zip", resp.Header().Get("Content-Disposition"))
+	expected := map[string]string{"dir1/": "", "dir1/dir2/": "", "dir1/dir2/file2": "content2", "file1": "content1"}
+	ut.AssertEqual(t, expected, readZip(t, resp.Body.Bytes()))
+
+	// A subdirectory is named after itself.
+	resp = httptest.NewRecorder()
+	nodes.ServeHTTP(resp, httptest.NewRequest("GET", "/tags/fictious/dir1/?format=zip", nil))
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "attachment; filename=dir1.zip", resp.Header().Get("Content-Disposition"))
+	ut.AssertEqual(t, map[string]string{"dir2/": "", "dir2/file2": "content2"}, readZip(t, resp.Body.Bytes()))
+
+	// The listing links to it.
+	body := request(t, nodes, "/tags/fictious/dir1/", 200, "")
+	ut.AssertEqual(t, true, bytes.Contains([]byte(body), []byte("<a href=\"?format=zip\">Download as zip</a>")))
+}
+
+func TestWriteZipMissingObject(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	_, root := makeEntryTree(map[string]string{"a": "content1", "b": "content2"})
+	_, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	buf := &bytes.Buffer{}
+	ut.AssertEqual(t, false, writeZip(buf, cas, root) == nil)
+	// Without the central directory, the truncated archive is invalid.
+	_, err = zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	ut.AssertEqual(t, false, err == nil)
+}
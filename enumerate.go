@@ -0,0 +1,117 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdEnumerate = &subcommands.Command{
+	UsageLine: "enumerate <cas|nodes>",
+	ShortDesc: "streams the entries of a table",
+	LongDesc:  "Prints the entries of the CAS or the Nodes table of a DumbCas(tm) archive as they are enumerated, without sorting them, for processing by other tools.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &enumerateRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.jsonLines, "json-lines", false, "Prints one JSON object per line with the name, the size and the modification time of each CAS object, or the name of each node, and the errors")
+		return c
+	},
+}
+
+type enumerateRun struct {
+	CommonFlags
+	jsonLines bool
+}
+
+// enumerateRecord is one line printed by enumerate -json-lines.
+type enumerateRecord struct {
+	Name    string `json:"name,omitempty"`
+	Size    *int64 `json:"size,omitempty"`
+	ModTime string `json:"mod_time,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (c *enumerateRun) main(a DumbcasApplication, table string) error {
+	if table != "cas" && table != "nodes" {
+		return fmt.Errorf("Unknown table %s; must be cas or nodes", table)
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	var t dumbcaslib.Table = c.nodes
+	if table == "cas" {
+		t = c.cas
+	}
+	// Stops the enumeration on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+	items := t.Enumerate(cancel)
+	enc := json.NewEncoder(a.GetOut())
+	errs := 0
+	for {
+		select {
+		case <-interrupt.Channel:
+			return errors.New("Was interrupted.")
+		case item, ok := <-items:
+			if !ok {
+				if errs != 0 {
+					return fmt.Errorf("Got %d errors!", errs)
+				}
+				return nil
+			}
+			if item.Error != nil {
+				errs++
+			}
+			if !c.jsonLines {
+				if item.Error != nil {
+					a.GetLog().Printf("While enumerating the %s table: %s", table, item.Error)
+				} else {
+					fmt.Fprintf(a.GetOut(), "%s\n", filepath.ToSlash(item.Item))
+				}
+				continue
+			}
+			r := enumerateRecord{Name: filepath.ToSlash(item.Item)}
+			if item.Error != nil {
+				r.Error = item.Error.Error()
+			} else if table == "cas" {
+				size := item.Size
+				r.Size = &size
+				if !item.ModTime.IsZero() {
+					r.ModTime = item.ModTime.UTC().Format(time.RFC3339)
+				}
+			}
+			if err := enc.Encode(&r); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *enumerateRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide the table to enumerate, cas or nodes.\n", a.GetName())
+		return 1
+	}
+	interrupt.HandleCtrlC()
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestEnumerate(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"enumerate", "-root=\\test_enumerate", "nodes"}, 0)
+	f.CheckBuffer(false, false)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"enumerate", "-root=\\test_enumerate", "nodes"}, 0)
+	f.CheckOut(strings.Join(nodes, "\n") + "\n")
+
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"enumerate", "-root=\\test_enumerate", "-json-lines", "cas"}, 0)
+	lines := strings.Split(strings.TrimSpace(f.GetOut().(*bytes.Buffer).String()), "\n")
+	ut.AssertEqual(t, len(items), len(lines))
+	for i, line := range lines {
+		r := enumerateRecord{}
+		ut.AssertEqual(t, nil, json.Unmarshal([]byte(line), &r))
+		ut.AssertEqual(t, items[i], r.Name)
+		ut.AssertEqual(t, true, r.Size != nil)
+		ut.AssertEqual(t, true, r.ModTime != "")
+	}
+}
+
+func TestEnumerateInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"enumerate", "-root=\\test_enumerate", "refs"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"enumerate", "-root=\\test_enumerate"}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -0,0 +1,102 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/maruel/subcommands"
+)
+
+// The exit codes of archive, restore, fsck, gc and info, so a script can tell
+// the failure classes apart. The other commands exit with exitFailure on any
+// error.
+const (
+	exitOK = 0
+	// exitFailure is any failure not in the classes below.
+	exitFailure = 1
+	// exitUsage is an invalid argument or flag.
+	exitUsage = 2
+	// exitNotFound is a node, tag or object that doesn't exist.
+	exitNotFound = 3
+	// exitCorrupted is a corruption found in the store, or a store that needs
+	// fsck.
+	exitCorrupted = 4
+	// exitInterrupted is an interruption by Ctrl-C.
+	exitInterrupted = 5
+	// exitIO is a failure to read or write files.
+	exitIO = 6
+)
+
+// errInterrupted is returned when a command is interrupted by Ctrl-C.
+var errInterrupted = errors.New("Was interrupted.")
+
+// exitError is an error with the exit code of its class.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &exitError{exitUsage, fmt.Errorf(format, a...)}
+}
+
+func notFoundErrorf(format string, a ...interface{}) error {
+	return &exitError{exitNotFound, fmt.Errorf(format, a...)}
+}
+
+func corruptedErrorf(format string, a ...interface{}) error {
+	return &exitError{exitCorrupted, fmt.Errorf(format, a...)}
+}
+
+func interruptedErrorf(format string, a ...interface{}) error {
+	return &exitError{exitInterrupted, fmt.Errorf(format, a...)}
+}
+
+func ioErrorf(format string, a ...interface{}) error {
+	return &exitError{exitIO, fmt.Errorf(format, a...)}
+}
+
+// exitCode returns the exit code for the error returned by a command.
+func exitCode(err error) int {
+	var e *exitError
+	var pathErr *os.PathError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case os.IsNotExist(err):
+		return exitNotFound
+	case errors.As(err, &pathErr):
+		return exitIO
+	}
+	return exitFailure
+}
+
+// exitWith prints the error of a command, if any, and returns its exit code.
+func exitWith(a subcommands.Application, err error) int {
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+	}
+	return exitCode(err)
+}
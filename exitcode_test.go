@@ -0,0 +1,44 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+	_, notExist := os.Open("/nonexistent/dumbcas")
+	data := []struct {
+		err      error
+		expected int
+	}{
+		{nil, exitOK},
+		{errors.New("foo"), exitFailure},
+		{usageErrorf("-foo must be positive"), exitUsage},
+		{notFoundErrorf("Failed to find node %s", "foo"), exitNotFound},
+		{corruptedErrorf("Found %d problems", 2), exitCorrupted},
+		{errInterrupted, exitInterrupted},
+		{interruptedErrorf("Interrupted; run fsck -resume to continue"), exitInterrupted},
+		{ioErrorf("Got %d errors!", 2), exitIO},
+		{notExist, exitNotFound},
+		{&os.PathError{Op: "write", Path: "foo", Err: errors.New("disk full")}, exitIO},
+		{fmt.Errorf("Wrapped: %w", corruptedErrorf("bad")), exitCorrupted},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.expected, exitCode(line.err))
+	}
+	ut.AssertEqual(t, "Found 2 problems", corruptedErrorf("Found %d problems", 2).Error())
+}
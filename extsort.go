@@ -0,0 +1,233 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// mergeFanIn is the maximum number of files merged at once, to stay well
+// below the usual limit of open files.
+const mergeFanIn = 64
+
+// extSorter sorts strings that may not fit in memory. They are buffered then
+// written sorted and deduplicated to temporary files of up to chunk strings
+// each, which are merged when read back. The strings must not contain a
+// newline.
+type extSorter struct {
+	dir   string
+	chunk int
+	fanIn int
+	buf   []string
+	files []string
+}
+
+func makeExtSorter(dir string, chunk int) *extSorter {
+	return &extSorter{dir: dir, chunk: chunk, fanIn: mergeFanIn}
+}
+
+func (e *extSorter) add(s string) error {
+	e.buf = append(e.buf, s)
+	if len(e.buf) >= e.chunk {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered strings sorted and deduplicated to a new
+// temporary file.
+func (e *extSorter) flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	sort.Strings(e.buf)
+	unique := e.buf[:1]
+	for _, s := range e.buf[1:] {
+		if s != unique[len(unique)-1] {
+			unique = append(unique, s)
+		}
+	}
+	f, err := ioutil.TempFile(e.dir, "sort")
+	if err != nil {
+		return err
+	}
+	e.files = append(e.files, f.Name())
+	w := bufio.NewWriter(f)
+	for _, s := range unique {
+		if _, err = w.WriteString(s + "\n"); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	e.buf = e.buf[:0]
+	return err
+}
+
+// sorted returns the strings added so far sorted and deduplicated. The files
+// are first merged fanIn at a time until at most fanIn are left.
+func (e *extSorter) sorted() (*mergeReader, error) {
+	if err := e.flush(); err != nil {
+		return nil, err
+	}
+	for len(e.files) > e.fanIn {
+		name, err := e.merge(e.files[:e.fanIn])
+		if err != nil {
+			return nil, err
+		}
+		e.files = append(e.files[e.fanIn:], name)
+	}
+	return openMerge(e.files)
+}
+
+// merge merges the files names into a new temporary file and removes them.
+func (e *extSorter) merge(names []string) (string, error) {
+	m, err := openMerge(names)
+	if err != nil {
+		return "", err
+	}
+	defer m.close()
+	f, err := ioutil.TempFile(e.dir, "sort")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	for {
+		var s string
+		var ok bool
+		if s, ok, err = m.next(); err != nil || !ok {
+			break
+		}
+		if _, err = w.WriteString(s + "\n"); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	m.close()
+	for _, name := range names {
+		_ = os.Remove(name)
+	}
+	return f.Name(), nil
+}
+
+// openMerge opens the sorted files names to merge them.
+func openMerge(names []string) (*mergeReader, error) {
+	m := &mergeReader{}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.files = append(m.files, f)
+		s := &mergeSource{scanner: bufio.NewScanner(f)}
+		if s.advance() {
+			m.heap = append(m.heap, s)
+		} else if err := s.scanner.Err(); err != nil {
+			m.close()
+			return nil, err
+		}
+	}
+	heap.Init(&m.heap)
+	return m, nil
+}
+
+// close deletes the temporary files.
+func (e *extSorter) close() {
+	for _, name := range e.files {
+		_ = os.Remove(name)
+	}
+	e.files = nil
+	e.buf = nil
+}
+
+// mergeSource is one sorted file being merged.
+type mergeSource struct {
+	scanner *bufio.Scanner
+	current string
+}
+
+func (m *mergeSource) advance() bool {
+	if !m.scanner.Scan() {
+		return false
+	}
+	m.current = m.scanner.Text()
+	return true
+}
+
+// mergeHeap orders the sources by their current string.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].current < h[j].current }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeReader merges the sorted files of an extSorter.
+type mergeReader struct {
+	files   []*os.File
+	heap    mergeHeap
+	last    string
+	started bool
+}
+
+// next returns the next string, skipping the duplicates. It returns false once
+// done.
+func (m *mergeReader) next() (string, bool, error) {
+	for len(m.heap) != 0 {
+		s := m.heap[0]
+		value := s.current
+		if s.advance() {
+			heap.Fix(&m.heap, 0)
+		} else {
+			if err := s.scanner.Err(); err != nil {
+				return "", false, err
+			}
+			heap.Pop(&m.heap)
+		}
+		if m.started && value == m.last {
+			continue
+		}
+		m.started = true
+		m.last = value
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+func (m *mergeReader) close() {
+	for _, f := range m.files {
+		_ = f.Close()
+	}
+	m.files = nil
+}
@@ -0,0 +1,96 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func readAllSorted(t *testing.T, e *extSorter) []string {
+	m, err := e.sorted()
+	ut.AssertEqual(t, nil, err)
+	defer m.close()
+	out := []string{}
+	for {
+		s, ok, err := m.next()
+		ut.AssertEqual(t, nil, err)
+		if !ok {
+			return out
+		}
+		out = append(out, s)
+	}
+}
+
+func TestExtSorter(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "extsort")
+	defer removeDir(t, tempData)
+
+	e := makeExtSorter(tempData, 97)
+	ut.AssertEqual(t, []string{}, readAllSorted(t, e))
+	e.close()
+
+	r := rand.New(rand.NewSource(0))
+	unique := map[string]bool{}
+	e = makeExtSorter(tempData, 97)
+	for i := 0; i < 20000; i++ {
+		// Many duplicates, including across chunks.
+		s := fmt.Sprintf("%040x", r.Intn(5000))
+		unique[s] = true
+		ut.AssertEqual(t, nil, e.add(s))
+	}
+	expected := make([]string, 0, len(unique))
+	for s := range unique {
+		expected = append(expected, s)
+	}
+	sort.Strings(expected)
+	ut.AssertEqual(t, true, len(e.files) > mergeFanIn)
+	ut.AssertEqual(t, expected, readAllSorted(t, e))
+	// The chunks were merged down to mergeFanIn files.
+	ut.AssertEqual(t, true, len(e.files) <= mergeFanIn)
+	e.close()
+	left, err := ioutil.ReadDir(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(left))
+}
+
+func TestExtSorterFanIn(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "extsort_fan_in")
+	defer removeDir(t, tempData)
+
+	e := makeExtSorter(tempData, 4)
+	e.fanIn = 3
+	expected := []string{}
+	for i := 0; i < 100; i++ {
+		s := fmt.Sprintf("%03d", i)
+		expected = append(expected, s)
+		// Each chunk has duplicates.
+		ut.AssertEqual(t, nil, e.add(s))
+		ut.AssertEqual(t, nil, e.add(s))
+	}
+	ut.AssertEqual(t, 50, len(e.files))
+	m, err := e.sorted()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, len(m.files) <= 3)
+	m.close()
+	ut.AssertEqual(t, expected, readAllSorted(t, e))
+	// The merged files are removed as they are replaced.
+	left, err := ioutil.ReadDir(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(e.files), len(left))
+	e.close()
+}
@@ -0,0 +1,135 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// outputFormat is the value of the -format flag of the commands printing rows.
+// The zero value is the text format.
+type outputFormat string
+
+const (
+	formatText outputFormat = "text"
+	formatJSON outputFormat = "json"
+	formatCSV  outputFormat = "csv"
+)
+
+const formatUsage = "Output format: text, json or csv"
+
+func (o *outputFormat) String() string {
+	if *o == "" {
+		return string(formatText)
+	}
+	return string(*o)
+}
+
+func (o *outputFormat) Set(value string) error {
+	switch f := outputFormat(value); f {
+	case formatText, formatJSON, formatCSV:
+		*o = f
+		return nil
+	}
+	return fmt.Errorf("Unknown format %s", value)
+}
+
+// isText returns true for the text format, which is specific to each command.
+func (o outputFormat) isText() bool {
+	return o == "" || o == formatText
+}
+
+// rowPrinter prints rows of values with named columns in an outputFormat. The
+// json format is an array of objects keyed by the column names, the csv format
+// starts with the column names. The text format is specific to each command so
+// it is delegated to text.
+type rowPrinter struct {
+	out     io.Writer
+	format  outputFormat
+	columns []string
+	text    func(out io.Writer, row []interface{})
+	csv     *csv.Writer
+	rows    int
+}
+
+func makeRowPrinter(out io.Writer, format outputFormat, columns []string, text func(out io.Writer, row []interface{})) *rowPrinter {
+	return &rowPrinter{out: out, format: format, columns: columns, text: text}
+}
+
+// print prints one row. The values must be in the order of the columns.
+func (r *rowPrinter) print(row ...interface{}) error {
+	if len(row) != len(r.columns) {
+		panic("internal error: invalid row")
+	}
+	r.rows++
+	switch r.format {
+	case formatJSON:
+		sep := ",\n"
+		if r.rows == 1 {
+			sep = "[\n"
+		}
+		// Keep the columns in order, which a map wouldn't.
+		obj := "  {"
+		for i, c := range r.columns {
+			k, _ := json.Marshal(c)
+			v, err := json.Marshal(row[i])
+			if err != nil {
+				return err
+			}
+			if i != 0 {
+				obj += ", "
+			}
+			obj += string(k) + ": " + string(v)
+		}
+		_, err := io.WriteString(r.out, sep+obj+"}")
+		return err
+	case formatCSV:
+		if r.csv == nil {
+			r.csv = csv.NewWriter(r.out)
+			if err := r.csv.Write(r.columns); err != nil {
+				return err
+			}
+		}
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = fmt.Sprint(v)
+		}
+		return r.csv.Write(record)
+	default:
+		r.text(r.out, row)
+		return nil
+	}
+}
+
+// close terminates the output. It must be called even if no row was printed.
+func (r *rowPrinter) close() error {
+	switch r.format {
+	case formatJSON:
+		end := "\n]\n"
+		if r.rows == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(r.out, end)
+		return err
+	case formatCSV:
+		if r.csv == nil {
+			r.csv = csv.NewWriter(r.out)
+			if err := r.csv.Write(r.columns); err != nil {
+				return err
+			}
+		}
+		r.csv.Flush()
+		return r.csv.Error()
+	}
+	return nil
+}
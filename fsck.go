@@ -10,10 +10,23 @@ limitations under the License. */
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -24,58 +37,462 @@ var cmdFsck = &subcommands.Command{
 	CommandRun: func() subcommands.CommandRun {
 		c := &fsckRun{}
 		c.Init()
+		c.InitProgress()
+		c.Flags.BoolVar(&c.quick, "quick", false, "Only verify that the objects referenced by the nodes exist and have the expected size, without hashing them")
+		c.Flags.BoolVar(&c.resume, "resume", false, "Continues an interrupted fsck from its checkpoint instead of starting over; the checkpoint is ignored if the nodes changed since")
+		c.Flags.DurationVar(&c.olderThan, "older-than", 0, "Only re-hashes the objects last modified more than this long ago")
+		c.Flags.DurationVar(&c.newerThan, "newer-than", 0, "Only re-hashes the objects last modified less than this long ago")
+		c.Flags.BoolVar(&c.dryRun, "dry-run", false, "Prints the objects and the nodes that would be moved to the trash and why, without changing anything; fails if any is found")
+		c.Flags.BoolVar(&c.verbose, "verbose", false, "Prints each object and node moved to the trash and why")
+		c.Flags.IntVar(&c.ioWorkers, "io-workers", 1, "Number of objects read concurrently; more helps on SSDs and network storage")
+		c.Flags.IntVar(&c.hashWorkers, "hash-workers", runtime.NumCPU(), "Number of objects hashed concurrently; the readers stream the content to them")
 		return c
 	},
 }
 
 type fsckRun struct {
 	CommonFlags
+	quick       bool
+	resume      bool
+	olderThan   time.Duration
+	newerThan   time.Duration
+	dryRun      bool
+	verbose     bool
+	ioWorkers   int
+	hashWorkers int
 }
 
-func (c *fsckRun) main(a DumbcasApplication) error {
-	if err := c.Parse(a, true); err != nil {
+// trash moves an object or a node to the trash with remove, printing the
+// decision and its reason with -verbose. With -dry-run, it is only printed.
+func (c *fsckRun) trash(a DumbcasApplication, what, name, reason string, remove func(string) error) error {
+	if c.dryRun {
+		fmt.Fprintf(a.GetOut(), "Would trash %s %s: %s\n", what, name, reason)
+		return nil
+	}
+	if c.verbose {
+		fmt.Fprintf(a.GetOut(), "Trashing %s %s: %s\n", what, name, reason)
+	}
+	return remove(name)
+}
+
+// inWindow returns true if an object last modified at modTime must be
+// verified according to -older-than and -newer-than. An object with an unknown
+// modification time is always verified.
+func (c *fsckRun) inWindow(modTime, now time.Time) bool {
+	if modTime.IsZero() {
+		return true
+	}
+	if c.olderThan != 0 && modTime.After(now.Add(-c.olderThan)) {
+		return false
+	}
+	if c.newerThan != 0 && modTime.Before(now.Add(-c.newerThan)) {
+		return false
+	}
+	return true
+}
+
+// fsckCheckpointName is the file in the root where an interrupted fsck saves
+// its progress.
+const fsckCheckpointName = "fsck.checkpoint"
+
+// fsckCheckpoint is the progress of a full fsck. The objects are enumerated by
+// increasing prefix so all the objects up to Done were verified.
+type fsckCheckpoint struct {
+	// Done is the last 2 characters prefix fully verified.
+	Done string
+	// Nodes is the fingerprint of the nodes when the fsck started. The
+	// checkpoint is stale once it doesn't match anymore.
+	Nodes     string
+	Count     int
+	Corrupted int
+	// Skipped is the number of objects outside of the -older-than and
+	// -newer-than window.
+	Skipped int
+}
+
+// nodesFingerprint returns a hash of the list of the nodes, which changes
+// whenever a node is added or removed.
+func nodesFingerprint(nodes dumbcaslib.NodesTable) (string, error) {
+	names, err := dumbcaslib.EnumerateNodesAsList(nodes)
+	if err != nil {
+		return "", err
+	}
+	return dumbcaslib.Sha1Bytes([]byte(strings.Join(names, "\n"))), nil
+}
+
+// loadCheckpoint returns the checkpoint saved in root if it is still valid
+// for the nodes fingerprint, or an empty one.
+func loadCheckpoint(a DumbcasApplication, root, fingerprint string) *fsckCheckpoint {
+	cp := &fsckCheckpoint{}
+	data, err := ioutil.ReadFile(filepath.Join(root, fsckCheckpointName))
+	if err == nil {
+		err = json.Unmarshal(data, cp)
+	}
+	if err != nil {
+		a.GetLog().Printf("No usable checkpoint, starting over: %s", err)
+		return &fsckCheckpoint{Nodes: fingerprint}
+	}
+	if cp.Nodes != fingerprint {
+		a.GetLog().Printf("The nodes changed since the checkpoint, starting over")
+		return &fsckCheckpoint{Nodes: fingerprint}
+	}
+	a.GetLog().Printf("Resuming after prefix %s", cp.Done)
+	return cp
+}
+
+func (cp *fsckCheckpoint) save(root string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
 		return err
 	}
+	return ioutil.WriteFile(filepath.Join(root, fsckCheckpointName), data, 0640)
+}
 
-	count := 0
-	corrupted := 0
-	for item := range c.cas.Enumerate() {
+// verifyObject returns the actual sha1 of the object.
+func verifyObject(cas dumbcaslib.CasTable, name string) (string, error) {
+	f, err := cas.Open(name)
+	if err != nil {
+		return "", ioErrorf("Failed to open %s: %s", name, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	actual, err := sha1Reader(f)
+	if err != nil {
+		// Probably Disk error.
+		return "", ioErrorf("Aborting! Failed to calcultate the sha1 of %s: %s. Please find a valid copy of your CAS table ASAP.", name, err)
+	}
+	return actual, nil
+}
+
+// fsckChunkSize is the size of the chunks streamed from the readers to the
+// hashers by verifyObjects.
+const fsckChunkSize = 1024 * 1024
+
+// fsckResult is the verification of an object by verifyObjects.
+type fsckResult struct {
+	actual string
+	err    error
+	// done is false when the object was skipped because of an interrupt.
+	done bool
+}
+
+// verifyObjects returns the actual sha1 of each object. ioWorkers goroutines
+// open the objects and stream their content to hashWorkers goroutines hashing
+// it, so each pool can be sized for the storage and the CPU respectively. Once
+// interrupted, the objects not read yet are skipped.
+func verifyObjects(cas dumbcaslib.CasTable, names []string, ioWorkers, hashWorkers int) []fsckResult {
+	type chunk struct {
+		data []byte
+		err  error
+	}
+	type job struct {
+		i      int
+		chunks chan chunk
+	}
+	results := make([]fsckResult, len(names))
+	indexes := make(chan int)
+	jobs := make(chan job)
+	var readers, hashers sync.WaitGroup
+	for w := 0; w < ioWorkers; w++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := range indexes {
+				if interrupt.IsSet() {
+					continue
+				}
+				f, err := cas.Open(names[i])
+				if err != nil {
+					results[i] = fsckResult{err: ioErrorf("Failed to open %s: %s", names[i], err), done: true}
+					continue
+				}
+				// jobs is unbuffered so a hasher is consuming the chunks.
+				j := job{i, make(chan chunk, 4)}
+				jobs <- j
+				for {
+					buf := make([]byte, fsckChunkSize)
+					n, err := io.ReadFull(f, buf)
+					if n != 0 {
+						j.chunks <- chunk{data: buf[:n]}
+					}
+					if err == io.EOF || err == io.ErrUnexpectedEOF {
+						break
+					}
+					if err != nil {
+						j.chunks <- chunk{err: err}
+						break
+					}
+				}
+				close(j.chunks)
+				_ = f.Close()
+			}
+		}()
+	}
+	for w := 0; w < hashWorkers; w++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+			for j := range jobs {
+				h := sha1.New()
+				var err error
+				for c := range j.chunks {
+					if c.err != nil {
+						err = c.err
+					} else {
+						_, _ = h.Write(c.data)
+					}
+				}
+				if err != nil {
+					// Probably Disk error.
+					err = ioErrorf("Aborting! Failed to calcultate the sha1 of %s: %s. Please find a valid copy of your CAS table ASAP.", names[j.i], err)
+				}
+				results[j.i] = fsckResult{actual: hex.EncodeToString(h.Sum(nil)), err: err, done: true}
+			}
+		}()
+	}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	readers.Wait()
+	close(jobs)
+	hashers.Wait()
+	return results
+}
+
+// quickCheck verifies the size of every object referenced by the nodes
+// without hashing them. It doesn't modify the tables, except for setting the
+// fsck bit when an entry tree can't be loaded.
+func quickCheck(a DumbcasApplication, cas dumbcaslib.CasTable, nodes dumbcaslib.NodesTable, interval time.Duration) error {
+	// Expected size of each object; -1 means the size is unknown, like for the
+	// serialized entry trees themselves.
+	expected := map[string]int64{}
+	// merkle is the MerkleRoot() of each entry tree loaded.
+	merkle := map[string]string{}
+	nbNodes := 0
+	problems := 0
+	// Stops the enumerations on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+	p := makeScanProgress(a.GetLog(), "nodes", interval)
+	for item := range nodes.Enumerate(cancel) {
+		p.add()
 		if item.Error != nil {
-			a.GetLog().Printf("While enumerating the CAS table: %s", item.Error)
+			a.GetLog().Printf("While enumerating the Nodes table: %s", item.Error)
 			continue
 		}
-		count++
-		f, err := c.cas.Open(item.Item)
+		nbNodes++
+		f, err := nodes.Open(item.Item)
 		if err != nil {
-			// TODO(maruel): Leaks channel.
-			return fmt.Errorf("Failed to open %s: %s", item.Item, err)
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
 		}
-		defer func() {
-			_ = f.Close()
-		}()
-		actual, err := sha1Reader(f)
+		node := &dumbcaslib.Node{}
+		err = dumbcaslib.LoadReaderAsJSON(f, node)
+		_ = f.Close()
 		if err != nil {
-			// Probably Disk error.
-			// TODO(maruel): Leaks channel.
-			return fmt.Errorf("Aborting! Failed to calcultate the sha1 of %s: %s. Please find a valid copy of your CAS table ASAP.", item.Item, err)
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
 		}
-		if actual != item.Item {
-			corrupted++
-			a.GetLog().Printf("Found corrupted object, %s != %s", item.Item, actual)
-			if err := c.cas.Remove(item.Item); err != nil {
-				// TODO(maruel): Leaks channel.
-				return fmt.Errorf("Failed to trash object %s: %s", item.Item, err)
+		if _, ok := expected[node.Entry]; ok {
+			if root, ok := merkle[node.Entry]; ok && node.Merkle != "" && node.Merkle != root {
+				problems++
+				a.GetLog().Printf("Node %s doesn't match its Merkle root", item.Item)
+			}
+			continue
+		}
+		expected[node.Entry] = -1
+		entry, err := dumbcaslib.LoadEntry(cas, node.Entry)
+		if err != nil {
+			// Not reported again as a missing object.
+			delete(expected, node.Entry)
+			problems++
+			cas.SetFsckBit()
+			a.GetLog().Printf("Failed to load entry %s of node %s: %s", node.Entry, item.Item, err)
+			continue
+		}
+		merkle[node.Entry] = dumbcaslib.MerkleRoot(entry)
+		if node.Merkle != "" && node.Merkle != merkle[node.Entry] {
+			problems++
+			a.GetLog().Printf("Node %s doesn't match its Merkle root", item.Item)
+		}
+		_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+			if e.Sha1 != "" {
+				expected[e.Sha1] = e.Size
+			}
+			return nil
+		})
+	}
+
+	seen := 0
+	p = makeScanProgress(a.GetLog(), "objects", interval)
+	for item := range cas.Enumerate(cancel) {
+		p.add()
+		if item.Error != nil {
+			a.GetLog().Printf("While enumerating the CAS table: %s", item.Error)
+			continue
+		}
+		size, ok := expected[item.Item]
+		if !ok {
+			continue
+		}
+		seen++
+		delete(expected, item.Item)
+		if size == -1 || item.Size == size {
+			continue
+		}
+		// The size enumerated is the stored size; only a compressed object has to
+		// be opened to get its uncompressed size.
+		if actual := objectSize(cas, item.Item); actual != size {
+			problems++
+			a.GetLog().Printf("Object %s has size %d, expected %d", item.Item, actual, size)
+		}
+	}
+	missing := make([]string, 0, len(expected))
+	for hash := range expected {
+		missing = append(missing, hash)
+	}
+	sort.Strings(missing)
+	for _, hash := range missing {
+		problems++
+		a.GetLog().Printf("Object %s is missing", hash)
+	}
+	a.GetLog().Printf("Scanned %d nodes and %d objects; found %d problems.", nbNodes, seen, problems)
+	if problems != 0 {
+		return corruptedErrorf("Found %d problems", problems)
+	}
+	return nil
+}
+
+func (c *fsckRun) main(a DumbcasApplication) error {
+	if c.ioWorkers < 1 {
+		return usageErrorf("-io-workers must be at least 1")
+	}
+	if c.hashWorkers < 1 {
+		return usageErrorf("-hash-workers must be at least 1")
+	}
+	// A dry run doesn't modify the root.
+	c.exclusive = !c.dryRun
+	if c.dryRun {
+		c.casOptions.ReadOnly = true
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+	if c.quick {
+		if c.olderThan != 0 || c.newerThan != 0 {
+			return usageErrorf("-older-than and -newer-than can't be used with -quick")
+		}
+		return quickCheck(a, c.cas, c.nodes, c.progressInterval)
+	}
+
+	fingerprint, err := nodesFingerprint(c.nodes)
+	if err != nil {
+		return err
+	}
+	cp := &fsckCheckpoint{Nodes: fingerprint}
+	if c.resume {
+		cp = loadCheckpoint(a, c.Root, fingerprint)
+	}
+	// Stops the enumerations on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+	// current is the prefix being verified.
+	current := ""
+	// bad is the number of corrupted objects found by this run, unlike
+	// cp.Corrupted which includes the ones found before -resume.
+	bad := 0
+	// batch is the objects of the current prefix to verify. They are verified
+	// together before the prefix is marked as done.
+	var batch []string
+	flush := func() error {
+		for i, r := range verifyObjects(c.cas, batch, c.ioWorkers, c.hashWorkers) {
+			if !r.done {
+				continue
+			}
+			if r.err != nil {
+				return r.err
+			}
+			cp.Count++
+			if r.actual != batch[i] {
+				cp.Corrupted++
+				bad++
+				a.GetLog().Printf("Found corrupted object, %s != %s", batch[i], r.actual)
+				if err := c.trash(a, "object", batch[i], "hash mismatch, the content hashes to "+r.actual, c.cas.Remove); err != nil {
+					return fmt.Errorf("Failed to trash object %s: %s", batch[i], err)
+				}
 			}
 		}
+		batch = batch[:0]
+		return nil
+	}
+	now := time.Now()
+	p := makeScanProgress(a.GetLog(), "objects", c.progressInterval)
+	for item := range c.cas.Enumerate(cancel) {
+		p.add()
+		if item.Error != nil {
+			a.GetLog().Printf("While enumerating the CAS table: %s", item.Error)
+			continue
+		}
+		prefix := item.Item[:2]
+		if cp.Done != "" && prefix <= cp.Done {
+			continue
+		}
+		if prefix != current {
+			if err := flush(); err != nil {
+				return err
+			}
+			if current != "" && !c.dryRun && !interrupt.IsSet() {
+				cp.Done = current
+				if err := cp.save(c.Root); err != nil {
+					a.GetLog().Printf("Failed to save the checkpoint: %s", err)
+				}
+			}
+			current = prefix
+		}
+		if interrupt.IsSet() {
+			break
+		}
+		if !c.inWindow(item.ModTime, now) {
+			cp.Skipped++
+			continue
+		}
+		batch = append(batch, item.Item)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if interrupt.IsSet() {
+		if c.dryRun {
+			return errInterrupted
+		}
+		// The enumeration may have stopped early so the current prefix is not
+		// known to be done.
+		if err := cp.save(c.Root); err != nil {
+			return interruptedErrorf("Interrupted and failed to save the checkpoint: %s", err)
+		}
+		return interruptedErrorf("Interrupted; run fsck -resume to continue")
+	}
+	a.GetLog().Printf("Scanned %d entries in CasTable; found %d corrupted.", cp.Count, cp.Corrupted)
+	if cp.Skipped != 0 {
+		a.GetLog().Printf("Skipped %d entries outside of the modification time window.", cp.Skipped)
+	}
+	if !c.dryRun {
+		_ = os.Remove(filepath.Join(c.Root, fsckCheckpointName))
 	}
-	a.GetLog().Printf("Scanned %d entries in CasTable; found %d corrupted.", count, corrupted)
 
 	// TODO(maruel): Get the value from CasTable.
 	hashLength := 40
 	resha1 := regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength))
-	count = 0
-	corrupted = 0
-	for item := range c.nodes.Enumerate() {
+	count := 0
+	corrupted := 0
+	// merkle is the MerkleRoot() of each entry tree loaded, so a tree shared by
+	// a node and its tags is only loaded once. It is "" when the tree can't be
+	// loaded.
+	merkle := map[string]string{}
+	p = makeScanProgress(a.GetLog(), "nodes", c.progressInterval)
+	for item := range c.nodes.Enumerate(cancel) {
+		p.add()
 		// TODO(maruel): Can't differentiate between an I/O error or a corrupted node.
 		// NodesTable.Enumerate() automatically clears corrupted nodes.
 		// TODO(maruel): This is a layering error.
@@ -87,7 +504,7 @@ func (c *fsckRun) main(a DumbcasApplication) error {
 		f, err := c.nodes.Open(item.Item)
 		if err != nil {
 			a.GetLog().Printf("Failed opening node %s: %s", item.Item, err)
-			_ = c.nodes.Remove(item.Item)
+			_ = c.trash(a, "node", item.Item, "unreadable, "+err.Error(), c.nodes.Remove)
 			corrupted++
 			continue
 		}
@@ -97,19 +514,49 @@ func (c *fsckRun) main(a DumbcasApplication) error {
 		node := &dumbcaslib.Node{}
 		if err := dumbcaslib.LoadReaderAsJSON(f, node); err != nil {
 			a.GetLog().Printf("Failed opening node %s: %s", item.Item, err)
-			_ = c.nodes.Remove(item.Item)
+			_ = c.trash(a, "node", item.Item, "invalid JSON, "+err.Error(), c.nodes.Remove)
 			corrupted++
 			continue
 		}
 		if !resha1.MatchString(node.Entry) {
 			a.GetLog().Printf("Node %s is corrupted: %v", item.Item, node)
-			_ = c.nodes.Remove(item.Item)
+			_ = c.trash(a, "node", item.Item, fmt.Sprintf("invalid entry %q", node.Entry), c.nodes.Remove)
 			corrupted++
 			continue
 		}
+		if node.Merkle != "" {
+			// The node may point to another valid entry tree. The missing
+			// entry trees are not fsck's concern.
+			root, ok := merkle[node.Entry]
+			if !ok {
+				if entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry); err == nil {
+					root = dumbcaslib.MerkleRoot(entry)
+				}
+				merkle[node.Entry] = root
+			}
+			if root != "" && root != node.Merkle {
+				a.GetLog().Printf("Node %s doesn't match its Merkle root", item.Item)
+				_ = c.trash(a, "node", item.Item, "Merkle root mismatch", c.nodes.Remove)
+				corrupted++
+				continue
+			}
+		}
 	}
 	a.GetLog().Printf("Scanned %d entries in NodesTable; found %d corrupted.", count, corrupted)
+	if c.dryRun {
+		if problems := bad + corrupted; problems != 0 {
+			return corruptedErrorf("Found %d problems; nothing was changed", problems)
+		}
+		return nil
+	}
 
+	if cp.Skipped != 0 {
+		// Not every object was verified.
+		if c.cas.GetFsckBit() {
+			a.GetLog().Printf("Not clearing the fsck bit since some entries were skipped.")
+		}
+		return nil
+	}
 	c.cas.ClearFsckBit()
 	return nil
 }
@@ -117,12 +564,9 @@ func (c *fsckRun) main(a DumbcasApplication) error {
 func (c *fsckRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
 	if len(args) != 0 {
 		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
-		return 1
+		return exitUsage
 	}
+	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
-	if err := c.main(d); err != nil {
-		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
-		return 1
-	}
-	return 0
+	return exitWith(a, c.main(d))
 }
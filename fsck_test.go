@@ -10,7 +10,13 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/ut"
@@ -90,3 +96,310 @@ func TestFsckCorruptNodeEntry(t *testing.T) {
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, 1, len(n1))
 }
+
+func TestFsckCorruptNodeNoLeak(t *testing.T) {
+	// Not parallel since it counts the goroutines.
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_leak", "-quick"}
+	f.Run(args, 0)
+	_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	f.nodes.(dumbcaslib.Corruptable).Corrupt()
+	addNodes(f.TB, f.nodes, entry, 10)
+
+	// fsck returns on the corrupted node while the nodes enumeration is
+	// blocked on the next one.
+	before := countGoroutines()
+	f.Run(args, exitCorrupted)
+	assertNoLeak(t, before)
+}
+
+func TestFsckQuick(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_quick", "-quick"}
+	f.Run(args, 0)
+
+	sha1tree, _, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	f.Run(args, 0)
+	f.Run(append(args, "-progress-interval=1ns"), 0)
+	f.Run([]string{"fsck", "-root=\\test_fsck_quick", "-progress-interval=1ns"}, 0)
+
+	// Truncate an object.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	ut.AssertEqual(t, nil, f.cas.AddEntry(bytes.NewBufferString("content"), sha1tree["file1"]))
+	f.Run(args, exitCorrupted)
+
+	// Missing object.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	f.Run(args, exitCorrupted)
+
+	// -quick doesn't quarantine anything.
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(i1))
+}
+
+func TestFsckQuickCompressed(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_quick_compressed", "-quick"}
+	f.Run(args, 0)
+
+	// The stored size of a compressed object differs from its size in the
+	// entry so it is opened.
+	cas, err := dumbcaslib.MakeCompressedCasTable(f.cas, "zstd")
+	ut.AssertEqual(t, nil, err)
+	sha1tree, _, _ := archiveData(f.TB, cas, f.nodes, map[string]string{
+		"file1": strings.Repeat("content1", 100),
+		"file2": "content2",
+	})
+	f.Run(args, 0)
+
+	// Replaces the object with a shorter one, compressed too.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewBufferString("content1"), sha1tree["file1"]))
+	f.Run(args, exitCorrupted)
+}
+
+func TestFsckQuickBrokenEntry(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_quick_broken_entry", "-quick"}
+	f.Run(args, 0)
+	_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	f.Run(args, 0)
+
+	// Corrupted entry tree.
+	ut.AssertEqual(t, nil, f.cas.Remove(entry))
+	ut.AssertEqual(t, nil, f.cas.AddEntry(bytes.NewBufferString("{"), entry))
+	f.Run(args, exitCorrupted)
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+	f.cas.ClearFsckBit()
+
+	// Deleted entry tree.
+	ut.AssertEqual(t, nil, f.cas.Remove(entry))
+	f.Run(args, exitCorrupted)
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+}
+
+func TestFsckResume(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "fsck_resume")
+	defer removeDir(t, tempData)
+	args := []string{"fsck", "-root=" + tempData, "-resume"}
+	f.Run(args, 0)
+	f.CheckBuffer(false, false)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	low := strings.Repeat("0", 40)
+	high := strings.Repeat("f", 40)
+	ut.AssertEqual(t, nil, f.cas.AddEntry(bytes.NewBufferString("bad"), low))
+	ut.AssertEqual(t, nil, f.cas.AddEntry(bytes.NewBufferString("bad"), high))
+
+	// Only the objects after the checkpoint are verified.
+	fingerprint, err := nodesFingerprint(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	cp := &fsckCheckpoint{Done: "7f", Nodes: fingerprint}
+	ut.AssertEqual(t, nil, cp.save(tempData))
+	f.Run(args, 0)
+	f.CheckBuffer(false, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, low, items[0])
+	ut.AssertEqual(t, false, items[len(items)-1] == high)
+	// The checkpoint is removed once done.
+	_, err = os.Stat(filepath.Join(tempData, fsckCheckpointName))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// A checkpoint taken before the nodes changed is ignored.
+	cp.Nodes = "stale"
+	ut.AssertEqual(t, nil, cp.save(tempData))
+	f.Run(args, 0)
+	f.CheckBuffer(false, false)
+	items, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, items[0] == low)
+}
+
+func TestFsckAge(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"fsck", "-root=\\test_fsck_age", "-quick", "-older-than=1h"}, exitUsage)
+	f.CheckBuffer(false, true)
+
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	bad := strings.Repeat("0", 40)
+	ut.AssertEqual(t, nil, f.cas.AddEntry(bytes.NewBufferString("bad"), bad))
+	f.cas.SetFsckBit()
+
+	// The objects were just added so they are all skipped and the fsck bit is
+	// kept.
+	f.Run([]string{"fsck", "-root=\\test_fsck_age", "-older-than=1h"}, 0)
+	f.CheckBuffer(false, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, bad, items[0])
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_age", "-newer-than=1h"}, 0)
+	f.CheckBuffer(false, false)
+	items, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, items[0] == bad)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+}
+
+func TestFsckInWindow(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	c := &fsckRun{olderThan: 2 * day, newerThan: 5 * day}
+	ut.AssertEqual(t, true, c.inWindow(time.Time{}, now))
+	ut.AssertEqual(t, false, c.inWindow(now.Add(-day), now))
+	ut.AssertEqual(t, true, c.inWindow(now.Add(-3*day), now))
+	ut.AssertEqual(t, false, c.inWindow(now.Add(-6*day), now))
+	c = &fsckRun{}
+	ut.AssertEqual(t, true, c.inWindow(now.Add(-6*day), now))
+}
+
+func TestFsckMerkle(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_merkle"}
+	f.Run(args, 0)
+	_, _, entry1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1", "file2": "content2"})
+	_, _, entry2 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	root1, err := dumbcaslib.LoadEntry(f.cas, entry1)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: entry1, Merkle: dumbcaslib.MerkleRoot(root1)}, "good")
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"fsck", "-root=\\test_fsck_merkle", "-quick"}, 0)
+	f.CheckBuffer(false, false)
+
+	// The node points to another valid entry tree.
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: entry2, Merkle: dumbcaslib.MerkleRoot(root1)}, "tampered")
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"fsck", "-root=\\test_fsck_merkle", "-quick"}, exitCorrupted)
+	f.CheckBuffer(false, true)
+
+	// The full fsck trashes the node and its tag.
+	n1, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	f.Run(args, 0)
+	n2, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(n1)-2, len(n2))
+	f.Run([]string{"fsck", "-root=\\test_fsck_merkle", "-quick"}, 0)
+}
+
+func TestFsckMerkleTagLoadedOnce(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_merkle_tag"}
+	f.Run(args, 0)
+	_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	root, err := dumbcaslib.LoadEntry(f.cas, entry)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: entry, Merkle: dumbcaslib.MerkleRoot(root)}, "merkle")
+	ut.AssertEqual(t, nil, err)
+
+	// The entry tree is hashed once, then loaded once for the Merkle root of
+	// both the node and its tag.
+	cas := &countingCasTable{CasTable: f.cas}
+	f.cas = cas
+	f.Run(args, 0)
+	ut.AssertEqual(t, 2, cas.opened[entry])
+}
+
+func TestFsckDryRun(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_dry_run"}
+	f.Run(args, 0)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	f.cas.(dumbcaslib.Corruptable).Corrupt()
+	f.nodes.(dumbcaslib.Corruptable).Corrupt()
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	n1, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+
+	// Nothing is changed but the plan is printed and the issues are reported.
+	f.Run([]string{"fsck", "-root=\\test_fsck_dry_run", "-dry-run"}, exitCorrupted)
+	ut.AssertEqual(t, true, f.casOptions.ReadOnly)
+	out := f.GetOut().(*bytes.Buffer).String()
+	ut.AssertEqualf(t, true, strings.Contains(out, "Would trash object "), "Unexpected output: %s", out)
+	ut.AssertEqualf(t, true, strings.Contains(out, ": hash mismatch, the content hashes to "), "Unexpected output: %s", out)
+	ut.AssertEqualf(t, true, strings.Contains(out, "Would trash node tags/fictious: invalid JSON, "), "Unexpected output: %s", out)
+	f.GetOut().(*bytes.Buffer).Reset()
+	f.CheckBuffer(false, true)
+	i2, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i1, i2)
+	n2, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, n1, n2)
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_dry_run", "-verbose"}, 0)
+	ut.AssertEqual(t, false, f.casOptions.ReadOnly)
+	out = f.GetOut().(*bytes.Buffer).String()
+	ut.AssertEqualf(t, true, strings.Contains(out, "Trashing node tags/fictious: invalid JSON, "), "Unexpected output: %s", out)
+	f.GetOut().(*bytes.Buffer).Reset()
+	f.CheckBuffer(false, false)
+	i3, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(i1)-1, len(i3))
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_dry_run", "-dry-run"}, 0)
+	f.CheckBuffer(false, false)
+}
+
+func TestVerifyObjects(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	var names []string
+	for i := 0; i < 20; i++ {
+		name, err := dumbcaslib.AddBytes(cas, []byte(fmt.Sprintf("content%d", i)))
+		ut.AssertEqual(t, nil, err)
+		names = append(names, name)
+	}
+	// Spans multiple chunks.
+	large, err := dumbcaslib.AddBytes(cas, bytes.Repeat([]byte("l"), 2*fsckChunkSize+1))
+	ut.AssertEqual(t, nil, err)
+	names = append(names, large)
+	for _, workers := range [][2]int{{1, 1}, {4, 2}, {2, 8}} {
+		results := verifyObjects(cas, names, workers[0], workers[1])
+		ut.AssertEqual(t, len(names), len(results))
+		for i, r := range results {
+			ut.AssertEqual(t, fsckResult{actual: names[i], done: true}, r)
+		}
+	}
+
+	results := verifyObjects(cas, []string{names[0], sha1String("missing")}, 2, 2)
+	ut.AssertEqual(t, names[0], results[0].actual)
+	ut.AssertEqual(t, true, results[1].err != nil)
+}
+
+func TestFsckWorkers(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=\\test_fsck_workers", "-io-workers=4", "-hash-workers=2"}
+	f.Run(args, 0)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	f.cas.(dumbcaslib.Corruptable).Corrupt()
+	f.Run(args, 0)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(items))
+
+	f.Run([]string{"fsck", "-root=\\test_fsck_workers", "-io-workers=0"}, exitUsage)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"fsck", "-root=\\test_fsck_workers", "-hash-workers=0"}, exitUsage)
+	f.CheckBuffer(false, true)
+}
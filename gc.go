@@ -10,9 +10,16 @@ limitations under the License. */
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -23,14 +30,95 @@ var cmdGc = &subcommands.Command{
 	CommandRun: func() subcommands.CommandRun {
 		c := &gcRun{}
 		c.Init()
+		c.InitProgress()
+		c.Flags.BoolVar(&c.incremental, "incremental", false, "Trusts the reference index to find the orphans; only the nodes added or removed since the last gc are walked")
+		c.Flags.BoolVar(&c.rebuildIndex, "rebuild-index", false, "Regenerates the reference index used by -incremental from the full scan")
+		c.Flags.BoolVar(&c.lowMemory, "low-memory", false, "Sorts the hashes in temporary files instead of keeping them all in memory, for stores with hundreds of millions of objects")
+		c.Flags.StringVar(&c.tempDir, "temp-dir", "", "Directory for the temporary files of -low-memory; defaults to the system temporary directory")
+		c.Flags.Int64Var(&c.budget.maxDeletes, "max-deletes", 0, "Maximum number of orphans removed; the others are left for the next gc. 0 means no limit")
+		c.Flags.Int64Var(&c.budget.maxBytes, "max-delete-bytes", 0, "Maximum number of bytes of orphans removed; the others are left for the next gc. 0 means no limit")
 		return c
 	},
 }
 
 type gcRun struct {
 	CommonFlags
+	incremental  bool
+	rebuildIndex bool
+	lowMemory    bool
+	tempDir      string
+	budget       gcBudget
 }
 
+// gcBudget limits the orphans removed by one gc run so it can be run
+// repeatedly in small increments. A limit of 0 means no limit.
+type gcBudget struct {
+	maxDeletes int64
+	maxBytes   int64
+	deletes    int64
+	bytes      int64
+}
+
+// allow returns true and accounts for the orphan if it can be removed within
+// the budget. The first orphan is always allowed so gc makes progress even if
+// it is larger than -max-delete-bytes.
+func (b *gcBudget) allow(cas dumbcaslib.CasTable, orphan string) bool {
+	if b.maxDeletes != 0 && b.deletes >= b.maxDeletes {
+		return false
+	}
+	if b.maxBytes != 0 {
+		size := objectSize(cas, orphan)
+		if size < 0 {
+			size = 0
+		}
+		if b.deletes != 0 && b.bytes+size > b.maxBytes {
+			return false
+		}
+		b.bytes += size
+	}
+	b.deletes++
+	return true
+}
+
+// split returns the orphans that fit in the budget and the ones left for the
+// next gc. Once an orphan doesn't fit, the following ones are left too.
+func (b *gcBudget) split(cas dumbcaslib.CasTable, orphans []string) ([]string, []string) {
+	for i, orphan := range orphans {
+		if !b.allow(cas, orphan) {
+			return orphans[:i], orphans[i:]
+		}
+	}
+	return orphans, nil
+}
+
+// objectSize returns the size of an object as returned by Open(), or -1 if it
+// can't be opened.
+func objectSize(cas dumbcaslib.CasTable, hash string) int64 {
+	f, err := cas.Open(hash)
+	if err != nil {
+		return -1
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// reportLeft prints the number of orphans left by the budget.
+func reportLeft(a DumbcasApplication, left int) {
+	if left != 0 {
+		fmt.Fprintf(a.GetOut(), "Budget reached; %d orphans left for the next gc\n", left)
+	}
+}
+
+// gcSortChunk is the number of hashes sorted in memory at once by gc
+// -low-memory, about 64mb.
+const gcSortChunk = 1024 * 1024
+
 func tagRecurse(entries map[string]bool, entry *dumbcaslib.Entry) {
 	if entry.Sha1 != "" {
 		entries[entry.Sha1] = true
@@ -40,42 +128,322 @@ func tagRecurse(entries map[string]bool, entry *dumbcaslib.Entry) {
 	}
 }
 
+// removeOrphans moves the orphans to the trash. The ones already gone are
+// ignored so an interrupted gc can be run again.
+func removeOrphans(a DumbcasApplication, cas dumbcaslib.CasTable, orphans []string, left int) error {
+	a.GetLog().Printf("Found %d orphan", len(orphans)+left)
+	for _, orphan := range orphans {
+		if interrupt.IsSet() {
+			// The orphans left are removed by the next gc.
+			return errInterrupted
+		}
+		if err := cas.Remove(orphan); err != nil && !os.IsNotExist(err) {
+			cas.SetFsckBit()
+			return fmt.Errorf("Internal error while removing %s: %s", orphan, err)
+		}
+	}
+	reportLeft(a, left)
+	return nil
+}
+
+// incrementalGc finds the orphans with the reference index. Only the nodes
+// that changed since the index was saved are walked; the CAS is not
+// enumerated.
+func (c *gcRun) incrementalGc(a DumbcasApplication) error {
+	index, err := c.refs.Load()
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		return errors.New("No reference index; run gc -rebuild-index first")
+	}
+	// The orphans left by the previous run are candidates again, like the
+	// objects dereferenced by the nodes journaled since.
+	changes, err := c.refs.Journal()
+	if err != nil {
+		return err
+	}
+	candidates, err := index.Fold(c.cas, changes)
+	if err != nil {
+		return fmt.Errorf("%s; run gc -rebuild-index", err)
+	}
+	candidates = append(candidates, index.Pending...)
+
+	current := map[string]string{}
+	names := []string{}
+	cancel := make(chan struct{})
+	defer close(cancel)
+	p := makeScanProgress(a.GetLog(), "nodes", c.progressInterval)
+	for item := range c.nodes.Enumerate(cancel) {
+		p.add()
+		if item.Error != nil {
+			return item.Error
+		}
+		data, err := readNode(c.nodes, item.Item)
+		if err != nil {
+			c.cas.SetFsckBit()
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
+		}
+		node := &dumbcaslib.Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			c.cas.SetFsckBit()
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
+		}
+		if isTag(item.Item) {
+			// The node it refers to is enumerated too.
+			continue
+		}
+		current[item.Item] = node.Entry
+		names = append(names, item.Item)
+	}
+	if interrupt.IsSet() {
+		return errInterrupted
+	}
+	removed := []string{}
+	for name := range index.Nodes {
+		if _, ok := current[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(removed)
+
+	// Nodes are added first so the objects they share with the removed nodes
+	// are never dereferenced to zero. The journaled nodes are already indexed
+	// so this only catches the changes that were not journaled.
+	for _, name := range names {
+		o, err := index.AddNode(c.cas, name, current[name])
+		if err != nil {
+			return fmt.Errorf("%s; run gc -rebuild-index", err)
+		}
+		candidates = append(candidates, o...)
+	}
+	for _, name := range removed {
+		o, err := index.RemoveNode(c.cas, name)
+		if err != nil {
+			return fmt.Errorf("%s; run gc -rebuild-index", err)
+		}
+		candidates = append(candidates, o...)
+	}
+	a.GetLog().Printf("Indexed %d nodes, %d removed", len(index.Nodes), len(removed))
+
+	// A candidate may have been referenced again by a node indexed after.
+	orphans := []string{}
+	seen := map[string]bool{}
+	for _, o := range candidates {
+		if index.Refs[o] == 0 && !seen[o] {
+			seen[o] = true
+			orphans = append(orphans, o)
+		}
+	}
+	sort.Strings(orphans)
+	orphans, index.Pending = c.budget.split(c.cas, orphans)
+
+	// Save first; if gc is interrupted while removing the orphans, the
+	// remaining ones are leaked until the next gc -rebuild-index instead of
+	// breaking the next run.
+	if err := c.refs.Save(index); err != nil {
+		return err
+	}
+	return removeOrphans(a, c.cas, orphans, len(index.Pending))
+}
+
+// lowMemoryGc finds the orphans by merging the sorted hashes of the CAS with
+// the sorted hashes referenced by the nodes. Both are sorted in temporary files
+// of chunk hashes so the memory used doesn't depend on the size of the store.
+func (c *gcRun) lowMemoryGc(a DumbcasApplication, chunk int) error {
+	dir, err := ioutil.TempDir(c.tempDir, "dumbcas_gc")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	objects := makeExtSorter(dir, chunk)
+	defer objects.close()
+	refs := makeExtSorter(dir, chunk)
+	defer refs.close()
+
+	// Stops the enumerations on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+	count := 0
+	p := makeScanProgress(a.GetLog(), "objects", c.progressInterval)
+	for item := range c.cas.Enumerate(cancel) {
+		p.add()
+		if item.Error != nil {
+			c.cas.SetFsckBit()
+			return ioErrorf("Failed enumerating the CAS table %s", item.Error)
+		}
+		if err := objects.add(item.Item); err != nil {
+			return err
+		}
+		count++
+	}
+	if interrupt.IsSet() {
+		return errInterrupted
+	}
+	a.GetLog().Printf("Found %d entries", count)
+
+	p = makeScanProgress(a.GetLog(), "nodes", c.progressInterval)
+	for item := range c.nodes.Enumerate(cancel) {
+		p.add()
+		if item.Error != nil {
+			return item.Error
+		}
+		data, err := readNode(c.nodes, item.Item)
+		if err != nil {
+			c.cas.SetFsckBit()
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
+		}
+		node := &dumbcaslib.Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			c.cas.SetFsckBit()
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
+		}
+		if isTag(item.Item) {
+			// The node it refers to is enumerated too.
+			continue
+		}
+		if err := refs.add(node.Entry); err != nil {
+			return err
+		}
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil {
+			return err
+		}
+		err = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+			if e.Sha1 != "" {
+				return refs.add(e.Sha1)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if interrupt.IsSet() {
+		return errInterrupted
+	}
+
+	o, err := objects.sorted()
+	if err != nil {
+		return err
+	}
+	defer o.close()
+	r, err := refs.sorted()
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	ref, refOk, err := r.next()
+	orphans := 0
+	left := 0
+	for err == nil {
+		var obj string
+		var ok bool
+		if obj, ok, err = o.next(); err != nil || !ok {
+			break
+		}
+		for refOk && ref < obj {
+			if ref, refOk, err = r.next(); err != nil {
+				return err
+			}
+		}
+		if refOk && ref == obj {
+			continue
+		}
+		if left != 0 || !c.budget.allow(c.cas, obj) {
+			// Keep merging to count the orphans left.
+			left++
+			continue
+		}
+		if interrupt.IsSet() {
+			// The orphans left are removed by the next gc.
+			return errInterrupted
+		}
+		if err = c.cas.Remove(obj); err != nil && !os.IsNotExist(err) {
+			c.cas.SetFsckBit()
+			return fmt.Errorf("Internal error while removing %s: %s", obj, err)
+		}
+		err = nil
+		orphans++
+	}
+	if err != nil {
+		return err
+	}
+	a.GetLog().Printf("Removed %d orphan", orphans)
+	reportLeft(a, left)
+	return nil
+}
+
 func (c *gcRun) main(a DumbcasApplication) error {
+	if c.incremental && c.rebuildIndex {
+		return usageErrorf("-incremental and -rebuild-index are mutually exclusive")
+	}
+	if c.lowMemory && (c.incremental || c.rebuildIndex) {
+		return usageErrorf("-low-memory can't be used with -incremental or -rebuild-index")
+	}
+	if c.budget.maxDeletes < 0 || c.budget.maxBytes < 0 {
+		return usageErrorf("-max-deletes and -max-delete-bytes must not be negative")
+	}
+	c.exclusive = true
 	if err := c.Parse(a, false); err != nil {
 		return err
 	}
+	defer c.unlock()
+	if c.incremental {
+		return c.incrementalGc(a)
+	}
+	if c.lowMemory {
+		return c.lowMemoryGc(a, gcSortChunk)
+	}
 
+	var index *dumbcaslib.RefIndex
+	if c.rebuildIndex {
+		index = dumbcaslib.MakeRefIndex()
+	}
 	entries := map[string]bool{}
-	for item := range c.cas.Enumerate() {
+	// Stops the enumerations on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+	p := makeScanProgress(a.GetLog(), "objects", c.progressInterval)
+	for item := range c.cas.Enumerate(cancel) {
+		p.add()
 		if item.Error != nil {
-			// TODO(maruel): Leaks channel.
 			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed enumerating the CAS table %s", item.Error)
+			return ioErrorf("Failed enumerating the CAS table %s", item.Error)
 		}
 		entries[item.Item] = false
 	}
+	if interrupt.IsSet() {
+		return errInterrupted
+	}
 	a.GetLog().Printf("Found %d entries", len(entries))
 
 	// Load all the nodes.
-	for item := range c.nodes.Enumerate() {
+	p = makeScanProgress(a.GetLog(), "nodes", c.progressInterval)
+	for item := range c.nodes.Enumerate(cancel) {
+		p.add()
 		if item.Error != nil {
-			// TODO(maruel): Leaks channel.
 			return item.Error
 		}
 		f, err := c.nodes.Open(item.Item)
 		if err != nil {
-			// TODO(maruel): Leaks channel.
 			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
 		}
 		defer func() {
 			_ = f.Close()
 		}()
 		node := &dumbcaslib.Node{}
 		if err := dumbcaslib.LoadReaderAsJSON(f, node); err != nil {
-			// TODO(maruel): Leaks channel.
 			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+			return corruptedErrorf("Failed opening node %s: %s", item.Item, err)
+		}
+		if isTag(item.Item) {
+			// The node it refers to is enumerated too.
+			continue
 		}
 
 		entries[node.Entry] = true
@@ -84,33 +452,41 @@ func (c *gcRun) main(a DumbcasApplication) error {
 			return err
 		}
 		tagRecurse(entries, entry)
+		if index != nil {
+			if _, err := index.AddNode(c.cas, item.Item, node.Entry); err != nil {
+				return err
+			}
+		}
 	}
 
+	if interrupt.IsSet() {
+		return errInterrupted
+	}
 	orphans := []string{}
 	for entry, tagged := range entries {
 		if !tagged {
 			orphans = append(orphans, entry)
 		}
 	}
-	a.GetLog().Printf("Found %d orphan", len(orphans))
-	for _, orphan := range orphans {
-		if err := c.cas.Remove(orphan); err != nil {
-			c.cas.SetFsckBit()
-			return fmt.Errorf("Internal error while removing %s: %s", orphan, err)
+	// Sorted so the orphans left by the budget are the same from run to run.
+	sort.Strings(orphans)
+	orphans, left := c.budget.split(c.cas, orphans)
+	if index != nil {
+		a.GetLog().Printf("Indexed %d nodes", len(index.Nodes))
+		index.Pending = left
+		if err := c.refs.Save(index); err != nil {
+			return err
 		}
 	}
-	return nil
+	return removeOrphans(a, c.cas, orphans, len(left))
 }
 
 func (c *gcRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
 	if len(args) != 0 {
 		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
-		return 1
+		return exitUsage
 	}
+	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
-	if err := c.main(d); err != nil {
-		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
-		return 1
-	}
-	return 0
+	return exitWith(a, c.main(d))
 }
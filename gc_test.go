@@ -10,6 +10,9 @@ limitations under the License. */
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"sort"
 	"testing"
 
@@ -55,6 +58,51 @@ func TestGcKept(t *testing.T) {
 	n2, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, n1, n2)
+
+	// The progress is logged, not printed.
+	f.Run(append(args, "-progress-interval=1ns"), 0)
+	f.CheckBuffer(false, false)
+	i3, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i1, i3)
+}
+
+func TestGcCorruptNodeNoLeak(t *testing.T) {
+	// Not parallel since it counts the goroutines.
+	for _, mode := range []string{"", "-low-memory", "-incremental"} {
+		f := makeDumbcasAppMock(t)
+		args := []string{"gc", "-root=\\test_gc_leak"}
+		f.Run(append(args, "-rebuild-index"), 0)
+		_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+		f.nodes.(dumbcaslib.Corruptable).Corrupt()
+		addNodes(f.TB, f.nodes, entry, 10)
+		if mode != "" {
+			args = append(args, mode)
+		}
+
+		before := countGoroutines()
+		f.Run(args, exitCorrupted)
+		assertNoLeak(t, before)
+	}
+}
+
+func TestGcTagLoadedOnce(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []string{"", "-low-memory", "-incremental"} {
+		f := makeDumbcasAppMock(t)
+		args := []string{"gc", "-root=\\test_gc_tag_loaded_once"}
+		f.Run(append(args, "-rebuild-index"), 0)
+		_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+		if mode != "" {
+			args = append(args, mode)
+		}
+
+		// The entry tree of the node isn't walked again for its tag.
+		cas := &countingCasTable{CasTable: f.cas}
+		f.cas = cas
+		f.Run(args, 0)
+		ut.AssertEqualf(t, 1, cas.opened[entry], "%q", mode)
+	}
 }
 
 func TestGcTrim(t *testing.T) {
@@ -107,3 +155,188 @@ func TestGcTrim(t *testing.T) {
 	sort.Strings(rest)
 	ut.AssertEqual(t, i3, rest)
 }
+
+func TestGcIncremental(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	// There is no index yet.
+	f.Run([]string{"gc", "-root=\\test_gc_incremental", "-incremental"}, 1)
+
+	args := []string{"gc", "-root=\\test_gc_incremental", "-rebuild-index"}
+	f.Run(args, 0)
+	_, node1, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	f.Run(args, 0)
+	index, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	// Only the node; its tag refers to it.
+	ut.AssertEqual(t, 1, len(index.Nodes))
+
+	// This node is not in the index yet; it is indexed by the incremental gc.
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file3":  "content3",
+		"file1a": "content1",
+	})
+	i2, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 5, len(i2))
+
+	args = []string{"gc", "-root=\\test_gc_incremental", "-incremental"}
+	ut.AssertEqual(t, nil, f.nodes.Remove(node1))
+	f.Run(args, 0)
+	i3, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	rest := Sub(i2, i1)
+	rest = append(rest, sha1String("content1"))
+	sort.Strings(rest)
+	ut.AssertEqual(t, rest, i3)
+
+	// Running it again is a no-op.
+	f.Run(args, 0)
+	i4, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i3, i4)
+
+	// The index matches a rebuilt one.
+	index, err = f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"gc", "-root=\\test_gc_incremental", "-rebuild-index"}, 0)
+	rebuilt, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, rebuilt, index)
+}
+
+func TestGcIncrementalJournal(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "gc_journal")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "file1\n", "file1": "content1"}); err != nil {
+		t.Fatal(err)
+	}
+	f.Run([]string{"gc", "-root=\\test_gc_journal", "-rebuild-index"}, 0)
+	before, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+
+	// archive journals the node instead of rewriting the index.
+	f.Run([]string{"archive", "-root=\\test_gc_journal", filepath.Join(tempData, "toArchive")}, 0)
+	index, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, before, index)
+	changes, err := f.refs.Journal()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(changes))
+
+	// gc -incremental folds the journal in.
+	f.Run([]string{"gc", "-root=\\test_gc_journal", "-incremental"}, 0)
+	index, err = f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, changes[0].Entry, index.Nodes[changes[0].Node])
+	changes, err = f.refs.Journal()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []dumbcaslib.RefChange{}, changes)
+	f.Run([]string{"gc", "-root=\\test_gc_journal", "-rebuild-index"}, 0)
+	rebuilt, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, rebuilt, index)
+}
+
+func TestGcLowMemory(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"gc", "-root=\\test_gc_low_memory", "-low-memory"}, 0)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1", "dir1/file2": "content2"})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file3": "content3"})
+	expected, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	for i := 0; i < 5000; i++ {
+		_, err := dumbcaslib.AddBytes(f.cas, []byte(fmt.Sprintf("orphan%d", i)))
+		ut.AssertEqual(t, nil, err)
+	}
+
+	// Use tiny chunks so the hashes are merged from many files.
+	tempData := makeTempDir(t, "gc_low_memory")
+	defer removeDir(t, tempData)
+	c := &gcRun{tempDir: tempData}
+	c.cas = f.cas
+	c.nodes = f.nodes
+	ut.AssertEqual(t, nil, c.lowMemoryGc(f, 97))
+	actual, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+	left, err := ioutil.ReadDir(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(left))
+
+	// Same result through the command line.
+	f.Run([]string{"gc", "-root=\\test_gc_low_memory", "-low-memory", "-temp-dir=" + tempData}, 0)
+	actual, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, actual)
+	f.Run([]string{"gc", "-root=\\test_gc_low_memory", "-low-memory", "-incremental"}, exitUsage)
+}
+
+func TestGcBudget(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	root := "-root=\\test_gc_budget"
+	f.Run([]string{"gc", root, "-rebuild-index"}, 0)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	expected, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	addOrphans := func() {
+		for i := 0; i < 5; i++ {
+			// Each orphan is 7 bytes.
+			_, err := dumbcaslib.AddBytes(f.cas, []byte(fmt.Sprintf("orphan%d", i)))
+			ut.AssertEqual(t, nil, err)
+		}
+	}
+	countLeft := func() int {
+		items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+		ut.AssertEqual(t, nil, err)
+		return len(items) - len(expected)
+	}
+
+	addOrphans()
+	f.Run([]string{"gc", root, "-max-deletes=2"}, 0)
+	f.CheckOut("Budget reached; 3 orphans left for the next gc\n")
+	ut.AssertEqual(t, 3, countLeft())
+	f.Run([]string{"gc", root, "-max-delete-bytes=14"}, 0)
+	f.CheckOut("Budget reached; 1 orphans left for the next gc\n")
+	ut.AssertEqual(t, 1, countLeft())
+	// The first orphan is removed even if it is larger than the budget.
+	f.Run([]string{"gc", root, "-max-delete-bytes=1"}, 0)
+	f.CheckOut("")
+	ut.AssertEqual(t, 0, countLeft())
+
+	// -low-memory still finds all the orphans.
+	addOrphans()
+	f.Run([]string{"gc", root, "-low-memory", "-max-deletes=4"}, 0)
+	f.CheckOut("Budget reached; 1 orphans left for the next gc\n")
+	ut.AssertEqual(t, 1, countLeft())
+	f.Run([]string{"gc", root, "-low-memory"}, 0)
+	ut.AssertEqual(t, 0, countLeft())
+
+	// The orphans left by -incremental are saved in the index for the next run.
+	addOrphans()
+	f.Run([]string{"gc", root, "-rebuild-index", "-max-deletes=1"}, 0)
+	f.CheckOut("Budget reached; 4 orphans left for the next gc\n")
+	index, err := f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 4, len(index.Pending))
+	f.Run([]string{"gc", root, "-incremental", "-max-deletes=3"}, 0)
+	f.CheckOut("Budget reached; 1 orphans left for the next gc\n")
+	ut.AssertEqual(t, 1, countLeft())
+	f.Run([]string{"gc", root, "-incremental"}, 0)
+	f.CheckOut("")
+	ut.AssertEqual(t, 0, countLeft())
+	index, err = f.refs.Load()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(index.Pending))
+
+	f.Run([]string{"gc", root, "-max-deletes=-1"}, exitUsage)
+}
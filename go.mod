@@ -1,9 +1,28 @@
 module github.com/maruel/dumbcas
 
-go 1.15
+go 1.22
 
 require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
+	github.com/klauspost/compress v1.18.0
 	github.com/maruel/interrupt v1.0.2
 	github.com/maruel/subcommands v1.0.0
 	github.com/maruel/ut v1.0.2
+	github.com/pkg/sftp v1.13.5
+	github.com/yuin/goldmark v1.8.2
+	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
+	golang.org/x/sys v0.20.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/kr/pretty v0.2.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/texttheater/golang-levenshtein v1.0.1 // indirect
+	github.com/tv42/httpunix v0.0.0-20191220191345-2ba4b9c3382c // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
+	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/tools v0.0.0-20180917221912-90fa682c2a6e // indirect
 )
@@ -0,0 +1,75 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdIdentical = &subcommands.Command{
+	UsageLine: "identical <nodeA> <nodeB>",
+	ShortDesc: "tells if two nodes archived the same files",
+	LongDesc:  "Compares the entry hash of <nodeA> and <nodeB> in a DumbCas(tm) archive. The entry identifies the whole tree so the comparison doesn't need to load it. A node can be a tag.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &identicalRun{}
+		c.Init()
+		return c
+	},
+}
+
+type identicalRun struct {
+	CommonFlags
+}
+
+func (c *identicalRun) main(a DumbcasApplication, nodeA, nodeB string) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	entries := [2]string{}
+	for i, name := range []string{nodeA, nodeB} {
+		name, err := resolveNodeArg(c.nodes, name)
+		if err != nil {
+			return err
+		}
+		f, err := c.nodes.Open(name)
+		if err != nil {
+			return err
+		}
+		node := &dumbcaslib.Node{}
+		err = dumbcaslib.LoadReaderAsJSON(f, node)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to load node %s: %s", name, err)
+		}
+		entries[i] = node.Entry
+	}
+	if entries[0] == entries[1] {
+		fmt.Fprintf(a.GetOut(), "Identical: %s\n", entries[0])
+	} else {
+		fmt.Fprintf(a.GetOut(), "Different: %s != %s\n", entries[0], entries[1])
+	}
+	return nil
+}
+
+func (c *identicalRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 2 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide a <nodeA> and a <nodeB>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0], args[1]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,42 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestIdentical(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	_, node1, entry1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	// The same files archived again produce the same entry.
+	node2, err := f.nodes.AddEntry(&dumbcaslib.Node{Entry: entry1, Comment: "again"}, "copy")
+	ut.AssertEqual(t, nil, err)
+	_, node3, entry3 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content2"})
+
+	f.Run([]string{"identical", "-root=\\test_archive", node1, node2}, 0)
+	f.CheckOut("Identical: " + entry1 + "\n")
+	f.Run([]string{"identical", "-root=\\test_archive", node1, node3}, 0)
+	f.CheckOut("Different: " + entry1 + " != " + entry3 + "\n")
+	// A tag can be used.
+	f.Run([]string{"identical", "-root=\\test_archive", "tags/fictious", node3}, 0)
+	f.CheckOut("Identical: " + entry3 + "\n")
+
+	f.Run([]string{"identical", "-root=\\test_archive", node1, "missing"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"identical", "-root=\\test_archive", node1}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -10,8 +10,10 @@ limitations under the License. */
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 	"sort"
 
@@ -27,17 +29,109 @@ var cmdInfo = &subcommands.Command{
 	CommandRun: func() subcommands.CommandRun {
 		c := &infoRun{}
 		c.Init()
+		c.Flags.BoolVar(&c.json, "json", false, "Prints the node and its files as a JSON document")
+		c.Flags.Var(&c.format, "format", formatUsage+"; only the files are printed with json and csv")
+		c.Flags.StringVar(&c.dumpEntry, "dump-entry", "", "Also writes the entry tree of the node, as stored, to this file as indented JSON with readable field names, e.g. to diff the trees of two nodes")
+		c.Flags.BoolVar(&c.summary, "summary", false, "Prints only the number of files and directories, the total size and the largest file instead of listing every file")
 		return c
 	},
 }
 
 type infoRun struct {
 	CommonFlags
+	json      bool
+	format    outputFormat
+	summary   bool
+	dumpEntry string
 }
 
-func printEntry(out io.Writer, entry *dumbcaslib.Entry, relPath string) (count int) {
+// infoDoc is the document printed with -json.
+type infoDoc struct {
+	Node    string         `json:"node"`
+	Entry   string         `json:"entry"`
+	Comment string         `json:"comment,omitempty"`
+	Inputs  []string       `json:"inputs,omitempty"`
+	Files   []infoDocEntry `json:"files"`
+}
+
+type infoDocEntry struct {
+	Path       string `json:"path"`
+	Sha1       string `json:"sha1"`
+	Size       int64  `json:"size"`
+	HardLinkTo string `json:"hard_link_to,omitempty"`
+	Compressed bool   `json:"compressed,omitempty"`
+	StoredSize int64  `json:"stored_size,omitempty"`
+}
+
+// printJSON prints the node and its files sorted by path.
+func printJSON(out io.Writer, nodeName string, node *dumbcaslib.Node, entry *dumbcaslib.Entry) error {
+	doc := &infoDoc{Node: nodeName, Entry: node.Entry, Comment: node.Comment, Inputs: node.Inputs, Files: []infoDocEntry{}}
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 != "" {
+			doc.Files = append(doc.Files, infoDocEntry{relPath, e.Sha1, e.Size, e.HardLinkTo, e.Compressed, e.StoredSize})
+		}
+		return nil
+	})
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+// dumpedEntry is an Entry as written by -dump-entry. It has the same fields
+// as the stored Entry but with readable names.
+type dumpedEntry struct {
+	Sha1       string                  `json:"sha1,omitempty"`
+	Size       int64                   `json:"size,omitempty"`
+	Files      map[string]*dumpedEntry `json:"files,omitempty"`
+	HardLinkTo string                  `json:"hard_link_to,omitempty"`
+	OrigPath   string                  `json:"orig_path,omitempty"`
+	Holes      [][2]int64              `json:"holes,omitempty"`
+	Xattrs     map[string][]byte       `json:"xattrs,omitempty"`
+	Compressed bool                    `json:"compressed,omitempty"`
+	StoredSize int64                   `json:"stored_size,omitempty"`
+}
+
+func makeDumpedEntry(e *dumbcaslib.Entry) *dumpedEntry {
+	d := &dumpedEntry{e.Sha1, e.Size, nil, e.HardLinkTo, e.OrigPath, e.Holes, e.Xattrs, e.Compressed, e.StoredSize}
+	if len(e.Files) != 0 {
+		d.Files = make(map[string]*dumpedEntry, len(e.Files))
+		for name, child := range e.Files {
+			d.Files[name] = makeDumpedEntry(child)
+		}
+	}
+	return d
+}
+
+// writeDumpedEntry writes entry to path. The keys are sorted so the files of
+// two nodes can be diffed.
+func writeDumpedEntry(path string, entry *dumbcaslib.Entry) error {
+	data, err := json.MarshalIndent(makeDumpedEntry(entry), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// infoColumns are the columns of the rows printed by printEntry.
+var infoColumns = []string{"path", "sha1", "size", "hard_link_to", "compressed", "stored_size"}
+
+// storedSize returns the size of the object of e in the CAS, as recorded by
+// archive -compress, or its size.
+func storedSize(e *dumbcaslib.Entry) int64 {
+	if e.Compressed {
+		return e.StoredSize
+	}
+	return e.Size
+}
+
+func printEntry(out *rowPrinter, entry *dumbcaslib.Entry, relPath string) (count int, err error) {
 	if entry.Sha1 != "" {
-		fmt.Fprintf(out, " %s(%d)\n", relPath, entry.Size)
+		if err = out.print(relPath, entry.Sha1, entry.Size, entry.HardLinkTo, entry.Compressed, storedSize(entry)); err != nil {
+			return
+		}
 		count++
 	}
 	names := make([]string, 0, len(entry.Files))
@@ -47,17 +141,93 @@ func printEntry(out io.Writer, entry *dumbcaslib.Entry, relPath string) (count i
 	sort.Strings(names)
 	for _, name := range names {
 		child := entry.Files[name]
-		c := printEntry(out, child, filepath.Join(relPath, name))
+		c, err := printEntry(out, child, filepath.Join(relPath, name))
 		count += c
+		if err != nil {
+			return count, err
+		}
 	}
 	return
 }
 
+// compressionRatio returns how much the files of entry take in the CAS when
+// some were archived compressed, or "".
+func compressionRatio(entry *dumbcaslib.Entry) string {
+	var size, stored int64
+	compressed := false
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 != "" && e.HardLinkTo == "" {
+			size += e.Size
+			stored += storedSize(e)
+			compressed = compressed || e.Compressed
+		}
+		return nil
+	})
+	if !compressed || size == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", stored %d of %d bytes (%.1f%%)", stored, size, 100.*float64(stored)/float64(size))
+}
+
+// printSummary prints the node and aggregates about its files. The hard links
+// are counted as files but their size only once.
+func printSummary(out io.Writer, nodeName string, node *dumbcaslib.Node, entry *dumbcaslib.Entry) {
+	files := 0
+	dirs := 0
+	var size int64
+	largest := ""
+	var largestSize int64 = -1
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 == "" {
+			if relPath != "" {
+				dirs++
+			}
+			return nil
+		}
+		files++
+		if e.HardLinkTo == "" {
+			size += e.Size
+		}
+		if e.Size > largestSize {
+			largest = relPath
+			largestSize = e.Size
+		}
+		return nil
+	})
+	fmt.Fprintf(out, "Node: %s\n", filepath.ToSlash(nodeName))
+	if node.Comment != "" {
+		fmt.Fprintf(out, "Comment: %s\n", node.Comment)
+	}
+	if len(node.Inputs) != 0 {
+		fmt.Fprintf(out, "Inputs:\n")
+		for _, input := range node.Inputs {
+			fmt.Fprintf(out, " %s\n", input)
+		}
+	}
+	fmt.Fprintf(out, "Files: %d\n", files)
+	fmt.Fprintf(out, "Directories: %d\n", dirs)
+	fmt.Fprintf(out, "Size: %d bytes%s\n", size, compressionRatio(entry))
+	if largest != "" {
+		fmt.Fprintf(out, "Largest: %s(%d)\n", largest, largestSize)
+	}
+}
+
 func (c *infoRun) main(a DumbcasApplication, nodeArg string) error {
+	if c.json && !c.format.isText() {
+		return usageErrorf("-json and -format can't be used together")
+	}
+	if c.summary && (c.json || !c.format.isText()) {
+		return usageErrorf("-summary can't be used with -json or -format")
+	}
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
 
+	nodeArg, err := resolveNodeArg(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+
 	// Load the Node and process it.
 	f, err := c.nodes.Open(nodeArg)
 	if err != nil {
@@ -76,21 +246,49 @@ func (c *infoRun) main(a DumbcasApplication, nodeArg string) error {
 		return err
 	}
 
-	count := printEntry(a.GetOut(), entry, "")
-	fmt.Fprintf(a.GetOut(), "Total %d\n", count)
+	if c.dumpEntry != "" {
+		if err := writeDumpedEntry(c.dumpEntry, entry); err != nil {
+			return err
+		}
+		a.GetLog().Printf("Wrote the entry tree of %s to %s", nodeArg, c.dumpEntry)
+	}
+	if c.json {
+		return printJSON(a.GetOut(), nodeArg, node, entry)
+	}
+	if c.summary {
+		printSummary(a.GetOut(), nodeArg, node, entry)
+		return nil
+	}
+	out := makeRowPrinter(a.GetOut(), c.format, infoColumns, func(w io.Writer, row []interface{}) {
+		fmt.Fprintf(w, " %s(%d)\n", row[0], row[2])
+	})
+	if !c.format.isText() {
+		if _, err := printEntry(out, entry, ""); err != nil {
+			return err
+		}
+		return out.close()
+	}
+	if len(node.Inputs) != 0 {
+		fmt.Fprintf(a.GetOut(), "Inputs:\n")
+		for _, input := range node.Inputs {
+			fmt.Fprintf(a.GetOut(), " %s\n", input)
+		}
+		fmt.Fprintf(a.GetOut(), "Files:\n")
+	}
+	count, err := printEntry(out, entry, "")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Total %d%s\n", count, compressionRatio(entry))
 	return nil
 }
 
 func (c *infoRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
 	if len(args) != 1 {
 		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
-		return 1
+		return exitUsage
 	}
 	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
-	if err := c.main(d, args[0]); err != nil {
-		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
-		return 1
-	}
-	return 0
+	return exitWith(a, c.main(d, args[0]))
 }
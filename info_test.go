@@ -10,7 +10,13 @@ limitations under the License. */
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
 )
 
 func TestInfo(t *testing.T) {
@@ -18,8 +24,8 @@ func TestInfo(t *testing.T) {
 	f := makeDumbcasAppMock(t)
 	// Force the creation of CAS and NodesTable so content can be archived in
 	// memory before running the command.
-	_, _ = f.MakeCasTable("")
-	_, _ = f.LoadNodesTable("", f.cas)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
 
 	// Create an archive.
 	tree := map[string]string{
@@ -38,3 +44,119 @@ func TestInfo(t *testing.T) {
 	f.CheckOut(expected)
 	f.CheckBuffer(false, false)
 }
+
+func TestInfoJSON(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+
+	tree := map[string]string{
+		"dir1/bar": "bar\n",
+		"file1":    "content1",
+	}
+	sha1tree, nodeName, entrySha1 := archiveData(f.TB, f.cas, f.nodes, tree)
+
+	args := []string{"info", "-root=\\test_archive", "-json", nodeName}
+	f.Run(args, 0)
+
+	expected := &infoDoc{
+		Node:    nodeName,
+		Entry:   entrySha1,
+		Comment: "useful comment",
+		Files: []infoDocEntry{
+			{Path: "dir1/bar", Sha1: sha1tree["dir1/bar"], Size: 4},
+			{Path: "file1", Sha1: sha1tree["file1"], Size: 8},
+		},
+	}
+	data, err := json.MarshalIndent(expected, "", "  ")
+	ut.AssertEqual(t, nil, err)
+	f.CheckOut(string(data) + "\n")
+	f.CheckBuffer(false, false)
+}
+
+func TestInfoFormat(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	sha1tree, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"dir1/bar": "bar\n", "file1": "content1"})
+
+	f.Run([]string{"info", "-root=\\test_archive", "-format=csv", nodeName}, 0)
+	f.CheckOut("path,sha1,size,hard_link_to,compressed,stored_size\ndir1/bar," + sha1tree["dir1/bar"] + ",4,,false,4\nfile1," + sha1tree["file1"] + ",8,,false,8\n")
+	f.Run([]string{"info", "-root=\\test_archive", "-format=json", nodeName}, 0)
+	f.CheckOut("[\n" +
+		"  {\"path\": \"dir1/bar\", \"sha1\": \"" + sha1tree["dir1/bar"] + "\", \"size\": 4, \"hard_link_to\": \"\", \"compressed\": false, \"stored_size\": 4},\n" +
+		"  {\"path\": \"file1\", \"sha1\": \"" + sha1tree["file1"] + "\", \"size\": 8, \"hard_link_to\": \"\", \"compressed\": false, \"stored_size\": 8}\n" +
+		"]\n")
+	f.Run([]string{"info", "-root=\\test_archive", "-format=text", nodeName}, 0)
+	f.CheckOut(" dir1/bar(4)\n file1(8)\nTotal 2\n")
+
+	f.Run([]string{"info", "-root=\\test_archive", "-format=xml", nodeName}, 2)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"info", "-root=\\test_archive", "-format=csv", "-json", nodeName}, exitUsage)
+	f.CheckBuffer(false, true)
+}
+
+func TestInfoSummary(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	tree := map[string]string{
+		"dir1/bar":           "bar\n",
+		"dir1/dir2/dir3/foo": "foo\n",
+		"dir1/dir2/file2":    "content2",
+		"file1":              "content1",
+		"x":                  "x\n",
+	}
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
+
+	f.Run([]string{"info", "-root=\\test_archive", "-summary", nodeName}, 0)
+	expected := "Node: " + filepath.ToSlash(nodeName) + "\nComment: useful comment\nFiles: 5\nDirectories: 3\nSize: 26 bytes\nLargest: dir1/dir2/file2(8)\n"
+	f.CheckOut(expected)
+	f.CheckBuffer(false, false)
+
+	f.Run([]string{"info", "-root=\\test_archive", "-summary", "-json", nodeName}, exitUsage)
+	f.CheckBuffer(false, true)
+}
+
+func TestInfoDumpEntry(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	tempData := makeTempDir(t, "info_dump_entry")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"dir1/bar": "bar\n",
+		"file1":    "content1",
+	}
+	sha1tree, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
+
+	dump := filepath.Join(tempData, "entry.json")
+	args := []string{"info", "-root=\\test_archive", "-summary", "-dump-entry=" + dump, nodeName}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	data, err := ioutil.ReadFile(dump)
+	ut.AssertEqual(t, nil, err)
+	expected := "{\n" +
+		"  \"files\": {\n" +
+		"    \"dir1\": {\n" +
+		"      \"files\": {\n" +
+		"        \"bar\": {\n" +
+		"          \"sha1\": \"" + sha1tree["dir1/bar"] + "\",\n" +
+		"          \"size\": 4\n" +
+		"        }\n" +
+		"      }\n" +
+		"    },\n" +
+		"    \"file1\": {\n" +
+		"      \"sha1\": \"" + sha1tree["file1"] + "\",\n" +
+		"      \"size\": 8\n" +
+		"    }\n" +
+		"  }\n" +
+		"}\n"
+	ut.AssertEqual(t, expected, string(data))
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinksSupported is true when getFileID can detect hard links.
+const hardLinksSupported = true
+
+// fileID uniquely identifies a file on the system.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// getFileID returns the identity of a file and true if the file has more than
+// one hard link.
+func getFileID(stat os.FileInfo) (fileID, bool) {
+	s, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok || s.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{uint64(s.Dev), uint64(s.Ino)}, true
+}
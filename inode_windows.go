@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"os"
+)
+
+// hardLinksSupported is true when getFileID can detect hard links.
+const hardLinksSupported = false
+
+// fileID uniquely identifies a file on the system.
+type fileID struct{}
+
+// getFileID is not implemented on Windows since os.FileInfo doesn't expose the
+// file index.
+func getFileID(stat os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,66 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/maruel/subcommands"
+)
+
+var cmdLabel = &subcommands.Command{
+	UsageLine: "label <node> <label>",
+	ShortDesc: "labels a node",
+	LongDesc:  "Makes tags/labels/<label> point to <node> in a DumbCas(tm) archive. Unlike the tags, a label is only moved by labeling another node and it protects its node from clean. When <node> is a tag, the node it points to is labeled.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &labelRun{}
+		c.Init()
+		return c
+	},
+}
+
+type labelRun struct {
+	CommonFlags
+}
+
+func (c *labelRun) main(a DumbcasApplication, nodeArg, label string) error {
+	c.exclusive = true
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+	nodeName, err := resolveNodeArg(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+	if isTag(nodeName) {
+		if nodeName, err = resolveTag(c.nodes, nodeName[len("tags/"):]); err != nil {
+			return err
+		}
+	}
+	if err := c.nodes.SetLabel(label, nodeName); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Labeled %s as %s\n", nodeName, label)
+	return nil
+}
+
+func (c *labelRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 2 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide a <node> and a <label>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0], args[1]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
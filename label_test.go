@@ -0,0 +1,77 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestLabel(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	_, node1, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content2"})
+	_, node3, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content3"})
+
+	f.Run([]string{"label", "-root=\\test_archive", node1, "release"}, 0)
+	f.CheckOut("Labeled " + node1 + " as release\n")
+	f.Run([]string{"label", "-root=\\test_archive", "tags/fictious", "pre-upgrade"}, 0)
+	f.CheckOut("Labeled " + node3 + " as pre-upgrade\n")
+	f.Run([]string{"labels", "-root=\\test_archive"}, 0)
+	f.CheckOut("pre-upgrade: " + filepath.ToSlash(node3) + "\nrelease: " + filepath.ToSlash(node1) + "\n")
+	f.Run([]string{"labels", "-root=\\test_archive", "-format=csv"}, 0)
+	f.CheckOut("label,node\npre-upgrade," + filepath.ToSlash(node3) + "\nrelease," + filepath.ToSlash(node1) + "\n")
+
+	// The labeled node is kept by clean.
+	f.Run([]string{"clean", "-root=\\test_archive", "-keep-last=1"}, 0)
+	f.CheckOut("Removed node " + node2 + "\nRemoved 1 nodes and 2 objects, reclaiming 0.0mb\n")
+	tempData := makeTempDir(t, "label")
+	defer removeDir(t, tempData)
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, "tags/labels/release"}, 0)
+	f.CheckBuffer(true, false)
+	actual, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"file1": "content1"}, actual)
+
+	f.Run([]string{"label", "-root=\\test_archive", node1, "a/b"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"label", "-root=\\test_archive", node1}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestLabelPointerTags(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "label_pointer")
+	defer removeDir(t, tempData)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	nodes, err := dumbcaslib.LoadLocalNodesTable(tempData, f.cas, dumbcaslib.NodesTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	f.nodes = nodes
+	_, node1, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content2"})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content3"})
+	f.Run([]string{"label", "-root=\\test_archive", node1, "release"}, 0)
+	f.CheckOut("Labeled " + node1 + " as release\n")
+
+	// The labels are found without symlinks too.
+	symlinksToPointers(t, tempData)
+	f.Run([]string{"labels", "-root=\\test_archive"}, 0)
+	f.CheckOut("release: " + filepath.ToSlash(node1) + "\n")
+	f.Run([]string{"clean", "-root=\\test_archive", "-keep-last=1"}, 0)
+	f.CheckOut("Removed node " + node2 + "\nRemoved 1 nodes and 2 objects, reclaiming 0.0mb\n")
+}
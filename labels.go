@@ -0,0 +1,76 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdLabels = &subcommands.Command{
+	UsageLine: "labels",
+	ShortDesc: "lists the labels",
+	LongDesc:  "Lists the labels of a DumbCas(tm) archive and the node each one points to.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &labelsRun{}
+		c.Init()
+		c.Flags.Var(&c.format, "format", formatUsage)
+		return c
+	},
+}
+
+type labelsRun struct {
+	CommonFlags
+	format outputFormat
+}
+
+func (c *labelsRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	names, err := dumbcaslib.EnumerateNodesAsList(c.nodes)
+	if err != nil {
+		return err
+	}
+	out := makeRowPrinter(a.GetOut(), c.format, []string{"label", "node"}, func(w io.Writer, row []interface{}) {
+		fmt.Fprintf(w, "%s: %s\n", row[0], row[1])
+	})
+	for _, name := range names {
+		if !isLabel(name) {
+			continue
+		}
+		label := filepath.ToSlash(name)[len("tags/labels/"):]
+		target, err := resolveTag(c.nodes, "labels/"+label)
+		if err != nil {
+			return err
+		}
+		if err := out.print(label, filepath.ToSlash(target)); err != nil {
+			return err
+		}
+	}
+	return out.close()
+}
+
+func (c *labelsRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -10,6 +10,7 @@ limitations under the License. */
 package main
 
 import (
+	"io"
 	"log"
 	"os"
 
@@ -22,14 +23,31 @@ var application = &subcommands.DefaultApplication{
 	Name:  "dumbcas",
 	Title: "Dumbcas is a simple Content Addressed Datastore to be used as a simple backup tool.",
 	Commands: []*subcommands.Command{
+		cmdAnnotate,
 		cmdArchive,
+		cmdArchiveFile,
+		cmdArchiveTar,
+		cmdCacheRebuild,
+		cmdClean,
+		cmdCompare,
+		cmdEnumerate,
 		cmdFsck,
 		cmdGc,
 		subcommands.CmdHelp,
+		cmdIdentical,
 		cmdInfo,
+		cmdLabel,
+		cmdLabels,
+		cmdMount,
+		cmdNodesExport,
+		cmdNodesImport,
+		cmdPut,
 		cmdRestore,
+		cmdSyncCas,
+		cmdTrash,
 		cmdVersion,
 		cmdWeb,
+		cmdWhoReferences,
 	},
 }
 
@@ -37,9 +55,14 @@ var application = &subcommands.DefaultApplication{
 type DumbcasApplication interface {
 	subcommandstest.Application
 	// LoadCache must return a valid Cache instance even in case of failure.
-	LoadCache() (dumbcaslib.Cache, error)
-	MakeCasTable(rootDir string) (dumbcaslib.CasTable, error)
-	LoadNodesTable(rootDir string, cas dumbcaslib.CasTable) (dumbcaslib.NodesTable, error)
+	// rootDir is the root to keep the cache in, or "" for the cache shared by
+	// all the roots.
+	LoadCache(rootDir string) (dumbcaslib.Cache, error)
+	MakeCasTable(rootDir string, opts dumbcaslib.CasTableOptions) (dumbcaslib.CasTable, error)
+	LoadNodesTable(rootDir string, cas dumbcaslib.CasTable, opts dumbcaslib.NodesTableOptions) (dumbcaslib.NodesTable, error)
+	MakeRefIndexTable(rootDir string) dumbcaslib.RefIndexTable
+	// LockRoot takes the lock of the root for a command modifying it.
+	LockRoot(rootDir string) (io.Closer, error)
 }
 
 type dumbapp struct {
@@ -52,16 +75,27 @@ func (d *dumbapp) GetLog() *log.Logger {
 	return d.log
 }
 
-func (d *dumbapp) LoadCache() (dumbcaslib.Cache, error) {
+func (d *dumbapp) LoadCache(rootDir string) (dumbcaslib.Cache, error) {
+	if rootDir != "" {
+		return dumbcaslib.LoadRootCache(rootDir)
+	}
 	return dumbcaslib.LoadCache()
 }
 
-func (d *dumbapp) MakeCasTable(rootDir string) (dumbcaslib.CasTable, error) {
-	return dumbcaslib.MakeLocalCasTable(rootDir)
+func (d *dumbapp) MakeCasTable(rootDir string, opts dumbcaslib.CasTableOptions) (dumbcaslib.CasTable, error) {
+	return dumbcaslib.MakeLocalCasTable(rootDir, opts)
 }
 
-func (d *dumbapp) LoadNodesTable(rootDir string, cas dumbcaslib.CasTable) (dumbcaslib.NodesTable, error) {
-	return dumbcaslib.LoadLocalNodesTable(rootDir, cas)
+func (d *dumbapp) LoadNodesTable(rootDir string, cas dumbcaslib.CasTable, opts dumbcaslib.NodesTableOptions) (dumbcaslib.NodesTable, error) {
+	return dumbcaslib.LoadLocalNodesTable(rootDir, cas, opts)
+}
+
+func (d *dumbapp) MakeRefIndexTable(rootDir string) dumbcaslib.RefIndexTable {
+	return dumbcaslib.MakeLocalRefIndexTable(rootDir)
+}
+
+func (d *dumbapp) LockRoot(rootDir string) (io.Closer, error) {
+	return dumbcaslib.LockRoot(rootDir)
 }
 
 func main() {
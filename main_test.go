@@ -10,6 +10,9 @@ limitations under the License. */
 package main
 
 import (
+	"fmt"
+	"io"
+	"sync"
 	"testing"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
@@ -27,8 +30,18 @@ type DumbcasAppMock struct {
 	*subcommandstest.ApplicationMock
 	// Statefullness
 	cache dumbcaslib.Cache
-	cas   dumbcaslib.CasTable
-	nodes dumbcaslib.NodesTable
+	// cacheRoot is the rootDir passed to LoadCache.
+	cacheRoot string
+	cas       dumbcaslib.CasTable
+	// casOptions are the options of the last MakeCasTable call.
+	casOptions dumbcaslib.CasTableOptions
+	// mirrors are the tables returned for the other roots, if any.
+	mirrors map[string]dumbcaslib.CasTable
+	nodes   dumbcaslib.NodesTable
+	refs    dumbcaslib.RefIndexTable
+	// locked are the roots currently locked.
+	lock   sync.Mutex
+	locked map[string]bool
 }
 
 func (a *DumbcasAppMock) Run(args []string, expected int) {
@@ -37,27 +50,64 @@ func (a *DumbcasAppMock) Run(args []string, expected int) {
 	ut.AssertEqual(a, expected, returncode)
 }
 
-func (a *DumbcasAppMock) MakeCasTable(rootDir string) (dumbcaslib.CasTable, error) {
+func (a *DumbcasAppMock) MakeCasTable(rootDir string, opts dumbcaslib.CasTableOptions) (dumbcaslib.CasTable, error) {
+	a.casOptions = opts
+	if t, ok := a.mirrors[rootDir]; ok {
+		return t, nil
+	}
 	if a.cas == nil {
 		a.cas = dumbcaslib.MakeMemoryCasTable()
 	}
 	return a.cas, nil
 }
 
-func (a *DumbcasAppMock) LoadCache() (dumbcaslib.Cache, error) {
+func (a *DumbcasAppMock) LoadCache(rootDir string) (dumbcaslib.Cache, error) {
+	a.cacheRoot = rootDir
 	if a.cache == nil {
 		a.cache = dumbcaslib.MakeMemoryCache()
 	}
 	return a.cache, nil
 }
 
-func (a *DumbcasAppMock) LoadNodesTable(rootDir string, cas dumbcaslib.CasTable) (dumbcaslib.NodesTable, error) {
+func (a *DumbcasAppMock) LoadNodesTable(rootDir string, cas dumbcaslib.CasTable, opts dumbcaslib.NodesTableOptions) (dumbcaslib.NodesTable, error) {
 	if a.nodes == nil {
 		a.nodes = dumbcaslib.MakeMemoryNodesTable(a.cas)
 	}
 	return a.nodes, nil
 }
 
+func (a *DumbcasAppMock) MakeRefIndexTable(rootDir string) dumbcaslib.RefIndexTable {
+	if a.refs == nil {
+		a.refs = dumbcaslib.MakeMemoryRefIndexTable()
+	}
+	return a.refs
+}
+
+type mockLock struct {
+	a       *DumbcasAppMock
+	rootDir string
+}
+
+func (m *mockLock) Close() error {
+	m.a.lock.Lock()
+	defer m.a.lock.Unlock()
+	delete(m.a.locked, m.rootDir)
+	return nil
+}
+
+func (a *DumbcasAppMock) LockRoot(rootDir string) (io.Closer, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.locked[rootDir] {
+		return nil, fmt.Errorf("Another operation is in progress on %s", rootDir)
+	}
+	if a.locked == nil {
+		a.locked = map[string]bool{}
+	}
+	a.locked[rootDir] = true
+	return &mockLock{a, rootDir}, nil
+}
+
 func makeDumbcasAppMock(t *testing.T) *DumbcasAppMock {
 	return &DumbcasAppMock{ApplicationMock: subcommandstest.MakeAppMock(t, application)}
 }
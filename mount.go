@@ -0,0 +1,78 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdMount = &subcommands.Command{
+	UsageLine: "mount <node> <mountpoint>",
+	ShortDesc: "mounts a node as a read-only file system",
+	LongDesc:  "Mounts the files of <node> from a DumbCas(tm) archive as a read-only FUSE file system at <mountpoint> until interrupted with Ctrl-C.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &mountRun{}
+		c.Init()
+		return c
+	},
+}
+
+type mountRun struct {
+	CommonFlags
+}
+
+func (c *mountRun) main(a DumbcasApplication, nodeArg, mountPoint string) error {
+	if !fuseSupported {
+		return errors.New("mount is not supported on this platform")
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+
+	nodeArg, err := resolveNodeArg(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+	f, err := c.nodes.Open(nodeArg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	node := &dumbcaslib.Node{}
+	if err := dumbcaslib.LoadReaderAsJSON(f, node); err != nil {
+		return err
+	}
+	entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+	if err != nil {
+		return err
+	}
+	return mountEntry(a.GetLog(), c.cas, entry, mountPoint)
+}
+
+func (c *mountRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 2 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node> and a <mountpoint>.\n", a.GetName())
+		return 1
+	}
+	interrupt.HandleCtrlC()
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0], args[1]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
+)
+
+// fuseSupported is true when mountEntry can mount a file system.
+const fuseSupported = true
+
+// mountEntry serves entry as a read-only file system at mountPoint until it
+// is unmounted or interrupted.
+func mountEntry(l *log.Logger, cas dumbcaslib.CasTable, entry *dumbcaslib.Entry, mountPoint string) error {
+	conn, err := fuse.Mount(mountPoint, fuse.ReadOnly(), fuse.FSName("dumbcas"), fuse.Subtype("dumbcas"))
+	if err != nil {
+		return fmt.Errorf("Failed to mount %s: %s", mountPoint, err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Serve() returns once the file system is unmounted.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt.Channel:
+			if err := fuse.Unmount(mountPoint); err != nil {
+				l.Printf("Failed to unmount %s: %s", mountPoint, err)
+			}
+		case <-done:
+		}
+	}()
+
+	l.Printf("Serving %s", mountPoint)
+	if err := fs.Serve(conn, &fuseFS{cas, entry}); err != nil {
+		return fmt.Errorf("Failed to serve %s: %s", mountPoint, err)
+	}
+	<-conn.Ready
+	return conn.MountError
+}
+
+// fuseFS is the root of the mounted file system.
+type fuseFS struct {
+	cas  dumbcaslib.CasTable
+	root *dumbcaslib.Entry
+}
+
+func (f *fuseFS) Root() (fs.Node, error) {
+	return &fuseDir{f.cas, f.root}, nil
+}
+
+func makeFuseNode(cas dumbcaslib.CasTable, entry *dumbcaslib.Entry) fs.Node {
+	if entry.Sha1 != "" {
+		return &fuseFile{cas, entry}
+	}
+	return &fuseDir{cas, entry}
+}
+
+// fuseDir is a directory; its children are Entry.Files.
+type fuseDir struct {
+	cas   dumbcaslib.CasTable
+	entry *dumbcaslib.Entry
+}
+
+func (d *fuseDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *fuseDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	child, ok := d.entry.Files[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return makeFuseNode(d.cas, child), nil
+}
+
+func (d *fuseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	names := d.entry.SortedFiles()
+	out := make([]fuse.Dirent, 0, len(names))
+	for _, name := range names {
+		t := fuse.DT_Dir
+		if d.entry.Files[name].Sha1 != "" {
+			t = fuse.DT_File
+		}
+		out = append(out, fuse.Dirent{Name: name, Type: t})
+	}
+	return out, nil
+}
+
+// fuseFile is a file streamed from the CAS.
+type fuseFile struct {
+	cas   dumbcaslib.CasTable
+	entry *dumbcaslib.Entry
+}
+
+func (f *fuseFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	a.Size = uint64(f.entry.Size)
+	return nil
+}
+
+func (f *fuseFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	src, err := f.cas.Open(f.entry.Sha1)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s: %s", f.entry.Sha1, err)
+	}
+	// The content never changes.
+	resp.Flags |= fuse.OpenKeepCache
+	return &fuseHandle{src: src}, nil
+}
+
+// fuseHandle is an opened fuseFile.
+type fuseHandle struct {
+	lock sync.Mutex
+	src  dumbcaslib.ReadSeekCloser
+}
+
+func (h *fuseHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, err := h.src.Seek(req.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(h.src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *fuseHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.src.Close()
+}
@@ -0,0 +1,71 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+// TestFuseFS exercises the file system nodes without mounting them.
+func TestFuseFS(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	tree := map[string]string{
+		"dir1/bar": "bar\n",
+		"file1":    "content1",
+	}
+	_, _, entrySha1 := archiveData(t, cas, nodes, tree)
+	entry, err := dumbcaslib.LoadEntry(cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+
+	ctx := context.Background()
+	root, err := (&fuseFS{cas, entry}).Root()
+	ut.AssertEqual(t, nil, err)
+	attr := fuse.Attr{}
+	ut.AssertEqual(t, nil, root.Attr(ctx, &attr))
+	ut.AssertEqual(t, os.ModeDir|0555, attr.Mode)
+
+	dirents, err := root.(fs.HandleReadDirAller).ReadDirAll(ctx)
+	ut.AssertEqual(t, nil, err)
+	expected := []fuse.Dirent{
+		{Name: "dir1", Type: fuse.DT_Dir},
+		{Name: "file1", Type: fuse.DT_File},
+	}
+	ut.AssertEqual(t, expected, dirents)
+
+	_, err = root.(fs.NodeStringLookuper).Lookup(ctx, "missing")
+	ut.AssertEqual(t, fuse.ENOENT, err)
+	dir1, err := root.(fs.NodeStringLookuper).Lookup(ctx, "dir1")
+	ut.AssertEqual(t, nil, err)
+	bar, err := dir1.(fs.NodeStringLookuper).Lookup(ctx, "bar")
+	ut.AssertEqual(t, nil, err)
+	attr = fuse.Attr{}
+	ut.AssertEqual(t, nil, bar.Attr(ctx, &attr))
+	ut.AssertEqual(t, os.FileMode(0444), attr.Mode)
+	ut.AssertEqual(t, uint64(4), attr.Size)
+
+	h, err := bar.(fs.NodeOpener).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	ut.AssertEqual(t, nil, err)
+	resp := &fuse.ReadResponse{}
+	ut.AssertEqual(t, nil, h.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Offset: 1, Size: 4096}, resp))
+	ut.AssertEqual(t, "ar\n", string(resp.Data))
+	ut.AssertEqual(t, nil, h.(fs.HandleReleaser).Release(ctx, &fuse.ReleaseRequest{}))
+}
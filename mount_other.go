@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+)
+
+// fuseSupported is true when mountEntry can mount a file system.
+const fuseSupported = false
+
+func mountEntry(l *log.Logger, cas dumbcaslib.CasTable, entry *dumbcaslib.Entry, mountPoint string) error {
+	return errors.New("FUSE is not supported on this platform")
+}
@@ -0,0 +1,125 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdNodesExport = &subcommands.Command{
+	UsageLine: "nodes-export -o <bundle.json>",
+	ShortDesc: "exports all the nodes into a portable bundle",
+	LongDesc:  "Exports all the nodes and tags of a DumbCas(tm) archive into a single JSON file that can be imported into another root with nodes-import. The CAS objects are not exported.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &nodesExportRun{}
+		c.Init()
+		c.Flags.StringVar(&c.out, "o", "", "File to write the bundle to; defaults to stdout")
+		return c
+	},
+}
+
+type nodesExportRun struct {
+	CommonFlags
+	out string
+}
+
+// nodesBundle is the portable representation of a NodesTable.
+type nodesBundle struct {
+	// Nodes are sorted by name, which is also the chronological order.
+	Nodes []bundleNode
+	// Tags maps each tag to the name of the node it points to.
+	Tags map[string]string `json:",omitempty"`
+	// Labels maps each label to the name of the node it points to.
+	Labels map[string]string `json:",omitempty"`
+}
+
+type bundleNode struct {
+	// Name is the posix-style name of the node in the source NodesTable.
+	Name string
+	Node dumbcaslib.Node
+}
+
+func (c *nodesExportRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	names, err := dumbcaslib.EnumerateNodesAsList(c.nodes)
+	if err != nil {
+		return err
+	}
+	bundle := &nodesBundle{Nodes: []bundleNode{}, Tags: map[string]string{}, Labels: map[string]string{}}
+	for _, name := range names {
+		if isTag(name) {
+			target, err := resolveTag(c.nodes, strings.TrimPrefix(filepath.ToSlash(name), "tags/"))
+			if err != nil {
+				return err
+			}
+			if isLabel(name) {
+				bundle.Labels[filepath.Base(name)] = filepath.ToSlash(target)
+			} else {
+				bundle.Tags[filepath.Base(name)] = filepath.ToSlash(target)
+			}
+			continue
+		}
+		f, err := c.nodes.Open(name)
+		if err != nil {
+			return fmt.Errorf("Failed opening node %s: %s", name, err)
+		}
+		n := bundleNode{Name: filepath.ToSlash(name)}
+		err = dumbcaslib.LoadReaderAsJSON(f, &n.Node)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed reading node %s: %s", name, err)
+		}
+		bundle.Nodes = append(bundle.Nodes, n)
+	}
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	var out io.Writer = a.GetOut()
+	if c.out != "" {
+		f, err := os.Create(c.out)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		out = f
+	}
+	if _, err := out.Write(data); err != nil {
+		return err
+	}
+	a.GetLog().Printf("Exported %d nodes and %d tags", len(bundle.Nodes), len(bundle.Tags))
+	return nil
+}
+
+func (c *nodesExportRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestNodesExportImport(t *testing.T) {
+	t.Parallel()
+	src := makeDumbcasAppMock(t)
+	_, _ = src.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = src.LoadNodesTable("", src.cas, dumbcaslib.NodesTableOptions{})
+	_, srcName, entrySha1 := archiveData(src.TB, src.cas, src.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	ut.AssertEqual(t, nil, src.nodes.SetLabel("release", srcName))
+
+	tempData := makeTempDir(t, "nodes_export")
+	defer removeDir(t, tempData)
+	bundle := filepath.Join(tempData, "bundle.json")
+	src.Run([]string{"nodes-export", "-root=\\test_export", "-o", bundle}, 0)
+	src.CheckBuffer(false, false)
+
+	dst := makeDumbcasAppMock(t)
+	dst.Run([]string{"nodes-import", "-root=\\test_import", bundle}, 0)
+	dst.CheckOut("Imported 1 nodes\n")
+
+	nodes, err := dumbcaslib.EnumerateNodesAsList(dst.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(nodes))
+	ut.AssertEqual(t, "tags/fictious", nodes[1])
+	ut.AssertEqual(t, "tags/labels/release", nodes[2])
+	target, err := resolveTag(dst.nodes, "fictious")
+	ut.AssertEqual(t, nil, err)
+	labeled, err := resolveTag(dst.nodes, "labels/release")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, target, labeled)
+	tag, _, ok := parseNodeName(target)
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, "fictious", tag)
+
+	f, err := dst.nodes.Open(target)
+	ut.AssertEqual(t, nil, err)
+	defer f.Close()
+	node := &dumbcaslib.Node{}
+	ut.AssertEqual(t, nil, dumbcaslib.LoadReaderAsJSON(f, node))
+	ut.AssertEqual(t, entrySha1, node.Entry)
+	ut.AssertEqual(t, "useful comment", node.Comment)
+}
+
+func TestNodesImportIdempotent(t *testing.T) {
+	t.Parallel()
+	src := makeDumbcasAppMock(t)
+	_, _ = src.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = src.LoadNodesTable("", src.cas, dumbcaslib.NodesTableOptions{})
+	_, srcName, _ := archiveData(src.TB, src.cas, src.nodes, map[string]string{"file1": "content1"})
+
+	tempData := makeTempDir(t, "nodes_import")
+	defer removeDir(t, tempData)
+	bundle := filepath.Join(tempData, "bundle.json")
+	src.Run([]string{"nodes-export", "-root=\\test_export", "-o", bundle}, 0)
+
+	dst := makeDumbcasAppMock(t)
+	dst.Run([]string{"nodes-import", "-root=\\test_import", bundle}, 0)
+	dst.CheckOut("Imported 1 nodes\n")
+	nodes, err := dumbcaslib.EnumerateNodesAsList(dst.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+
+	// The original creation time is kept.
+	_, created, _ := parseNodeName(srcName)
+	ut.AssertEqual(t, created.Unix(), loadNode(t, dst.nodes, nodes[0]).Timestamp)
+
+	// Importing again is a no-op.
+	dst.Run([]string{"nodes-import", "-root=\\test_import", bundle}, 0)
+	dst.CheckOut("Imported 0 nodes, skipped 1 already present\n")
+	actual, err := dumbcaslib.EnumerateNodesAsList(dst.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nodes, actual)
+
+	// Only the new node is imported.
+	archiveData(src.TB, src.cas, src.nodes, map[string]string{"file1": "content2"})
+	src.Run([]string{"nodes-export", "-root=\\test_export", "-o", bundle}, 0)
+	dst.Run([]string{"nodes-import", "-root=\\test_import", bundle}, 0)
+	dst.CheckOut("Imported 1 nodes, skipped 1 already present\n")
+	actual, err = dumbcaslib.EnumerateNodesAsList(dst.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(actual))
+}
+
+func TestParseNodeName(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		in  string
+		tag string
+		ok  bool
+	}{
+		{"2012-01/host_2012-01-02_03-04-05_foo", "foo", true},
+		{"2012-01/host_name_2012-01-02_03-04-05_foo(2)", "foo", true},
+		{"2012-01/2012-01-02_03-04-05_foo_bar", "foo_bar", true},
+		{"tags/foo", "", false},
+	}
+	for i, d := range data {
+		tag, _, ok := parseNodeName(d.in)
+		ut.AssertEqualIndex(t, i, d.ok, ok)
+		ut.AssertEqualIndex(t, i, d.tag, tag)
+	}
+}
@@ -0,0 +1,178 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdNodesImport = &subcommands.Command{
+	UsageLine: "nodes-import <bundle.json>",
+	ShortDesc: "imports nodes from a bundle created with nodes-export",
+	LongDesc:  "Recreates the nodes, tags and labels listed in a bundle created by nodes-export. The nodes already present, with the same entry and creation time, are skipped so a bundle can be imported repeatedly. The CAS objects referenced by the nodes must be copied separately.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &nodesImportRun{}
+		c.Init()
+		c.InitNodeNameTemplate()
+		return c
+	},
+}
+
+type nodesImportRun struct {
+	CommonFlags
+}
+
+// nodeKey identifies a node across roots, since the node name changes on
+// import.
+func nodeKey(entry string, created time.Time) string {
+	return fmt.Sprintf("%s@%d", entry, created.Unix())
+}
+
+// existingNodes returns the name of the nodes already in the table by their
+// key.
+func (c *nodesImportRun) existingNodes() (map[string]string, error) {
+	names, err := dumbcaslib.EnumerateNodesAsList(c.nodes)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]string{}
+	for _, name := range names {
+		if isTag(name) {
+			continue
+		}
+		data, err := readNode(c.nodes, name)
+		if err != nil {
+			return nil, err
+		}
+		node := &dumbcaslib.Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			return nil, fmt.Errorf("Failed reading node %s: %s", name, err)
+		}
+		if created, ok := nodeTimestamp(name, node); ok {
+			existing[nodeKey(node.Entry, created)] = name
+		}
+	}
+	return existing, nil
+}
+
+func (c *nodesImportRun) main(a DumbcasApplication, bundlePath string) error {
+	c.exclusive = true
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	bundle := &nodesBundle{}
+	if err := dumbcaslib.LoadReaderAsJSON(f, bundle); err != nil {
+		return fmt.Errorf("Failed to read %s: %s", bundlePath, err)
+	}
+
+	// The tag is always updated to the last node added with this name, so add
+	// the nodes that are pointed to by a tag last.
+	targets := map[string]bool{}
+	for _, target := range bundle.Tags {
+		targets[target] = true
+	}
+	ordered := make([]bundleNode, 0, len(bundle.Nodes))
+	for _, n := range bundle.Nodes {
+		if !targets[n.Name] {
+			ordered = append(ordered, n)
+		}
+	}
+	for _, n := range bundle.Nodes {
+		if targets[n.Name] {
+			ordered = append(ordered, n)
+		}
+	}
+
+	existing, err := c.existingNodes()
+	if err != nil {
+		return err
+	}
+	imported := 0
+	// renamed maps the name of each node in the bundle to its name in the table.
+	renamed := map[string]string{}
+	for i := range ordered {
+		n := &ordered[i]
+		tag, _, _ := nodeInfo(n.Name, &n.Node)
+		if tag == "" {
+			tag = path.Base(n.Name)
+		}
+		// The new node is named after the time of the import so keep the
+		// original creation time in the node itself.
+		key := ""
+		if created, ok := nodeTimestamp(n.Name, &n.Node); ok {
+			key = nodeKey(n.Node.Entry, created)
+			if name, ok := existing[key]; ok {
+				a.GetLog().Printf("Skipped %s, already present as %s", n.Name, name)
+				renamed[n.Name] = name
+				continue
+			}
+			n.Node.Timestamp = created.Unix()
+		}
+		newName, err := c.nodes.AddEntry(&n.Node, tag)
+		if err != nil {
+			return fmt.Errorf("Failed to import %s: %s", n.Name, err)
+		}
+		a.GetLog().Printf("Imported %s as %s", n.Name, newName)
+		if key != "" {
+			existing[key] = newName
+		}
+		renamed[n.Name] = newName
+		imported++
+	}
+	labels := make([]string, 0, len(bundle.Labels))
+	for label := range bundle.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		name, ok := renamed[bundle.Labels[label]]
+		if !ok {
+			return fmt.Errorf("Label %s points to the unknown node %s", label, bundle.Labels[label])
+		}
+		if err := c.nodes.SetLabel(label, name); err != nil {
+			return err
+		}
+	}
+	if skipped := len(ordered) - imported; skipped != 0 {
+		fmt.Fprintf(a.GetOut(), "Imported %d nodes, skipped %d already present\n", imported, skipped)
+	} else {
+		fmt.Fprintf(a.GetOut(), "Imported %d nodes\n", imported)
+	}
+	return nil
+}
+
+func (c *nodesImportRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a bundle file.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdPut = &subcommands.Command{
+	UsageLine: "put [<file>|-]",
+	ShortDesc: "stores a single object in the CAS",
+	LongDesc:  "Stores the content of <file>, or of stdin when <file> is - or omitted, as a single object in a DumbCas(tm) archive and prints its hash. No node is created so the object is not protected from gc.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &putRun{}
+		c.Init()
+		c.InitMirror()
+		c.InitTempDir()
+		c.Flags.StringVar(&c.compress, "compress", "none", "Codec used to compress the new objects: none, gzip or zstd; the objects are always read whatever their codec")
+		return c
+	},
+}
+
+type putRun struct {
+	CommonFlags
+}
+
+func (c *putRun) main(a DumbcasApplication, source io.Reader) error {
+	c.exclusive = true
+	if err := c.Parse(a, false); err != nil {
+		return err
+	}
+	defer c.unlock()
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		return fmt.Errorf("Failed to read the input: %s", err)
+	}
+	hash, err := dumbcaslib.AddBytes(c.cas, data)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to store %s: %s", hash, err)
+	}
+	fmt.Fprintf(a.GetOut(), "%s\n", hash)
+	return nil
+}
+
+func (c *putRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) > 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Can only provide one <file>.\n", a.GetName())
+		return 1
+	}
+	var source io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+			return 1
+		}
+		defer f.Close()
+		source = f
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, source); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
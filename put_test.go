@@ -0,0 +1,45 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestPut(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "put")
+	defer removeDir(t, tempData)
+	src := filepath.Join(tempData, "blob")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, []byte("content1"), 0600))
+
+	f.Run([]string{"put", "-root=\\test_archive", src}, 0)
+	f.CheckOut(sha1String("content1") + "\n")
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{sha1String("content1")}, items)
+
+	// Storing it again is a no-op.
+	f.Run([]string{"put", "-root=\\test_archive", src}, 0)
+	f.CheckOut(sha1String("content1") + "\n")
+}
+
+func TestPutTooManyArgs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"put", "-root=\\test_archive", "a", "b"}, 1)
+	f.CheckBuffer(false, true)
+}
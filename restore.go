@@ -10,11 +10,15 @@ limitations under the License. */
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/interrupt"
@@ -24,68 +28,416 @@ import (
 var cmdRestore = &subcommands.Command{
 	UsageLine: "restore <node> -out <out>",
 	ShortDesc: "restores a tree from a dumbcas archive",
-	LongDesc:  "Restores files listed in <node> archive to a directory from a DumbCas(tm) archive.",
+	LongDesc:  "Restores files listed in <node> archive to a directory from a DumbCas(tm) archive. <node> can be @<tag> to restore the latest node of a tag.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &restoreRun{}
 		c.Init()
-		c.Flags.StringVar(&c.Out, "out", "", "Directory to restore data to; required.")
+		c.Flags.StringVar(&c.Out, "out", "", "Directory to restore data to, or sftp://[user@]host[:port]/path to restore to another host; required.")
+		c.Flags.BoolVar(&c.preservePrefix, "preserve-prefix", false, "Restores the files archived with -orig-path at their original absolute path under -out, e.g. /etc/passwd is restored as <out>/etc/passwd")
+		c.Flags.IntVar(&c.bufferSize, "buffer-size", 1024*1024, "Size of the buffer used to copy each file")
+		c.Flags.Int64Var(&c.limitRate, "limit-rate", 0, "Maximum number of bytes written per second; 0 means unlimited")
+		c.Flags.DurationVar(&c.progressInterval, "progress-interval", 5*time.Second, "Interval between progress updates")
+		c.Flags.StringVar(&c.base, "base", "", "Node previously restored to -out; the files it restored that are unchanged on disk and in <node> are skipped, the others are replaced")
+		c.Flags.BoolVar(&c.baseHash, "base-hash", false, "Hashes the files on disk to compare them with -base instead of only comparing their size")
+		c.Flags.BoolVar(&c.verifyAfter, "verify-after", false, "Re-hashes each restored file once done and compares it with the node, reporting the missing or mismatched files")
 		return c
 	},
 }
 
 type restoreRun struct {
 	CommonFlags
-	Out string
+	Out              string
+	bufferSize       int
+	limitRate        int64
+	progressInterval time.Duration
+	preservePrefix   bool
+	verifyAfter      bool
+	base             string
+	baseHash         bool
+}
+
+// restorer holds the state shared while restoring a tree.
+type restorer struct {
+	log *log.Logger
+	cas dumbcaslib.CasTable
+	// sink is where the files are written.
+	sink FileSink
+	// bufs is a pool of *[]byte used to copy the files.
+	bufs sync.Pool
+	// links are the hard links to create once the files are restored.
+	links []pendingLink
+	// prefixRoot, when set, is the directory under which the files with an
+	// OrigPath are restored at their original path.
+	prefixRoot string
+	// bucket, when set, throttles the writes.
+	bucket *tokenBucket
+	// baseHash hashes the files on disk to compare them with the base node.
+	baseHash bool
+	// Progress, updated while restoring.
+	nbRestored    syncInt
+	bytesRestored syncInt
+	nbSkipped     syncInt
+	bytesSkipped  syncInt
+}
+
+// pendingLink is a hard link to create at dst.
+type pendingLink struct {
+	entry *dumbcaslib.Entry
+	dst   string
+}
+
+func makeRestorer(l *log.Logger, cas dumbcaslib.CasTable, bufferSize int) *restorer {
+	r := &restorer{log: l, cas: cas, sink: localSink{}}
+	r.bufs.New = func() interface{} {
+		b := make([]byte, bufferSize)
+		return &b
+	}
+	return r
+}
+
+// tokenBucket limits the throughput to rate bytes per second, allowing bursts
+// of up to one second.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func makeTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take consumes n tokens, sleeping as needed. n may be larger than the bucket;
+// the deficit is paid by sleeping.
+func (t *tokenBucket) take(n int) {
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	if t.tokens < 0 {
+		time.Sleep(time.Duration(-t.tokens / t.rate * float64(time.Second)))
+	}
+}
+
+// throttledWriter waits for the bucket before each write.
+type throttledWriter struct {
+	io.Writer
+	bucket *tokenBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	t.bucket.take(len(p))
+	return t.Writer.Write(p)
+}
+
+// copyFile copies src into dst using a buffer from the pool. The io.ReaderFrom
+// and io.WriterTo implementations are hidden so the buffer is always used.
+func (r *restorer) copyFile(dst io.Writer, src io.Reader) (int64, error) {
+	buf := r.bufs.Get().(*[]byte)
+	defer r.bufs.Put(buf)
+	if r.bucket != nil {
+		dst = &throttledWriter{dst, r.bucket}
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// validHoles returns true if entry has holes that are sorted and within the
+// file.
+func validHoles(entry *dumbcaslib.Entry) bool {
+	if len(entry.Holes) == 0 {
+		return false
+	}
+	end := int64(0)
+	for _, h := range entry.Holes {
+		if h[0] < end || h[1] <= 0 || h[0]+h[1] > entry.Size {
+			return false
+		}
+		end = h[0] + h[1]
+	}
+	return true
+}
+
+// copySparse copies the data of src into dst, skipping the holes of entry so
+// they stay unallocated. Returns the size of dst.
+func (r *restorer) copySparse(dst SinkFile, src io.ReadSeeker, entry *dumbcaslib.Entry) (int64, error) {
+	offset := int64(0)
+	for i := 0; i <= len(entry.Holes); i++ {
+		// The data up to the next hole or the end of the file.
+		end, next := entry.Size, entry.Size
+		if i < len(entry.Holes) {
+			end, next = entry.Holes[i][0], entry.Holes[i][0]+entry.Holes[i][1]
+		}
+		if end > offset {
+			if _, err := src.Seek(offset, io.SeekStart); err != nil {
+				return 0, err
+			}
+			if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+				return 0, err
+			}
+			n, err := r.copyFile(dst, io.LimitReader(src, end-offset))
+			if err != nil {
+				return 0, err
+			}
+			if n != end-offset {
+				// The object is too short.
+				return offset + n, nil
+			}
+		}
+		offset = next
+	}
+	// Extends the file when it ends with a hole.
+	if err := dst.Truncate(entry.Size); err != nil {
+		return 0, err
+	}
+	return entry.Size, nil
+}
+
+// dstPath returns where entry is restored; treePath is its location based on
+// the Entry tree.
+func (r *restorer) dstPath(entry *dumbcaslib.Entry, treePath string) string {
+	if r.prefixRoot == "" || entry.OrigPath == "" {
+		return treePath
+	}
+	p := filepath.FromSlash(entry.OrigPath)
+	if v := filepath.VolumeName(p); v != "" {
+		// "C:\foo" is restored as "<out>\C\foo".
+		p = strings.TrimSuffix(v, ":") + string(filepath.Separator) + p[len(v):]
+	}
+	// Clean it as an absolute path first so it can't escape prefixRoot.
+	return filepath.Join(r.prefixRoot, filepath.Clean(string(filepath.Separator)+p))
+}
+
+// unchanged returns true if dst, restored from base, still matches it and entry
+// has the same content, so it doesn't need to be restored again.
+func (r *restorer) unchanged(entry, base *dumbcaslib.Entry, dst string) bool {
+	if base.Sha1 != entry.Sha1 || base.HardLinkTo != "" {
+		return false
+	}
+	stat, err := r.sink.Lstat(dst)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != base.Size {
+		return false
+	}
+	if !r.baseHash {
+		return true
+	}
+	digest, err := r.sha1(dst)
+	return err == nil && digest == base.Sha1
+}
+
+// sha1 returns the hash of the file dst written to the sink.
+func (r *restorer) sha1(dst string) (string, error) {
+	f, err := r.sink.Open(dst)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return sha1Reader(f)
 }
 
 // Restores entries and keep going on in case of error. Returns the first seen
 // error.
-// Do not overwrite files. A file already present is considered an error.
-func restoreEntry(l *log.Logger, cas dumbcaslib.CasTable, entry *dumbcaslib.Entry, root string) (count int, out error) {
-	if entry.Sha1 != "" {
-		f, err := cas.Open(entry.Sha1)
-		if err != nil {
-			out = fmt.Errorf("Failed to fetch %s for %s: %s", entry.Sha1, root, err)
+// Do not overwrite files. A file already present is considered an error,
+// unless base, the entry at the same path in the node previously restored
+// there, has a file: it is then skipped if unchanged or replaced.
+// Hard links are only recorded; restoreLinks() must be called afterward.
+func (r *restorer) restoreEntry(entry, base *dumbcaslib.Entry, root string) (count int, out error) {
+	if interrupt.IsSet() {
+		return 0, errInterrupted
+	}
+	if entry.HardLinkTo != "" {
+		// Its target may not be restored yet.
+		r.links = append(r.links, pendingLink{entry, r.dstPath(entry, root)})
+	} else if entry.Sha1 != "" {
+		dst := r.dstPath(entry, root)
+		fromBase := base != nil && base.Sha1 != ""
+		if fromBase && r.unchanged(entry, base, dst) {
+			r.nbSkipped.Add(1)
+			r.bytesSkipped.Add(entry.Size)
+			r.log.Printf("%s(%d): unchanged", dst, entry.Size)
+		} else {
+			if fromBase {
+				// It was restored from base, so it can be replaced.
+				_ = r.sink.Remove(dst)
+			}
+			if out = r.restoreFile(entry, dst); out == nil {
+				count++
+			}
+		}
+	}
+	for name, child := range entry.Files {
+		var childBase *dumbcaslib.Entry
+		if base != nil {
+			childBase = base.Files[name]
+		}
+		c, err := r.restoreEntry(child, childBase, filepath.Join(root, name))
+		if err != nil && out == nil {
+			out = err
+		}
+		count += c
+	}
+	return
+}
+
+// restoreFile writes the content of entry to dst.
+func (r *restorer) restoreFile(entry *dumbcaslib.Entry, dst string) (out error) {
+	f, err := r.cas.Open(entry.Sha1)
+	if err != nil {
+		out = fmt.Errorf("Failed to fetch %s for %s: %s", entry.Sha1, dst, err)
+	} else {
+		defer func() {
+			_ = f.Close()
+		}()
+		baseDir := filepath.Dir(dst)
+		if err = r.sink.MkdirAll(baseDir); err != nil && !os.IsExist(err) {
+			out = fmt.Errorf("Failed to create %s: %s", baseDir, err)
 		} else {
-			defer func() {
-				_ = f.Close()
-			}()
-			baseDir := filepath.Dir(root)
-			if err = os.MkdirAll(baseDir, 0755); err != nil && !os.IsExist(err) {
-				out = fmt.Errorf("Failed to create %s: %s", baseDir, err)
+			d, err := r.sink.Create(dst)
+			if err != nil {
+				out = fmt.Errorf("Failed to create %s in %s: %s", dst, baseDir, err)
 			} else {
-				dst, err := os.OpenFile(root, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+				var size int64
+				if validHoles(entry) {
+					size, err = r.copySparse(d, f, entry)
+				} else {
+					size, err = r.copyFile(d, f)
+				}
+				if err2 := d.Close(); err == nil {
+					err = err2
+				}
 				if err != nil {
-					out = fmt.Errorf("Failed to create %s in %s: %s", root, baseDir, err)
+					out = fmt.Errorf("Failed to copy %s: %s", dst, err)
+				} else if size != entry.Size {
+					out = fmt.Errorf("Failed to write %s, expected %d, wrote %d", dst, entry.Size, size)
 				} else {
-					size, err := io.Copy(dst, f)
-					if err != nil {
-						out = fmt.Errorf("Failed to copy %s: %s", root, err)
-					} else if size != entry.Size {
-						out = fmt.Errorf("Failed to write %s, expected %d, wrote %d", root, entry.Size, size)
-					} else {
-						count++
+					r.nbRestored.Add(1)
+					r.bytesRestored.Add(size)
+					if len(entry.Xattrs) != 0 {
+						// The content is restored, only warn.
+						if err := r.sink.SetXattrs(dst, entry.Xattrs); err != nil {
+							r.log.Printf("Failed to set the extended attributes of %s: %s", dst, err)
+						}
 					}
 				}
 			}
 		}
-		if out != nil {
-			l.Printf("%s(%d): %s", root, entry.Size, out)
+	}
+	if out != nil {
+		r.log.Printf("%s(%d): %s", dst, entry.Size, out)
+	} else {
+		r.log.Printf("%s(%d)", dst, entry.Size)
+	}
+	return
+}
+
+// restoreLinks creates the hard links found by restoreEntry() when restoring
+// top into root. It falls back to copying the content when a link can't be
+// created.
+func (r *restorer) restoreLinks(top *dumbcaslib.Entry, root string) (count int, out error) {
+	for _, l := range r.links {
+		if interrupt.IsSet() {
+			if out == nil {
+				out = errors.New("Was interrupted.")
+			}
+			break
+		}
+		target := filepath.Join(root, filepath.FromSlash(l.entry.HardLinkTo))
+		if t := findEntry(top, l.entry.HardLinkTo); t != nil {
+			target = r.dstPath(t, target)
+		}
+		err := r.sink.MkdirAll(filepath.Dir(l.dst))
+		if err == nil {
+			err = r.sink.Link(target, l.dst)
+		}
+		if err != nil {
+			r.log.Printf("Failed to link %s to %s: %s; copying instead", l.dst, target, err)
+			err = r.restoreFile(l.entry, l.dst)
 		} else {
-			l.Printf("%s(%d)", root, entry.Size)
+			r.log.Printf("%s -> %s", l.dst, target)
+			r.nbRestored.Add(1)
 		}
+		if err != nil {
+			if out == nil {
+				out = err
+			}
+			continue
+		}
+		count++
 	}
-	for name, child := range entry.Files {
-		c, err := restoreEntry(l, cas, child, filepath.Join(root, name))
-		if err != nil && out == nil {
-			out = err
+	r.links = nil
+	return
+}
+
+// verifyRestored re-hashes the files of top restored in root and logs the
+// ones missing or not matching their entry. Returns the number of files
+// checked and the number of problems.
+func (r *restorer) verifyRestored(top *dumbcaslib.Entry, root string) (count int, bad int) {
+	_ = top.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 == "" {
+			return nil
+		}
+		count++
+		dst := r.dstPath(e, filepath.Join(root, filepath.FromSlash(relPath)))
+		digest, err := r.sha1(dst)
+		if err != nil {
+			bad++
+			r.log.Printf("Failed to verify %s: %s", dst, err)
+		} else if digest != e.Sha1 {
+			bad++
+			r.log.Printf("%s has sha1 %s, expected %s", dst, digest, e.Sha1)
+		}
+		return nil
+	})
+	return
+}
+
+// findEntry returns the Entry at posix-style relPath in top or nil.
+func findEntry(top *dumbcaslib.Entry, relPath string) *dumbcaslib.Entry {
+	for _, p := range strings.Split(relPath, "/") {
+		if top = top.Files[p]; top == nil {
+			return nil
 		}
-		count += c
 	}
+	return top
+}
+
+// countFiles returns the number of files in entry and their total size. Hard
+// links are counted but not their size.
+func countFiles(entry *dumbcaslib.Entry) (files int64, size int64) {
+	_ = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+		if e.Sha1 != "" {
+			files++
+			if e.HardLinkTo == "" {
+				size += e.Size
+			}
+		}
+		return nil
+	})
 	return
 }
 
 func (c *restoreRun) main(a DumbcasApplication, nodeArg string) error {
+	if c.bufferSize <= 0 {
+		return usageErrorf("-buffer-size must be positive")
+	}
+	if c.limitRate < 0 {
+		return usageErrorf("-limit-rate must not be negative")
+	}
+	if c.progressInterval <= 0 {
+		return usageErrorf("-progress-interval must be positive")
+	}
+	c.Out = expandPath(c.Out)
+	sink, out, err := makeFileSink(c.Out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = sink.Close()
+	}()
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
@@ -94,6 +446,19 @@ func (c *restoreRun) main(a DumbcasApplication, nodeArg string) error {
 	// Do it serially for now, assuming that it is I/O bound on magnetic disks.
 	// For a network CAS, it would be good to implement concurrent fetches.
 
+	nodeArg, err = resolveNodeArg(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+	if isTag(nodeArg) {
+		// Tell which backup the tag points to since the user didn't name it.
+		tag := strings.TrimPrefix(filepath.ToSlash(nodeArg), "tags/")
+		if name, err := resolveTag(c.nodes, tag); err == nil {
+			fmt.Fprintf(a.GetOut(), "Restoring %s, the node of tag %s\n", name, tag)
+		} else {
+			a.GetLog().Printf("Restoring tag %s: %s", tag, err)
+		}
+	}
 	f, err := c.nodes.Open(nodeArg)
 	if err != nil {
 		return err
@@ -110,22 +475,74 @@ func (c *restoreRun) main(a DumbcasApplication, nodeArg string) error {
 	if err != nil {
 		return err
 	}
-	// TODO(maruel): Progress bar.
-	count, err := restoreEntry(a.GetLog(), c.cas, entry, c.Out)
-	fmt.Fprintf(a.GetOut(), "Restored %d files in %s\n", count, c.Out)
-	return err
+	var base *dumbcaslib.Entry
+	if c.base != "" {
+		if base, err = loadNodeEntry(c.nodes, c.cas, c.base); err != nil {
+			return err
+		}
+	}
+	r := makeRestorer(a.GetLog(), c.cas, c.bufferSize)
+	r.sink = sink
+	r.baseHash = c.baseHash
+	if c.preservePrefix {
+		r.prefixRoot = out
+	}
+	if c.limitRate > 0 {
+		r.bucket = makeTokenBucket(c.limitRate)
+	}
+	totalFiles, totalSize := countFiles(entry)
+
+	type result struct {
+		count int
+		err   error
+	}
+	done := make(chan result)
+	go func() {
+		count, err := r.restoreEntry(entry, base, out)
+		links, err2 := r.restoreLinks(entry, out)
+		if err == nil {
+			err = err2
+		}
+		done <- result{count + links, err}
+	}()
+
+	ticker := time.NewTicker(c.progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case res := <-done:
+			fmt.Fprintf(a.GetOut(), "Restored %d files in %s\n", res.count, c.Out)
+			if base != nil {
+				fmt.Fprintf(a.GetOut(), "Skipped %d unchanged files\n", r.nbSkipped.Get())
+			}
+			if res.err != nil || !c.verifyAfter {
+				return res.err
+			}
+			count, bad := r.verifyRestored(entry, out)
+			fmt.Fprintf(a.GetOut(), "Verified %d files\n", count)
+			if bad != 0 {
+				return ioErrorf("Verification failed for %d files", bad)
+			}
+			return nil
+		case <-ticker.C:
+			bytes := r.bytesRestored.Get() + r.bytesSkipped.Get()
+			fractionDone := 1.
+			if totalSize != 0 {
+				fractionDone = float64(bytes) / float64(totalSize)
+			}
+			a.GetLog().Printf(
+				"%d/%d files %.1fmb/%.1fmb %3.1f%%",
+				r.nbRestored.Get()+r.nbSkipped.Get(), totalFiles, toMb(bytes), toMb(totalSize), 100.*fractionDone)
+		}
+	}
 }
 
 func (c *restoreRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
 	if len(args) != 1 {
 		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
-		return 1
+		return exitUsage
 	}
 	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
-	if err := c.main(d, args[0]); err != nil {
-		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
-		return 1
-	}
-	return 0
+	return exitWith(a, c.main(d, args[0]))
 }
@@ -10,12 +10,19 @@ limitations under the License. */
 package main
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/ut"
+	"github.com/pkg/sftp"
 )
 
 // Reads all files in the tree and return their content as a map.
@@ -47,8 +54,8 @@ func TestRestore(t *testing.T) {
 	f := makeDumbcasAppMock(t)
 	// Force the creation of CAS and NodesTable so content can be archived in
 	// memory before running the command.
-	_, _ = f.MakeCasTable("")
-	_, _ = f.LoadNodesTable("", f.cas)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
 
 	// Create an archive.
 	tree := map[string]string{
@@ -71,3 +78,288 @@ func TestRestore(t *testing.T) {
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, tree, actualTree)
 }
+
+func TestRestoreTag(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "old"})
+	latest := map[string]string{"file1": "new", "dir1/file2": "content2"}
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, latest)
+
+	tempData := makeTempDir(t, "restore_tag")
+	defer removeDir(t, tempData)
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + tempData, "@fictious"}, 0)
+	f.CheckOut("Restoring " + nodeName + ", the node of tag fictious\nRestored 2 files in " + tempData + "\n")
+	actualTree, err := readTree(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, latest, actualTree)
+
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + tempData, "@missing"}, exitNotFound)
+	f.CheckBuffer(false, true)
+}
+
+func TestRestoreVerifyAfter(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	tree := map[string]string{
+		"dir1/bar": "bar\n",
+		"file1":    "content1",
+	}
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
+	tempData := makeTempDir(t, "restore_verify_after")
+	defer removeDir(t, tempData)
+
+	out := filepath.Join(tempData, "out1")
+	f.Run([]string{"restore", "-root=\\test_archive", "-verify-after", "-out=" + out, nodeName}, 0)
+	f.CheckOut("Restored 2 files in " + out + "\nVerified 2 files\n")
+
+	// An object whose content doesn't match its hash is caught.
+	ut.AssertEqual(t, nil, f.cas.AddEntry(strings.NewReader("baad"), sha1String("good")))
+	_, nodeName, _ = archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1", "file2": "good"})
+	out = filepath.Join(tempData, "out2")
+	f.Run([]string{"restore", "-root=\\test_archive", "-verify-after", "-out=" + out, nodeName}, exitIO)
+	f.CheckOut("Restored 2 files in " + out + "\nVerified 2 files\n")
+	f.CheckBuffer(false, true)
+}
+
+func TestRestoreLimitRate(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	tree := map[string]string{
+		"dir1/bar": "bar\n",
+		"file1":    "content1",
+	}
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
+
+	tempData := makeTempDir(t, "restore")
+	defer removeDir(t, tempData)
+
+	args := []string{"restore", "-root=\\test_archive", "-out=" + tempData, "-limit-rate=1000000", "-progress-interval=1ms", nodeName}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	actualTree, err := readTree(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, tree, actualTree)
+}
+
+func TestRestoreSparse(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	content := "head" + strings.Repeat("\x00", 10000) + "tail" + strings.Repeat("\x00", 5000)
+	sha1, err := dumbcaslib.AddBytes(cas, []byte(content))
+	ut.AssertEqual(t, nil, err)
+	size := int64(len(content))
+	entry := &dumbcaslib.Entry{
+		Files: map[string]*dumbcaslib.Entry{
+			"sparse": {Sha1: sha1, Size: size, Holes: [][2]int64{{4, 10000}, {10008, 5000}}},
+			// Invalid holes are ignored.
+			"overlap": {Sha1: sha1, Size: size, Holes: [][2]int64{{4, 10000}, {5, 5000}}},
+			"past":    {Sha1: sha1, Size: size, Holes: [][2]int64{{10008, 5001}}},
+		},
+	}
+	ut.AssertEqual(t, true, validHoles(entry.Files["sparse"]))
+	ut.AssertEqual(t, false, validHoles(entry.Files["overlap"]))
+	ut.AssertEqual(t, false, validHoles(entry.Files["past"]))
+
+	tempData := makeTempDir(t, "restore")
+	defer removeDir(t, tempData)
+	r := makeRestorer(log.New(ioutil.Discard, "", 0), cas, 1024)
+	count, err := r.restoreEntry(entry, nil, tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, count)
+	actualTree, err := readTree(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"sparse": content, "overlap": content, "past": content}, actualTree)
+}
+
+func TestRestoreBase(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	_, _, baseSha1 := archiveData(t, cas, nodes, map[string]string{"a": "content1", "b": "content2"})
+	_, _, newSha1 := archiveData(t, cas, nodes, map[string]string{"a": "content1", "b": "content3", "c": "content4"})
+	base, err := dumbcaslib.LoadEntry(cas, baseSha1)
+	ut.AssertEqual(t, nil, err)
+	entry, err := dumbcaslib.LoadEntry(cas, newSha1)
+	ut.AssertEqual(t, nil, err)
+
+	tempData := makeTempDir(t, "restore_base")
+	defer removeDir(t, tempData)
+	r := makeRestorer(log.New(ioutil.Discard, "", 0), cas, 1024)
+	count, err := r.restoreEntry(base, nil, tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, count)
+
+	r = makeRestorer(log.New(ioutil.Discard, "", 0), cas, 1024)
+	count, err = r.restoreEntry(entry, base, tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, count)
+	ut.AssertEqual(t, int64(1), r.nbSkipped.Get())
+	actualTree, err := readTree(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"a": "content1", "b": "content3", "c": "content4"}, actualTree)
+
+	// Only -base-hash notices a change that keeps the size.
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "a"), []byte("modified"), 0600))
+	r = makeRestorer(log.New(ioutil.Discard, "", 0), cas, 1024)
+	count, err = r.restoreEntry(entry, entry, tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, count)
+	r.baseHash = true
+	count, err = r.restoreEntry(entry, entry, tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, count)
+	actualTree, err = readTree(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"a": "content1", "b": "content3", "c": "content4"}, actualTree)
+}
+
+func TestCountFiles(t *testing.T) {
+	t.Parallel()
+	entry := &dumbcaslib.Entry{
+		Files: map[string]*dumbcaslib.Entry{
+			"a": {Sha1: "1", Size: 10},
+			"b": {Sha1: "1", Size: 10, HardLinkTo: "a"},
+			"d": {Files: map[string]*dumbcaslib.Entry{"c": {Sha1: "2", Size: 5}}},
+		},
+	}
+	files, size := countFiles(entry)
+	ut.AssertEqual(t, int64(3), files)
+	ut.AssertEqual(t, int64(15), size)
+}
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+	b := makeTokenBucket(10000)
+	start := time.Now()
+	// The bucket starts full so this doesn't wait.
+	b.take(10000)
+	// This one has to wait for half a second.
+	b.take(5000)
+	ut.AssertEqual(t, true, time.Since(start) >= 400*time.Millisecond)
+}
+
+func BenchmarkRestore(b *testing.B) {
+	// Restores a synthetic tree of 64 files of 1mb from the memory CAS.
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	tree := map[string]string{}
+	for i := 0; i < 64; i++ {
+		tree[fmt.Sprintf("dir%d/file%d", i%8, i)] = strings.Repeat(fmt.Sprintf("%d", i%10), 1024*1024)
+	}
+	_, _, entrySha1 := archiveData(b, cas, nodes, tree)
+	entry, err := dumbcaslib.LoadEntry(cas, entrySha1)
+	ut.AssertEqual(b, nil, err)
+	tempData := makeTempDir(b, "restore_bench")
+	defer removeDir(b, tempData)
+
+	for _, bufferSize := range []int{32 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dkb", bufferSize/1024), func(b *testing.B) {
+			r := makeRestorer(log.New(ioutil.Discard, "", 0), cas, bufferSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				out := filepath.Join(tempData, fmt.Sprintf("%d_%d", bufferSize, i))
+				count, err := r.restoreEntry(entry, nil, out)
+				ut.AssertEqual(b, nil, err)
+				ut.AssertEqual(b, len(tree), count)
+				b.StopTimer()
+				removeDir(b, out)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// recordingSink is a local FileSink that records the files created.
+type recordingSink struct {
+	localSink
+	created []string
+}
+
+func (r *recordingSink) Create(filePath string) (SinkFile, error) {
+	r.created = append(r.created, filePath)
+	return r.localSink.Create(filePath)
+}
+
+func TestRestoreSink(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	_, _, entrySha1 := archiveData(t, cas, nodes, map[string]string{"dir1/a": "content1"})
+	entry, err := dumbcaslib.LoadEntry(cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+	tempData := makeTempDir(t, "restore_sink")
+	defer removeDir(t, tempData)
+
+	sink := &recordingSink{}
+	r := makeRestorer(log.New(ioutil.Discard, "", 0), cas, 1024)
+	r.sink = sink
+	count, err := r.restoreEntry(entry, nil, tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, count)
+	ut.AssertEqual(t, []string{filepath.Join(tempData, "dir1", "a")}, sink.created)
+}
+
+func TestRestoreRemoteOut(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=s3://bucket/path", "foo"}, 1)
+	f.CheckBuffer(false, true)
+	// The remote directory is required.
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=sftp://host", "foo"}, 1)
+	f.CheckBuffer(false, true)
+}
+
+// makePipeSftpSink returns an sftpSink talking to an in-process SFTP server
+// serving the local file system.
+func makePipeSftpSink(t *testing.T) *sftpSink {
+	clientIn, serverOut := io.Pipe()
+	serverIn, clientOut := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverIn, serverOut})
+	ut.AssertEqual(t, nil, err)
+	go func() {
+		_ = server.Serve()
+		_ = serverOut.Close()
+	}()
+	client, err := sftp.NewClientPipe(clientIn, clientOut)
+	ut.AssertEqual(t, nil, err)
+	return &sftpSink{client: client}
+}
+
+func TestRestoreSftpSink(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	nodes := dumbcaslib.MakeMemoryNodesTable(cas)
+	tree := map[string]string{"dir1/a": "content1", "b": strings.Repeat("content2", 1000)}
+	_, _, entrySha1 := archiveData(t, cas, nodes, tree)
+	entry, err := dumbcaslib.LoadEntry(cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+	tempData := makeTempDir(t, "restore_sftp")
+	defer removeDir(t, tempData)
+
+	sink := makePipeSftpSink(t)
+	r := makeRestorer(log.New(ioutil.Discard, "", 0), cas, 1024)
+	r.sink = sink
+	out := filepath.Join(tempData, "out")
+	count, err := r.restoreEntry(entry, nil, out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, count)
+	actual, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, tree, actual)
+
+	// Existing files are not overwritten.
+	_, err = sink.Create(filepath.Join(out, "b"))
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, nil, sink.Close())
+}
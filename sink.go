@@ -0,0 +1,94 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// FileSink is where restore writes the tree. The paths are in the OS format
+// of the sink.
+type FileSink interface {
+	// MkdirAll creates dir and its parents as needed.
+	MkdirAll(dir string) error
+	// Create creates a new file, failing if it already exists.
+	Create(filePath string) (SinkFile, error)
+	// Link creates filePath as a hard link to target.
+	Link(target, filePath string) error
+	// SetXattrs sets the extended attributes of the file.
+	SetXattrs(filePath string, xattrs map[string][]byte) error
+	// Lstat returns the metadata of the file without following symlinks.
+	Lstat(filePath string) (os.FileInfo, error)
+	// Open opens a file for reading, to verify it.
+	Open(filePath string) (io.ReadCloser, error)
+	// Remove removes a file.
+	Remove(filePath string) error
+	// Close releases the connection of a remote sink.
+	Close() error
+}
+
+// SinkFile is a file being written to a FileSink. Truncate and Seek are used
+// to restore sparse files.
+type SinkFile interface {
+	io.WriteSeeker
+	io.Closer
+	Truncate(size int64) error
+}
+
+// localSink is the FileSink writing to the local file system.
+type localSink struct{}
+
+func (localSink) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (localSink) Create(filePath string) (SinkFile, error) {
+	return os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+func (localSink) Link(target, filePath string) error {
+	return os.Link(target, filePath)
+}
+
+func (localSink) SetXattrs(filePath string, xattrs map[string][]byte) error {
+	return writeXattrs(filePath, xattrs)
+}
+
+func (localSink) Lstat(filePath string) (os.FileInfo, error) {
+	return os.Lstat(filePath)
+}
+
+func (localSink) Open(filePath string) (io.ReadCloser, error) {
+	return os.Open(filePath)
+}
+
+func (localSink) Remove(filePath string) error {
+	return os.Remove(filePath)
+}
+
+func (localSink) Close() error {
+	return nil
+}
+
+// makeFileSink returns the FileSink for the -out value of restore and the
+// directory to restore to in it. An sftp://host/path URL connects to host;
+// other URLs are refused instead of being used as a relative path.
+func makeFileSink(out string) (FileSink, string, error) {
+	if u, err := url.Parse(out); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.Scheme == "sftp" {
+			return dialSftp(u)
+		}
+		return nil, "", fmt.Errorf("Restoring to %s is not supported; -out must be a local directory or sftp://host/path", u.Scheme+"://"+u.Host)
+	}
+	return localSink{}, out, nil
+}
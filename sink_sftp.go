@@ -0,0 +1,154 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSink is the FileSink writing to a remote host over SFTP. The paths are
+// sent with forward slashes.
+type sftpSink struct {
+	client *sftp.Client
+	// conn is the SSH connection carrying client. It is nil when the client
+	// runs over something else, like pipes in the tests.
+	conn io.Closer
+}
+
+func (s *sftpSink) MkdirAll(dir string) error {
+	return s.client.MkdirAll(filepath.ToSlash(dir))
+}
+
+func (s *sftpSink) Create(filePath string) (SinkFile, error) {
+	return s.client.OpenFile(filepath.ToSlash(filePath), os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+}
+
+// Link requires the hardlink@openssh.com extension, which OpenSSH supports.
+func (s *sftpSink) Link(target, filePath string) error {
+	return s.client.Link(filepath.ToSlash(target), filepath.ToSlash(filePath))
+}
+
+func (s *sftpSink) SetXattrs(filePath string, xattrs map[string][]byte) error {
+	return errors.New("extended attributes are not supported over SFTP")
+}
+
+func (s *sftpSink) Lstat(filePath string) (os.FileInfo, error) {
+	return s.client.Lstat(filepath.ToSlash(filePath))
+}
+
+func (s *sftpSink) Open(filePath string) (io.ReadCloser, error) {
+	return s.client.Open(filepath.ToSlash(filePath))
+}
+
+func (s *sftpSink) Remove(filePath string) error {
+	return s.client.Remove(filepath.ToSlash(filePath))
+}
+
+func (s *sftpSink) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		if err2 := s.conn.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// dialSftp connects to the host of an sftp://[user@]host[:port]/path URL and
+// returns the sink and the remote directory. The host key must be in
+// ~/.ssh/known_hosts. The keys of the SSH agent are used, then the
+// unencrypted keys in ~/.ssh.
+func dialSftp(u *url.URL) (FileSink, string, error) {
+	if u.Path == "" || u.Path == "/" {
+		return nil, "", fmt.Errorf("%s must include the directory to restore to", u)
+	}
+	name := u.User.Username()
+	if name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, "", err
+		}
+		name = current.Username
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, "", err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to load the known hosts: %s", err)
+	}
+	auth, closeAgent := sshAuth(home)
+	defer closeAgent()
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to connect to %s: %s", addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", fmt.Errorf("Failed to start SFTP on %s: %s", addr, err)
+	}
+	return &sftpSink{client, conn}, u.Path, nil
+}
+
+// sshAuth returns the keys of the SSH agent, if one is running, and the
+// unencrypted private keys in ~/.ssh. The returned function closes the
+// connection to the agent once the SSH handshake is done.
+func sshAuth(home string) ([]ssh.AuthMethod, func()) {
+	methods := []ssh.AuthMethod{}
+	closeAgent := func() {}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(c).Signers))
+			closeAgent = func() {
+				_ = c.Close()
+			}
+		}
+	}
+	signers := []ssh.Signer{}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) != 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods, closeAgent
+}
@@ -0,0 +1,58 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// sparseSupported is true when findHoles can detect holes.
+const sparseSupported = true
+
+// lseek() whence values, see lseek(2).
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// findHoles returns the [offset, length] of the holes in the first size bytes
+// of the file. A file system without hole support reports none.
+func findHoles(filePath string, size int64) ([][2]int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var holes [][2]int64
+	for offset := int64(0); offset < size; {
+		hole, err := f.Seek(offset, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole >= size {
+			break
+		}
+		data, err := f.Seek(hole, seekData)
+		if errors.Is(err, syscall.ENXIO) || data > size {
+			// The file ends with a hole.
+			data, err = size, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		holes = append(holes, [2]int64{hole, data - hole})
+		offset = data
+	}
+	return holes, nil
+}
@@ -0,0 +1,72 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+// makeSparseFile creates a 4mb file with data only at the start and at 1mb.
+func makeSparseFile(t *testing.T, filePath string) {
+	f, err := os.Create(filePath)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Write([]byte("head"))
+	ut.AssertEqual(t, nil, err)
+	_, err = f.WriteAt([]byte("middle"), 1024*1024)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.Truncate(4*1024*1024))
+	ut.AssertEqual(t, nil, f.Close())
+}
+
+func TestArchiveSparse(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_sparse")
+	defer removeDir(t, tempData)
+	src := filepath.Join(tempData, "src")
+	ut.AssertEqual(t, nil, os.Mkdir(src, 0700))
+	makeSparseFile(t, filepath.Join(src, "image"))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(src, "toArchive"), []byte("image\n"), 0600))
+
+	holes, err := findHoles(filepath.Join(src, "image"), 4*1024*1024)
+	ut.AssertEqual(t, nil, err)
+	if len(holes) == 0 {
+		t.Skip("The file system doesn't support holes")
+	}
+	ut.AssertEqual(t, int64(4*1024*1024), holes[len(holes)-1][0]+holes[len(holes)-1][1])
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-sparse", filepath.Join(src, "toArchive")}, 0)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	node := loadNode(t, f.nodes, nodes[0])
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, holes, entry.Files["image"].Holes)
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, nodes[0]}, 0)
+	expected, err := ioutil.ReadFile(filepath.Join(src, "image"))
+	ut.AssertEqual(t, nil, err)
+	actual, err := ioutil.ReadFile(filepath.Join(out, "image"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, bytes.Equal(expected, actual))
+	stat, err := os.Stat(filepath.Join(out, "image"))
+	ut.AssertEqual(t, nil, err)
+	// Blocks are 512 bytes; far less than the 4mb are allocated.
+	ut.AssertEqual(t, true, stat.Sys().(*syscall.Stat_t).Blocks*512 < 1024*1024)
+}
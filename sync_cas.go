@@ -0,0 +1,128 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdSyncCas = &subcommands.Command{
+	UsageLine: "sync-cas -from <root> -to <root>",
+	ShortDesc: "copies the CAS objects missing in another root",
+	LongDesc:  "Copies the objects of the CAS table of -from that are missing in the one of -to, e.g. to migrate a store or to mirror it periodically. The objects are copied verbatim so compressed and encrypted objects stay so. The nodes are not copied: use nodes-export and nodes-import.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &syncCasRun{}
+		c.Flags.StringVar(&c.from, "from", "", "Root to copy the objects from; required")
+		c.Flags.StringVar(&c.to, "to", "", "Root to copy the objects to; required. It is created if needed")
+		c.Flags.IntVar(&c.parallel, "parallel", 4, "Number of objects copied concurrently")
+		c.Flags.BoolVar(&c.fsync, "fsync", true, "Flushes each object to disk so the copy survives a power loss; disabling it is faster but less safe")
+		return c
+	},
+}
+
+type syncCasRun struct {
+	subcommands.CommandRunBase
+	from     string
+	to       string
+	parallel int
+	fsync    bool
+}
+
+// syncRoot returns the absolute path of a root given to -from or -to.
+func syncRoot(flag, root string) (string, error) {
+	if root == "" {
+		return "", usageErrorf("Must provide -%s", flag)
+	}
+	if u, err := url.Parse(root); err == nil && u.Scheme != "" && u.Host != "" {
+		return "", usageErrorf("Syncing with %s is not supported; -%s must be a local directory", u.Scheme+"://"+u.Host, flag)
+	}
+	abs, err := filepath.Abs(expandPath(root))
+	if err != nil {
+		return "", usageErrorf("Failed to find %s", root)
+	}
+	return abs, nil
+}
+
+func (c *syncCasRun) main(a DumbcasApplication) error {
+	if c.parallel < 1 {
+		return usageErrorf("-parallel must be at least 1")
+	}
+	from, err := syncRoot("from", c.from)
+	if err != nil {
+		return err
+	}
+	to, err := syncRoot("to", c.to)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return usageErrorf("Can't sync %s to itself", c.from)
+	}
+	// MakeCasTable() would create an empty table in a mistyped -from.
+	if _, err := os.Stat(from); err != nil {
+		return notFoundErrorf("Failed to find %s: %s", c.from, err)
+	}
+	src, err := a.MakeCasTable(from, dumbcaslib.CasTableOptions{ReadOnly: true, Logger: a.GetLog()})
+	if err != nil {
+		return err
+	}
+	if src.GetFsckBit() {
+		return corruptedErrorf("Can't copy from %s while fsck is needed. Please run fsck first.", c.from)
+	}
+	lock, err := a.LockRoot(to)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = lock.Close()
+	}()
+	dst, err := a.MakeCasTable(to, dumbcaslib.CasTableOptions{Fsync: c.fsync, Logger: a.GetLog()})
+	if err != nil {
+		return err
+	}
+
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt.Channel:
+			close(cancel)
+		case <-done:
+		}
+	}()
+	copied, skipped, err := dumbcaslib.SyncCas(src, dst, dumbcaslib.SyncOptions{Parallel: c.parallel, Cancel: cancel})
+	fmt.Fprintf(a.GetOut(), "Copied %d objects, skipped %d already present\n", copied, skipped)
+	if errors.Is(err, dumbcaslib.ErrSyncCanceled) {
+		return errInterrupted
+	}
+	if err != nil {
+		return ioErrorf("%s", err)
+	}
+	return nil
+}
+
+func (c *syncCasRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return exitUsage
+	}
+	interrupt.HandleCtrlC()
+	d := a.(DumbcasApplication)
+	return exitWith(a, c.main(d))
+}
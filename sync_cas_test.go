@@ -0,0 +1,62 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestSyncCas(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "sync_cas")
+	defer removeDir(t, tempData)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1", "dir1/file2": "content2"})
+	to := filepath.Join(tempData, "to")
+	mirror := dumbcaslib.MakeMemoryCasTable()
+	f.mirrors = map[string]dumbcaslib.CasTable{to: mirror}
+	_, err := dumbcaslib.AddBytes(mirror, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+
+	args := []string{"sync-cas", "-from=" + tempData, "-to=" + to}
+	f.Run(args, 0)
+	f.CheckOut("Copied 2 objects, skipped 1 already present\n")
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	mirrored, err := dumbcaslib.EnumerateCasAsList(mirror)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, items, mirrored)
+
+	f.Run(args, 0)
+	f.CheckOut("Copied 0 objects, skipped 3 already present\n")
+}
+
+func TestSyncCasInvalid(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "sync_cas_invalid")
+	defer removeDir(t, tempData)
+	f.Run([]string{"sync-cas", "-to=" + tempData}, exitUsage)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"sync-cas", "-from=" + tempData}, exitUsage)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"sync-cas", "-from=" + tempData, "-to=" + tempData}, exitUsage)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"sync-cas", "-from=" + tempData, "-to=s3://bucket/path"}, exitUsage)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"sync-cas", "-from=" + filepath.Join(tempData, "missing"), "-to=" + tempData}, exitNotFound)
+	f.CheckBuffer(false, true)
+}
@@ -0,0 +1,99 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdTrash = &subcommands.Command{
+	UsageLine: "trash <list|restore> [item]",
+	ShortDesc: "lists or restores the items removed by fsck, gc and clean",
+	LongDesc:  "Lists the objects and the nodes that fsck, gc and clean moved to the trash of a DumbCas(tm) archive, or moves an item back in place. A restored object is hashed again and put back in the trash if it is corrupted.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &trashRun{}
+		c.Init()
+		c.Flags.Var(&c.format, "format", formatUsage)
+		return c
+	},
+}
+
+type trashRun struct {
+	CommonFlags
+	format outputFormat
+}
+
+func (c *trashRun) list(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	items, err := dumbcaslib.ListTrash(c.Root)
+	if err != nil {
+		return err
+	}
+	out := makeRowPrinter(a.GetOut(), c.format, []string{"name", "size"}, func(w io.Writer, row []interface{}) {
+		fmt.Fprintf(w, "%s (%d bytes)\n", row[0], row[1])
+	})
+	for _, item := range items {
+		if err := out.print(item.Name, item.Size); err != nil {
+			return err
+		}
+	}
+	return out.close()
+}
+
+func (c *trashRun) restore(a DumbcasApplication, name string) error {
+	c.exclusive = true
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	defer c.unlock()
+	if err := dumbcaslib.RestoreTrash(c.Root, name); err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, "cas/") {
+		// The object is named cas/<prefix>/<rest>.
+		hash := strings.Replace(name[len("cas/"):], "/", "", -1)
+		actual, err := verifyObject(c.cas, hash)
+		if err == nil && actual != hash {
+			err = fmt.Errorf("Object %s is corrupted, its sha1 is %s", hash, actual)
+		}
+		if err != nil {
+			_ = c.cas.Remove(hash)
+			return fmt.Errorf("%s; it was put back in the trash", err)
+		}
+	}
+	fmt.Fprintf(a.GetOut(), "Restored %s\n", name)
+	return nil
+}
+
+func (c *trashRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	d := a.(DumbcasApplication)
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		err = c.list(d)
+	case len(args) == 2 && args[0] == "restore":
+		err = c.restore(d, args[1])
+	default:
+		fmt.Fprintf(a.GetErr(), "%s: Must provide list or restore <item>.\n", a.GetName())
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
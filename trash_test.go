@@ -0,0 +1,62 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "trash")
+	defer removeDir(t, tempData)
+	cas, err := dumbcaslib.MakeLocalCasTable(tempData, dumbcaslib.CasTableOptions{})
+	ut.AssertEqual(t, nil, err)
+	f.mirrors = map[string]dumbcaslib.CasTable{tempData: cas}
+
+	good, err := dumbcaslib.AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	bad, err := dumbcaslib.AddBytes(cas, []byte("other"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(good))
+	ut.AssertEqual(t, nil, cas.Remove(bad))
+	goodItem := "cas/" + good[:3] + "/" + good[3:]
+	badItem := "cas/" + bad[:3] + "/" + bad[3:]
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "cas", "trash", bad[:3], bad[3:]), []byte("corrupted"), 0600))
+
+	f.Run([]string{"trash", "-root=" + tempData, "list"}, 0)
+	out := f.GetOut().(*bytes.Buffer)
+	expected := []string{goodItem + " (7 bytes)\n", badItem + " (9 bytes)\n"}
+	if badItem < goodItem {
+		expected[0], expected[1] = expected[1], expected[0]
+	}
+	ut.AssertEqual(t, expected[0]+expected[1], out.String())
+	out.Reset()
+
+	f.Run([]string{"trash", "-root=" + tempData, "restore", goodItem}, 0)
+	ut.AssertEqual(t, "Restored "+goodItem+"\n", out.String())
+	out.Reset()
+	actual, err := verifyObject(cas, good)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, good, actual)
+
+	f.Run([]string{"trash", "-root=" + tempData, "restore", badItem}, 1)
+	f.CheckBuffer(false, true)
+	items, err := dumbcaslib.ListTrash(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []dumbcaslib.TrashItem{{Name: badItem, Size: 9}}, items)
+}
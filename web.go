@@ -10,11 +10,22 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
 )
 
@@ -27,20 +38,41 @@ var cmdWeb = &subcommands.Command{
 		c.Init()
 		c.Flags.IntVar(&c.port, "port", 8010, "port number")
 		c.Flags.BoolVar(&c.local, "local", false, "only listed on localhost")
+		c.Flags.StringVar(&c.listenFile, "listen-file", "", "once listening, writes the host:port actually used to this file, e.g. with -port 0 which picks a free port")
+		c.Flags.BoolVar(&c.nodesOptions.Markdown, "markdown", false, "render the node comments as Markdown at the top of their root directory")
+		c.Flags.BoolVar(&c.casOptions.ReadOnly, "read-only", false, "never write to the root, e.g. when serving a read-only replica")
+		c.Flags.DurationVar(&c.readTimeout, "read-timeout", 30*time.Second, "maximum duration to read a request, including its headers; 0 disables it")
+		c.Flags.DurationVar(&c.writeTimeout, "write-timeout", time.Minute, "maximum duration to write a response; it doesn't apply to the content under /content/retrieve/ since large files can take longer. 0 disables it")
+		c.Flags.DurationVar(&c.idleTimeout, "idle-timeout", 2*time.Minute, "maximum duration a keep-alive connection is kept open while idle; 0 uses -read-timeout")
 		return c
 	},
 }
 
 type webRun struct {
 	CommonFlags
-	port  int
-	local bool
+	port         int
+	local        bool
+	listenFile   string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
 }
 
-// Converts an handler to log every HTTP request.
+// Converts an handler to log every HTTP request. It also accumulates the
+// statistics printed by summary() when the server stops.
 type loggingHandler struct {
 	handler http.Handler
 	log     *log.Logger
+	started time.Time
+
+	lock     sync.Mutex
+	requests int
+	bytes    int64
+	nodes    map[string]bool
+}
+
+func makeLoggingHandler(handler http.Handler, l *log.Logger) *loggingHandler {
+	return &loggingHandler{handler: handler, log: l, started: time.Now(), nodes: map[string]bool{}}
 }
 
 type loggingResponseWriter struct {
@@ -60,6 +92,11 @@ func (l *loggingResponseWriter) WriteHeader(status int) {
 	l.status = status
 }
 
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (l *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
 func (l *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	lW := &loggingResponseWriter{ResponseWriter: w}
 	l.handler.ServeHTTP(lW, r)
@@ -69,6 +106,42 @@ func (l *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		lW.length,
 		r.Method,
 		r.RequestURI)
+	node := accessedNode(r.URL.Path)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.requests++
+	l.bytes += int64(lW.length)
+	if node != "" {
+		l.nodes[node] = true
+	}
+}
+
+// summary returns the statistics of the session.
+func (l *loggingHandler) summary() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return fmt.Sprintf("Served %d requests, %d bytes, %d unique nodes in %s",
+		l.requests, l.bytes, len(l.nodes), time.Since(l.started).Round(time.Second))
+}
+
+// accessedNode returns the node or the tag referenced by an url under
+// /content/retrieve/nodes/, or "" for any other url.
+func accessedNode(path string) string {
+	const prefix = "/content/retrieve/nodes/"
+	if !strings.HasPrefix(path, prefix) {
+		return ""
+	}
+	parts := strings.Split(path[len(prefix):], "/")
+	// Nodes are "<month>/<name>", tags "tags/<name>" and labels
+	// "tags/labels/<name>". "latest/<tag>" is kept as-is.
+	n := 2
+	if len(parts) > 2 && parts[0] == "tags" && parts[1] == "labels" {
+		n = 3
+	}
+	if len(parts) < n || parts[n-1] == "" {
+		return ""
+	}
+	return strings.Join(parts[:n], "/")
 }
 
 type restricted struct {
@@ -93,6 +166,169 @@ func restrict(h http.Handler, m ...string) http.Handler {
 	return restricted{h, m}
 }
 
+// noWriteTimeout lifts the server write timeout for downloads, since a large
+// file can legitimately take longer than that on a slow link.
+type noWriteTimeout struct {
+	http.Handler
+}
+
+func (n noWriteTimeout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	n.Handler.ServeHTTP(w, r)
+}
+
+// latestHandler serves "/<tag>/<path>" from the node the tag points to. The
+// tag is resolved on each request so it always reflects the newest archive.
+type latestHandler struct {
+	nodes dumbcaslib.NodesTable
+}
+
+func (l *latestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(r.URL.Path, "/")
+	rest := ""
+	if i := strings.Index(tag, "/"); i != -1 {
+		tag, rest = tag[:i], tag[i:]
+	}
+	if tag == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "" {
+		// Use a relative redirect since the prefix was stripped.
+		w.Header().Set("Location", tag+"/")
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+	nodeName, err := resolveTag(l.nodes, tag)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.URL.Path = "/" + filepath.ToSlash(nodeName) + rest
+	l.nodes.ServeHTTP(w, r)
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<html><head><title>DumbCas</title></head><body>
+<h1>Tags</h1>
+<pre>{{range .Tags}}<a href="/content/retrieve/nodes/latest/{{.Name}}/">{{.Name}}</a> -> {{if .Node}}<a href="/content/retrieve/nodes/{{.Node}}/">{{.Node}}</a>{{else}}missing node{{end}}
+{{else}}No tag.
+{{end}}</pre>
+<h1>Labels</h1>
+<pre>{{range .Labels}}<a href="/content/retrieve/nodes/tags/labels/{{.Name}}/">{{.Name}}</a> -> {{if .Node}}<a href="/content/retrieve/nodes/{{.Node}}/">{{.Node}}</a>{{else}}missing node{{end}}
+{{else}}No label.
+{{end}}</pre>
+<h1>Nodes</h1>
+<form method="GET" action="/"><input type="text" name="q" value="{{.Query}}"> <input type="submit" value="Search"></form>
+<pre>{{range .Nodes}}<a href="/content/retrieve/nodes/{{.}}/">{{.}}</a>
+{{else}}No node.
+{{end}}</pre>
+</body></html>`))
+
+type indexTag struct {
+	Name string
+	Node string
+}
+
+// healthzHandler is a cheap liveness and readiness probe. The tables are
+// already loaded once it is served so it only checks the fsck bit, which can
+// be set while serving when a corrupted object is found.
+type healthzHandler struct {
+	cas dumbcaslib.CasTable
+}
+
+func (h *healthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if h.cas.GetFsckBit() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "fsck is needed\n")
+		return
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// indexHandler serves the landing page, listing the tags and the labels with
+// the node they point to and the nodes, optionally filtered by the "q" query parameter.
+// Anything else than "/" is redirected to the node list.
+type indexHandler struct {
+	nodes dumbcaslib.NodesTable
+}
+
+func (i *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.Redirect(w, r, "/content/retrieve/nodes/", http.StatusFound)
+		return
+	}
+	names, err := dumbcaslib.EnumerateNodesAsList(i.nodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Map the content of each node to its most recent name so each tag is
+	// resolved without reading all the nodes again, like resolveTag() does.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	byContent := map[string]string{}
+	query := r.URL.Query().Get("q")
+	data := struct {
+		Tags   []indexTag
+		Labels []indexTag
+		Nodes  []string
+		Query  string
+	}{Query: query}
+	var tags []string
+	for _, name := range names {
+		if isTag(name) {
+			tags = append(tags, name)
+			continue
+		}
+		content, err := readNode(i.nodes, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, ok := byContent[string(content)]; !ok {
+			byContent[string(content)] = filepath.ToSlash(name)
+		}
+		if strings.Contains(filepath.ToSlash(name), query) {
+			data.Nodes = append(data.Nodes, filepath.ToSlash(name))
+		}
+	}
+	sort.Strings(tags)
+	for _, name := range tags {
+		content, err := readNode(i.nodes, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if isLabel(name) {
+			data.Labels = append(data.Labels, indexTag{filepath.ToSlash(name)[len("tags/labels/"):], byContent[string(content)]})
+		} else {
+			data.Tags = append(data.Tags, indexTag{filepath.ToSlash(name)[len("tags/"):], byContent[string(content)]})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := indexTemplate.Execute(buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeListenFile writes the address to a temporary file renamed to p so a
+// script polling p never reads a partial address.
+func writeListenFile(p, addr string) error {
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(addr+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", p, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("Failed to write %s: %s", p, err)
+	}
+	return nil
+}
+
 func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
 	if err := c.Parse(d, true); err != nil {
 		return err
@@ -101,10 +337,13 @@ func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
 	serveMux := http.NewServeMux()
 
 	x := http.StripPrefix("/content/retrieve/default", c.cas)
-	serveMux.Handle("/content/retrieve/default/", restrict(x, "GET"))
+	serveMux.Handle("/content/retrieve/default/", restrict(noWriteTimeout{x}, "GET"))
 	x = http.StripPrefix("/content/retrieve/nodes", c.nodes)
-	serveMux.Handle("/content/retrieve/nodes/", restrict(x, "GET"))
-	serveMux.Handle("/", restrict(http.RedirectHandler("/content/retrieve/nodes/", http.StatusFound), "GET"))
+	serveMux.Handle("/content/retrieve/nodes/", restrict(noWriteTimeout{x}, "GET"))
+	x = http.StripPrefix("/content/retrieve/nodes/latest", &latestHandler{c.nodes})
+	serveMux.Handle("/content/retrieve/nodes/latest/", restrict(noWriteTimeout{x}, "GET"))
+	serveMux.Handle("/healthz", restrict(&healthzHandler{c.cas}, "GET", "HEAD"))
+	serveMux.Handle("/", restrict(&indexHandler{c.nodes}, "GET"))
 
 	var addr string
 	if c.local {
@@ -112,9 +351,14 @@ func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
 	} else {
 		addr = fmt.Sprintf(":%d", c.port)
 	}
+	l := makeLoggingHandler(serveMux, d.GetLog())
 	s := &http.Server{
-		Addr:    addr,
-		Handler: &loggingHandler{serveMux, d.GetLog()},
+		Addr:              addr,
+		Handler:           l,
+		ReadTimeout:       c.readTimeout,
+		ReadHeaderTimeout: c.readTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
 	}
 	ls, e := net.Listen("tcp", s.Addr)
 	if e != nil {
@@ -124,10 +368,18 @@ func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
 	_, portStr, _ := net.SplitHostPort(ls.Addr().String())
 	d.GetLog().Printf("Serving %s on port %s", c.Root, portStr)
 
+	if c.listenFile != "" {
+		if err := writeListenFile(c.listenFile, ls.Addr().String()); err != nil {
+			_ = ls.Close()
+			return err
+		}
+	}
 	if ready != nil {
 		ready <- ls
 	}
-	return s.Serve(ls)
+	err := s.Serve(ls)
+	d.GetLog().Print(l.summary())
+	return err
 }
 
 func (c *webRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
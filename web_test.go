@@ -10,16 +10,20 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
 	"github.com/maruel/subcommands/subcommandstest"
 	"github.com/maruel/ut"
@@ -31,6 +35,10 @@ type WebDumbcasAppMock struct {
 	socket  net.Listener
 	closed  chan bool
 	baseURL string
+	// writeTimeout overrides -write-timeout when set.
+	writeTimeout time.Duration
+	// listenFile sets -listen-file.
+	listenFile string
 }
 
 func makeWebDumbcasAppMock(t *testing.T) *WebDumbcasAppMock {
@@ -48,6 +56,12 @@ func (f *WebDumbcasAppMock) goWeb() {
 	// Simulate -local. It is important to use it while testing otherwise it
 	// may trigger the Windows firewall.
 	r.local = true
+	// Use a free port so tests can run concurrently.
+	r.port = 0
+	if f.writeTimeout != 0 {
+		r.writeTimeout = f.writeTimeout
+	}
+	r.listenFile = f.listenFile
 	c := make(chan net.Listener)
 	go func() {
 		err := r.main(f, c)
@@ -105,8 +119,8 @@ func TestWeb(t *testing.T) {
 	// Create a tree of stuff. Call the factory functions directly because we
 	// can't use Run(). The reason Run() can't be used is because we need the
 	// channel to get the socket address back.
-	_, _ = f.DumbcasAppMock.MakeCasTable("")
-	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
 	tree1 := map[string]string{
 		"file1":           "content1",
 		"dir1/dir2/file2": "content2",
@@ -130,9 +144,9 @@ func TestWeb(t *testing.T) {
 	ut.AssertEqual(t, 2, len(nodeItems))
 	ut.AssertEqual(t, nodeName, month+"/"+nodeItems[1])
 
-	f.GetLog().Print("T: Get the node.")
+	f.GetLog().Print("T: Get the node; its comment is shown at the top.")
 	r = f.get("/content/retrieve/nodes/"+nodeName, "/content/retrieve/nodes/"+nodeName+"/")
-	expected = "<html><body><pre><a href=\"dir1/\">dir1/</a>\n<a href=\"file1\">file1</a>\n</pre></body></html>"
+	expected = "<html><body><pre class=\"comment\">useful comment</pre><hr><a href=\"?format=zip\">Download as zip</a><pre><a href=\"dir1/\">dir1/</a>\n<a href=\"file1\">file1</a>\n</pre></body></html>"
 	expectedBody(f.TB, r, expected)
 
 	r = f.get("/content/retrieve/default/"+sha1tree["file1"], "/content/retrieve/default/"+sha1tree["file1"])
@@ -141,4 +155,132 @@ func TestWeb(t *testing.T) {
 	expectedBody(f.TB, r, "content1")
 	r = f.get("/content/retrieve/nodes/"+nodeName+"/dir1/dir2/file2", "")
 	expectedBody(f.TB, r, "content2")
+	r = f.get("/healthz", "")
+	expectedBody(f.TB, r, "ok\n")
+}
+
+func TestWebLatest(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	f.goWeb()
+	defer f.closeWeb()
+	r := f.get("/content/retrieve/nodes/latest/fictious", "/content/retrieve/nodes/latest/fictious/")
+	expectedBody(f.TB, r, "<html><body><pre class=\"comment\">useful comment</pre><hr><a href=\"?format=zip\">Download as zip</a><pre><a href=\"file1\">file1</a>\n</pre></body></html>")
+	r = f.get("/content/retrieve/nodes/latest/fictious/file1", "")
+	expectedBody(f.TB, r, "content1")
+
+	// A new archive with the same tag is served right away.
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content2"})
+	r = f.get("/content/retrieve/nodes/latest/fictious/file1", "")
+	expectedBody(f.TB, r, "content2")
+
+	f.get404("/content/retrieve/nodes/latest/unknown/file1")
+}
+
+func TestWebIndex(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	ut.AssertEqual(t, nil, f.nodes.SetLabel("release", nodeName))
+	nodeName = filepath.ToSlash(nodeName)
+
+	f.goWeb()
+	defer f.closeWeb()
+	r := f.get("/", "/")
+	ut.AssertEqual(t, "text/html; charset=utf-8", r.Header.Get("Content-Type"))
+	actual := readBody(f.TB, r)
+	tagLink := "<a href=\"/content/retrieve/nodes/latest/fictious/\">fictious</a> -> <a href=\"/content/retrieve/nodes/" + nodeName + "/\">" + nodeName + "</a>"
+	ut.AssertEqualf(t, true, strings.Contains(actual, tagLink), "%s", actual)
+	labelLink := "<a href=\"/content/retrieve/nodes/tags/labels/release/\">release</a> -> <a href=\"/content/retrieve/nodes/" + nodeName + "/\">"
+	ut.AssertEqualf(t, true, strings.Contains(actual, labelLink), "%s", actual)
+	nodeLink := "<a href=\"/content/retrieve/nodes/" + nodeName + "/\">" + nodeName + "</a>\n"
+	ut.AssertEqualf(t, true, strings.Contains(actual, "<pre>"+nodeLink), "%s", actual)
+
+	// Filter the nodes.
+	actual = readBody(f.TB, f.get("/?q=unknown", "/"))
+	ut.AssertEqualf(t, false, strings.Contains(actual, "<pre>"+nodeLink), "%s", actual)
+	ut.AssertEqualf(t, true, strings.Contains(actual, "No node."), "%s", actual)
+	ut.AssertEqualf(t, true, strings.Contains(actual, "value=\"unknown\""), "%s", actual)
+	actual = readBody(f.TB, f.get("/?q=fict", "/"))
+	ut.AssertEqualf(t, true, strings.Contains(actual, "<pre>"+nodeLink), "%s", actual)
+
+	// Other paths are still redirected to the nodes.
+	f.get("/foo", "/content/retrieve/nodes/")
+}
+
+func TestWebWriteTimeout(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	sha1tree, _, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	// The deadline is always exceeded by the time the response is written.
+	f.writeTimeout = time.Nanosecond
+	f.goWeb()
+	defer f.closeWeb()
+	_, err := http.Get(f.baseURL + "/")
+	ut.AssertEqual(t, false, err == nil)
+
+	// Except for the downloads.
+	r := f.get("/content/retrieve/default/"+sha1tree["file1"], "")
+	expectedBody(f.TB, r, "content1")
+	r = f.get("/content/retrieve/nodes/latest/fictious/file1", "")
+	expectedBody(f.TB, r, "content1")
+}
+
+func TestWebListenFile(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	tempData := makeTempDir(t, "web_listen_file")
+	defer removeDir(t, tempData)
+	f.listenFile = filepath.Join(tempData, "addr")
+	f.goWeb()
+	defer f.closeWeb()
+	data, err := ioutil.ReadFile(f.listenFile)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, f.socket.Addr().String()+"\n", string(data))
+}
+
+func TestWebHealthz(t *testing.T) {
+	t.Parallel()
+	cas := dumbcaslib.MakeMemoryCasTable()
+	h := &healthzHandler{cas}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	ut.AssertEqual(t, http.StatusOK, w.Code)
+	ut.AssertEqual(t, "ok\n", w.Body.String())
+
+	cas.SetFsckBit()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	ut.AssertEqual(t, http.StatusServiceUnavailable, w.Code)
+	ut.AssertEqual(t, "fsck is needed\n", w.Body.String())
+}
+
+func TestWebSummary(t *testing.T) {
+	t.Parallel()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	b := &bytes.Buffer{}
+	l := makeLoggingHandler(h, log.New(b, "", 0))
+	urls := []string{
+		"/",
+		"/content/retrieve/nodes/2012-12/node1/file1",
+		"/content/retrieve/nodes/2012-12/node1/dir1/",
+		"/content/retrieve/nodes/2012-12/",
+		"/content/retrieve/nodes/tags/labels/foo/",
+		"/content/retrieve/nodes/latest/fictious/file1",
+	}
+	for _, u := range urls {
+		l.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", u, nil))
+	}
+	ut.AssertEqual(t, "Served 6 requests, 30 bytes, 3 unique nodes in 0s", l.summary())
 }
@@ -0,0 +1,126 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/interrupt"
+	"github.com/maruel/subcommands"
+)
+
+var cmdWhoReferences = &subcommands.Command{
+	UsageLine: "whoreferences <hash>",
+	ShortDesc: "lists the files referencing an object",
+	LongDesc:  "Walks every node of a DumbCas(tm) archive and prints each node and path referencing the CAS object <hash>, e.g. to know which backups are affected by a corrupted object. The path is empty when <hash> is the entry tree of the node itself.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &whoReferencesRun{}
+		c.Init()
+		c.Flags.Var(&c.format, "format", formatUsage)
+		return c
+	},
+}
+
+type whoReferencesRun struct {
+	CommonFlags
+	format outputFormat
+}
+
+var reHash = regexp.MustCompile("^[a-f0-9]{40}$")
+
+func (c *whoReferencesRun) main(a DumbcasApplication, hash string) error {
+	if !reHash.MatchString(hash) {
+		return fmt.Errorf("Invalid hash %s", hash)
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	out := makeRowPrinter(a.GetOut(), c.format, []string{"node", "path"}, func(w io.Writer, row []interface{}) {
+		if row[1] == "" {
+			fmt.Fprintf(w, "%s: entry tree\n", row[0])
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", row[0], row[1])
+		}
+	})
+	found := 0
+	// Stops the enumeration on early return.
+	cancel := make(chan struct{})
+	defer close(cancel)
+	for item := range c.nodes.Enumerate(cancel) {
+		if item.Error != nil {
+			return item.Error
+		}
+		if isTag(item.Item) {
+			// The node it points to is enumerated too.
+			continue
+		}
+		data, err := readNode(c.nodes, item.Item)
+		if err != nil {
+			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+		}
+		node := &dumbcaslib.Node{}
+		if err := json.Unmarshal(data, node); err != nil {
+			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+		}
+		nodeName := filepath.ToSlash(item.Item)
+		if node.Entry == hash {
+			found++
+			if err := out.print(nodeName, ""); err != nil {
+				return err
+			}
+			// The tree can't be loaded if its object is corrupted.
+			continue
+		}
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil {
+			a.GetLog().Printf("Failed to load entry %s of node %s: %s", node.Entry, nodeName, err)
+			continue
+		}
+		err = entry.Walk(func(relPath string, e *dumbcaslib.Entry) error {
+			if e.Sha1 != hash {
+				return nil
+			}
+			found++
+			return out.print(nodeName, relPath)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if interrupt.IsSet() {
+		return fmt.Errorf("Was interrupted.")
+	}
+	if err := out.close(); err != nil {
+		return err
+	}
+	if found == 0 && c.format.isText() {
+		fmt.Fprintf(a.GetOut(), "No node references %s\n", hash)
+	}
+	return nil
+}
+
+func (c *whoReferencesRun) Run(a subcommands.Application, args []string, _ subcommands.Env) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <hash>.\n", a.GetName())
+		return 1
+	}
+	interrupt.HandleCtrlC()
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+)
+
+func TestWhoReferences(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasTableOptions{})
+	_, _ = f.LoadNodesTable("", f.cas, dumbcaslib.NodesTableOptions{})
+	sha1tree, node1, entry1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1", "dir1/file2": "content2"})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"copy": "content2"})
+	node1 = filepath.ToSlash(node1)
+	node2 = filepath.ToSlash(node2)
+
+	f.Run([]string{"whoreferences", "-root=\\test_whoreferences", sha1tree["dir1/file2"]}, 0)
+	f.CheckOut(node1 + ": dir1/file2\n" + node2 + ": copy\n")
+	f.Run([]string{"whoreferences", "-root=\\test_whoreferences", "-format=csv", entry1}, 0)
+	f.CheckOut("node,path\n" + node1 + ",\n")
+	f.Run([]string{"whoreferences", "-root=\\test_whoreferences", sha1String("unknown")}, 0)
+	f.CheckOut("No node references " + sha1String("unknown") + "\n")
+	f.Run([]string{"whoreferences", "-root=\\test_whoreferences", "foo"}, 1)
+	f.CheckBuffer(false, true)
+}
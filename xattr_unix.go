@@ -0,0 +1,87 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrSupported is true when readXattrs and writeXattrs are implemented.
+const xattrSupported = true
+
+// readXattrs returns the extended attributes of the file. A file system
+// without extended attributes support reports none.
+func readXattrs(filePath string) (map[string][]byte, error) {
+	names, err := xattrCall(func(dest []byte) (int, error) {
+		return unix.Listxattr(filePath, dest)
+	})
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out map[string][]byte
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrCall(func(dest []byte) (int, error) {
+			return unix.Getxattr(filePath, string(name), dest)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = map[string][]byte{}
+		}
+		out[string(name)] = value
+	}
+	return out, nil
+}
+
+// writeXattrs sets the extended attributes on the file.
+func writeXattrs(filePath string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Setxattr(filePath, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xattrCall calls f with a buffer large enough for the result. The size is
+// queried first and retried if the attribute grew in the meantime.
+func xattrCall(f func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		size, err = f(buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestArchiveXattrs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_xattrs")
+	defer removeDir(t, tempData)
+	src := filepath.Join(tempData, "src")
+	ut.AssertEqual(t, nil, os.Mkdir(src, 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(src, "file1"), []byte("content1"), 0600))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(src, "toArchive"), []byte("file1\n"), 0600))
+	// The value is binary on purpose.
+	xattrs := map[string][]byte{"user.dumbcas": {0, 1, 0xff}}
+	if err := writeXattrs(filepath.Join(src, "file1"), xattrs); err != nil {
+		t.Skipf("The file system doesn't support extended attributes: %s", err)
+	}
+
+	f.Run([]string{"archive", "-root=\\test_archive", "-xattrs", filepath.Join(src, "toArchive")}, 0)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	node := loadNode(t, f.nodes, nodes[0])
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, xattrs, entry.Files["file1"].Xattrs)
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=\\test_archive", "-out=" + out, nodes[0]}, 0)
+	actual, err := readXattrs(filepath.Join(out, "file1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, xattrs, actual)
+}